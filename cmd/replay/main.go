@@ -0,0 +1,50 @@
+// replay 把一个房间的命令日志重放到新的对局大厅中，逐行输出房间发出的消息。
+//
+//	go run ./cmd/replay -room 12 -dir journal
+//	go run ./cmd/replay -room 12 -redis
+//
+// 与服务端一样需要数据库的环境变量，但回放不会写数据库
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"chinese-chess-backend/database"
+	"chinese-chess-backend/websocket"
+)
+
+func main() {
+	roomId := flag.Int("room", 0, "要回放的房间id")
+	dir := flag.String("dir", "journal", "日志文件所在的目录")
+	useRedis := flag.Bool("redis", false, "从Redis Stream读取日志")
+	flag.Parse()
+
+	var journal websocket.Journal
+	if *useRedis {
+		journal = websocket.NewRedisJournal(database.GetRedisClient())
+	} else {
+		j, err := websocket.NewFileJournal(*dir)
+		if err != nil {
+			log.Fatalf("打开日志目录失败: %v", err)
+		}
+		journal = j
+	}
+	entries, err := journal.Read(context.Background(), *roomId)
+	if err != nil {
+		log.Fatalf("读取房间 %d 的日志失败: %v", *roomId, err)
+	}
+	messages, err := websocket.Replay(entries)
+	encoder := json.NewEncoder(os.Stdout)
+	for _, msg := range messages {
+		if err := encoder.Encode(msg); err != nil {
+			log.Fatalf("输出消息失败: %v", err)
+		}
+	}
+	if err != nil {
+		log.Fatalf("回放失败: %v", err)
+	}
+}
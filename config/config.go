@@ -13,13 +13,53 @@ type SMTPConfig struct {
 	Password string `json:"password"`
 }
 
+type RoomConfig struct {
+	IdleTTL int `json:"idleTTL"` // 房间无操作多久后自动解散，单位为秒
+}
+
+type ServerConfig struct {
+	ShutdownTimeout int   `json:"shutdownTimeout"` // 停机时等待对局保存和连接关闭的最长时间，单位为秒
+	AdminIds        []int `json:"adminIds"`        // 可以访问管理接口的用户id
+}
+
+type ClusterConfig struct {
+	Enabled bool   `json:"enabled"`
+	NodeId  string `json:"nodeId"` // 节点id，为空时使用主机名
+}
+
+type JournalConfig struct {
+	Type string `json:"type"` // 房间命令日志的存储方式："file"、"redis"，为空时不记录
+	Dir  string `json:"dir"`  // type为file时日志文件所在的目录
+}
+
+type WebhookSubscription struct {
+	Url    string   `json:"url"`
+	Secret string   `json:"secret"` // 用于计算请求签名的密钥
+	Events []string `json:"events"` // 订阅的事件，为空时订阅所有事件
+}
+
+type WebhookConfig struct {
+	Subscriptions []WebhookSubscription `json:"subscriptions"`
+	MaxAttempts   int                   `json:"maxAttempts"` // 每次推送的最大尝试次数
+}
+
 type Config struct {
-	SMTPConfig     `json:"smtp"`
+	SMTPConfig    `json:"smtp"`
+	RoomConfig    `json:"room"`
+	ClusterConfig `json:"cluster"`
+	ServerConfig  `json:"server"`
+	JournalConfig `json:"journal"`
+	WebhookConfig `json:"webhook"`
 }
 
 var (
-	mu         sync.Mutex
-	smtpConfig SMTPConfig
+	mu            sync.Mutex
+	smtpConfig    SMTPConfig
+	roomConfig    RoomConfig
+	clusterConfig ClusterConfig
+	serverConfig  ServerConfig
+	journalConfig JournalConfig
+	webhookConfig WebhookConfig
 )
 
 func GetSMTPConfig() SMTPConfig {
@@ -28,6 +68,56 @@ func GetSMTPConfig() SMTPConfig {
 	return smtpConfig
 }
 
+func GetRoomConfig() RoomConfig {
+	mu.Lock()
+	defer mu.Unlock()
+	cfg := roomConfig
+	if cfg.IdleTTL <= 0 {
+		cfg.IdleTTL = 10 * 60
+	}
+	return cfg
+}
+
+func GetClusterConfig() ClusterConfig {
+	mu.Lock()
+	defer mu.Unlock()
+	cfg := clusterConfig
+	if cfg.NodeId == "" {
+		cfg.NodeId, _ = os.Hostname()
+	}
+	return cfg
+}
+
+func GetServerConfig() ServerConfig {
+	mu.Lock()
+	defer mu.Unlock()
+	cfg := serverConfig
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = 30
+	}
+	return cfg
+}
+
+func GetJournalConfig() JournalConfig {
+	mu.Lock()
+	defer mu.Unlock()
+	cfg := journalConfig
+	if cfg.Dir == "" {
+		cfg.Dir = "journal"
+	}
+	return cfg
+}
+
+func GetWebhookConfig() WebhookConfig {
+	mu.Lock()
+	defer mu.Unlock()
+	cfg := webhookConfig
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	return cfg
+}
+
 func loadConfig() error {
 	file, err := os.Open("config.json")
 	if err != nil {
@@ -41,7 +131,14 @@ func loadConfig() error {
 	if err != nil {
 		return err
 	}
+	mu.Lock()
+	defer mu.Unlock()
 	smtpConfig = appConfig.SMTPConfig
+	roomConfig = appConfig.RoomConfig
+	clusterConfig = appConfig.ClusterConfig
+	serverConfig = appConfig.ServerConfig
+	journalConfig = appConfig.JournalConfig
+	webhookConfig = appConfig.WebhookConfig
 	return nil
 }
 
@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"chinese-chess-backend/dto"
+	"chinese-chess-backend/dto/user"
+	"chinese-chess-backend/service"
+)
+
+type BlockController struct {
+	blockService *service.BlockService
+}
+
+func NewBlockController(blockService *service.BlockService) *BlockController {
+	return &BlockController{
+		blockService: blockService,
+	}
+}
+
+func (bc *BlockController) Block(c *gin.Context) {
+	var req user.BlockRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	resp, err := bc.blockService.Block(c.GetInt("userId"), req)
+	reply(c, resp, err)
+}
+
+func (bc *BlockController) Unblock(c *gin.Context) {
+	var req user.BlockRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	if err := bc.blockService.Unblock(c.GetInt("userId"), req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	dto.SuccessResponse(c)
+}
+
+func (bc *BlockController) List(c *gin.Context) {
+	resp, err := bc.blockService.List(c.GetInt("userId"))
+	reply(c, resp, err)
+}
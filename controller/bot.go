@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"chinese-chess-backend/dto"
+	"chinese-chess-backend/service"
+)
+
+type BotController struct {
+	botService *service.BotService
+}
+
+func NewBotController(botService *service.BotService) *BotController {
+	return &BotController{
+		botService: botService,
+	}
+}
+
+func (bc *BotController) UpgradeAccount(c *gin.Context) {
+	err := bc.botService.UpgradeAccount(c.GetInt("userId"))
+	if err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	dto.SuccessResponse(c, dto.WithMessage("已升级为机器人账号"))
+}
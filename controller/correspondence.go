@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"chinese-chess-backend/dto"
+	"chinese-chess-backend/dto/game"
+	"chinese-chess-backend/service"
+)
+
+type CorrespondenceController struct {
+	correspondenceService *service.CorrespondenceService
+}
+
+func NewCorrespondenceController(correspondenceService *service.CorrespondenceService) *CorrespondenceController {
+	return &CorrespondenceController{
+		correspondenceService: correspondenceService,
+	}
+}
+
+// reply 按服务的返回值回复，出错时回复错误信息
+func reply(c *gin.Context, data any, err error) {
+	if err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	dto.SuccessResponse(c, dto.WithData(data))
+}
+
+func (cc *CorrespondenceController) CreateGame(c *gin.Context) {
+	var req game.CreateGameRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	resp, err := cc.correspondenceService.CreateGame(c.GetInt("userId"), &req)
+	reply(c, resp, err)
+}
+
+func (cc *CorrespondenceController) OpenGames(c *gin.Context) {
+	var req game.ListGamesRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	resp, err := cc.correspondenceService.OpenGames(c.GetInt("userId"), req)
+	reply(c, resp, err)
+}
+
+func (cc *CorrespondenceController) ListGames(c *gin.Context) {
+	var req game.ListGamesRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	resp, err := cc.correspondenceService.ListGames(c.GetInt("userId"), req)
+	reply(c, resp, err)
+}
+
+func (cc *CorrespondenceController) GetGame(c *gin.Context) {
+	var req game.GameIdRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	resp, err := cc.correspondenceService.GetGame(req)
+	reply(c, resp, err)
+}
+
+func (cc *CorrespondenceController) JoinGame(c *gin.Context) {
+	var req game.GameIdRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	resp, err := cc.correspondenceService.JoinGame(c.GetInt("userId"), req)
+	reply(c, resp, err)
+}
+
+func (cc *CorrespondenceController) CancelGame(c *gin.Context) {
+	var req game.GameIdRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	if err := cc.correspondenceService.CancelGame(c.GetInt("userId"), req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	dto.SuccessResponse(c)
+}
+
+func (cc *CorrespondenceController) Move(c *gin.Context) {
+	var req game.MoveRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	resp, err := cc.correspondenceService.Move(c.GetInt("userId"), &req)
+	reply(c, resp, err)
+}
+
+func (cc *CorrespondenceController) Resign(c *gin.Context) {
+	var req game.GameIdRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	resp, err := cc.correspondenceService.Resign(c.GetInt("userId"), req)
+	reply(c, resp, err)
+}
+
+func (cc *CorrespondenceController) Draw(c *gin.Context) {
+	var req game.DrawRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	resp, err := cc.correspondenceService.Draw(c.GetInt("userId"), req)
+	reply(c, resp, err)
+}
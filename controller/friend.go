@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"chinese-chess-backend/dto"
+	"chinese-chess-backend/dto/user"
+	"chinese-chess-backend/service"
+)
+
+type FriendController struct {
+	friendService *service.FriendService
+}
+
+func NewFriendController(friendService *service.FriendService) *FriendController {
+	return &FriendController{
+		friendService: friendService,
+	}
+}
+
+func (fc *FriendController) SendRequest(c *gin.Context) {
+	var req user.FriendIdRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	resp, err := fc.friendService.SendRequest(c.GetInt("userId"), req)
+	reply(c, resp, err)
+}
+
+func (fc *FriendController) Accept(c *gin.Context) {
+	var req user.FriendIdRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	resp, err := fc.friendService.Accept(c.GetInt("userId"), req)
+	reply(c, resp, err)
+}
+
+func (fc *FriendController) Remove(c *gin.Context) {
+	var req user.FriendIdRequest
+	if err := dto.BindData(c, &req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	if err := fc.friendService.Remove(c.GetInt("userId"), req); err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	dto.SuccessResponse(c)
+}
+
+func (fc *FriendController) List(c *gin.Context) {
+	resp, err := fc.friendService.List(c.GetInt("userId"))
+	reply(c, resp, err)
+}
@@ -1,7 +1,8 @@
 package controller
 
 import (
-	"fmt"
+	"errors"
+	"io"
 
 	"github.com/gin-gonic/gin"
 
@@ -21,19 +22,17 @@ func NewRoomController(roomService *service.RoomService) *RoomController {
 }
 
 func (rc *RoomController) GetSpareRooms(c *gin.Context) {
-	info, exists := c.Get("rooms")
-	if !exists {
-		dto.ErrorResponse(c, dto.WithMessage("room not found"))
-		return
+	var req room.GetSpareRoomsRequest
+	err := dto.BindData(c, &req)
+	if errors.Is(err, io.EOF) {
+		// 兼容不带请求体的旧版前端
+		err = req.Examine()
 	}
-	infos, ok := info.([]room.RoomInfo)
-	if !ok {
-		dto.ErrorResponse(c, dto.WithMessage("room not found"))
+	if err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
 		return
 	}
-	fmt.Println(infos)
-	resp, err := rc.roomService.GetSpareRooms(room.GetSpareRoomsRequest{
-		Infos: infos})
+	resp, err := rc.roomService.GetSpareRooms(req)
 	if err != nil {
 		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
 		return
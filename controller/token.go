@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"chinese-chess-backend/dto"
+	"chinese-chess-backend/dto/user"
+	"chinese-chess-backend/service"
+)
+
+type TokenController struct {
+	tokenService *service.TokenService
+}
+
+func NewTokenController(tokenService *service.TokenService) *TokenController {
+	return &TokenController{
+		tokenService: tokenService,
+	}
+}
+
+func (tc *TokenController) CreateToken(c *gin.Context) {
+	var req user.CreateTokenRequest
+	err := dto.BindData(c, &req)
+	if err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	resp, err := tc.tokenService.CreateToken(c.GetInt("userId"), &req)
+	if err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	dto.SuccessResponse(c, dto.WithData(resp))
+}
+
+func (tc *TokenController) ListTokens(c *gin.Context) {
+	resp, err := tc.tokenService.ListTokens(c.GetInt("userId"))
+	if err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	dto.SuccessResponse(c, dto.WithData(resp))
+}
+
+func (tc *TokenController) RevokeToken(c *gin.Context) {
+	var req user.RevokeTokenRequest
+	err := dto.BindData(c, &req)
+	if err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	err = tc.tokenService.RevokeToken(c.GetInt("userId"), &req)
+	if err != nil {
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	dto.SuccessResponse(c)
+}
@@ -3,11 +3,18 @@ package database
 import (
 	"github.com/joho/godotenv"
 
+	"errors"
 	"os"
+	"testing"
 
 )
 
 func init() {
+	// 测试时不读取.env也不连接MySQL，用到数据库时由GetMysqlDb连接
+	if testing.Testing() {
+		initRedis()
+		return
+	}
 	if(os.Getenv("GO_ENV") != "docker") {
 		err := godotenv.Load()
 		if err != nil {
@@ -17,4 +24,20 @@ func init() {
 
 	initMysql()
 	initRedis()
+}
+
+// Close 关闭MySQL和Redis连接，停机时调用
+func Close() error {
+	var errs []error
+	mu.Lock()
+	if db != nil {
+		if sqlDB, err := db.DB(); err == nil {
+			errs = append(errs, sqlDB.Close())
+		}
+	}
+	mu.Unlock()
+	if rdb != nil {
+		errs = append(errs, rdb.Close())
+	}
+	return errors.Join(errs...)
 }
\ No newline at end of file
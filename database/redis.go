@@ -54,3 +54,12 @@ func DeleteValue(key string) error {
 	}
 	return rdb.Del(ctx, key).Err()
 }
+
+// GetRedisClient returns the shared Redis client, used by components that need
+// more than simple key-value access (e.g. pub/sub)
+func GetRedisClient() *redis.Client {
+	if rdb == nil {
+		initRedis()
+	}
+	return rdb
+}
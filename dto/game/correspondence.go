@@ -0,0 +1,180 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	gameModel "chinese-chess-backend/model/game"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+
+	MinDaysPerMove = 1
+	MaxDaysPerMove = 14
+)
+
+// Position 与实时对局相同的坐标，x为列，y为行，红帅在(4,9)，见xiangqi.Position
+type Position struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// Move 通信对局的一步棋，Ply为走完后的步数
+type Move struct {
+	From Position `json:"from"`
+	To   Position `json:"to"`
+	Ply  int      `json:"ply"`
+}
+
+type GameInfo struct {
+	Id          uint       `json:"id"`
+	RedId       uint       `json:"redId"`
+	BlackId     uint       `json:"blackId"`
+	DaysPerMove int        `json:"daysPerMove"`
+	Moves       []Move     `json:"moves"`
+	Ply         int        `json:"ply"`
+	Turn        string     `json:"turn"` // red或black
+	Status      string     `json:"status"`
+	Winner      string     `json:"winner,omitempty"` // red、black或draw，对局结束后才有
+	Reason      string     `json:"reason,omitempty"`
+	Deadline    *time.Time `json:"deadline"`
+	DrawOffer   uint       `json:"drawOffer,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+}
+
+func turnName(turn int) string {
+	if turn == gameModel.TurnBlack {
+		return "black"
+	}
+	return "red"
+}
+
+func NewGameInfo(g gameModel.CorrespondenceGame) GameInfo {
+	info := GameInfo{
+		Id:          g.ID,
+		RedId:       g.RedId,
+		BlackId:     g.BlackId,
+		DaysPerMove: g.DaysPerMove,
+		Moves:       make([]Move, 0),
+		Ply:         g.Ply,
+		Turn:        turnName(g.Turn),
+		Status:      g.Status,
+		Reason:      g.Reason,
+		Deadline:    g.Deadline,
+		DrawOffer:   g.DrawOffer,
+		CreatedAt:   g.CreatedAt,
+		UpdatedAt:   g.UpdatedAt,
+	}
+	if g.Moves != "" {
+		json.Unmarshal([]byte(g.Moves), &info.Moves)
+	}
+	if g.Status == gameModel.StatusFinished {
+		info.Winner = "draw"
+		if g.Winner != 0 {
+			info.Winner = turnName(g.Winner)
+		}
+	}
+	return info
+}
+
+// CurrentPlayer 当前行棋方的玩家id
+func (g GameInfo) CurrentPlayer() uint {
+	if g.Turn == "black" {
+		return g.BlackId
+	}
+	return g.RedId
+}
+
+type CreateGameRequest struct {
+	DaysPerMove int    `json:"daysPerMove"`
+	Color       string `json:"color"` // red、black或random，为空时随机
+}
+
+func (r *CreateGameRequest) Examine() error {
+	if r.DaysPerMove < MinDaysPerMove || r.DaysPerMove > MaxDaysPerMove {
+		return fmt.Errorf("每步天数必须在%d到%d之间", MinDaysPerMove, MaxDaysPerMove)
+	}
+	switch r.Color {
+	case "":
+		r.Color = "random"
+	case "red", "black", "random":
+	default:
+		return fmt.Errorf("执子颜色无效")
+	}
+	return nil
+}
+
+type GameIdRequest struct {
+	GameId uint `json:"gameId"`
+}
+
+func (r *GameIdRequest) Examine() error {
+	if r.GameId == 0 {
+		return fmt.Errorf("对局id不能为空")
+	}
+	return nil
+}
+
+type MoveRequest struct {
+	GameId uint     `json:"gameId"`
+	From   Position `json:"from"`
+	To     Position `json:"to"`
+	Ply    int      `json:"ply"` // 期望的步数，即走完后的步数，不为0时与服务端不一致会被拒绝
+}
+
+func (r *MoveRequest) Examine() error {
+	if r.GameId == 0 {
+		return fmt.Errorf("对局id不能为空")
+	}
+	if r.From == r.To {
+		return fmt.Errorf("起点和终点不能相同")
+	}
+	return nil
+}
+
+type DrawRequest struct {
+	GameId uint `json:"gameId"`
+	Accept bool `json:"accept"` // true为提和或接受提和，false为拒绝或撤回提和
+}
+
+func (r *DrawRequest) Examine() error {
+	if r.GameId == 0 {
+		return fmt.Errorf("对局id不能为空")
+	}
+	return nil
+}
+
+type ListGamesRequest struct {
+	Status   string `json:"status"` // 为空时列出所有状态
+	Page     int    `json:"page"`
+	PageSize int    `json:"pageSize"`
+}
+
+func (r *ListGamesRequest) Examine() error {
+	switch r.Status {
+	case "", gameModel.StatusWaiting, gameModel.StatusActive, gameModel.StatusFinished:
+	default:
+		return fmt.Errorf("对局状态无效")
+	}
+	if r.Page <= 0 {
+		r.Page = 1
+	}
+	if r.PageSize <= 0 {
+		r.PageSize = defaultPageSize
+	}
+	if r.PageSize > maxPageSize {
+		r.PageSize = maxPageSize
+	}
+	return nil
+}
+
+type ListGamesResponse struct {
+	Games    []GameInfo `json:"games"`
+	Total    int64      `json:"total"`
+	Page     int        `json:"page"`
+	PageSize int        `json:"pageSize"`
+}
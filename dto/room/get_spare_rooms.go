@@ -1,9 +1,66 @@
 package room
 
+import (
+	"fmt"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
 type GetSpareRoomsRequest struct {
-	Infos []RoomInfo `json:"-"`
+	Initial   *int  `json:"initial"`   // 初始时间，单位为秒
+	Increment *int  `json:"increment"` // 每步加秒
+	Rated     *bool `json:"rated"`
+	MinExp    int   `json:"minExp"` // 房主经验下限
+	MaxExp    int   `json:"maxExp"` // 房主经验上限，0表示不限
+	Page      int   `json:"page"`
+	PageSize  int   `json:"pageSize"`
+}
+
+func (r *GetSpareRoomsRequest) Examine() error {
+	if r.MinExp < 0 || r.MaxExp < 0 {
+		return fmt.Errorf("经验范围无效")
+	}
+	if r.MaxExp > 0 && r.MinExp > r.MaxExp {
+		return fmt.Errorf("经验范围无效")
+	}
+	if r.Page <= 0 {
+		r.Page = 1
+	}
+	if r.PageSize <= 0 {
+		r.PageSize = defaultPageSize
+	}
+	if r.PageSize > maxPageSize {
+		r.PageSize = maxPageSize
+	}
+	return nil
+}
+
+// Match 判断房间是否满足筛选条件
+func (r *GetSpareRoomsRequest) Match(info RoomInfo) bool {
+	if r.Initial != nil && info.Settings.TimeControl.Initial != *r.Initial {
+		return false
+	}
+	if r.Increment != nil && info.Settings.TimeControl.Increment != *r.Increment {
+		return false
+	}
+	if r.Rated != nil && info.Settings.Rated != *r.Rated {
+		return false
+	}
+	if info.Current.Exp < r.MinExp {
+		return false
+	}
+	if r.MaxExp > 0 && info.Current.Exp > r.MaxExp {
+		return false
+	}
+	return true
 }
 
 type GetSpareRoomsResponse struct {
-	Rooms []RoomInfo `json:"rooms"`
-}
\ No newline at end of file
+	Rooms    []RoomInfo `json:"rooms"`
+	Total    int        `json:"total"`
+	Page     int        `json:"page"`
+	PageSize int        `json:"pageSize"`
+}
@@ -5,7 +5,8 @@ import (
 )
 
 type RoomInfo struct {
-	Id      int           `json:"id"`
-	Current user.UserInfo `json:"current"`
-	Next    user.UserInfo `json:"next"`
+	Id       int           `json:"id"`
+	Current  user.UserInfo `json:"current"`
+	Next     user.UserInfo `json:"next"`
+	Settings RoomSettings  `json:"settings"`
 }
@@ -0,0 +1,61 @@
+package room
+
+import (
+	"fmt"
+)
+
+type ColorPreference string
+
+const (
+	ColorRed    ColorPreference = "red"
+	ColorBlack  ColorPreference = "black"
+	ColorRandom ColorPreference = "random"
+)
+
+// TimeControl 时间控制，单位为秒，Initial为0表示不限时
+type TimeControl struct {
+	Initial   int `json:"initial"`
+	Increment int `json:"increment"`
+}
+
+func (tc TimeControl) Unlimited() bool {
+	return tc.Initial <= 0
+}
+
+type RoomSettings struct {
+	Color           ColorPreference `json:"color"`           // 房主执子颜色
+	TimeControl     TimeControl     `json:"timeControl"`     // 时间控制
+	Rated           bool            `json:"rated"`           // 是否排位
+	AllowTakeback   bool            `json:"allowTakeback"`   // 是否允许悔棋
+	AllowSpectators bool            `json:"allowSpectators"` // 是否允许观战
+}
+
+func DefaultRoomSettings() RoomSettings {
+	return RoomSettings{
+		Color:           ColorRandom,
+		AllowSpectators: true,
+	}
+}
+
+func (s *RoomSettings) Examine() error {
+	switch s.Color {
+	case "":
+		s.Color = ColorRandom
+	case ColorRed, ColorBlack, ColorRandom:
+	default:
+		return fmt.Errorf("无效的执子颜色")
+	}
+	if s.TimeControl.Initial < 0 || s.TimeControl.Increment < 0 {
+		return fmt.Errorf("时间设置无效")
+	}
+	if s.TimeControl.Initial > 3*60*60 || s.TimeControl.Increment > 60 {
+		return fmt.Errorf("时间设置过长")
+	}
+	if s.TimeControl.Unlimited() && s.TimeControl.Increment > 0 {
+		return fmt.Errorf("不限时对局不能设置加秒")
+	}
+	if s.Rated && s.AllowTakeback {
+		return fmt.Errorf("排位对局不允许悔棋")
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package user
+
+import (
+	"fmt"
+	"time"
+)
+
+type BlockInfo struct {
+	Id        uint      `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type BlockRequest struct {
+	UserId int `json:"userId"`
+}
+
+func (r *BlockRequest) Examine() error {
+	if r.UserId <= 0 {
+		return fmt.Errorf("用户id不能为空")
+	}
+	return nil
+}
+
+type ListBlocksResponse struct {
+	Blocks []BlockInfo `json:"blocks"`
+}
@@ -0,0 +1,53 @@
+package user
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	PresenceOffline    = "offline"
+	PresenceOnline     = "online"
+	PresenceMatching   = "matching"
+	PresencePlaying    = "playing"
+	PresenceSpectating = "spectating"
+)
+
+// Presence 玩家的在线状态，在房间中时RoomId为房间号
+type Presence struct {
+	State  string `json:"state"`
+	RoomId int    `json:"roomId,omitempty"`
+}
+
+const (
+	FriendRequested = "requested" // 收到好友请求
+	FriendAccepted  = "accepted"  // 好友请求被同意
+	FriendRemoved   = "removed"   // 好友请求被拒绝、撤回或好友被删除
+)
+
+// FriendInfo 好友或好友请求的另一方，Presence只对已互为好友的玩家返回
+type FriendInfo struct {
+	Id       uint      `json:"id"`
+	Name     string    `json:"name"`
+	Exp      int       `json:"exp"`
+	Presence *Presence `json:"presence,omitempty"`
+	Since    time.Time `json:"since"`
+}
+
+type FriendIdRequest struct {
+	UserId int `json:"userId"`
+}
+
+func (r *FriendIdRequest) Examine() error {
+	if r.UserId <= 0 {
+		return fmt.Errorf("用户id不能为空")
+	}
+	return nil
+}
+
+// ListFriendsResponse Incoming为收到的好友请求，Outgoing为发出的好友请求
+type ListFriendsResponse struct {
+	Friends  []FriendInfo `json:"friends"`
+	Incoming []FriendInfo `json:"incoming"`
+	Outgoing []FriendInfo `json:"outgoing"`
+}
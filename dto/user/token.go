@@ -0,0 +1,62 @@
+package user
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	userModel "chinese-chess-backend/model/user"
+)
+
+type TokenInfo struct {
+	Id         uint       `json:"id"`
+	Name       string     `json:"name"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+func NewTokenInfo(t userModel.ApiToken) TokenInfo {
+	return TokenInfo{
+		Id:         t.ID,
+		Name:       t.Name,
+		LastUsedAt: t.LastUsedAt,
+		CreatedAt:  t.CreatedAt,
+	}
+}
+
+type CreateTokenRequest struct {
+	Name string `json:"name"` // 令牌的用途，便于之后识别和撤销
+}
+
+func (r *CreateTokenRequest) Examine() error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return fmt.Errorf("令牌名称不能为空")
+	}
+	if utf8.RuneCountInString(r.Name) > 100 {
+		return fmt.Errorf("令牌名称过长")
+	}
+	return nil
+}
+
+// CreateTokenResponse Token只在创建时返回一次，服务端只保存其哈希
+type CreateTokenResponse struct {
+	TokenInfo
+	Token string `json:"token"`
+}
+
+type ListTokensResponse struct {
+	Tokens []TokenInfo `json:"tokens"`
+}
+
+type RevokeTokenRequest struct {
+	Id uint `json:"id"`
+}
+
+func (r *RevokeTokenRequest) Examine() error {
+	if r.Id == 0 {
+		return fmt.Errorf("令牌id不能为空")
+	}
+	return nil
+}
@@ -5,4 +5,5 @@ type UserInfo struct {
 	Token string `json:"token"`
 	Name  string `json:"name"`
 	Exp   int    `json:"exp"`
+	Bot   bool   `json:"bot"`
 }
\ No newline at end of file
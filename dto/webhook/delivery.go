@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"fmt"
+	"time"
+
+	webhookModel "chinese-chess-backend/model/webhook"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+type DeliveryInfo struct {
+	Id         uint      `json:"id"`
+	Url        string    `json:"url"`
+	Event      string    `json:"event"`
+	Payload    string    `json:"payload"`
+	Status     string    `json:"status"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"statusCode"`
+	LastError  string    `json:"lastError"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+func NewDeliveryInfo(d webhookModel.Delivery) DeliveryInfo {
+	return DeliveryInfo{
+		Id:         d.ID,
+		Url:        d.Url,
+		Event:      d.Event,
+		Payload:    d.Payload,
+		Status:     d.Status,
+		Attempts:   d.Attempts,
+		StatusCode: d.StatusCode,
+		LastError:  d.LastError,
+		CreatedAt:  d.CreatedAt,
+		UpdatedAt:  d.UpdatedAt,
+	}
+}
+
+type ListDeliveriesRequest struct {
+	Status   string `json:"status"` // 为空时默认只列出失败的推送
+	Page     int    `json:"page"`
+	PageSize int    `json:"pageSize"`
+}
+
+func (r *ListDeliveriesRequest) Examine() error {
+	switch r.Status {
+	case "":
+		r.Status = webhookModel.StatusFailed
+	case webhookModel.StatusPending, webhookModel.StatusSucceeded, webhookModel.StatusFailed:
+	default:
+		return fmt.Errorf("推送状态无效")
+	}
+	if r.Page <= 0 {
+		r.Page = 1
+	}
+	if r.PageSize <= 0 {
+		r.PageSize = defaultPageSize
+	}
+	if r.PageSize > maxPageSize {
+		r.PageSize = maxPageSize
+	}
+	return nil
+}
+
+type ListDeliveriesResponse struct {
+	Deliveries []DeliveryInfo `json:"deliveries"`
+	Total      int64          `json:"total"`
+	Page       int            `json:"page"`
+	PageSize   int            `json:"pageSize"`
+}
+
+type ReplayDeliveryRequest struct {
+	Id uint `json:"id"`
+}
+
+func (r *ReplayDeliveryRequest) Examine() error {
+	if r.Id == 0 {
+		return fmt.Errorf("推送id不能为空")
+	}
+	return nil
+}
@@ -1,14 +1,62 @@
 package main
 
 import (
-	// _ "chinese-chess-backend/database"
-	"chinese-chess-backend/route"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"chinese-chess-backend/config"
+	"chinese-chess-backend/database"
+	"chinese-chess-backend/route"
 )
 
 func main() {
 	config.InitConfig()
-	r := route.SetupRouter()
+	r, services := route.SetupRouter()
+	hub := services.Hub
+
+	srv := &http.Server{
+		Addr:    ":8080",
+		Handler: r,
+	}
+	// 停机时先断开事件流、长轮询和机器人对局流，否则Shutdown会一直等待这些请求
+	srv.RegisterOnShutdown(hub.CloseStreams)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("服务启动失败: %v", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop()
+	log.Println("收到停机信号，开始停机")
+
+	timeout := time.Duration(config.GetServerConfig().ShutdownTimeout) * time.Second
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	r.Run(":8080")
+	// 通信对局的超时判负会通知大厅，先于大厅停止
+	services.Correspondence.Stop()
+	// 先停止大厅，大厅停机后拒绝新的连接和对局，保存对局后断开所有玩家
+	if err := hub.Shutdown(shutdownCtx); err != nil {
+		log.Printf("对局大厅停止失败: %v", err)
+	}
+	// 大厅可能用完了超时时间，HTTP服务使用单独的期限
+	srvCtx, srvCancel := context.WithTimeout(context.Background(), timeout)
+	defer srvCancel()
+	if err := srv.Shutdown(srvCtx); err != nil {
+		log.Printf("HTTP服务停止失败: %v", err)
+	}
+	// 大厅停机时结束的对局仍会推送webhook，最后停止重试，未完成的推送在下次启动时继续发送
+	services.Webhooks.Stop()
+	if err := database.Close(); err != nil {
+		log.Printf("关闭数据库连接失败: %v", err)
+	}
+	log.Println("停机完成")
 }
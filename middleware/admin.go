@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"slices"
+
+	"github.com/gin-gonic/gin"
+
+	"chinese-chess-backend/config"
+	"chinese-chess-backend/dto"
+)
+
+// AdminMiddleware 只允许配置中的管理员访问，需要在AuthMiddleware之后使用
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !slices.Contains(config.GetServerConfig().AdminIds, c.GetInt("userId")) {
+			dto.ErrorResponse(c, dto.WithMessage("没有管理员权限"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
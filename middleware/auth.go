@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -9,7 +10,42 @@ import (
 	"chinese-chess-backend/utils"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+type authOptions struct {
+	resolveToken func(token string) (int, error)
+	tokenPaths   []string
+}
+
+type AuthOption func(*authOptions)
+
+// WithTokenResolver 访问paths下的接口时，登录token校验失败再尝试作为API令牌解析，其他接口不接受API令牌
+func WithTokenResolver(resolve func(token string) (int, error), paths ...string) AuthOption {
+	return func(o *authOptions) {
+		o.resolveToken = resolve
+		o.tokenPaths = paths
+	}
+}
+
+func AuthMiddleware(opts ...AuthOption) gin.HandlerFunc {
+	var options authOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	// authenticate 返回用户id和是否为API令牌
+	authenticate := func(path, token string) (int, bool) {
+		if userId := utils.ParseToken(token); userId > 0 {
+			return userId, false
+		}
+		acceptToken := slices.ContainsFunc(options.tokenPaths, func(prefix string) bool {
+			return strings.HasPrefix(path, prefix)
+		})
+		if acceptToken && options.resolveToken != nil {
+			userId, err := options.resolveToken(strings.TrimPrefix(token, "Bearer "))
+			if err == nil {
+				return userId, true
+			}
+		}
+		return 0, false
+	}
 	return func(c *gin.Context) {
 		if strings.HasPrefix(c.Request.URL.Path, "/api/public") {
 			// 如果是公共接口，直接放行
@@ -17,7 +53,7 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 		authHeader := c.GetHeader("Authorization")
-		userId := utils.ParseToken(authHeader)
+		userId, apiToken := authenticate(c.Request.URL.Path, authHeader)
 		if userId <= 0 {
 			// 从路径中获取token
 			token := c.Query("token")
@@ -26,7 +62,7 @@ func AuthMiddleware() gin.HandlerFunc {
 				c.Abort()
 				return
 			}
-			userId = utils.ParseToken(token)
+			userId, apiToken = authenticate(c.Request.URL.Path, token)
 			if userId <= 0 {
 				dto.ErrorResponse(c, dto.WithMessage("未登录或token错误"))
 				c.Abort()
@@ -34,6 +70,7 @@ func AuthMiddleware() gin.HandlerFunc {
 			}
 		}
 		c.Set("userId", userId)
+		c.Set("apiToken", apiToken)
 		c.Next()
 	}
 }
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"chinese-chess-backend/utils"
+)
+
+const testApiToken = "ccb_test"
+
+// newAuthRouter 所有接口返回鉴权得到的用户id和是否为API令牌，只有/api/bot/下接受API令牌
+func newAuthRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	resolve := func(token string) (int, error) {
+		if token == testApiToken {
+			return 7, nil
+		}
+		return 0, errors.New("令牌无效")
+	}
+	r.Use(AuthMiddleware(WithTokenResolver(resolve, "/api/bot/")))
+	handler := func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"userId": c.GetInt("userId"), "apiToken": c.GetBool("apiToken")})
+	}
+	r.POST("/api/bot/account/upgrade", handler)
+	r.GET("/api/bot/stream/event", handler)
+	r.POST("/api/user/tokens/create", handler)
+	r.POST("/api/admin/webhooks/replay", handler)
+	r.GET("/ws", handler)
+	return r
+}
+
+// authenticate 以Authorization头访问path，返回鉴权结果，被拒绝时userId为0
+func authenticate(t *testing.T, r *gin.Engine, method, path, token string) (int, bool) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var resp struct {
+		UserId   int  `json:"userId"`
+		ApiToken bool `json:"apiToken"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("解析%s的响应失败: %v", path, err)
+	}
+	return resp.UserId, resp.ApiToken
+}
+
+func TestApiTokenOnlyOnBotRoutes(t *testing.T) {
+	r := newAuthRouter()
+	session, err := utils.GenerateToken(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, route := range [][2]string{
+		{http.MethodPost, "/api/bot/account/upgrade"},
+		{http.MethodGet, "/api/bot/stream/event"},
+	} {
+		if userId, apiToken := authenticate(t, r, route[0], route[1], "Bearer "+testApiToken); userId != 7 || !apiToken {
+			t.Fatalf("%s 应当接受API令牌", route[1])
+		}
+		if userId, apiToken := authenticate(t, r, route[0], route[1], session); userId != 3 || apiToken {
+			t.Fatalf("%s 应当将登录token识别为登录状态", route[1])
+		}
+	}
+
+	// 泄露的API令牌不能管理令牌、访问管理接口或连接websocket
+	for _, route := range [][2]string{
+		{http.MethodPost, "/api/user/tokens/create"},
+		{http.MethodPost, "/api/admin/webhooks/replay"},
+		{http.MethodGet, "/ws"},
+	} {
+		if userId, _ := authenticate(t, r, route[0], route[1], "Bearer "+testApiToken); userId != 0 {
+			t.Fatalf("%s 不应当接受API令牌", route[1])
+		}
+		if userId, _ := authenticate(t, r, route[0], route[1]+"?token="+testApiToken, ""); userId != 0 {
+			t.Fatalf("%s 不应当接受路径中的API令牌", route[1])
+		}
+		if userId, _ := authenticate(t, r, route[0], route[1], session); userId != 3 {
+			t.Fatalf("%s 应当接受登录token", route[1])
+		}
+	}
+}
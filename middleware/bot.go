@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"chinese-chess-backend/dto"
+)
+
+// ApiTokenMiddleware 只允许使用API令牌访问，需要在AuthMiddleware之后使用
+func ApiTokenMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.GetBool("apiToken") {
+			dto.ErrorResponse(c, dto.WithMessage("请使用API令牌访问"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// BotMiddleware 只允许机器人账号访问，check返回错误时拒绝
+func BotMiddleware(check func(userId int) error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := check(c.GetInt("userId")); err != nil {
+			dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,41 @@
+package game
+
+import (
+	"time"
+)
+
+const (
+	StatusWaiting  = "waiting"  // 等待对手加入
+	StatusActive   = "active"   // 对局中
+	StatusFinished = "finished" // 已结束
+)
+
+const (
+	TurnRed   = 1
+	TurnBlack = 2
+)
+
+const (
+	ReasonResign    = "resign"    // 认输
+	ReasonTimeout   = "timeout"   // 超过每步期限
+	ReasonAgreement = "agreement" // 双方同意和棋
+	ReasonCheckmate = "checkmate" // 将死或困毙对方
+)
+
+// CorrespondenceGame 通信对局，对局状态保存在数据库中，双方可以隔几天走一步
+type CorrespondenceGame struct {
+	ID          uint       `gorm:"primaryKey"`
+	RedId       uint       `gorm:"index;default:0"` // 为0表示等待对手加入
+	BlackId     uint       `gorm:"index;default:0"`
+	DaysPerMove int        `gorm:"not null"`
+	Moves       string     `gorm:"type:mediumtext"` // 走子记录的JSON数组
+	Ply         int        `gorm:"default:0"`       // 已走的步数，走子时用作乐观锁
+	Turn        int        `gorm:"default:1"`       // 当前行棋方，1红方，2黑方
+	Status      string     `gorm:"type:varchar(20);index;not null"`
+	Winner      int        `gorm:"default:0"` // 0和棋，1红方，2黑方，只在对局结束后有意义
+	Reason      string     `gorm:"type:varchar(20)"`
+	Deadline    *time.Time `gorm:"index"`     // 当前行棋方的截止时间
+	DrawOffer   uint       `gorm:"default:0"` // 提和的玩家，对方走子后失效
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
@@ -3,13 +3,20 @@ package model
 import (
 	"gorm.io/gorm"
 
+	"chinese-chess-backend/model/game"
 	"chinese-chess-backend/model/user"
+	"chinese-chess-backend/model/webhook"
 )
 
 func InitTable(db *gorm.DB) error {
 	// 自动迁移数据库表结构
 	err := db.AutoMigrate(
 		&user.User{},
+		&user.ApiToken{},
+		&user.Friendship{},
+		&user.Block{},
+		&webhook.Delivery{},
+		&game.CorrespondenceGame{},
 	)
 	if err != nil {
 		return err
@@ -0,0 +1,13 @@
+package user
+
+import (
+	"time"
+)
+
+// Block 玩家屏蔽了BlockedId，不会再与其匹配，也看不到其聊天和挑战
+type Block struct {
+	ID        uint `gorm:"primaryKey"`
+	UserId    uint `gorm:"uniqueIndex:idx_block_pair;not null"`
+	BlockedId uint `gorm:"uniqueIndex:idx_block_pair;not null"`
+	CreatedAt time.Time
+}
@@ -0,0 +1,20 @@
+package user
+
+import (
+	"time"
+)
+
+const (
+	FriendPending  = "pending"  // 等待对方同意
+	FriendAccepted = "accepted" // 已互为好友
+)
+
+// Friendship 好友关系，每对玩家只有一行，UserId为发起好友请求的一方
+type Friendship struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserId    uint   `gorm:"uniqueIndex:idx_friendship_pair;not null"`
+	FriendId  uint   `gorm:"uniqueIndex:idx_friendship_pair;index;not null"`
+	Status    string `gorm:"type:varchar(20);not null"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
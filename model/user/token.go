@@ -0,0 +1,15 @@
+package user
+
+import (
+	"time"
+)
+
+// ApiToken 长期有效的API令牌，供机器人和第三方客户端使用，只保存令牌的哈希
+type ApiToken struct {
+	ID         uint   `gorm:"primaryKey"`
+	UserId     uint   `gorm:"index;not null"`
+	Name       string `gorm:"type:varchar(100);not null"`
+	Hash       string `gorm:"type:char(64);uniqueIndex;not null"` // 令牌的SHA-256
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
@@ -11,6 +11,7 @@ type User struct {
     Email     string         `gorm:"type:varchar(100);uniqueIndex;not null"`
 	Password  string         `gorm:"type:varchar(100);not null"`
 	Exp 	  int            `gorm:"default:0"`
+	Bot       bool           `gorm:"default:false"` // 机器人账号，升级后不能撤销
     CreatedAt time.Time
     UpdatedAt time.Time
 }
\ No newline at end of file
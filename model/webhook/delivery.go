@@ -0,0 +1,25 @@
+package webhook
+
+import (
+	"time"
+)
+
+const (
+	StatusPending   = "pending"   // 等待发送或重试
+	StatusSucceeded = "succeeded" // 接收方返回2xx
+	StatusFailed    = "failed"    // 重试次数用完仍未成功
+)
+
+// Delivery 一次webhook推送的记录
+type Delivery struct {
+	ID         uint   `gorm:"primaryKey"`
+	Url        string `gorm:"type:varchar(500);not null"`
+	Event      string `gorm:"type:varchar(50);not null"`
+	Payload    string `gorm:"type:text;not null"`
+	Status     string `gorm:"type:varchar(20);index;not null"`
+	Attempts   int    `gorm:"default:0"`
+	StatusCode int    `gorm:"default:0"` // 最近一次请求的响应状态码
+	LastError  string `gorm:"type:varchar(500)"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
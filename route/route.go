@@ -3,16 +3,27 @@ package route
 import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"log"
 	"os"
 
+	"chinese-chess-backend/config"
 	"chinese-chess-backend/controller"
+	"chinese-chess-backend/database"
 	"chinese-chess-backend/service"
 
 	"chinese-chess-backend/middleware"
 	"chinese-chess-backend/websocket"
 )
 
-func SetupRouter() *gin.Engine {
+// Services 带有后台任务的服务，停机时需要按顺序停止
+type Services struct {
+	Hub            *websocket.ChessHub
+	Webhooks       *service.WebhookService
+	Correspondence *service.CorrespondenceService
+}
+
+// SetupRouter 返回路由和需要在停机时停止的服务
+func SetupRouter() (*gin.Engine, *Services) {
 	r := gin.Default()
 
 	origin := os.Getenv("FRONTEND_URL")
@@ -24,13 +35,54 @@ func SetupRouter() *gin.Engine {
 	r.Use(cors.New(cors.Config{
 		AllowOrigins: []string{origin},
 		AllowMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders: []string{"Origin", "Content-Type", "Accept", "Authorization"},
+		AllowHeaders: []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Request-Id"},
 	}))
 	// r.Use(middleware.CorsMiddleware())
-	r.Use(middleware.AuthMiddleware())
+	tokenService := service.NewTokenService()
+	// API令牌只能访问机器人接口，其他接口只接受登录token
+	r.Use(middleware.AuthMiddleware(middleware.WithTokenResolver(tokenService.ResolveToken, "/api/bot/")))
 
+	rdb := database.GetRedisClient()
+	snapshotKey := "chess:snapshot"
+	var hubOpts []websocket.HubOption
+	if cluster := config.GetClusterConfig(); cluster.Enabled {
+		hubOpts = append(hubOpts, websocket.WithCluster(websocket.NewRedisBroker(rdb), cluster.NodeId))
+		// 每个节点只恢复自己的房间
+		snapshotKey += ":" + cluster.NodeId
+	}
+	hubOpts = append(hubOpts, websocket.WithSnapshotStore(websocket.NewRedisSnapshotStore(rdb, snapshotKey)))
+	// 挑战在所有节点间共享，对方不在线时保留到过期
+	hubOpts = append(hubOpts, websocket.WithChallengeStore(websocket.NewRedisChallengeStore(rdb)))
+	hubOpts = append(hubOpts, websocket.WithPresenceStore(websocket.NewRedisPresenceStore(rdb)))
+	switch journal := config.GetJournalConfig(); journal.Type {
+	case "file":
+		j, err := websocket.NewFileJournal(journal.Dir)
+		if err != nil {
+			log.Fatalf("创建房间日志目录失败: %v", err)
+		}
+		hubOpts = append(hubOpts, websocket.WithJournal(j))
+	case "redis":
+		hubOpts = append(hubOpts, websocket.WithJournal(websocket.NewRedisJournal(rdb)))
+	}
+	hub := websocket.NewChessHub(hubOpts...)
 	user := controller.NewUserController(service.NewUserService())
-	room := controller.NewRoomController(service.NewRoomService())
+	token := controller.NewTokenController(tokenService)
+	botService := service.NewBotService()
+	bot := controller.NewBotController(botService)
+	room := controller.NewRoomController(service.NewRoomService(hub))
+	webhookService := service.NewWebhookService(config.GetWebhookConfig())
+	websocket.SubscribeWebhooks(hub.Events(), webhookService)
+	webhook := controller.NewWebhookController(webhookService)
+	correspondenceService := service.NewCorrespondenceService(service.WithCorrespondenceNotifier(hub))
+	websocket.RegisterCorrespondence(hub, correspondenceService)
+	correspondence := controller.NewCorrespondenceController(correspondenceService)
+	// 屏蔽列表变化时通知所有节点丢弃缓存
+	blockService := service.NewBlockService(service.WithBlockNotifier(hub))
+	websocket.RegisterBlocks(hub, blockService)
+	friendService := service.NewFriendService(service.WithFriendNotifier(hub), service.WithPresenceProvider(hub))
+	websocket.RegisterFriends(hub, friendService)
+	friend := controller.NewFriendController(friendService)
+	block := controller.NewBlockController(blockService)
 	// 设置路由组
 	api := r.Group("/api")
 	api.POST("/info", user.GetUserInfo)
@@ -42,11 +94,70 @@ func SetupRouter() *gin.Engine {
 	publicRoute.POST("/send-code", user.SendVCode)
 
 	userRoute := api.Group("/user")
-	
-	hub := websocket.NewChessHub()
-	userRoute.POST("/rooms", hub.GetSpareRooms, room.GetSpareRooms)
+	userRoute.POST("/rooms", room.GetSpareRooms)
+	userRoute.POST("/challenges", hub.HandleChallenges)
+	userRoute.POST("/tokens/create", token.CreateToken)
+	userRoute.POST("/tokens/list", token.ListTokens)
+	userRoute.POST("/tokens/revoke", token.RevokeToken)
+
+	// 拒绝和撤回好友请求同样使用remove
+	friendRoute := api.Group("/friends")
+	friendRoute.POST("/request", friend.SendRequest)
+	friendRoute.POST("/accept", friend.Accept)
+	friendRoute.POST("/remove", friend.Remove)
+	friendRoute.POST("/list", friend.List)
+
+	// 屏蔽的玩家不会再被匹配到，其聊天和挑战也不会显示
+	blockRoute := api.Group("/blocks")
+	blockRoute.POST("/add", block.Block)
+	blockRoute.POST("/remove", block.Unblock)
+	blockRoute.POST("/list", block.List)
+
+	// 通信对局保存在数据库中，双方在每步的期限内随时走棋
+	correspondenceRoute := api.Group("/correspondence")
+	correspondenceRoute.POST("/create", correspondence.CreateGame)
+	correspondenceRoute.POST("/open", correspondence.OpenGames)
+	correspondenceRoute.POST("/list", correspondence.ListGames)
+	correspondenceRoute.POST("/get", correspondence.GetGame)
+	correspondenceRoute.POST("/join", correspondence.JoinGame)
+	correspondenceRoute.POST("/cancel", correspondence.CancelGame)
+	correspondenceRoute.POST("/move", correspondence.Move)
+	correspondenceRoute.POST("/resign", correspondence.Resign)
+	correspondenceRoute.POST("/draw", correspondence.Draw)
+
+	adminRoute := api.Group("/admin", middleware.AdminMiddleware())
+	adminRoute.POST("/webhooks/deliveries", webhook.ListDeliveries)
+	adminRoute.POST("/webhooks/replay", webhook.ReplayDelivery)
+
+	// 无法使用websocket时，通过事件流或长轮询接收消息，通过REST接口发送消息
+	streamRoute := api.Group("/stream")
+	streamRoute.GET("/events", hub.HandleEvents)
+	streamRoute.GET("/poll", hub.HandlePoll)
+	streamRoute.POST("/messages", hub.HandleStreamMessage)
+	streamRoute.POST("/match", hub.HandleStreamMatch)
+	streamRoute.POST("/move", hub.HandleStreamMove)
+	streamRoute.POST("/chat", hub.HandleStreamChat)
+
+	// 机器人接口只接受API令牌，账号需要先升级为机器人账号
+	api.POST("/bot/account/upgrade", middleware.ApiTokenMiddleware(), bot.UpgradeAccount)
+	botRoute := api.Group("/bot", middleware.ApiTokenMiddleware(), middleware.BotMiddleware(botService.CheckBot))
+	botRoute.GET("/stream/event", hub.HandleBotEvents)
+	botRoute.GET("/game/stream/:gameId", hub.HandleBotGame)
+	botRoute.POST("/game/:gameId/move", hub.HandleBotMove)
+	botRoute.POST("/game/:gameId/draw/:accept", hub.HandleBotDraw)
+	botRoute.POST("/game/:gameId/resign", hub.HandleBotResign)
+	botRoute.POST("/game/:gameId/chat", hub.HandleBotChat)
+	botRoute.POST("/match", hub.HandleStreamMatch)
+	botRoute.POST("/challenge", hub.HandleBotChallenge)
+	botRoute.POST("/challenge/:challengeId/accept", hub.HandleBotChallengeAccept)
+	botRoute.POST("/challenge/:challengeId/decline", hub.HandleBotChallengeDecline)
+	botRoute.POST("/challenge/:challengeId/cancel", hub.HandleBotChallengeCancel)
 	r.GET("/ws", hub.HandleConnection)
 	go hub.Run()
 
-	return r
+	return r, &Services{
+		Hub:            hub,
+		Webhooks:       webhookService,
+		Correspondence: correspondenceService,
+	}
 }
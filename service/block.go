@@ -0,0 +1,215 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"chinese-chess-backend/database"
+	dto "chinese-chess-backend/dto/user"
+	userModel "chinese-chess-backend/model/user"
+)
+
+const (
+	maxBlocksPerUser = 500
+	blockCacheTTL    = time.Minute // 屏蔽列表的缓存时间，没有收到失效通知时最多延迟这么久生效
+	maxCachedBlocks  = 10000       // 缓存的玩家数超过后整体清空
+)
+
+type blockCacheEntry struct {
+	ids      map[int]struct{}
+	loadedAt time.Time
+}
+
+// BlockNotifier 屏蔽列表变化后通知所有节点丢弃缓存，由websocket中的ChessHub实现
+type BlockNotifier interface {
+	NotifyBlocksChanged(userId int)
+}
+
+// BlockService 管理屏蔽列表。匹配和聊天时会频繁查询，查询结果按玩家缓存
+type BlockService struct {
+	mu       sync.Mutex
+	cache    map[int]blockCacheEntry
+	notifier BlockNotifier
+}
+
+type BlockOption func(*BlockService)
+
+// WithBlockNotifier 指定屏蔽列表变化的通知方式，不指定时只清除本节点的缓存
+func WithBlockNotifier(notifier BlockNotifier) BlockOption {
+	return func(bs *BlockService) {
+		bs.notifier = notifier
+	}
+}
+
+func NewBlockService(opts ...BlockOption) *BlockService {
+	bs := &BlockService{
+		cache: make(map[int]blockCacheEntry),
+	}
+	for _, opt := range opts {
+		opt(bs)
+	}
+	return bs
+}
+
+// changed 清除本节点的缓存并通知其他节点
+func (bs *BlockService) changed(userId int) {
+	bs.Invalidate(userId)
+	if bs.notifier != nil {
+		bs.notifier.NotifyBlocksChanged(userId)
+	}
+}
+
+// Invalidate 丢弃玩家屏蔽列表的缓存，下次查询时重新读取
+func (bs *BlockService) Invalidate(userId int) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	delete(bs.cache, userId)
+}
+
+// blockedIds 返回玩家屏蔽的所有玩家，优先使用缓存
+func (bs *BlockService) blockedIds(userId int) (map[int]struct{}, error) {
+	bs.mu.Lock()
+	entry, ok := bs.cache[userId]
+	bs.mu.Unlock()
+	if ok && time.Since(entry.loadedAt) < blockCacheTTL {
+		return entry.ids, nil
+	}
+
+	var ids []uint
+	err := database.GetMysqlDb().
+		Model(&userModel.Block{}).
+		Where("user_id = ?", userId).
+		Pluck("blocked_id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	entry = blockCacheEntry{
+		ids:      make(map[int]struct{}, len(ids)),
+		loadedAt: time.Now(),
+	}
+	for _, id := range ids {
+		entry.ids[int(id)] = struct{}{}
+	}
+	bs.mu.Lock()
+	if len(bs.cache) >= maxCachedBlocks {
+		clear(bs.cache)
+	}
+	bs.cache[userId] = entry
+	bs.mu.Unlock()
+	return entry.ids, nil
+}
+
+// BlockedIds 返回玩家屏蔽的所有玩家，按id排序
+func (bs *BlockService) BlockedIds(userId int) ([]int, error) {
+	ids, err := bs.blockedIds(userId)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Sorted(maps.Keys(ids)), nil
+}
+
+// Blocks 返回userId是否屏蔽了otherId，查询失败时视为没有屏蔽
+func (bs *BlockService) Blocks(userId, otherId int) bool {
+	ids, err := bs.blockedIds(userId)
+	if err != nil {
+		log.Printf("查询屏蔽列表失败: %v\n", err)
+		return false
+	}
+	_, ok := ids[otherId]
+	return ok
+}
+
+// Block 屏蔽玩家，同时解除双方的好友关系
+func (bs *BlockService) Block(userId int, req dto.BlockRequest) (dto.BlockInfo, error) {
+	if req.UserId == userId {
+		return dto.BlockInfo{}, errors.New("不能屏蔽自己")
+	}
+	db := database.GetMysqlDb()
+	target, err := loadUser(db, req.UserId)
+	if err != nil {
+		return dto.BlockInfo{}, err
+	}
+	var count int64
+	if err := db.Model(&userModel.Block{}).Where("user_id = ?", userId).Count(&count).Error; err != nil {
+		return dto.BlockInfo{}, err
+	}
+	if count >= maxBlocksPerUser {
+		return dto.BlockInfo{}, fmt.Errorf("最多屏蔽%d名玩家", maxBlocksPerUser)
+	}
+	var existing int64
+	err = db.Model(&userModel.Block{}).
+		Where("user_id = ? AND blocked_id = ?", userId, req.UserId).
+		Count(&existing).Error
+	if err != nil {
+		return dto.BlockInfo{}, err
+	}
+	if existing > 0 {
+		return dto.BlockInfo{}, errors.New("已屏蔽该玩家")
+	}
+	block := userModel.Block{
+		UserId:    uint(userId),
+		BlockedId: uint(req.UserId),
+	}
+	if err := db.Create(&block).Error; err != nil {
+		return dto.BlockInfo{}, err
+	}
+	bs.changed(userId)
+	// 不通知被屏蔽的玩家
+	err = db.Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)", userId, req.UserId, req.UserId, userId).
+		Delete(&userModel.Friendship{}).Error
+	if err != nil {
+		log.Printf("解除好友关系失败: %v\n", err)
+	}
+	return dto.BlockInfo{
+		Id:        target.ID,
+		Name:      target.Name,
+		CreatedAt: block.CreatedAt,
+	}, nil
+}
+
+func (bs *BlockService) Unblock(userId int, req dto.BlockRequest) error {
+	result := database.GetMysqlDb().
+		Where("user_id = ? AND blocked_id = ?", userId, req.UserId).
+		Delete(&userModel.Block{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("未屏蔽该玩家")
+	}
+	bs.changed(userId)
+	return nil
+}
+
+func (bs *BlockService) List(userId int) (dto.ListBlocksResponse, error) {
+	resp := dto.ListBlocksResponse{Blocks: make([]dto.BlockInfo, 0)}
+	var blocks []userModel.Block
+	err := database.GetMysqlDb().
+		Where("user_id = ?", userId).
+		Order("id desc").
+		Find(&blocks).Error
+	if err != nil {
+		return resp, err
+	}
+	ids := make([]uint, 0, len(blocks))
+	for _, b := range blocks {
+		ids = append(ids, b.BlockedId)
+	}
+	users, err := loadUsers(database.GetMysqlDb(), ids)
+	if err != nil {
+		return resp, err
+	}
+	for _, b := range blocks {
+		resp.Blocks = append(resp.Blocks, dto.BlockInfo{
+			Id:        b.BlockedId,
+			Name:      users[b.BlockedId].Name,
+			CreatedAt: b.CreatedAt,
+		})
+	}
+	return resp, nil
+}
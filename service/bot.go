@@ -0,0 +1,44 @@
+package service
+
+import (
+	"errors"
+
+	"chinese-chess-backend/database"
+	userModel "chinese-chess-backend/model/user"
+)
+
+type BotService struct {
+}
+
+func NewBotService() *BotService {
+	return &BotService{}
+}
+
+// UpgradeAccount 把账号升级为机器人账号，升级后不能撤销
+func (bs *BotService) UpgradeAccount(userId int) error {
+	db := database.GetMysqlDb()
+	var user userModel.User
+	if err := db.Select("id, bot").Where("id = ?", userId).First(&user).Error; err != nil {
+		return errors.New("用户不存在")
+	}
+	if user.Bot {
+		return errors.New("已经是机器人账号")
+	}
+	return db.Model(&user).Update("bot", true).Error
+}
+
+// CheckBot 只有机器人账号可以使用机器人接口
+func (bs *BotService) CheckBot(userId int) error {
+	var user userModel.User
+	err := database.GetMysqlDb().
+		Select("id, bot").
+		Where("id = ?", userId).
+		First(&user).Error
+	if err != nil {
+		return errors.New("用户不存在")
+	}
+	if !user.Bot {
+		return errors.New("不是机器人账号，请先升级账号")
+	}
+	return nil
+}
@@ -0,0 +1,474 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"gorm.io/gorm"
+
+	"chinese-chess-backend/database"
+	dto "chinese-chess-backend/dto/game"
+	gameModel "chinese-chess-backend/model/game"
+	userModel "chinese-chess-backend/model/user"
+	"chinese-chess-backend/utils"
+	"chinese-chess-backend/xiangqi"
+)
+
+const (
+	maxOpenGamesPerUser  = 20          // 每个玩家未结束的通信对局上限
+	timeoutCheckInterval = time.Minute // 检查超时对局的间隔
+	timeoutBatchSize     = 100         // 每次最多判负的超时对局数
+)
+
+var (
+	errGameNotFound = errors.New("对局不存在")
+	errGameChanged  = errors.New("棋局已变化，请刷新后重试")
+	errNotInGame    = errors.New("您不在该对局中")
+	errGameInactive = errors.New("对局不在进行中")
+)
+
+// CorrespondenceNotifier 把对局变化推送给在线的玩家，由websocket中的ChessHub实现。
+// 返回false表示玩家不在线，轮到该玩家走棋时改为发送邮件提醒
+type CorrespondenceNotifier interface {
+	NotifyCorrespondence(userId int, game dto.GameInfo) bool
+}
+
+type CorrespondenceService struct {
+	db        func() *gorm.DB
+	clock     utils.Clock
+	scheduler *utils.Scheduler
+	notifier  CorrespondenceNotifier
+	sendMail  func(to, subject, body string) error
+}
+
+type CorrespondenceOption func(*CorrespondenceService)
+
+// WithCorrespondenceNotifier 指定推送对局变化的方式，不指定时只发送邮件提醒
+func WithCorrespondenceNotifier(notifier CorrespondenceNotifier) CorrespondenceOption {
+	return func(cs *CorrespondenceService) {
+		cs.notifier = notifier
+	}
+}
+
+// WithCorrespondenceDB 指定保存对局的数据库，默认使用database.GetMysqlDb
+func WithCorrespondenceDB(db *gorm.DB) CorrespondenceOption {
+	return func(cs *CorrespondenceService) {
+		cs.db = func() *gorm.DB { return db }
+	}
+}
+
+// WithCorrespondenceClock 指定时间来源，测试中可以传入FakeClock
+func WithCorrespondenceClock(clock utils.Clock) CorrespondenceOption {
+	return func(cs *CorrespondenceService) {
+		cs.clock = clock
+	}
+}
+
+// NewCorrespondenceService 创建服务并启动超时判负的后台任务
+func NewCorrespondenceService(opts ...CorrespondenceOption) *CorrespondenceService {
+	cs := &CorrespondenceService{
+		db:       database.GetMysqlDb,
+		clock:    utils.RealClock,
+		sendMail: utils.SendMail,
+	}
+	for _, opt := range opts {
+		opt(cs)
+	}
+	cs.scheduler = utils.NewScheduler(utils.WithClock(cs.clock))
+	cs.scheduler.Start()
+	cs.scheduler.Schedule(timeoutCheckInterval, cs.checkTimeouts)
+	return cs
+}
+
+// Stop 停止超时判负的后台任务
+func (cs *CorrespondenceService) Stop() {
+	cs.scheduler.Stop()
+}
+
+func (cs *CorrespondenceService) deadline(days int) *time.Time {
+	deadline := cs.clock.Now().Add(time.Duration(days) * 24 * time.Hour)
+	return &deadline
+}
+
+func (cs *CorrespondenceService) find(gameId uint) (gameModel.CorrespondenceGame, error) {
+	var g gameModel.CorrespondenceGame
+	err := cs.db().First(&g, gameId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return g, errGameNotFound
+	}
+	return g, err
+}
+
+// role 返回玩家在对局中执红还是执黑，不在对局中时返回0
+func role(g gameModel.CorrespondenceGame, userId int) int {
+	switch uint(userId) {
+	case g.RedId:
+		return gameModel.TurnRed
+	case g.BlackId:
+		return gameModel.TurnBlack
+	}
+	return 0
+}
+
+func other(turn int) int {
+	if turn == gameModel.TurnRed {
+		return gameModel.TurnBlack
+	}
+	return gameModel.TurnRed
+}
+
+func (cs *CorrespondenceService) CreateGame(userId int, req *dto.CreateGameRequest) (dto.GameInfo, error) {
+	var count int64
+	err := cs.db().Model(&gameModel.CorrespondenceGame{}).
+		Where("(red_id = ? OR black_id = ?) AND status <> ?", userId, userId, gameModel.StatusFinished).
+		Count(&count).Error
+	if err != nil {
+		return dto.GameInfo{}, err
+	}
+	if count >= maxOpenGamesPerUser {
+		return dto.GameInfo{}, fmt.Errorf("进行中的通信对局最多%d局", maxOpenGamesPerUser)
+	}
+	g := gameModel.CorrespondenceGame{
+		DaysPerMove: req.DaysPerMove,
+		Moves:       "[]",
+		Turn:        gameModel.TurnRed,
+		Status:      gameModel.StatusWaiting,
+	}
+	red := req.Color == "red" || (req.Color == "random" && rand.IntN(2) == 0)
+	if red {
+		g.RedId = uint(userId)
+	} else {
+		g.BlackId = uint(userId)
+	}
+	if err := cs.db().Create(&g).Error; err != nil {
+		return dto.GameInfo{}, err
+	}
+	return dto.NewGameInfo(g), nil
+}
+
+// OpenGames 列出等待对手加入的对局，不包括自己创建的
+func (cs *CorrespondenceService) OpenGames(userId int, req dto.ListGamesRequest) (dto.ListGamesResponse, error) {
+	query := cs.db().Model(&gameModel.CorrespondenceGame{}).
+		Where("status = ? AND red_id <> ? AND black_id <> ?", gameModel.StatusWaiting, userId, userId)
+	return cs.list(query, req)
+}
+
+// ListGames 列出自己参与的对局，轮到自己走棋的对局按截止时间排在前面
+func (cs *CorrespondenceService) ListGames(userId int, req dto.ListGamesRequest) (dto.ListGamesResponse, error) {
+	query := cs.db().Model(&gameModel.CorrespondenceGame{}).
+		Where("red_id = ? OR black_id = ?", userId, userId)
+	if req.Status != "" {
+		query = query.Where("status = ?", req.Status)
+	}
+	return cs.list(query, req)
+}
+
+func (cs *CorrespondenceService) list(query *gorm.DB, req dto.ListGamesRequest) (dto.ListGamesResponse, error) {
+	resp := dto.ListGamesResponse{
+		Games:    make([]dto.GameInfo, 0),
+		Page:     req.Page,
+		PageSize: req.PageSize,
+	}
+	query = query.Session(&gorm.Session{})
+	if err := query.Count(&resp.Total).Error; err != nil {
+		return resp, err
+	}
+	var games []gameModel.CorrespondenceGame
+	err := query.Order("deadline IS NULL, deadline, id desc").
+		Offset((req.Page - 1) * req.PageSize).
+		Limit(req.PageSize).
+		Find(&games).Error
+	if err != nil {
+		return resp, err
+	}
+	for _, g := range games {
+		resp.Games = append(resp.Games, dto.NewGameInfo(g))
+	}
+	return resp, nil
+}
+
+// GetGame 对局记录对所有登录用户公开
+func (cs *CorrespondenceService) GetGame(req dto.GameIdRequest) (dto.GameInfo, error) {
+	g, err := cs.find(req.GameId)
+	if err != nil {
+		return dto.GameInfo{}, err
+	}
+	return dto.NewGameInfo(g), nil
+}
+
+// JoinGame 加入等待中的对局，对局随即开始，红方先走
+func (cs *CorrespondenceService) JoinGame(userId int, req dto.GameIdRequest) (dto.GameInfo, error) {
+	g, err := cs.find(req.GameId)
+	if err != nil {
+		return dto.GameInfo{}, err
+	}
+	if g.Status != gameModel.StatusWaiting {
+		return dto.GameInfo{}, errors.New("对局已开始")
+	}
+	if role(g, userId) != 0 {
+		return dto.GameInfo{}, errors.New("不能加入自己创建的对局")
+	}
+	seat := "red_id"
+	if g.RedId == 0 {
+		g.RedId = uint(userId)
+	} else {
+		seat = "black_id"
+		g.BlackId = uint(userId)
+	}
+	g.Status = gameModel.StatusActive
+	g.Deadline = cs.deadline(g.DaysPerMove)
+	result := cs.db().Model(&gameModel.CorrespondenceGame{}).
+		Where("id = ? AND status = ?", g.ID, gameModel.StatusWaiting).
+		Updates(map[string]any{
+			seat:       userId,
+			"status":   g.Status,
+			"deadline": g.Deadline,
+		})
+	if result.Error != nil {
+		return dto.GameInfo{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return dto.GameInfo{}, errors.New("对局已被其他玩家加入")
+	}
+	g.UpdatedAt = cs.clock.Now()
+	cs.notify(g, true)
+	return dto.NewGameInfo(g), nil
+}
+
+// CancelGame 撤销自己创建的、还没有对手加入的对局
+func (cs *CorrespondenceService) CancelGame(userId int, req dto.GameIdRequest) error {
+	result := cs.db().
+		Where("id = ? AND status = ? AND (red_id = ? OR black_id = ?)", req.GameId, gameModel.StatusWaiting, userId, userId).
+		Delete(&gameModel.CorrespondenceGame{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("对局不存在或已开始")
+	}
+	return nil
+}
+
+// active 读取玩家参与的进行中的对局。已过截止时间的对局在这里判负，不必等待后台任务
+func (cs *CorrespondenceService) active(userId int, gameId uint) (gameModel.CorrespondenceGame, int, error) {
+	g, err := cs.find(gameId)
+	if err != nil {
+		return g, 0, err
+	}
+	r := role(g, userId)
+	if r == 0 {
+		return g, 0, errNotInGame
+	}
+	if g.Status != gameModel.StatusActive {
+		return g, 0, errGameInactive
+	}
+	if g.Deadline != nil && !cs.clock.Now().Before(*g.Deadline) {
+		if err := cs.finish(&g, other(g.Turn), gameModel.ReasonTimeout); err != nil {
+			return g, 0, err
+		}
+		return g, 0, errors.New("对局已超时结束")
+	}
+	return g, r, nil
+}
+
+// Move 走子，走完后轮到对方，并重新计算截止时间。走法按规则校验，将死或困毙对方时对局随即结束
+func (cs *CorrespondenceService) Move(userId int, req *dto.MoveRequest) (dto.GameInfo, error) {
+	g, r, err := cs.active(userId, req.GameId)
+	if err != nil {
+		return dto.GameInfo{}, err
+	}
+	if g.Turn != r {
+		return dto.GameInfo{}, errors.New("请等待对方走棋")
+	}
+	if req.Ply != 0 && req.Ply != g.Ply+1 {
+		return dto.GameInfo{}, errGameChanged
+	}
+	var moves []dto.Move
+	if err := json.Unmarshal([]byte(g.Moves), &moves); err != nil {
+		return dto.GameInfo{}, err
+	}
+	game, err := replayMoves(moves)
+	if err != nil {
+		return dto.GameInfo{}, err
+	}
+	if err := game.Play(xiangqi.Position(req.From), xiangqi.Position(req.To)); err != nil {
+		return dto.GameInfo{}, err
+	}
+	moves = append(moves, dto.Move{From: req.From, To: req.To, Ply: g.Ply + 1})
+	data, err := json.Marshal(moves)
+	if err != nil {
+		return dto.GameInfo{}, err
+	}
+	ply := g.Ply
+	g.Moves = string(data)
+	g.Ply++
+	g.Turn = other(g.Turn)
+	g.Deadline = cs.deadline(g.DaysPerMove)
+	g.DrawOffer = 0
+	updates := map[string]any{
+		"moves":      g.Moves,
+		"ply":        g.Ply,
+		"turn":       g.Turn,
+		"deadline":   g.Deadline,
+		"draw_offer": 0,
+	}
+	over := game.Over()
+	if over {
+		g.Status = gameModel.StatusFinished
+		g.Winner = r
+		g.Reason = gameModel.ReasonCheckmate
+		g.Deadline = nil
+		updates["status"] = g.Status
+		updates["winner"] = g.Winner
+		updates["reason"] = g.Reason
+		updates["deadline"] = nil
+	}
+	result := cs.db().Model(&gameModel.CorrespondenceGame{}).
+		Where("id = ? AND ply = ? AND status = ?", g.ID, ply, gameModel.StatusActive).
+		Updates(updates)
+	if result.Error != nil {
+		return dto.GameInfo{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return dto.GameInfo{}, errGameChanged
+	}
+	g.UpdatedAt = cs.clock.Now()
+	cs.notify(g, !over)
+	return dto.NewGameInfo(g), nil
+}
+
+// replayMoves 按走子记录重建局面
+func replayMoves(moves []dto.Move) (*xiangqi.Game, error) {
+	game := xiangqi.NewGame()
+	for _, m := range moves {
+		if err := game.Play(xiangqi.Position(m.From), xiangqi.Position(m.To)); err != nil {
+			return nil, fmt.Errorf("对局记录第%d步不合法", m.Ply)
+		}
+	}
+	return game, nil
+}
+
+// Resign 认输
+func (cs *CorrespondenceService) Resign(userId int, req dto.GameIdRequest) (dto.GameInfo, error) {
+	g, r, err := cs.active(userId, req.GameId)
+	if err != nil {
+		return dto.GameInfo{}, err
+	}
+	if err := cs.finish(&g, other(r), gameModel.ReasonResign); err != nil {
+		return dto.GameInfo{}, err
+	}
+	return dto.NewGameInfo(g), nil
+}
+
+// Draw 提和、接受提和，或者拒绝对方和撤回自己的提和
+func (cs *CorrespondenceService) Draw(userId int, req dto.DrawRequest) (dto.GameInfo, error) {
+	g, _, err := cs.active(userId, req.GameId)
+	if err != nil {
+		return dto.GameInfo{}, err
+	}
+	offer := g.DrawOffer
+	switch {
+	case req.Accept && offer != 0 && offer != uint(userId):
+		if err := cs.finish(&g, 0, gameModel.ReasonAgreement); err != nil {
+			return dto.GameInfo{}, err
+		}
+		return dto.NewGameInfo(g), nil
+	case req.Accept:
+		g.DrawOffer = uint(userId)
+	default:
+		g.DrawOffer = 0
+	}
+	if g.DrawOffer == offer {
+		return dto.NewGameInfo(g), nil
+	}
+	result := cs.db().Model(&gameModel.CorrespondenceGame{}).
+		Where("id = ? AND ply = ? AND status = ? AND draw_offer = ?", g.ID, g.Ply, gameModel.StatusActive, offer).
+		Update("draw_offer", g.DrawOffer)
+	if result.Error != nil {
+		return dto.GameInfo{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return dto.GameInfo{}, errGameChanged
+	}
+	g.UpdatedAt = cs.clock.Now()
+	cs.notify(g, false)
+	return dto.NewGameInfo(g), nil
+}
+
+// finish 结束进行中的对局，winner为0表示和棋。对局在读取后发生变化时返回errGameChanged
+func (cs *CorrespondenceService) finish(g *gameModel.CorrespondenceGame, winner int, reason string) error {
+	result := cs.db().Model(&gameModel.CorrespondenceGame{}).
+		Where("id = ? AND ply = ? AND status = ?", g.ID, g.Ply, gameModel.StatusActive).
+		Updates(map[string]any{
+			"status":     gameModel.StatusFinished,
+			"winner":     winner,
+			"reason":     reason,
+			"deadline":   nil,
+			"draw_offer": 0,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errGameChanged
+	}
+	g.Status = gameModel.StatusFinished
+	g.Winner = winner
+	g.Reason = reason
+	g.Deadline = nil
+	g.DrawOffer = 0
+	g.UpdatedAt = cs.clock.Now()
+	cs.notify(*g, false)
+	return nil
+}
+
+// checkTimeouts 判负超过截止时间仍未走棋的一方，多个节点同时执行时每局只会结算一次
+func (cs *CorrespondenceService) checkTimeouts() {
+	defer cs.scheduler.Schedule(timeoutCheckInterval, cs.checkTimeouts)
+	var games []gameModel.CorrespondenceGame
+	err := cs.db().
+		Where("status = ? AND deadline <= ?", gameModel.StatusActive, cs.clock.Now()).
+		Order("deadline").
+		Limit(timeoutBatchSize).
+		Find(&games).Error
+	if err != nil {
+		log.Printf("查询超时的通信对局失败: %v\n", err)
+		return
+	}
+	for i := range games {
+		g := &games[i]
+		err := cs.finish(g, other(g.Turn), gameModel.ReasonTimeout)
+		if err != nil && !errors.Is(err, errGameChanged) {
+			log.Printf("通信对局 %d 超时判负失败: %v\n", g.ID, err)
+		}
+	}
+}
+
+// notify 把对局的最新状态推送给双方。turn为true时提醒当前行棋方，不在线的玩家改为邮件提醒
+func (cs *CorrespondenceService) notify(g gameModel.CorrespondenceGame, turn bool) {
+	info := dto.NewGameInfo(g)
+	current := info.CurrentPlayer()
+	for _, id := range []uint{g.RedId, g.BlackId} {
+		online := cs.notifier != nil && cs.notifier.NotifyCorrespondence(int(id), info)
+		if turn && !online && id == current {
+			go cs.mailTurn(id, info)
+		}
+	}
+}
+
+func (cs *CorrespondenceService) mailTurn(userId uint, info dto.GameInfo) {
+	var user userModel.User
+	if err := cs.db().Select("id, email").First(&user, userId).Error; err != nil {
+		log.Printf("查询玩家邮箱失败: %v\n", err)
+		return
+	}
+	body := fmt.Sprintf("您在通信对局 %d 中轮到走棋了，请在 %s 之前走棋，超时将被判负。",
+		info.Id, info.Deadline.Format("2006-01-02 15:04"))
+	if err := cs.sendMail(user.Email, "轮到您走棋了", body); err != nil {
+		log.Printf("发送走棋提醒失败: %v\n", err)
+	}
+}
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	dto "chinese-chess-backend/dto/game"
+	gameModel "chinese-chess-backend/model/game"
+	userModel "chinese-chess-backend/model/user"
+	"chinese-chess-backend/utils"
+	"chinese-chess-backend/xiangqi"
+)
+
+// fakeNotifier 记录推送给每个玩家的对局状态，online中的玩家视为在线
+type fakeNotifier struct {
+	mu       sync.Mutex
+	online   map[int]bool
+	notified map[int][]dto.GameInfo
+}
+
+func (fn *fakeNotifier) NotifyCorrespondence(userId int, game dto.GameInfo) bool {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	fn.notified[userId] = append(fn.notified[userId], game)
+	return fn.online[userId]
+}
+
+// last 玩家最近收到的对局状态
+func (fn *fakeNotifier) last(userId int) (dto.GameInfo, bool) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	games := fn.notified[userId]
+	if len(games) == 0 {
+		return dto.GameInfo{}, false
+	}
+	return games[len(games)-1], true
+}
+
+// testMail 发出的一封邮件
+type testMail struct {
+	to, subject, body string
+}
+
+// newTestCorrespondenceService 创建使用内存数据库和FakeClock的服务，玩家1、2、3的邮箱为playerN@example.com，
+// 只有online中的玩家在线。发出的邮件写入返回的通道
+func newTestCorrespondenceService(t *testing.T, online ...int) (*CorrespondenceService, *fakeNotifier, <-chan testMail, *utils.FakeClock) {
+	t.Helper()
+	db := newTestDB(t, &gameModel.CorrespondenceGame{}, &userModel.User{})
+	for id := 1; id <= 3; id++ {
+		u := userModel.User{ID: uint(id), Name: "player", Email: fmt.Sprintf("player%d@example.com", id)}
+		if err := db.Create(&u).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	notifier := &fakeNotifier{online: make(map[int]bool), notified: make(map[int][]dto.GameInfo)}
+	for _, id := range online {
+		notifier.online[id] = true
+	}
+	clock := utils.NewFakeClock(time.Now())
+	cs := NewCorrespondenceService(
+		WithCorrespondenceDB(db),
+		WithCorrespondenceClock(clock),
+		WithCorrespondenceNotifier(notifier),
+	)
+	t.Cleanup(cs.Stop)
+	mails := make(chan testMail, 10)
+	cs.sendMail = func(to, subject, body string) error {
+		mails <- testMail{to, subject, body}
+		return nil
+	}
+	return cs, notifier, mails, clock
+}
+
+// startGame 玩家1执红创建对局，玩家2加入
+func startGame(t *testing.T, cs *CorrespondenceService, daysPerMove int) dto.GameInfo {
+	t.Helper()
+	created, err := cs.CreateGame(1, &dto.CreateGameRequest{DaysPerMove: daysPerMove, Color: "red"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	game, err := cs.JoinGame(2, dto.GameIdRequest{GameId: created.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return game
+}
+
+// move 以userId的身份从(fx,fy)走到(tx,ty)
+func move(cs *CorrespondenceService, userId int, gameId uint, fx, fy, tx, ty int) (dto.GameInfo, error) {
+	return cs.Move(userId, &dto.MoveRequest{
+		GameId: gameId,
+		From:   dto.Position{X: fx, Y: fy},
+		To:     dto.Position{X: tx, Y: ty},
+	})
+}
+
+func TestCorrespondenceCreateAndJoin(t *testing.T) {
+	cs, _, _, clock := newTestCorrespondenceService(t)
+
+	created, err := cs.CreateGame(1, &dto.CreateGameRequest{DaysPerMove: 3, Color: "black"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Status != gameModel.StatusWaiting || created.BlackId != 1 || created.RedId != 0 || created.Deadline != nil {
+		t.Fatalf("新建的对局应当等待对手加入: %+v", created)
+	}
+
+	// 自己创建的对局不出现在可加入的列表中，也不能加入
+	open, err := cs.OpenGames(1, dto.ListGamesRequest{Page: 1, PageSize: 10})
+	if err != nil || open.Total != 0 {
+		t.Fatalf("不应当列出自己创建的对局: %+v, %v", open, err)
+	}
+	open, err = cs.OpenGames(2, dto.ListGamesRequest{Page: 1, PageSize: 10})
+	if err != nil || open.Total != 1 || open.Games[0].Id != created.Id {
+		t.Fatalf("应当列出等待加入的对局: %+v, %v", open, err)
+	}
+	if _, err := cs.JoinGame(1, dto.GameIdRequest{GameId: created.Id}); err == nil {
+		t.Fatal("不能加入自己创建的对局")
+	}
+	if _, err := cs.JoinGame(2, dto.GameIdRequest{GameId: created.Id + 100}); !errors.Is(err, errGameNotFound) {
+		t.Fatalf("加入不存在的对局应当返回errGameNotFound: %v", err)
+	}
+
+	// 对手坐到空着的一方，对局开始，红方的截止时间从加入时算起
+	game, err := cs.JoinGame(2, dto.GameIdRequest{GameId: created.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if game.Status != gameModel.StatusActive || game.RedId != 2 || game.Turn != "red" ||
+		game.Deadline == nil || !game.Deadline.Equal(clock.Now().Add(3*24*time.Hour)) {
+		t.Fatalf("加入后对局应当开始并轮到红方: %+v", game)
+	}
+	if _, err := cs.JoinGame(3, dto.GameIdRequest{GameId: created.Id}); err == nil {
+		t.Fatal("不能加入已开始的对局")
+	}
+	if err := cs.CancelGame(1, dto.GameIdRequest{GameId: created.Id}); err == nil {
+		t.Fatal("不能撤销已开始的对局")
+	}
+
+	// 还没有对手的对局可以由创建者撤销
+	waiting, err := cs.CreateGame(1, &dto.CreateGameRequest{DaysPerMove: 1, Color: "red"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.CancelGame(2, dto.GameIdRequest{GameId: waiting.Id}); err == nil {
+		t.Fatal("不能撤销别人创建的对局")
+	}
+	if err := cs.CancelGame(1, dto.GameIdRequest{GameId: waiting.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.GetGame(dto.GameIdRequest{GameId: waiting.Id}); !errors.Is(err, errGameNotFound) {
+		t.Fatalf("撤销的对局应当被删除: %v", err)
+	}
+}
+
+func TestCorrespondenceMoveOrderAndLegality(t *testing.T) {
+	cs, _, _, clock := newTestCorrespondenceService(t, 1, 2)
+	game := startGame(t, cs, 2)
+
+	if _, err := move(cs, 2, game.Id, 7, 2, 4, 2); err == nil {
+		t.Fatal("红方先走，黑方不能走棋")
+	}
+	if _, err := move(cs, 3, game.Id, 7, 7, 4, 7); !errors.Is(err, errNotInGame) {
+		t.Fatalf("不在对局中的玩家不能走棋: %v", err)
+	}
+	// 炮不能斜走，车不能越子
+	for _, m := range [][4]int{{7, 7, 6, 6}, {0, 9, 0, 5}} {
+		if _, err := move(cs, 1, game.Id, m[0], m[1], m[2], m[3]); !errors.Is(err, xiangqi.ErrIllegalMove) {
+			t.Fatalf("%v应当被判为不合法: %v", m, err)
+		}
+	}
+	if _, err := cs.Move(1, &dto.MoveRequest{GameId: game.Id, From: dto.Position{X: 7, Y: 7}, To: dto.Position{X: 4, Y: 7}, Ply: 2}); !errors.Is(err, errGameChanged) {
+		t.Fatalf("步数不一致时应当拒绝: %v", err)
+	}
+
+	clock.Advance(time.Hour)
+	game, err := move(cs, 1, game.Id, 7, 7, 4, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if game.Ply != 1 || game.Turn != "black" || len(game.Moves) != 1 || !game.Deadline.Equal(clock.Now().Add(2*24*time.Hour)) {
+		t.Fatalf("走子后应当轮到黑方并重新计算截止时间: %+v", game)
+	}
+	if _, err := move(cs, 1, game.Id, 4, 7, 4, 3); err == nil {
+		t.Fatal("红方不能连走两步")
+	}
+	if _, err := move(cs, 2, game.Id, 7, 2, 4, 2); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := cs.GetGame(dto.GameIdRequest{GameId: game.Id})
+	if err != nil || saved.Ply != 2 || saved.Turn != "red" || saved.Moves[1].Ply != 2 {
+		t.Fatalf("走子记录应当保存: %+v, %v", saved, err)
+	}
+}
+
+func TestCorrespondenceMateEndsGame(t *testing.T) {
+	cs, notifier, mails, _ := newTestCorrespondenceService(t)
+	game := startGame(t, cs, 1)
+	<-mails
+	// 红炮打象将军，黑将被自己的士挡住，无处可走
+	moves := [][4]int{{1, 7, 1, 4}, {0, 0, 0, 1}, {1, 4, 2, 4}, {5, 0, 4, 1}, {2, 4, 2, 0}}
+	var err error
+	for i, m := range moves {
+		if game, err = move(cs, 1+i%2, game.Id, m[0], m[1], m[2], m[3]); err != nil {
+			t.Fatalf("第%d步: %v", i+1, err)
+		}
+		if i < len(moves)-1 {
+			<-mails // 双方都不在线，每步都给下一个行棋方发送提醒
+		}
+	}
+	if game.Status != gameModel.StatusFinished || game.Winner != "red" || game.Reason != gameModel.ReasonCheckmate || game.Deadline != nil {
+		t.Fatalf("将死后对局应当结束并由红方获胜: %+v", game)
+	}
+	select {
+	case mail := <-mails:
+		t.Fatalf("对局结束后不应当再提醒走棋: %+v", mail)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if last, ok := notifier.last(2); !ok || last.Status != gameModel.StatusFinished {
+		t.Fatalf("应当把结束的对局推送给黑方: %+v", last)
+	}
+	if _, err := move(cs, 2, game.Id, 4, 0, 5, 0); !errors.Is(err, errGameInactive) {
+		t.Fatalf("对局结束后不能再走棋: %v", err)
+	}
+}
+
+func TestCorrespondenceTimeoutAdjudication(t *testing.T) {
+	cs, notifier, _, clock := newTestCorrespondenceService(t, 1, 2)
+	game := startGame(t, cs, 1)
+	if _, err := move(cs, 1, game.Id, 7, 7, 4, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	// 黑方超过一天没有走棋，后台任务判负，不需要有人访问对局
+	clock.Advance(24*time.Hour + timeoutCheckInterval)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if last, _ := notifier.last(2); last.Status == gameModel.StatusFinished {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("等待超时判负超时")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	saved, err := cs.GetGame(dto.GameIdRequest{GameId: game.Id})
+	if err != nil || saved.Winner != "red" || saved.Reason != gameModel.ReasonTimeout || saved.Deadline != nil {
+		t.Fatalf("黑方应当被判超时负: %+v, %v", saved, err)
+	}
+	if _, err := move(cs, 2, game.Id, 7, 2, 4, 2); !errors.Is(err, errGameInactive) {
+		t.Fatalf("超时结束后不能再走棋: %v", err)
+	}
+}
+
+func TestCorrespondenceDrawOfferAndAccept(t *testing.T) {
+	cs, notifier, _, _ := newTestCorrespondenceService(t, 1, 2)
+	game := startGame(t, cs, 1)
+
+	game, err := cs.Draw(1, dto.DrawRequest{GameId: game.Id, Accept: true})
+	if err != nil || game.DrawOffer != 1 || game.Status != gameModel.StatusActive {
+		t.Fatalf("红方提和: %+v, %v", game, err)
+	}
+	if offer, _ := notifier.last(2); offer.DrawOffer != 1 {
+		t.Fatalf("应当把提和推送给黑方: %+v", offer)
+	}
+	// 提和的一方再次提和不会结束对局
+	if game, err = cs.Draw(1, dto.DrawRequest{GameId: game.Id, Accept: true}); err != nil || game.Status != gameModel.StatusActive {
+		t.Fatalf("不能接受自己的提和: %+v, %v", game, err)
+	}
+	if _, err := cs.Draw(3, dto.DrawRequest{GameId: game.Id, Accept: true}); !errors.Is(err, errNotInGame) {
+		t.Fatalf("不在对局中的玩家不能提和: %v", err)
+	}
+
+	game, err = cs.Draw(2, dto.DrawRequest{GameId: game.Id, Accept: true})
+	if err != nil || game.Status != gameModel.StatusFinished || game.Winner != "draw" || game.Reason != gameModel.ReasonAgreement {
+		t.Fatalf("黑方接受提和后应当和棋: %+v, %v", game, err)
+	}
+}
+
+func TestCorrespondenceTurnNotification(t *testing.T) {
+	// 红方在线，黑方不在线
+	cs, notifier, mails, _ := newTestCorrespondenceService(t, 1)
+	game := startGame(t, cs, 1)
+	if last, ok := notifier.last(1); !ok || last.Id != game.Id || last.Status != gameModel.StatusActive {
+		t.Fatalf("对局开始时应当推送给在线的红方: %+v", last)
+	}
+
+	// 轮到不在线的黑方时发送邮件提醒
+	if _, err := move(cs, 1, game.Id, 7, 7, 4, 7); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case mail := <-mails:
+		if mail.to != "player2@example.com" || mail.subject != "轮到您走棋了" {
+			t.Fatalf("应当提醒黑方走棋: %+v", mail)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待邮件提醒超时")
+	}
+
+	// 轮到在线的红方时只推送，不发送邮件
+	if _, err := move(cs, 2, game.Id, 7, 2, 4, 2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case mail := <-mails:
+		t.Fatalf("在线的玩家不应当收到邮件: %+v", mail)
+	case <-time.After(50 * time.Millisecond):
+	}
+	last, _ := notifier.last(1)
+	if last.Ply != 2 || last.Turn != "red" || !slices.ContainsFunc(last.Moves, func(m dto.Move) bool { return m.Ply == 2 }) {
+		t.Fatalf("应当把黑方的走子推送给红方: %+v", last)
+	}
+}
@@ -0,0 +1,315 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"chinese-chess-backend/database"
+	dto "chinese-chess-backend/dto/user"
+	userModel "chinese-chess-backend/model/user"
+)
+
+const maxFriendsPerUser = 200 // 好友和未处理的好友请求的总数上限
+
+var errFriendNotFound = errors.New("好友关系不存在")
+
+// FriendNotifier 把好友请求和好友关系的变化推送给在线的玩家，由websocket中的ChessHub实现
+type FriendNotifier interface {
+	NotifyFriend(userId int, event string, friend dto.FriendInfo)
+}
+
+// PresenceProvider 查询玩家的在线状态，由websocket中的ChessHub实现
+type PresenceProvider interface {
+	Presence(userIds []int) map[int]dto.Presence
+}
+
+type FriendService struct {
+	db       func() *gorm.DB
+	notifier FriendNotifier
+	presence PresenceProvider
+}
+
+type FriendOption func(*FriendService)
+
+// WithFriendNotifier 指定推送好友变化的方式，不指定时不推送
+func WithFriendNotifier(notifier FriendNotifier) FriendOption {
+	return func(fs *FriendService) {
+		fs.notifier = notifier
+	}
+}
+
+// WithPresenceProvider 指定在线状态的来源，不指定时好友都显示为离线
+func WithPresenceProvider(presence PresenceProvider) FriendOption {
+	return func(fs *FriendService) {
+		fs.presence = presence
+	}
+}
+
+// WithFriendDB 指定保存好友关系的数据库，默认使用database.GetMysqlDb
+func WithFriendDB(db *gorm.DB) FriendOption {
+	return func(fs *FriendService) {
+		fs.db = func() *gorm.DB { return db }
+	}
+}
+
+func NewFriendService(opts ...FriendOption) *FriendService {
+	fs := &FriendService{db: database.GetMysqlDb}
+	for _, opt := range opts {
+		opt(fs)
+	}
+	return fs
+}
+
+func (fs *FriendService) notify(userId int, event string, friend dto.FriendInfo) {
+	if fs.notifier != nil {
+		fs.notifier.NotifyFriend(userId, event, friend)
+	}
+}
+
+func (fs *FriendService) presenceOf(userIds []int) map[int]dto.Presence {
+	if fs.presence == nil || len(userIds) == 0 {
+		return map[int]dto.Presence{}
+	}
+	return fs.presence.Presence(userIds)
+}
+
+// withPresence 给已互为好友的玩家补上在线状态
+func (fs *FriendService) withPresence(info dto.FriendInfo) dto.FriendInfo {
+	p, ok := fs.presenceOf([]int{int(info.Id)})[int(info.Id)]
+	if !ok {
+		p = dto.Presence{State: dto.PresenceOffline}
+	}
+	info.Presence = &p
+	return info
+}
+
+func loadUsers(db *gorm.DB, ids []uint) (map[uint]userModel.User, error) {
+	users := make(map[uint]userModel.User, len(ids))
+	if len(ids) == 0 {
+		return users, nil
+	}
+	var list []userModel.User
+	err := db.
+		Select("id, name, exp").
+		Where("id IN ?", ids).
+		Find(&list).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range list {
+		users[u.ID] = u
+	}
+	return users, nil
+}
+
+func loadUser(db *gorm.DB, id int) (userModel.User, error) {
+	users, err := loadUsers(db, []uint{uint(id)})
+	if err != nil {
+		return userModel.User{}, err
+	}
+	u, ok := users[uint(id)]
+	if !ok {
+		return u, errors.New("用户不存在")
+	}
+	return u, nil
+}
+
+func newFriendInfo(u userModel.User, f userModel.Friendship) dto.FriendInfo {
+	return dto.FriendInfo{
+		Id:    u.ID,
+		Name:  u.Name,
+		Exp:   u.Exp,
+		Since: f.UpdatedAt,
+	}
+}
+
+// findFriendship 查找两名玩家之间的好友关系，不区分由哪一方发起
+func findFriendship(db *gorm.DB, a, b int) (userModel.Friendship, error) {
+	var f userModel.Friendship
+	err := db.Where("(user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)", a, b, b, a).
+		First(&f).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return f, errFriendNotFound
+	}
+	return f, err
+}
+
+// SendRequest 发送好友请求，对方已向自己发送过请求时直接成为好友
+func (fs *FriendService) SendRequest(userId int, req dto.FriendIdRequest) (dto.FriendInfo, error) {
+	if req.UserId == userId {
+		return dto.FriendInfo{}, errors.New("不能添加自己为好友")
+	}
+	db := fs.db()
+	target, err := loadUser(db, req.UserId)
+	if err != nil {
+		return dto.FriendInfo{}, err
+	}
+	self, err := loadUser(db, userId)
+	if err != nil {
+		return dto.FriendInfo{}, err
+	}
+	var blocked int64
+	err = db.Model(&userModel.Block{}).
+		Where("(user_id = ? AND blocked_id = ?) OR (user_id = ? AND blocked_id = ?)", userId, req.UserId, req.UserId, userId).
+		Count(&blocked).Error
+	if err != nil {
+		return dto.FriendInfo{}, err
+	}
+	if blocked > 0 {
+		return dto.FriendInfo{}, errors.New("无法添加该玩家为好友")
+	}
+	f, err := findFriendship(db, userId, req.UserId)
+	switch {
+	case err == nil && f.Status == userModel.FriendAccepted:
+		return dto.FriendInfo{}, errors.New("你们已经是好友")
+	case err == nil && f.UserId == uint(userId):
+		return dto.FriendInfo{}, errors.New("已发送过好友请求，请等待对方处理")
+	case err == nil:
+		// 对方已向自己发送过请求
+		return fs.Accept(userId, dto.FriendIdRequest{UserId: req.UserId})
+	case !errors.Is(err, errFriendNotFound):
+		return dto.FriendInfo{}, err
+	}
+
+	var count int64
+	err = db.Model(&userModel.Friendship{}).
+		Where("user_id = ? OR friend_id = ?", userId, userId).
+		Count(&count).Error
+	if err != nil {
+		return dto.FriendInfo{}, err
+	}
+	if count >= maxFriendsPerUser {
+		return dto.FriendInfo{}, fmt.Errorf("好友和好友请求最多%d个", maxFriendsPerUser)
+	}
+	f = userModel.Friendship{
+		UserId:   uint(userId),
+		FriendId: uint(req.UserId),
+		Status:   userModel.FriendPending,
+	}
+	if err := db.Create(&f).Error; err != nil {
+		return dto.FriendInfo{}, err
+	}
+	fs.notify(req.UserId, dto.FriendRequested, newFriendInfo(self, f))
+	return newFriendInfo(target, f), nil
+}
+
+// Accept 同意对方发来的好友请求，返回新好友的信息和在线状态
+func (fs *FriendService) Accept(userId int, req dto.FriendIdRequest) (dto.FriendInfo, error) {
+	db := fs.db()
+	result := db.Model(&userModel.Friendship{}).
+		Where("user_id = ? AND friend_id = ? AND status = ?", req.UserId, userId, userModel.FriendPending).
+		Update("status", userModel.FriendAccepted)
+	if result.Error != nil {
+		return dto.FriendInfo{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return dto.FriendInfo{}, errors.New("好友请求不存在或已处理")
+	}
+	f, err := findFriendship(db, userId, req.UserId)
+	if err != nil {
+		return dto.FriendInfo{}, err
+	}
+	users, err := loadUsers(db, []uint{uint(userId), uint(req.UserId)})
+	if err != nil {
+		return dto.FriendInfo{}, err
+	}
+	fs.notify(req.UserId, dto.FriendAccepted, fs.withPresence(newFriendInfo(users[uint(userId)], f)))
+	return fs.withPresence(newFriendInfo(users[uint(req.UserId)], f)), nil
+}
+
+// Remove 删除好友，也用于拒绝收到的好友请求和撤回发出的好友请求
+func (fs *FriendService) Remove(userId int, req dto.FriendIdRequest) error {
+	db := fs.db()
+	f, err := findFriendship(db, userId, req.UserId)
+	if err != nil {
+		return err
+	}
+	if err := db.Delete(&f).Error; err != nil {
+		return err
+	}
+	self, err := loadUser(db, userId)
+	if err != nil {
+		// 好友关系已删除，只是无法通知对方
+		return nil
+	}
+	fs.notify(req.UserId, dto.FriendRemoved, newFriendInfo(self, f))
+	return nil
+}
+
+// List 列出好友及其在线状态，以及未处理的好友请求
+func (fs *FriendService) List(userId int) (dto.ListFriendsResponse, error) {
+	resp := dto.ListFriendsResponse{
+		Friends:  make([]dto.FriendInfo, 0),
+		Incoming: make([]dto.FriendInfo, 0),
+		Outgoing: make([]dto.FriendInfo, 0),
+	}
+	var friendships []userModel.Friendship
+	err := fs.db().
+		Where("user_id = ? OR friend_id = ?", userId, userId).
+		Order("updated_at desc").
+		Find(&friendships).Error
+	if err != nil {
+		return resp, err
+	}
+	ids := make([]uint, 0, len(friendships))
+	friendIds := make([]int, 0, len(friendships))
+	for _, f := range friendships {
+		other := f.UserId
+		if other == uint(userId) {
+			other = f.FriendId
+		}
+		ids = append(ids, other)
+		if f.Status == userModel.FriendAccepted {
+			friendIds = append(friendIds, int(other))
+		}
+	}
+	users, err := loadUsers(fs.db(), ids)
+	if err != nil {
+		return resp, err
+	}
+	presence := fs.presenceOf(friendIds)
+	for i, f := range friendships {
+		u, ok := users[ids[i]]
+		if !ok {
+			continue
+		}
+		info := newFriendInfo(u, f)
+		switch {
+		case f.Status == userModel.FriendAccepted:
+			p, ok := presence[int(u.ID)]
+			if !ok {
+				p = dto.Presence{State: dto.PresenceOffline}
+			}
+			info.Presence = &p
+			resp.Friends = append(resp.Friends, info)
+		case f.FriendId == uint(userId):
+			resp.Incoming = append(resp.Incoming, info)
+		default:
+			resp.Outgoing = append(resp.Outgoing, info)
+		}
+	}
+	return resp, nil
+}
+
+// FriendIds 返回玩家所有好友的id，在线状态变化时推送给这些玩家
+func (fs *FriendService) FriendIds(userId int) ([]int, error) {
+	var friendships []userModel.Friendship
+	err := fs.db().
+		Select("user_id, friend_id").
+		Where("(user_id = ? OR friend_id = ?) AND status = ?", userId, userId, userModel.FriendAccepted).
+		Find(&friendships).Error
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(friendships))
+	for _, f := range friendships {
+		if f.UserId == uint(userId) {
+			ids = append(ids, int(f.FriendId))
+		} else {
+			ids = append(ids, int(f.UserId))
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"gorm.io/gorm"
+
+	dto "chinese-chess-backend/dto/user"
+	userModel "chinese-chess-backend/model/user"
+)
+
+// friendNotice 推送给玩家的一次好友变化
+type friendNotice struct {
+	userId int
+	event  string
+	friend dto.FriendInfo
+}
+
+// fakeFriendHub 记录好友变化的推送，presence中的玩家视为在线
+type fakeFriendHub struct {
+	mu       sync.Mutex
+	notices  []friendNotice
+	presence map[int]dto.Presence
+}
+
+func (fh *fakeFriendHub) NotifyFriend(userId int, event string, friend dto.FriendInfo) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	fh.notices = append(fh.notices, friendNotice{userId, event, friend})
+}
+
+func (fh *fakeFriendHub) Presence(userIds []int) map[int]dto.Presence {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	result := make(map[int]dto.Presence)
+	for _, id := range userIds {
+		if p, ok := fh.presence[id]; ok {
+			result[id] = p
+		}
+	}
+	return result
+}
+
+// last 最近一次推送
+func (fh *fakeFriendHub) last() friendNotice {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if len(fh.notices) == 0 {
+		return friendNotice{}
+	}
+	return fh.notices[len(fh.notices)-1]
+}
+
+// newTestFriendService 创建使用内存数据库的服务，玩家1到4已注册
+func newTestFriendService(t *testing.T) (*FriendService, *fakeFriendHub, *gorm.DB) {
+	t.Helper()
+	db := newTestDB(t, &userModel.User{}, &userModel.Friendship{}, &userModel.Block{})
+	for id := 1; id <= 4; id++ {
+		u := userModel.User{ID: uint(id), Name: fmt.Sprintf("player%d", id), Email: fmt.Sprintf("player%d@example.com", id), Exp: id * 10}
+		if err := db.Create(&u).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	hub := &fakeFriendHub{presence: make(map[int]dto.Presence)}
+	fs := NewFriendService(WithFriendDB(db), WithFriendNotifier(hub), WithPresenceProvider(hub))
+	return fs, hub, db
+}
+
+// friendIds 取出列表中的玩家id
+func friendIds(infos []dto.FriendInfo) []uint {
+	ids := make([]uint, 0, len(infos))
+	for _, info := range infos {
+		ids = append(ids, info.Id)
+	}
+	return ids
+}
+
+func TestFriendRequestAndAccept(t *testing.T) {
+	fs, hub, _ := newTestFriendService(t)
+
+	target, err := fs.SendRequest(1, dto.FriendIdRequest{UserId: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Id != 2 || target.Name != "player2" || target.Presence != nil {
+		t.Fatalf("请求返回的应当是对方的信息，不带在线状态: %+v", target)
+	}
+	if n := hub.last(); n.userId != 2 || n.event != dto.FriendRequested || n.friend.Id != 1 {
+		t.Fatalf("应当把请求推送给对方: %+v", n)
+	}
+
+	for _, c := range []struct {
+		userId, targetId int
+		reason           string
+	}{
+		{1, 1, "不能添加自己"},
+		{1, 99, "对方不存在"},
+		{1, 2, "已发送过请求"},
+	} {
+		if _, err := fs.SendRequest(c.userId, dto.FriendIdRequest{UserId: c.targetId}); err == nil {
+			t.Fatalf("%s时应当拒绝", c.reason)
+		}
+	}
+	if _, err := fs.Accept(1, dto.FriendIdRequest{UserId: 2}); err == nil {
+		t.Fatal("不能同意自己发出的请求")
+	}
+
+	incoming, err := fs.List(2)
+	if err != nil || len(incoming.Incoming) != 1 || incoming.Incoming[0].Id != 1 || len(incoming.Friends) != 0 {
+		t.Fatalf("对方应当看到收到的请求: %+v, %v", incoming, err)
+	}
+	outgoing, err := fs.List(1)
+	if err != nil || len(outgoing.Outgoing) != 1 || outgoing.Outgoing[0].Id != 2 {
+		t.Fatalf("应当看到发出的请求: %+v, %v", outgoing, err)
+	}
+
+	// 同意后双方成为好友，发起方收到推送和对方的在线状态
+	hub.presence[2] = dto.Presence{State: dto.PresenceOnline}
+	friend, err := fs.Accept(2, dto.FriendIdRequest{UserId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if friend.Id != 1 || friend.Presence == nil || friend.Presence.State != dto.PresenceOffline {
+		t.Fatalf("同意后应当返回新好友及其在线状态: %+v", friend)
+	}
+	if n := hub.last(); n.userId != 1 || n.event != dto.FriendAccepted || n.friend.Presence.State != dto.PresenceOnline {
+		t.Fatalf("应当把同意推送给发起方: %+v", n)
+	}
+	if _, err := fs.Accept(2, dto.FriendIdRequest{UserId: 1}); err == nil {
+		t.Fatal("请求不能重复同意")
+	}
+	if _, err := fs.SendRequest(2, dto.FriendIdRequest{UserId: 1}); err == nil {
+		t.Fatal("已经是好友时应当拒绝")
+	}
+
+	// 对方已发来请求时，再向对方发送请求直接成为好友
+	if _, err := fs.SendRequest(3, dto.FriendIdRequest{UserId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.SendRequest(1, dto.FriendIdRequest{UserId: 3}); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := fs.FriendIds(1)
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("玩家1应当有两个好友: %v, %v", ids, err)
+	}
+}
+
+func TestFriendListRemoveAndBlock(t *testing.T) {
+	fs, hub, db := newTestFriendService(t)
+	for _, id := range []int{2, 3} {
+		if _, err := fs.SendRequest(1, dto.FriendIdRequest{UserId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.Accept(2, dto.FriendIdRequest{UserId: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 只有好友带在线状态，不在线的好友显示为离线
+	hub.presence[2] = dto.Presence{State: dto.PresencePlaying, RoomId: 5}
+	hub.presence[3] = dto.Presence{State: dto.PresenceOnline}
+	list, err := fs.List(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Friends) != 1 || *list.Friends[0].Presence != hub.presence[2] || list.Friends[0].Exp != 20 {
+		t.Fatalf("好友应当带有在线状态: %+v", list.Friends)
+	}
+	if ids := friendIds(list.Outgoing); len(ids) != 1 || ids[0] != 3 || list.Outgoing[0].Presence != nil {
+		t.Fatalf("发出的请求不应当带在线状态: %+v", list.Outgoing)
+	}
+	delete(hub.presence, 2)
+	if list, _ = fs.List(1); list.Friends[0].Presence.State != dto.PresenceOffline {
+		t.Fatalf("不在线的好友应当显示为离线: %+v", list.Friends[0])
+	}
+
+	// 删除好友和撤回请求都通知对方
+	if err := fs.Remove(1, dto.FriendIdRequest{UserId: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if n := hub.last(); n.userId != 2 || n.event != dto.FriendRemoved || n.friend.Id != 1 {
+		t.Fatalf("应当把删除推送给对方: %+v", n)
+	}
+	if err := fs.Remove(3, dto.FriendIdRequest{UserId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove(1, dto.FriendIdRequest{UserId: 2}); !errors.Is(err, errFriendNotFound) {
+		t.Fatalf("删除不存在的好友关系应当返回errFriendNotFound: %v", err)
+	}
+	list, err = fs.List(1)
+	if err != nil || len(list.Friends)+len(list.Incoming)+len(list.Outgoing) != 0 {
+		t.Fatalf("删除后列表应当为空: %+v, %v", list, err)
+	}
+
+	// 任意一方屏蔽了对方时不能发送请求
+	if err := db.Create(&userModel.Block{UserId: 4, BlockedId: 1}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.SendRequest(1, dto.FriendIdRequest{UserId: 4}); err == nil {
+		t.Fatal("被对方屏蔽时应当拒绝")
+	}
+	if _, err := fs.SendRequest(4, dto.FriendIdRequest{UserId: 1}); err == nil {
+		t.Fatal("屏蔽对方时应当拒绝")
+	}
+}
@@ -1,83 +1,45 @@
 package service
 
 import (
-	"chinese-chess-backend/database"
 	"chinese-chess-backend/dto/room"
-	userModel "chinese-chess-backend/model/user"
 )
 
-type RoomService struct{}
+// SpareRoomProvider 提供当前有空位的房间，由websocket中的ChessHub实现
+type SpareRoomProvider interface {
+	SpareRooms() []room.RoomInfo
+}
+
+type RoomService struct {
+	provider SpareRoomProvider
+}
 
-func NewRoomService() *RoomService {
-	return &RoomService{}
+func NewRoomService(provider SpareRoomProvider) *RoomService {
+	return &RoomService{
+		provider: provider,
+	}
 }
 
 func (rs *RoomService) GetSpareRooms(req room.GetSpareRoomsRequest) (room.GetSpareRoomsResponse, error) {
-    db := database.GetMysqlDb()
-	rooms := req.Infos
-	var resp room.GetSpareRoomsResponse
-    
-    // Collect all user IDs that need to be fetched
-    var userIDs []uint
-    userIDPositionMap := make(map[uint][]struct{
-        roomIndex int
-        isCurrentUser bool
-    })
-    
-    for i, room := range rooms {
-        if room.Current.ID != 0 {
-            id := uint(room.Current.ID)
-            userIDs = append(userIDs, id)
-            userIDPositionMap[id] = append(userIDPositionMap[id], struct{
-                roomIndex int
-                isCurrentUser bool
-            }{i, true})
-        }
-        
-        if room.Next.ID != 0 {
-            id := uint(room.Next.ID)
-            userIDs = append(userIDs, id)
-            userIDPositionMap[id] = append(userIDPositionMap[id], struct{
-                roomIndex int
-                isCurrentUser bool
-            }{i, false})
-        }
-    }
-    
-    // If no users to fetch, return the original array
-    if len(userIDs) == 0 {
-        return resp, nil
-    }
-    
-    // Fetch all users at once with only the needed fields
-    var users []userModel.User
-    if err := db.Model(&userModel.User{}).
-        Select("id, name, exp").
-        Where("id IN ?", userIDs).
-        Find(&users).Error; err != nil {
-        return resp, err
-    }
-    
-    // Create a map for quick lookup
-    userMap := make(map[uint]userModel.User)
-    for _, user := range users {
-        userMap[user.ID] = user
-    }
-    
-    // Update rooms with user information
-    for _, user := range users {
-        positions := userIDPositionMap[user.ID]
-        for _, pos := range positions {
-            if pos.isCurrentUser {
-                rooms[pos.roomIndex].Current.Name = user.Name
-                rooms[pos.roomIndex].Current.Exp = user.Exp
-            } else {
-                rooms[pos.roomIndex].Next.Name = user.Name
-                rooms[pos.roomIndex].Next.Exp = user.Exp
-            }
-        }
-    }
+	resp := room.GetSpareRoomsResponse{
+		Rooms:    make([]room.RoomInfo, 0),
+		Page:     req.Page,
+		PageSize: req.PageSize,
+	}
+
+	// 房主的经验在内存中随排位对局结算更新，筛选时不再查询数据库
+	matched := make([]room.RoomInfo, 0)
+	for _, info := range rs.provider.SpareRooms() {
+		if req.Match(info) {
+			matched = append(matched, info)
+		}
+	}
+	resp.Total = len(matched)
 
-	resp.Rooms = rooms
+	start := (req.Page - 1) * req.PageSize
+	if start >= len(matched) {
+		return resp, nil
+	}
+	end := min(start+req.PageSize, len(matched))
+	resp.Rooms = matched[start:end]
 	return resp, nil
 }
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"chinese-chess-backend/database"
+	dto "chinese-chess-backend/dto/user"
+	userModel "chinese-chess-backend/model/user"
+)
+
+const (
+	apiTokenPrefix    = "chess_" // 用于和登录token区分
+	maxTokensPerUser  = 20
+	tokenUsedInterval = time.Minute // 最近使用时间的更新间隔，避免每次请求都写数据库
+)
+
+var errInvalidToken = errors.New("API令牌无效")
+
+type TokenService struct {
+}
+
+func NewTokenService() *TokenService {
+	return &TokenService{}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (ts *TokenService) CreateToken(userId int, req *dto.CreateTokenRequest) (dto.CreateTokenResponse, error) {
+	var resp dto.CreateTokenResponse
+	db := database.GetMysqlDb()
+	var count int64
+	if err := db.Model(&userModel.ApiToken{}).Where("user_id = ?", userId).Count(&count).Error; err != nil {
+		return resp, err
+	}
+	if count >= maxTokensPerUser {
+		return resp, errors.New("令牌数量已达上限，请先撤销不用的令牌")
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return resp, err
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	record := userModel.ApiToken{
+		UserId: uint(userId),
+		Name:   req.Name,
+		Hash:   hashToken(token),
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return resp, err
+	}
+	resp.TokenInfo = dto.NewTokenInfo(record)
+	resp.Token = token
+	return resp, nil
+}
+
+func (ts *TokenService) ListTokens(userId int) (dto.ListTokensResponse, error) {
+	resp := dto.ListTokensResponse{Tokens: make([]dto.TokenInfo, 0)}
+	var tokens []userModel.ApiToken
+	err := database.GetMysqlDb().
+		Where("user_id = ?", userId).
+		Order("id desc").
+		Find(&tokens).Error
+	if err != nil {
+		return resp, err
+	}
+	for _, t := range tokens {
+		resp.Tokens = append(resp.Tokens, dto.NewTokenInfo(t))
+	}
+	return resp, nil
+}
+
+func (ts *TokenService) RevokeToken(userId int, req *dto.RevokeTokenRequest) error {
+	result := database.GetMysqlDb().
+		Where("id = ? AND user_id = ?", req.Id, userId).
+		Delete(&userModel.ApiToken{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("令牌不存在")
+	}
+	return nil
+}
+
+// ResolveToken 返回API令牌所属的用户id，供鉴权中间件使用
+func (ts *TokenService) ResolveToken(token string) (int, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return 0, errInvalidToken
+	}
+	db := database.GetMysqlDb()
+	var record userModel.ApiToken
+	err := db.Where("hash = ?", hashToken(token)).First(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, errInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	if record.LastUsedAt == nil || now.Sub(*record.LastUsedAt) >= tokenUsedInterval {
+		err := db.Model(&record).Update("last_used_at", now).Error
+		if err != nil {
+			log.Printf("更新令牌使用时间失败: %v\n", err)
+		}
+	}
+	return int(record.UserId), nil
+}
@@ -125,6 +125,7 @@ func (uc *UserService) GetUserInfo(req *dto.GetUserInfoRequest) (*dto.GetUserInf
 	}
 
 	userInfoResp.Name = user.Name
+	userInfoResp.Bot = user.Bot
 
 	return &userInfoResp, nil
 }
\ No newline at end of file
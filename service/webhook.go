@@ -0,0 +1,309 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"chinese-chess-backend/config"
+	"chinese-chess-backend/database"
+	dto "chinese-chess-backend/dto/webhook"
+	webhookModel "chinese-chess-backend/model/webhook"
+	"chinese-chess-backend/utils"
+)
+
+const (
+	webhookSignatureHeader = "X-Chess-Signature" // sha256=请求体的HMAC-SHA256
+	webhookEventHeader     = "X-Chess-Event"
+	webhookDeliveryHeader  = "X-Chess-Delivery"
+)
+
+// webhookPayload 推送的请求体
+type webhookPayload struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Data  any       `json:"data"`
+}
+
+type WebhookService struct {
+	subscriptions []config.WebhookSubscription
+	maxAttempts   int
+	baseDelay     time.Duration // 第一次重试的等待时间，之后每次翻倍
+	maxDelay      time.Duration
+	client        *http.Client
+	db            func() *gorm.DB
+	scheduler     *utils.Scheduler
+}
+
+type WebhookOption func(*WebhookService)
+
+// WithHTTPClient 指定发送推送的HTTP客户端
+func WithHTTPClient(client *http.Client) WebhookOption {
+	return func(ws *WebhookService) {
+		ws.client = client
+	}
+}
+
+// WithRetryBackoff 指定重试的初始等待时间和最长等待时间
+func WithRetryBackoff(base, maxDelay time.Duration) WebhookOption {
+	return func(ws *WebhookService) {
+		ws.baseDelay = base
+		ws.maxDelay = maxDelay
+	}
+}
+
+// WithWebhookDB 指定保存推送记录的数据库，默认使用database.GetMysqlDb
+func WithWebhookDB(db *gorm.DB) WebhookOption {
+	return func(ws *WebhookService) {
+		ws.db = func() *gorm.DB { return db }
+	}
+}
+
+func NewWebhookService(cfg config.WebhookConfig, opts ...WebhookOption) *WebhookService {
+	ws := &WebhookService{
+		subscriptions: cfg.Subscriptions,
+		maxAttempts:   cfg.MaxAttempts,
+		baseDelay:     time.Second,
+		maxDelay:      5 * time.Minute,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		db:            database.GetMysqlDb,
+		scheduler:     utils.NewScheduler(),
+	}
+	for _, opt := range opts {
+		opt(ws)
+	}
+	ws.maxAttempts = max(ws.maxAttempts, 1)
+	ws.scheduler.Start()
+	go ws.resumeStale()
+	return ws
+}
+
+// staleBefore 在此之前最后更新的pending推送已经超过最长重试间隔和请求超时，
+// 说明发送它的进程在推送完成前停止了
+func (ws *WebhookService) staleBefore() time.Time {
+	return time.Now().Add(-(ws.maxDelay + ws.client.Timeout + time.Minute))
+}
+
+// resumeStale 启动时继续发送上次停机时未完成的推送
+func (ws *WebhookService) resumeStale() {
+	var deliveries []webhookModel.Delivery
+	err := ws.db().
+		Where("status = ? AND updated_at < ?", webhookModel.StatusPending, ws.staleBefore()).
+		Find(&deliveries).Error
+	if err != nil {
+		log.Printf("读取未完成的webhook推送失败: %v\n", err)
+		return
+	}
+	for _, d := range deliveries {
+		// 多个节点同时启动时只有一个节点能认领
+		res := ws.db().Model(&webhookModel.Delivery{}).
+			Where("id = ? AND status = ? AND updated_at = ?", d.ID, webhookModel.StatusPending, d.UpdatedAt).
+			Update("updated_at", time.Now())
+		if res.Error != nil {
+			log.Printf("认领webhook推送 %d 失败: %v\n", d.ID, res.Error)
+			continue
+		}
+		if res.RowsAffected == 0 {
+			continue
+		}
+		delivery := d
+		ws.attempt(&delivery)
+	}
+}
+
+// Stop 停止尚未开始的重试，未完成的推送保持pending状态，下次启动时继续发送
+func (ws *WebhookService) Stop() {
+	ws.scheduler.Stop()
+}
+
+// Dispatch 把事件推送给所有订阅了该事件的地址，不会阻塞调用方
+func (ws *WebhookService) Dispatch(event string, data any) {
+	body, err := json.Marshal(webhookPayload{
+		Event: event,
+		Time:  time.Now(),
+		Data:  data,
+	})
+	if err != nil {
+		log.Printf("序列化webhook事件失败: %v\n", err)
+		return
+	}
+	for _, sub := range ws.subscriptions {
+		if len(sub.Events) > 0 && !slices.Contains(sub.Events, event) {
+			continue
+		}
+		delivery := &webhookModel.Delivery{
+			Url:     sub.Url,
+			Event:   event,
+			Payload: string(body),
+			Status:  webhookModel.StatusPending,
+		}
+		go func() {
+			if err := ws.db().Create(delivery).Error; err != nil {
+				log.Printf("保存webhook推送记录失败: %v\n", err)
+				return
+			}
+			ws.attempt(delivery)
+		}()
+	}
+}
+
+func (ws *WebhookService) subscription(url string) (config.WebhookSubscription, bool) {
+	for _, sub := range ws.subscriptions {
+		if sub.Url == url {
+			return sub, true
+		}
+	}
+	return config.WebhookSubscription{}, false
+}
+
+// attempt 发送一次推送，失败时按指数退避安排下一次重试
+func (ws *WebhookService) attempt(delivery *webhookModel.Delivery) {
+	delivery.Attempts++
+	delivery.StatusCode = 0
+	var err error
+	sub, ok := ws.subscription(delivery.Url)
+	if ok {
+		delivery.StatusCode, err = ws.send(sub, delivery)
+	} else {
+		err = fmt.Errorf("订阅已从配置中移除")
+	}
+	retry := false
+	switch {
+	case err == nil:
+		delivery.Status = webhookModel.StatusSucceeded
+		delivery.LastError = ""
+	case ok && delivery.Attempts < ws.maxAttempts:
+		delivery.LastError = truncate(err.Error(), 500)
+		retry = true
+	default:
+		delivery.Status = webhookModel.StatusFailed
+		delivery.LastError = truncate(err.Error(), 500)
+		log.Printf("webhook推送 %d 失败: %v\n", delivery.ID, err)
+	}
+	if err := ws.db().Save(delivery).Error; err != nil {
+		log.Printf("更新webhook推送记录失败: %v\n", err)
+	}
+	// 保存完成后再安排重试，重试和保存不会同时修改同一条记录
+	if retry {
+		ws.scheduler.Schedule(ws.backoff(delivery.Attempts), func() {
+			ws.attempt(delivery)
+		})
+	}
+}
+
+func (ws *WebhookService) send(sub config.WebhookSubscription, delivery *webhookModel.Delivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ws.client.Timeout+time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Url, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, delivery.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(webhookSignatureHeader, "sha256="+SignWebhook(sub.Secret, []byte(delivery.Payload)))
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("接收方返回 %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff 第n次尝试失败后的等待时间
+func (ws *WebhookService) backoff(attempts int) time.Duration {
+	delay := ws.baseDelay
+	for i := 1; i < attempts && delay < ws.maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, ws.maxDelay)
+}
+
+// SignWebhook 计算请求体的HMAC-SHA256签名，接收方用同一密钥校验X-Chess-Signature
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+func (ws *WebhookService) ListDeliveries(req dto.ListDeliveriesRequest) (dto.ListDeliveriesResponse, error) {
+	resp := dto.ListDeliveriesResponse{
+		Deliveries: make([]dto.DeliveryInfo, 0),
+		Page:       req.Page,
+		PageSize:   req.PageSize,
+	}
+	query := ws.db().Model(&webhookModel.Delivery{}).
+		Where("status = ?", req.Status).
+		Session(&gorm.Session{})
+	if err := query.Count(&resp.Total).Error; err != nil {
+		return resp, err
+	}
+	var deliveries []webhookModel.Delivery
+	err := query.Order("id desc").
+		Offset((req.Page - 1) * req.PageSize).
+		Limit(req.PageSize).
+		Find(&deliveries).Error
+	if err != nil {
+		return resp, err
+	}
+	for _, d := range deliveries {
+		resp.Deliveries = append(resp.Deliveries, dto.NewDeliveryInfo(d))
+	}
+	return resp, nil
+}
+
+// ReplayDelivery 重新发送一次失败或停机时中断的推送，尝试次数从零开始计算
+func (ws *WebhookService) ReplayDelivery(req dto.ReplayDeliveryRequest) (dto.DeliveryInfo, error) {
+	var delivery webhookModel.Delivery
+	err := ws.db().First(&delivery, req.Id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return dto.DeliveryInfo{}, errors.New("推送记录不存在")
+	}
+	if err != nil {
+		return dto.DeliveryInfo{}, err
+	}
+	if _, ok := ws.subscription(delivery.Url); !ok {
+		return dto.DeliveryInfo{}, errors.New("订阅已从配置中移除")
+	}
+	// 条件更新，同时重新发送同一条推送时只有一次能成功
+	res := ws.db().Model(&webhookModel.Delivery{}).
+		Where("id = ? AND (status = ? OR (status = ? AND updated_at < ?))",
+			delivery.ID, webhookModel.StatusFailed, webhookModel.StatusPending, ws.staleBefore()).
+		Updates(map[string]any{"status": webhookModel.StatusPending, "attempts": 0})
+	if res.Error != nil {
+		return dto.DeliveryInfo{}, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return dto.DeliveryInfo{}, errors.New("只能重新发送失败或中断的推送")
+	}
+	if err := ws.db().First(&delivery, delivery.ID).Error; err != nil {
+		return dto.DeliveryInfo{}, err
+	}
+	info := dto.NewDeliveryInfo(delivery)
+	go ws.attempt(&delivery)
+	return info, nil
+}
@@ -0,0 +1,304 @@
+package service
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"chinese-chess-backend/config"
+	dto "chinese-chess-backend/dto/webhook"
+	webhookModel "chinese-chess-backend/model/webhook"
+)
+
+const testWebhookSecret = "test-secret"
+
+// webhookRequest 接收方收到的一次推送
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// webhookReceiver 记录收到的推送，按顺序返回预设的状态码，用完后一直返回最后一个
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []webhookRequest
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.requests = append(wr.requests, webhookRequest{header: r.Header.Clone(), body: body, at: time.Now()})
+	status := wr.statuses[min(len(wr.requests), len(wr.statuses))-1]
+	w.WriteHeader(status)
+}
+
+func (wr *webhookReceiver) received() []webhookRequest {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return append([]webhookRequest(nil), wr.requests...)
+}
+
+// newTestDB 每个测试使用独立的内存数据库，并建好models的表
+func newTestDB(t *testing.T, models ...any) *gorm.DB {
+	t.Helper()
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 记录在多个协程中读写，共用一个连接避免sqlite锁冲突
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newTestWebhookService 启动接收方并创建订阅了它的推送服务，重试等待时间为30ms起翻倍，最长70ms
+func newTestWebhookService(t *testing.T, maxAttempts int, statuses ...int) (*WebhookService, *webhookReceiver, *gorm.DB) {
+	t.Helper()
+	receiver := &webhookReceiver{statuses: statuses}
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+	db := newTestDB(t, &webhookModel.Delivery{})
+	ws := NewWebhookService(config.WebhookConfig{
+		Subscriptions: []config.WebhookSubscription{
+			{Url: srv.URL, Secret: testWebhookSecret, Events: []string{"game.end"}},
+		},
+		MaxAttempts: maxAttempts,
+	},
+		WithHTTPClient(srv.Client()),
+		WithRetryBackoff(30*time.Millisecond, 70*time.Millisecond),
+		WithWebhookDB(db),
+	)
+	t.Cleanup(ws.Stop)
+	return ws, receiver, db
+}
+
+// waitDelivery 等待唯一的推送记录变为指定状态
+func waitDelivery(t *testing.T, db *gorm.DB, status string) webhookModel.Delivery {
+	t.Helper()
+	var delivery webhookModel.Delivery
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := db.Where("status = ?", status).First(&delivery).Error
+		if err == nil {
+			return delivery
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("等待推送记录变为%s超时: %v", status, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookDispatchSignsPayload(t *testing.T) {
+	ws, receiver, db := newTestWebhookService(t, 3, http.StatusOK)
+
+	ws.Dispatch("game.start", map[string]int{"roomId": 1})
+	ws.Dispatch("game.end", map[string]int{"roomId": 1})
+	delivery := waitDelivery(t, db, webhookModel.StatusSucceeded)
+
+	requests := receiver.received()
+	if len(requests) != 1 {
+		t.Fatalf("只应当推送订阅的事件，收到%d次推送", len(requests))
+	}
+	req := requests[0]
+	expected := "sha256=" + SignWebhook(testWebhookSecret, req.body)
+	if got := req.header.Get(webhookSignatureHeader); !hmac.Equal([]byte(got), []byte(expected)) {
+		t.Fatalf("签名不正确: %s，应当为 %s", got, expected)
+	}
+	if got := req.header.Get(webhookEventHeader); got != "game.end" {
+		t.Fatalf("事件头为 %q，应当为 game.end", got)
+	}
+	if got := req.header.Get(webhookDeliveryHeader); got != strconv.FormatUint(uint64(delivery.ID), 10) {
+		t.Fatalf("推送编号头为 %q，应当为 %d", got, delivery.ID)
+	}
+	if delivery.Attempts != 1 || delivery.StatusCode != http.StatusOK || string(req.body) != delivery.Payload {
+		t.Fatalf("推送记录不正确: %+v", delivery)
+	}
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	ws, receiver, db := newTestWebhookService(t, 4, http.StatusInternalServerError)
+
+	ws.Dispatch("game.end", map[string]int{"roomId": 1})
+	delivery := waitDelivery(t, db, webhookModel.StatusFailed)
+	if delivery.Attempts != 4 || delivery.StatusCode != http.StatusInternalServerError || delivery.LastError == "" {
+		t.Fatalf("重试次数用完后的推送记录不正确: %+v", delivery)
+	}
+
+	// 达到最大尝试次数后不再重试
+	time.Sleep(100 * time.Millisecond)
+	requests := receiver.received()
+	if len(requests) != 4 {
+		t.Fatalf("应当尝试4次，实际%d次", len(requests))
+	}
+	// 等待时间翻倍，超过上限后保持上限。定时器按时间轮的10ms精度触发，最多提前一个精度
+	for i, ms := range []int{30, 60, 70} {
+		least := time.Duration(ms-10) * time.Millisecond
+		if gap := requests[i+1].at.Sub(requests[i].at); gap < least {
+			t.Fatalf("第%d次重试只等待了%v，应当约为%dms", i+1, gap, ms)
+		}
+	}
+	for i, ms := range []int{30, 60, 70, 70} {
+		if got := ws.backoff(i + 1); got != time.Duration(ms)*time.Millisecond {
+			t.Fatalf("第%d次失败后应当等待%dms，实际%v", i+1, ms, got)
+		}
+	}
+}
+
+func TestWebhookReplayFailedDelivery(t *testing.T) {
+	ws, receiver, db := newTestWebhookService(t, 2,
+		http.StatusBadGateway, http.StatusBadGateway, http.StatusOK)
+
+	ws.Dispatch("game.end", map[string]int{"roomId": 1})
+	failed := waitDelivery(t, db, webhookModel.StatusFailed)
+
+	list, err := ws.ListDeliveries(dto.ListDeliveriesRequest{Status: webhookModel.StatusFailed, Page: 1, PageSize: 20})
+	if err != nil || list.Total != 1 || list.Deliveries[0].Id != failed.ID {
+		t.Fatalf("失败的推送应当可以查询到: %+v, %v", list, err)
+	}
+
+	info, err := ws.ReplayDelivery(dto.ReplayDeliveryRequest{Id: failed.ID})
+	if err != nil {
+		t.Fatalf("重新发送失败的推送出错: %v", err)
+	}
+	if info.Status != webhookModel.StatusPending || info.Attempts != 0 {
+		t.Fatalf("重新发送时推送应当回到pending并清零尝试次数: %+v", info)
+	}
+	delivery := waitDelivery(t, db, webhookModel.StatusSucceeded)
+	if delivery.ID != failed.ID || delivery.Attempts != 1 || delivery.LastError != "" {
+		t.Fatalf("重新发送后的推送记录不正确: %+v", delivery)
+	}
+	if n := len(receiver.received()); n != 3 {
+		t.Fatalf("接收方应当收到3次推送，实际%d次", n)
+	}
+
+	if _, err := ws.ReplayDelivery(dto.ReplayDeliveryRequest{Id: failed.ID}); err == nil {
+		t.Fatal("已成功的推送不能重新发送")
+	}
+	if _, err := ws.ReplayDelivery(dto.ReplayDeliveryRequest{Id: failed.ID + 1}); err == nil {
+		t.Fatal("不存在的推送不能重新发送")
+	}
+}
+
+func TestWebhookConcurrentReplaySendsOnce(t *testing.T) {
+	ws, receiver, db := newTestWebhookService(t, 1, http.StatusBadGateway, http.StatusOK)
+
+	ws.Dispatch("game.end", map[string]int{"roomId": 1})
+	failed := waitDelivery(t, db, webhookModel.StatusFailed)
+
+	// 多个管理员同时重新发送同一条推送，只有一次成功。每次查询后稍作停顿，让读取和更新交错
+	err := db.Callback().Query().After("gorm:query").Register("test:pause", func(*gorm.DB) {
+		time.Sleep(5 * time.Millisecond)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	replayed := 0
+	start := make(chan struct{})
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if _, err := ws.ReplayDelivery(dto.ReplayDeliveryRequest{Id: failed.ID}); err == nil {
+				mu.Lock()
+				replayed++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if replayed != 1 {
+		t.Fatalf("同时重新发送时应当只有一次成功，实际%d次", replayed)
+	}
+	waitDelivery(t, db, webhookModel.StatusSucceeded)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(receiver.received()); n != 2 {
+		t.Fatalf("接收方应当收到2次推送，实际%d次", n)
+	}
+}
+
+func TestWebhookResumesStalePendingDeliveries(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{http.StatusOK}}
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+	db := newTestDB(t, &webhookModel.Delivery{})
+
+	// 上次停机时正在发送的推送，以及刚刚由其他节点安排了重试的推送
+	stale := webhookModel.Delivery{Url: srv.URL, Event: "game.end", Payload: `{"event":"game.end"}`, Status: webhookModel.StatusPending, Attempts: 1}
+	fresh := webhookModel.Delivery{Url: srv.URL, Event: "game.end", Payload: `{"event":"game.end"}`, Status: webhookModel.StatusPending, Attempts: 1}
+	if err := db.Create(&stale).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&fresh).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&stale).UpdateColumn("updated_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ws := NewWebhookService(config.WebhookConfig{
+		Subscriptions: []config.WebhookSubscription{{Url: srv.URL, Secret: testWebhookSecret}},
+		MaxAttempts:   3,
+	}, WithHTTPClient(srv.Client()), WithWebhookDB(db))
+	t.Cleanup(ws.Stop)
+
+	// 启动时继续发送中断的推送，尝试次数接着上次计算
+	delivery := waitDelivery(t, db, webhookModel.StatusSucceeded)
+	if delivery.ID != stale.ID || delivery.Attempts != 2 {
+		t.Fatalf("应当继续发送中断的推送: %+v", delivery)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(receiver.received()); n != 1 {
+		t.Fatalf("近期更新的推送不应当被重复发送，接收方收到%d次推送", n)
+	}
+
+	// 中断的推送可以手动重新发送，近期更新的推送不行
+	if _, err := ws.ReplayDelivery(dto.ReplayDeliveryRequest{Id: fresh.ID}); err == nil {
+		t.Fatal("正在发送的推送不能重新发送")
+	}
+	if err := db.Model(&fresh).UpdateColumn("updated_at", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	info, err := ws.ReplayDelivery(dto.ReplayDeliveryRequest{Id: fresh.ID})
+	if err != nil || info.Attempts != 0 {
+		t.Fatalf("中断的推送应当可以重新发送: %+v, %v", info, err)
+	}
+	waitUntilReceived(t, receiver, 2)
+}
+
+// waitUntilReceived 等待接收方收到n次推送
+func waitUntilReceived(t *testing.T, receiver *webhookReceiver, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(receiver.received()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待接收方收到%d次推送超时", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,317 @@
+package utils
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	wheelBits   = 6
+	wheelSize   = 1 << wheelBits // 每层时间轮的槽数
+	wheelMask   = wheelSize - 1
+	wheelLevels = 4 // 层数，默认精度下可以覆盖约46小时，更远的定时器会在到期前重新放置
+)
+
+// Timer 由Scheduler调度的定时器
+type Timer struct {
+	s    *Scheduler
+	when uint64 // 到期的tick
+	fn   func()
+	opts []JobOption
+	slot *list.List
+	elem *list.Element
+}
+
+// Stop 取消定时器，定时器已经触发或已被取消时返回false
+func (t *Timer) Stop() bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	if t.slot == nil {
+		return false
+	}
+	t.s.unlink(t)
+	return true
+}
+
+// Reset 让定时器在d之后重新触发，返回定时器在重置前是否仍在等待
+func (t *Timer) Reset(d time.Duration) bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	active := t.slot != nil
+	if active {
+		t.s.unlink(t)
+	}
+	t.when = t.s.tick + t.s.ticksFor(d)
+	t.s.place(t)
+	return active
+}
+
+type SchedulerOption func(*Scheduler)
+
+// WithClock 指定时间来源，测试中可以传入FakeClock
+func WithClock(clock Clock) SchedulerOption {
+	return func(s *Scheduler) {
+		s.clock = clock
+	}
+}
+
+// WithTick 指定时间轮的精度
+func WithTick(tick time.Duration) SchedulerOption {
+	return func(s *Scheduler) {
+		s.interval = tick
+	}
+}
+
+// WithWorkerPool 到期的回调提交到线程池执行，而不是为每个回调启动一个goroutine
+func WithWorkerPool(pool *WorkerPool) SchedulerOption {
+	return func(s *Scheduler) {
+		s.pool = pool
+	}
+}
+
+// Scheduler 分层时间轮，添加、取消和重置定时器都是O(1)的
+type Scheduler struct {
+	clock    Clock
+	interval time.Duration
+	pool     *WorkerPool
+
+	mu     sync.Mutex
+	start  time.Time
+	tick   uint64 // 下一个要处理的tick
+	wheels [wheelLevels][wheelSize]*list.List
+	stopCh chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+
+	// 线程池队列已满时，到期的定时器按顺序暂存在这里，由单独的协程提交，不阻塞时间轮
+	overflowMu sync.Mutex
+	overflow   []*Timer
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+func NewScheduler(opts ...SchedulerOption) *Scheduler {
+	s := &Scheduler{
+		clock:    RealClock,
+		interval: 10 * time.Millisecond,
+		stopCh:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.start = s.clock.Now()
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for l := range s.wheels {
+		for i := range s.wheels[l] {
+			s.wheels[l][i] = list.New()
+		}
+	}
+	return s
+}
+
+// Now 返回调度器使用的当前时间
+func (s *Scheduler) Now() time.Time {
+	return s.clock.Now()
+}
+
+// Start 按精度周期性推进时间轮
+func (s *Scheduler) Start() {
+	s.once.Do(func() {
+		ticks, stop := s.clock.NewTicker(s.interval)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer stop()
+			for {
+				select {
+				case now := <-ticks:
+					s.Advance(now)
+				case <-s.stopCh:
+					return
+				}
+			}
+		}()
+	})
+}
+
+// Stop 停止推进时间轮，尚未触发的定时器不会再触发
+func (s *Scheduler) Stop() {
+	select {
+	case <-s.stopCh:
+		return
+	default:
+	}
+	close(s.stopCh)
+	s.cancel()
+	s.wg.Wait()
+}
+
+// Schedule 在d之后调用fn。配置了线程池时opts会透传给WorkerPool.Submit，
+// 例如用WithKey让同一房间的回调串行执行
+func (s *Scheduler) Schedule(d time.Duration, fn func(), opts ...JobOption) *Timer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := &Timer{
+		s:    s,
+		fn:   fn,
+		opts: opts,
+	}
+	t.when = s.tick + s.ticksFor(d)
+	s.place(t)
+	return t
+}
+
+// Advance 处理截至now为止到期的所有定时器，通常由Start启动的协程调用，
+// 测试中可以配合FakeClock直接调用
+func (s *Scheduler) Advance(now time.Time) {
+	target := uint64(max(now.Sub(s.start), 0) / s.interval)
+	for {
+		s.mu.Lock()
+		if s.tick > target {
+			s.mu.Unlock()
+			return
+		}
+		expired := s.step()
+		s.mu.Unlock()
+		for _, t := range expired {
+			s.fire(t)
+		}
+	}
+}
+
+func (s *Scheduler) ticksFor(d time.Duration) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	// 向上取整，保证不会提前触发
+	return uint64((d + s.interval - 1) / s.interval)
+}
+
+// place 按剩余tick数把定时器放入对应层的槽，调用方需持有锁
+func (s *Scheduler) place(t *Timer) {
+	expires := max(t.when, s.tick)
+	delta := expires - s.tick
+	level := 0
+	for level < wheelLevels-1 && delta >= 1<<(wheelBits*(level+1)) {
+		level++
+	}
+	if delta >= 1<<(wheelBits*wheelLevels) {
+		// 超出时间轮范围，先放在最高层最远的槽，级联时会重新放置
+		expires = s.tick + 1<<(wheelBits*wheelLevels) - 1
+	}
+	slot := s.wheels[level][(expires>>(wheelBits*level))&wheelMask]
+	t.slot = slot
+	t.elem = slot.PushBack(t)
+}
+
+func (s *Scheduler) unlink(t *Timer) {
+	t.slot.Remove(t.elem)
+	t.slot = nil
+	t.elem = nil
+}
+
+// step 处理当前tick，返回到期的定时器，调用方需持有锁
+func (s *Scheduler) step() []*Timer {
+	idx := s.tick & wheelMask
+	if idx == 0 {
+		// 低层转完一圈，把高层对应槽里的定时器降级
+		for level := 1; level < wheelLevels; level++ {
+			li := (s.tick >> (wheelBits * level)) & wheelMask
+			s.cascade(s.wheels[level][li])
+			if li != 0 {
+				break
+			}
+		}
+	}
+
+	slot := s.wheels[0][idx]
+	expired := make([]*Timer, 0, slot.Len())
+	for e := slot.Front(); e != nil; {
+		next := e.Next()
+		t := e.Value.(*Timer)
+		s.unlink(t)
+		if t.when > s.tick {
+			// 超出范围的定时器还没有真正到期
+			s.place(t)
+		} else {
+			expired = append(expired, t)
+		}
+		e = next
+	}
+	s.tick++
+	return expired
+}
+
+func (s *Scheduler) cascade(slot *list.List) {
+	for e := slot.Front(); e != nil; {
+		next := e.Next()
+		t := e.Value.(*Timer)
+		s.unlink(t)
+		s.place(t)
+		e = next
+	}
+}
+
+func (s *Scheduler) fire(t *Timer) {
+	if s.pool == nil {
+		go t.fn()
+		return
+	}
+	s.overflowMu.Lock()
+	if len(s.overflow) == 0 {
+		// 没有积压时直接提交，队列已满则转入积压，不能阻塞推进时间轮的协程
+		_, err := s.pool.TrySubmit(context.Background(), t.task(), t.opts...)
+		if !errors.Is(err, ErrPoolFull) {
+			s.overflowMu.Unlock()
+			if err != nil {
+				log.Printf("提交定时任务失败: %v\n", err)
+			}
+			return
+		}
+	}
+	s.overflow = append(s.overflow, t)
+	drain := len(s.overflow) == 1
+	s.overflowMu.Unlock()
+	if drain {
+		s.wg.Add(1)
+		go s.drainOverflow()
+	}
+}
+
+// drainOverflow 按到期顺序等待线程池空出位置后提交积压的定时器，调度器停止后放弃剩余的定时器
+func (s *Scheduler) drainOverflow() {
+	defer s.wg.Done()
+	for {
+		s.overflowMu.Lock()
+		t := s.overflow[0]
+		s.overflowMu.Unlock()
+
+		_, err := s.pool.Submit(s.ctx, t.task(), t.opts...)
+		if err != nil {
+			log.Printf("提交定时任务失败: %v\n", err)
+		}
+
+		s.overflowMu.Lock()
+		if err != nil {
+			s.overflow = nil
+		} else {
+			s.overflow = s.overflow[1:]
+		}
+		if len(s.overflow) == 0 {
+			s.overflowMu.Unlock()
+			return
+		}
+		s.overflowMu.Unlock()
+	}
+}
+
+func (t *Timer) task() Task {
+	return func() error {
+		t.fn()
+		return nil
+	}
+}
@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"math/rand"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// firedSet 记录已触发的定时器，回调在其他协程中执行
+type firedSet struct {
+	mu    sync.Mutex
+	order []int
+}
+
+func (f *firedSet) add(id int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.order = append(f.order, id)
+}
+
+func (f *firedSet) snapshot() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.order)
+}
+
+// wait 等待触发的数量达到n，超时后返回当前的记录
+func (f *firedSet) wait(n int) []int {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if got := f.snapshot(); len(got) >= n {
+			return got
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return f.snapshot()
+}
+
+func newTestScheduler(opts ...SchedulerOption) (*Scheduler, func(time.Duration)) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	opts = append([]SchedulerOption{WithClock(clock), WithTick(time.Millisecond)}, opts...)
+	s := NewScheduler(opts...)
+	return s, func(d time.Duration) {
+		clock.Advance(d)
+		s.Advance(clock.Now())
+	}
+}
+
+func TestSchedulerScheduleCancelReset(t *testing.T) {
+	s, advance := newTestScheduler()
+	var fired firedSet
+	s.Schedule(10*time.Millisecond, func() { fired.add(1) })
+	cancelled := s.Schedule(10*time.Millisecond, func() { fired.add(2) })
+	reset := s.Schedule(10*time.Millisecond, func() { fired.add(3) })
+
+	if !cancelled.Stop() {
+		t.Fatal("等待中的定时器应当可以取消")
+	}
+	if cancelled.Stop() {
+		t.Fatal("重复取消应当返回false")
+	}
+	if !reset.Reset(30 * time.Millisecond) {
+		t.Fatal("重置等待中的定时器应当返回true")
+	}
+
+	advance(9 * time.Millisecond)
+	if got := fired.snapshot(); len(got) != 0 {
+		t.Fatalf("定时器提前触发: %v", got)
+	}
+	advance(time.Millisecond)
+	if got := fired.wait(1); !slices.Equal(got, []int{1}) {
+		t.Fatalf("10ms时触发了 %v，应当只有1", got)
+	}
+
+	advance(19 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if got := fired.snapshot(); len(got) != 1 {
+		t.Fatalf("重置后的定时器提前触发: %v", got)
+	}
+	advance(time.Millisecond)
+	if got := fired.wait(2); !slices.Equal(got, []int{1, 3}) {
+		t.Fatalf("30ms时应当触发重置的定时器，实际 %v", got)
+	}
+	if reset.Stop() {
+		t.Fatal("已触发的定时器不能再取消")
+	}
+
+	// 已触发的定时器可以重置后再次触发。当前tick已经处理过，为了不提前触发最多会晚一个tick
+	if reset.Reset(5 * time.Millisecond) {
+		t.Fatal("重置已触发的定时器应当返回false")
+	}
+	advance(6 * time.Millisecond)
+	if got := fired.wait(3); !slices.Equal(got, []int{1, 3, 3}) {
+		t.Fatalf("重置已触发的定时器后应当再次触发，实际 %v", got)
+	}
+}
+
+func TestSchedulerCascade(t *testing.T) {
+	s, advance := newTestScheduler()
+	var fired firedSet
+	// 分别落在第0到3层，以及超出时间轮范围需要重新放置的位置
+	delays := []time.Duration{
+		50,
+		wheelSize + 7,
+		wheelSize*wheelSize + 13,
+		wheelSize*wheelSize*wheelSize + 21,
+		wheelSize*wheelSize*wheelSize*wheelSize + 5,
+	}
+	for i, d := range delays {
+		s.Schedule(d*time.Millisecond, func() { fired.add(i) })
+	}
+
+	var elapsed time.Duration
+	for i, d := range delays {
+		d *= time.Millisecond
+		advance(d - time.Millisecond - elapsed)
+		time.Sleep(5 * time.Millisecond)
+		if got := fired.snapshot(); len(got) != i {
+			t.Fatalf("第%d个定时器提前触发: %v", i, got)
+		}
+		advance(time.Millisecond)
+		elapsed = d
+		if got := fired.wait(i + 1); len(got) != i+1 || got[i] != i {
+			t.Fatalf("第%d个定时器应当在%v触发，实际 %v", i, d, got)
+		}
+	}
+}
+
+func TestSchedulerManyTimers(t *testing.T) {
+	s, advance := newTestScheduler()
+	var fired firedSet
+	const count = 20000
+	const span = 300000 // 覆盖前三层
+	rng := rand.New(rand.NewSource(1))
+	due := make([]int, count)
+	timers := make([]*Timer, count)
+	for i := range count {
+		due[i] = rng.Intn(span) + 1
+		timers[i] = s.Schedule(time.Duration(due[i])*time.Millisecond, func() { fired.add(i) })
+	}
+	// 取消十分之一，再重置十分之一
+	cancelled := make(map[int]bool)
+	for i := 0; i < count; i += 10 {
+		timers[i].Stop()
+		cancelled[i] = true
+	}
+	for i := 5; i < count; i += 10 {
+		due[i] = rng.Intn(span) + 1
+		timers[i].Reset(time.Duration(due[i]) * time.Millisecond)
+	}
+
+	const step = 10000
+	expected := 0
+	for now := step; now <= span+step; now += step {
+		advance(step * time.Millisecond)
+		for i := range count {
+			if !cancelled[i] && due[i] > now-step && due[i] <= now {
+				expected++
+			}
+		}
+		got := fired.wait(expected)
+		if len(got) != expected {
+			t.Fatalf("%dms时应当触发%d个定时器，实际%d个", now, expected, len(got))
+		}
+	}
+	seen := make(map[int]bool, expected)
+	for _, id := range fired.snapshot() {
+		if cancelled[id] {
+			t.Fatalf("已取消的定时器%d被触发", id)
+		}
+		if seen[id] {
+			t.Fatalf("定时器%d触发了多次", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestSchedulerPoolFullDoesNotBlock(t *testing.T) {
+	pool := NewWorkerPool()
+	pool.WorkerCount = 1
+	pool.QueueSize = 1
+	s, advance := newTestScheduler(WithWorkerPool(pool))
+	var fired firedSet
+	for i := range 10 {
+		s.Schedule(time.Duration(i+1)*time.Millisecond, func() { fired.add(i) }, WithKey("room"))
+	}
+
+	// 线程池尚未启动，队列满后时间轮也不能被阻塞
+	done := make(chan struct{})
+	go func() {
+		advance(10 * time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("线程池队列已满时推进时间轮被阻塞")
+	}
+
+	pool.Start()
+	defer pool.Stop()
+	got := fired.wait(10)
+	if !slices.Equal(got, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Fatalf("积压的定时器应当按到期顺序执行，实际 %v", got)
+	}
+	s.Stop()
+}
@@ -1,41 +1,232 @@
 package utils
 
 import (
+	"container/heap"
 	"context"
+	"errors"
+	"fmt"
+	"log"
 	"runtime"
 	"sync"
 )
 
+var (
+	ErrPoolStopped = errors.New("worker pool stopped")
+	ErrPoolFull    = errors.New("worker pool queue full")
+)
+
 type Task func() error
+
+type Priority int
+
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+)
+
 type Job struct {
-	Task  Task
+	Task     Task
+	Key      string   // 相同Key的任务严格按提交顺序串行执行
+	Priority Priority // 不同Key之间优先执行高优先级的任务
+
+	ctx    context.Context
+	seq    uint64
+	future *Future
+}
+
+type JobOption func(*Job)
+
+func WithKey(key string) JobOption {
+	return func(j *Job) {
+		j.Key = key
+	}
+}
+
+func WithPriority(priority Priority) JobOption {
+	return func(j *Job) {
+		j.Priority = priority
+	}
+}
+
+// Future 任务的执行结果
+type Future struct {
+	done chan struct{}
+	err  error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Done 任务执行完成或被取消后关闭
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait 等待任务结束并返回任务的错误
+func (f *Future) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// keyQueue 同一Key下等待执行的任务，同一时间最多只有一个在执行
+type keyQueue struct {
+	key     string
+	jobs    []*Job
+	running bool
+}
+
+// readyItem 可以被worker取走的单个任务或某个Key的队首任务
+type readyItem struct {
+	job   *Job
+	queue *keyQueue
+}
+
+func (it readyItem) head() *Job {
+	if it.queue != nil {
+		return it.queue.jobs[0]
+	}
+	return it.job
+}
+
+type readyHeap []readyItem
+
+func (h readyHeap) Len() int { return len(h) }
+func (h readyHeap) Less(i, j int) bool {
+	a, b := h[i].head(), h[j].head()
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.seq < b.seq
+}
+func (h readyHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *readyHeap) Push(x any)   { *h = append(*h, x.(readyItem)) }
+func (h *readyHeap) Pop() any {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	*h = old[:n-1]
+	return it
 }
 
 type WorkerPool struct {
 	WorkerCount int
-	JobQueue    chan Job
+	QueueSize   int // 排队任务数的上限，超过后提交会阻塞
 	ErrChan     chan error
-	stopCh      chan struct{}
-	once        sync.Once
-	wg          sync.WaitGroup
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	ready   readyHeap
+	keys    map[string]*keyQueue
+	pending int // 排队中尚未执行的任务数
+	seq     uint64
+	stopped bool
+	space   chan struct{} // 有任务出队时通知阻塞的提交者
+
+	stopCh chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
 }
 
 func NewWorkerPool() *WorkerPool {
 	workerCount := max(runtime.NumCPU(), 1)
 	queueSize := workerCount * 10
-	return &WorkerPool{
+	wp := &WorkerPool{
 		WorkerCount: workerCount,
-		JobQueue:    make(chan Job, queueSize),
+		QueueSize:   queueSize,
+		ErrChan:     make(chan error, queueSize),
+		keys:        make(map[string]*keyQueue),
+		space:       make(chan struct{}, 1),
 		stopCh:      make(chan struct{}),
 	}
+	wp.cond = sync.NewCond(&wp.mu)
+	return wp
 }
 
+// Process 提交一个普通优先级、无Key的任务，队列已满时阻塞直到有空位或ctx结束
 func (wp *WorkerPool) Process(ctx context.Context, task Task) {
-	select {
-	case wp.JobQueue <- Job{Task: task}:
-	case <-ctx.Done():
+	wp.Submit(ctx, task)
+}
+
+// Submit 提交任务并返回可以等待结果的Future。
+// 任务开始执行前ctx被取消时，任务会被跳过，Future返回ctx的错误
+func (wp *WorkerPool) Submit(ctx context.Context, task Task, opts ...JobOption) (*Future, error) {
+	job := newJob(ctx, task, opts)
 
+	wp.mu.Lock()
+	for wp.pending >= wp.QueueSize && !wp.stopped {
+		wp.mu.Unlock()
+		select {
+		case <-wp.space:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-wp.stopCh:
+		}
+		wp.mu.Lock()
+	}
+	defer wp.mu.Unlock()
+	if wp.stopped {
+		return nil, ErrPoolStopped
 	}
+	wp.enqueue(job)
+	return job.future, nil
+}
+
+// TrySubmit 与Submit相同，但队列已满时不等待，直接返回ErrPoolFull
+func (wp *WorkerPool) TrySubmit(ctx context.Context, task Task, opts ...JobOption) (*Future, error) {
+	job := newJob(ctx, task, opts)
+
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.stopped {
+		return nil, ErrPoolStopped
+	}
+	if wp.pending >= wp.QueueSize {
+		return nil, ErrPoolFull
+	}
+	wp.enqueue(job)
+	return job.future, nil
+}
+
+func newJob(ctx context.Context, task Task, opts []JobOption) *Job {
+	job := &Job{
+		Task:     task,
+		Priority: PriorityNormal,
+		ctx:      ctx,
+		future:   newFuture(),
+	}
+	for _, opt := range opts {
+		opt(job)
+	}
+	return job
+}
+
+// enqueue 把任务放入就绪堆或其Key的队列，调用方需持有锁
+func (wp *WorkerPool) enqueue(job *Job) {
+	wp.seq++
+	job.seq = wp.seq
+	wp.pending++
+	if job.Key == "" {
+		heap.Push(&wp.ready, readyItem{job: job})
+	} else if q, ok := wp.keys[job.Key]; ok {
+		// 该Key已有任务在排队或执行，排在它们后面
+		q.jobs = append(q.jobs, job)
+	} else {
+		q := &keyQueue{key: job.Key, jobs: []*Job{job}}
+		wp.keys[job.Key] = q
+		heap.Push(&wp.ready, readyItem{queue: q})
+	}
+	wp.cond.Signal()
 }
 
 func (wp *WorkerPool) Start() {
@@ -45,35 +236,119 @@ func (wp *WorkerPool) Start() {
 			go func() {
 				defer wp.wg.Done()
 				for {
-					select {
-					case job, ok := <-wp.JobQueue:
-						if !ok {
-							return
-						}
-						var err error
-						func() {
-							defer func() {
-								if r := recover(); r != nil {
-									if e, ok := r.(error); ok {
-										err = e
-									}
-								}
-							}()
-							err = job.Task()
-						}()
-						if err != nil {
-							wp.ErrChan <- err
-						}
-					case <-wp.stopCh:
+					job, q, ok := wp.next()
+					if !ok {
 						return
 					}
+					wp.run(job)
+					if q != nil {
+						wp.release(q)
+					}
 				}
 			}()
 		}
 	})
 }
 
+// next 取出下一个要执行的任务，线程池停止后返回false
+func (wp *WorkerPool) next() (*Job, *keyQueue, bool) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	for len(wp.ready) == 0 && !wp.stopped {
+		wp.cond.Wait()
+	}
+	if wp.stopped {
+		return nil, nil, false
+	}
+	it := heap.Pop(&wp.ready).(readyItem)
+	wp.pending--
+	select {
+	case wp.space <- struct{}{}:
+	default:
+	}
+	if it.queue == nil {
+		return it.job, nil, true
+	}
+	job := it.queue.jobs[0]
+	it.queue.jobs = it.queue.jobs[1:]
+	it.queue.running = true
+	return job, it.queue, true
+}
+
+// release 同Key的任务执行完毕后，让该Key的下一个任务重新参与调度
+func (wp *WorkerPool) release(q *keyQueue) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	q.running = false
+	if len(q.jobs) == 0 {
+		delete(wp.keys, q.key)
+		return
+	}
+	if !wp.stopped {
+		heap.Push(&wp.ready, readyItem{queue: q})
+		wp.cond.Signal()
+	}
+}
+
+func (wp *WorkerPool) run(job *Job) {
+	if err := job.ctx.Err(); err != nil {
+		job.future.resolve(err)
+		return
+	}
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if e, ok := r.(error); ok {
+					err = e
+				} else {
+					err = fmt.Errorf("task panic: %v", r)
+				}
+			}
+		}()
+		err = job.Task()
+	}()
+	job.future.resolve(err)
+	if err != nil {
+		select {
+		case wp.ErrChan <- err:
+		default:
+			// 没有人读取错误时不能阻塞worker
+			log.Printf("Worker pool error dropped: %v\n", err)
+		}
+	}
+}
+
+// Stop 停止所有worker，尚未执行的任务以ErrPoolStopped结束
 func (wp *WorkerPool) Stop() {
+	wp.mu.Lock()
+	if wp.stopped {
+		wp.mu.Unlock()
+		return
+	}
+	wp.stopped = true
 	close(wp.stopCh)
+	wp.cond.Broadcast()
+	pending := make([]*Job, 0, wp.pending)
+	for _, it := range wp.ready {
+		if it.queue != nil {
+			pending = append(pending, it.queue.jobs...)
+			it.queue.jobs = nil
+		} else {
+			pending = append(pending, it.job)
+		}
+	}
+	for _, q := range wp.keys {
+		if q.running {
+			pending = append(pending, q.jobs...)
+			q.jobs = nil
+		}
+	}
+	wp.ready = nil
+	wp.mu.Unlock()
+
+	for _, job := range pending {
+		job.future.resolve(ErrPoolStopped)
+	}
 	wp.wg.Wait()
 }
@@ -0,0 +1,49 @@
+package websocket
+
+import "log"
+
+// BlockList 查询玩家之间的屏蔽关系，由service中的BlockService实现
+type BlockList interface {
+	// Blocks 返回userId是否屏蔽了otherId
+	Blocks(userId, otherId int) bool
+	// BlockedIds 返回userId屏蔽的所有玩家
+	BlockedIds(userId int) ([]int, error)
+	// Invalidate 丢弃userId屏蔽列表的缓存
+	Invalidate(userId int)
+}
+
+// RegisterBlocks 匹配时跳过有屏蔽关系的两名玩家，并隐藏被屏蔽玩家的聊天和挑战，需要在Run之前调用
+func RegisterBlocks(ch *ChessHub, blocks BlockList) {
+	ch.blockList = blocks
+}
+
+// NotifyBlocksChanged 玩家的屏蔽列表发生变化，集群模式下通知所有节点丢弃缓存
+func (ch *ChessHub) NotifyBlocksChanged(userId int) {
+	if ch.cluster != nil {
+		ch.cluster.broadcastBlocks(userId)
+	}
+}
+
+// blocks 返回userId是否屏蔽了otherId，没有配置屏蔽列表时总是false
+func (ch *ChessHub) blocks(userId, otherId int) bool {
+	return ch.blockList != nil && ch.blockList.Blocks(userId, otherId)
+}
+
+// loadBlocks 玩家加入匹配队列前读取其屏蔽列表，大厅协程匹配时只检查内存中的列表。
+// 排队期间屏蔽列表的变化在下次匹配时生效
+func (ch *ChessHub) loadBlocks(client *Client) {
+	if ch.blockList == nil {
+		return
+	}
+	ids, err := ch.blockList.BlockedIds(client.Id)
+	if err != nil {
+		log.Printf("查询屏蔽列表失败: %v\n", err)
+		return
+	}
+	client.setBlockedIds(ids)
+}
+
+// matchBlocked 返回两名排队的玩家中是否有一方屏蔽了另一方
+func matchBlocked(a, b *Client) bool {
+	return a.blocksUser(b.Id) || b.blocksUser(a.Id)
+}
@@ -0,0 +1,184 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"chinese-chess-backend/utils"
+)
+
+// fakeBlockList 内存中的屏蔽列表，记录查询和丢弃缓存的次数
+type fakeBlockList struct {
+	mu          sync.Mutex
+	blocked     map[int][]int
+	checks      int   // Blocks被调用的次数
+	invalidated []int // 被丢弃缓存的玩家
+}
+
+func (f *fakeBlockList) Blocks(userId, otherId int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checks++
+	return slices.Contains(f.blocked[userId], otherId)
+}
+
+func (f *fakeBlockList) BlockedIds(userId int) ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Sorted(slices.Values(f.blocked[userId])), nil
+}
+
+func (f *fakeBlockList) Invalidate(userId int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.invalidated = append(f.invalidated, userId)
+}
+
+func (f *fakeBlockList) getChecks() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.checks
+}
+
+func (f *fakeBlockList) getInvalidated() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.invalidated)
+}
+
+// newBlockTestHubs 启动使用指定屏蔽列表的节点，broker为nil时不开启集群模式
+func newBlockTestHubs(t *testing.T, broker Broker, lists ...*fakeBlockList) []*ChessHub {
+	t.Helper()
+	clock := utils.NewFakeClock(time.Now())
+	hubs := make([]*ChessHub, 0, len(lists))
+	for i, blocks := range lists {
+		opts := []HubOption{WithClock(clock)}
+		if broker != nil {
+			opts = append(opts, WithCluster(broker, string(rune('a'+i))))
+		}
+		hub := NewChessHub(opts...)
+		RegisterBlocks(hub, blocks)
+		go hub.Run()
+		hubs = append(hubs, hub)
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			hub.Shutdown(ctx)
+		})
+	}
+	return hubs
+}
+
+// waitQueued 等待玩家进入匹配队列
+func (tc *testClient) waitQueued(t *testing.T) {
+	t.Helper()
+	tc.waitMessage(t, messageNormal, func(m map[string]any) bool {
+		return m["message"] == "正在匹配，请稍等"
+	})
+}
+
+func TestMatchSkipsBlockedPlayers(t *testing.T) {
+	blocks := &fakeBlockList{blocked: map[int][]int{1: {2}}}
+	hub := newBlockTestHubs(t, nil, blocks)[0]
+	alice := newTestClient(t, hub, 1)
+	bob := newTestClient(t, hub, 2)
+	carol := newTestClient(t, hub, 3)
+
+	alice.send(t, `{"type":%d}`, messageMatch)
+	alice.waitQueued(t)
+	bob.send(t, `{"type":%d}`, messageMatch)
+	bob.waitQueued(t)
+
+	// 被屏蔽的玩家跳过，与排在后面的玩家匹配
+	carol.send(t, `{"type":%d}`, messageMatch)
+	carol.waitMessage(t, messageCountdown, nil)
+	alice.waitMessage(t, messageCountdown, nil)
+	if alice.getRoomId() != carol.getRoomId() || bob.getRoomId() != -1 {
+		t.Fatal("有屏蔽关系的玩家不应当被匹配到一起")
+	}
+	if n := blocks.getChecks(); n != 0 {
+		t.Fatalf("大厅协程匹配时不应当查询屏蔽列表，查询了%d次", n)
+	}
+}
+
+func TestClusterMatchSkipsBlockedPlayers(t *testing.T) {
+	// 两个节点共用同一份屏蔽列表，相当于同一个数据库
+	blocks := &fakeBlockList{blocked: map[int][]int{1: {2}}}
+	hubs := newBlockTestHubs(t, NewMemoryBroker(), blocks, blocks)
+	alice := newTestClient(t, hubs[0], 1)
+	bob := newTestClient(t, hubs[1], 2)
+	carol := newTestClient(t, hubs[1], 3)
+
+	// 节点b取到两人时只能从队列记录中得知节点a上的玩家屏蔽了谁
+	alice.send(t, `{"type":%d}`, messageMatch)
+	alice.waitQueued(t)
+	bob.send(t, `{"type":%d}`, messageMatch)
+	bob.waitQueued(t)
+
+	carol.send(t, `{"type":%d}`, messageMatch)
+	carol.waitMessage(t, messageCountdown, nil)
+	alice.waitMessage(t, messageCountdown, nil)
+	waitUntil(t, "节点a同步玩家1所在的房间", func() bool {
+		return alice.getRoomId() == carol.getRoomId()
+	})
+	if bob.getRoomId() != -1 {
+		t.Fatal("有屏蔽关系的玩家不应当被匹配到一起")
+	}
+	if n := blocks.getChecks(); n != 0 {
+		t.Fatalf("匹配时不应当查询屏蔽列表，查询了%d次", n)
+	}
+}
+
+func TestBlockChangeInvalidatesEveryNode(t *testing.T) {
+	a, b := &fakeBlockList{}, &fakeBlockList{}
+	hubs := newBlockTestHubs(t, NewMemoryBroker(), a, b)
+	// 大厅协程开始处理注册时已经订阅了集群消息
+	newTestClient(t, hubs[0], 1)
+	newTestClient(t, hubs[1], 2)
+
+	hubs[0].NotifyBlocksChanged(1)
+	// 发出通知的节点同样从集群频道收到
+	for i, blocks := range []*fakeBlockList{a, b} {
+		waitUntil(t, fmt.Sprintf("节点%d丢弃玩家1屏蔽列表的缓存", i), func() bool {
+			return slices.Equal(blocks.getInvalidated(), []int{1})
+		})
+	}
+}
+
+func TestChallengeFromBlockedPlayerIsDropped(t *testing.T) {
+	blocks := &fakeBlockList{blocked: map[int][]int{2: {1}}}
+	hub := newBlockTestHubs(t, nil, blocks)[0]
+	alice := newTestClient(t, hub, 1)
+	bob := newTestClient(t, hub, 2)
+	carol := newTestClient(t, hub, 3)
+
+	// 挑战者照常收到创建成功，但挑战没有保存
+	alice.send(t, `{"type":%d,"targetId":%d}`, messageChallenge, bob.Id)
+	alice.waitMessage(t, messageChallenge, func(m map[string]any) bool {
+		return m["event"] == challengeCreated
+	})
+	for _, id := range []int{alice.Id, bob.Id} {
+		challenges, err := hub.challenges.List(context.Background(), id)
+		if err != nil || len(challenges) != 0 {
+			t.Fatalf("被屏蔽玩家的挑战不应当保存: %v, %v", challenges, err)
+		}
+	}
+
+	// 没有屏蔽关系的挑战照常保存并推送，被屏蔽的挑战始终没有推送
+	carol.send(t, `{"type":%d,"targetId":%d}`, messageChallenge, bob.Id)
+	bob.waitMessage(t, messageChallenge, nil)
+	challenges, err := hub.challenges.List(context.Background(), bob.Id)
+	if err != nil || len(challenges) != 1 || challenges[0].ChallengerId != carol.Id {
+		t.Fatalf("应当只保存玩家3的挑战: %v, %v", challenges, err)
+	}
+	if bob.find(func(m map[string]any) bool {
+		c, _ := m["challenge"].(map[string]any)
+		return c["challengerId"] == float64(alice.Id)
+	}) != nil {
+		t.Fatal("被屏蔽玩家的挑战不应当推送")
+	}
+}
@@ -0,0 +1,589 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"chinese-chess-backend/dto"
+	"chinese-chess-backend/dto/room"
+)
+
+// 机器人接口的事件流和对局流都是NDJSON，每行一个JSON对象，空行是心跳
+
+const botQueryTimeout = 5 * time.Second // 读取对局状态的超时时间
+
+type botPlayer struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+	Exp  int    `json:"exp"`
+	Bot  bool   `json:"bot"`
+}
+
+// gameStateEvent 对局的当前状态，剩余时间单位为毫秒，不限时的对局为0
+type gameStateEvent struct {
+	Type      string        `json:"type"` // gameState
+	Moves     []MoveMessage `json:"moves"`
+	Ply       int           `json:"ply"`
+	Red       int64         `json:"red"`
+	Black     int64         `json:"black"`
+	Turn      string        `json:"turn"`             // red或black
+	Status    string        `json:"status"`           // started或ended
+	Winner    string        `json:"winner,omitempty"` // red、black或draw，对局结束时才有
+	DrawOffer int           `json:"drawOffer,omitempty"`
+}
+
+// gameFullEvent 对局流的第一行，包含双方玩家和设置
+type gameFullEvent struct {
+	Type     string            `json:"type"` // gameFull
+	Id       int               `json:"id"`
+	Red      *botPlayer        `json:"red"`
+	Black    *botPlayer        `json:"black"`
+	Settings room.RoomSettings `json:"settings"`
+	State    gameStateEvent    `json:"state"`
+}
+
+type botGame struct {
+	Id       int                `json:"id"`
+	Color    string             `json:"color"`
+	Opponent int                `json:"opponent"`
+	Settings *room.RoomSettings `json:"settings,omitempty"`
+	Winner   string             `json:"winner,omitempty"`
+}
+
+// botEvent 事件流中的一行
+type botEvent struct {
+	Type      string     `json:"type"` // gameStart、gameFinish、notice，或者challenge等挑战事件
+	Game      *botGame   `json:"game,omitempty"`
+	Challenge *Challenge `json:"challenge,omitempty"`
+	Message   string     `json:"message,omitempty"`
+}
+
+// botChallengeEvents 挑战事件在机器人事件流中的类型
+var botChallengeEvents = map[string]string{
+	challengeCreated:  "challenge",
+	challengeAccepted: "challengeAccepted",
+	challengeDeclined: "challengeDeclined",
+	challengeCanceled: "challengeCanceled",
+	challengeExpired:  "challengeExpired",
+}
+
+func roleName(role clientRole) string {
+	switch role {
+	case roleRed:
+		return "red"
+	case roleBlack:
+		return "black"
+	}
+	return ""
+}
+
+func winnerName(winner clientRole) string {
+	if winner == roleNone {
+		return "draw"
+	}
+	return roleName(winner)
+}
+
+func newBotPlayer(c *Client) *botPlayer {
+	if c == nil {
+		return nil
+	}
+	return &botPlayer{Id: c.Id, Name: c.Name, Exp: c.getExp(), Bot: c.Bot}
+}
+
+// gameState 当前对局的状态，只能在房间协程中调用
+func (cr *ChessRoom) gameState() gameStateEvent {
+	state := gameStateEvent{
+		Type:   "gameState",
+		Moves:  append(make([]MoveMessage, 0, len(cr.History)), cr.History...),
+		Ply:    cr.ply,
+		Status: "started",
+	}
+	if cr.State != roomPlaying {
+		state.Status = "ended"
+		return state
+	}
+	if !cr.Settings.TimeControl.Unlimited() {
+		state.Red = cr.remaining(roleRed).Milliseconds()
+		state.Black = cr.remaining(roleBlack).Milliseconds()
+	}
+	if cr.Current != nil {
+		state.Turn = roleName(cr.Current.Role)
+	}
+	if cr.drawOffer != nil {
+		state.DrawOffer = cr.drawOffer.Id
+	}
+	return state
+}
+
+// gameFull 包含双方玩家的完整对局信息，对局未在进行时没有玩家
+func (cr *ChessRoom) gameFull() gameFullEvent {
+	full := gameFullEvent{
+		Type:     "gameFull",
+		Id:       cr.Id,
+		Settings: cr.Settings,
+		State:    cr.gameState(),
+	}
+	if cr.State != roomPlaying {
+		return full
+	}
+	for _, c := range cr.players() {
+		switch c.Role {
+		case roleRed:
+			full.Red = newBotPlayer(c)
+		case roleBlack:
+			full.Black = newBotPlayer(c)
+		}
+	}
+	return full
+}
+
+// queryGame 经由房间协程读取对局状态，只支持本节点上的房间
+func (ch *ChessHub) queryGame(ctx context.Context, roomId int) (gameFullEvent, bool) {
+	r := ch.getRoom(roomId)
+	if r == nil {
+		return gameFullEvent{}, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, botQueryTimeout)
+	defer cancel()
+	reply := make(chan gameFullEvent, 1)
+	if !r.post(hubCommand{commandType: commandState, payload: reply}) {
+		return gameFullEvent{}, false
+	}
+	select {
+	case full := <-reply:
+		return full, true
+	case <-r.done:
+	case <-ctx.Done():
+	}
+	return gameFullEvent{}, false
+}
+
+// watchEvents 把满足filter的事件转到返回的通道中。通道满时丢弃事件并通知lost，
+// 调用方收到lost后需要重新读取完整状态
+func (ch *ChessHub) watchEvents(filter func(Event) bool) (events <-chan Event, lost <-chan struct{}, stop func()) {
+	watched := make(chan Event, 16)
+	dropped := make(chan struct{}, 1)
+	unsubscribe := Subscribe(ch.events, func(e Event) {
+		if !filter(e) {
+			return
+		}
+		select {
+		case watched <- e:
+		default:
+			log.Printf("机器人事件积压，丢弃事件: %T\n", e)
+			select {
+			case dropped <- struct{}{}:
+			default:
+			}
+		}
+	})
+	return watched, dropped, unsubscribe
+}
+
+func writeLine(w gin.ResponseWriter, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+func startNDJSON(c *gin.Context) {
+	header := c.Writer.Header()
+	header.Set("Content-Type", "application/x-ndjson")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+}
+
+// botGameEvent 把对局开始和结束事件转换为事件流中的一行，与userId无关的事件返回false
+func botGameEvent(e Event, userId int) (botEvent, bool) {
+	var redId, blackId int
+	game := &botGame{}
+	event := botEvent{Game: game}
+	switch e := e.(type) {
+	case GameStarted:
+		redId, blackId = e.RedId, e.BlackId
+		game.Id = e.RoomId
+		settings := e.Settings
+		game.Settings = &settings
+		event.Type = "gameStart"
+	case GameEnded:
+		redId, blackId = e.RedId, e.BlackId
+		game.Id = e.RoomId
+		game.Winner = winnerName(e.Winner)
+		event.Type = "gameFinish"
+	default:
+		return botEvent{}, false
+	}
+	switch userId {
+	case redId:
+		game.Color, game.Opponent = "red", blackId
+	case blackId:
+		game.Color, game.Opponent = "black", redId
+	default:
+		return botEvent{}, false
+	}
+	return event, true
+}
+
+// botGameResync 事件丢失后，根据机器人所在对局的当前状态补发对局开始事件
+func (ch *ChessHub) botGameResync(ctx context.Context, client *Client) (botEvent, bool) {
+	roomId := client.getRoomId()
+	if roomId == -1 {
+		return botEvent{}, false
+	}
+	full, ok := ch.queryGame(ctx, roomId)
+	if !ok || full.State.Status != "started" || full.Red == nil || full.Black == nil {
+		return botEvent{}, false
+	}
+	return botGameEvent(GameStarted{RoomId: full.Id, RedId: full.Red.Id, BlackId: full.Black.Id, Settings: full.Settings}, client.Id)
+}
+
+// botMessage 把大厅发给机器人的提示和挑战转换为事件流中的一行，
+// 集群转发来的消息是JSON，按类型解码后再转换
+func botMessage(message any) (botEvent, bool) {
+	if raw, ok := message.(json.RawMessage); ok {
+		var base BaseMessage
+		if err := json.Unmarshal(raw, &base); err != nil {
+			return botEvent{}, false
+		}
+		if base.Type == messageChallenge {
+			var msg challengeMessage
+			if err := json.Unmarshal(raw, &msg); err != nil {
+				return botEvent{}, false
+			}
+			message = msg
+		} else {
+			var msg NormalMessage
+			if err := json.Unmarshal(raw, &msg); err != nil || msg.Message == "" {
+				return botEvent{}, false
+			}
+			message = msg
+		}
+	}
+	switch msg := message.(type) {
+	case NormalMessage:
+		return botEvent{Type: "notice", Message: msg.Message}, true
+	case challengeMessage:
+		challenge := msg.Challenge
+		return botEvent{Type: botChallengeEvents[msg.Event], Challenge: &challenge}, true
+	}
+	return botEvent{}, false
+}
+
+// HandleBotEvents 机器人的事件流，推送自己参与的对局开始和结束、挑战，以及大厅发给机器人的提示。
+// 连接期间机器人作为在线玩家注册在大厅中，可以匹配和创建房间
+func (ch *ChessHub) HandleBotEvents(c *gin.Context) {
+	id, ok := ch.acceptStream(c)
+	if !ok {
+		return
+	}
+
+	client := NewClient(nil, id)
+	client.transport = transportBot
+	if err := ch.loadProfile(client); err != nil {
+		log.Printf("加载用户信息失败: %v\n", err)
+	}
+
+	events, lost, stop := ch.watchEvents(func(e Event) bool {
+		_, ok := botGameEvent(e, id)
+		return ok
+	})
+	defer stop()
+
+	startNDJSON(c)
+
+	defer client.close()
+	ch.commands <- hubCommand{
+		commandType: commandRegister,
+		client:      client,
+	}
+	defer func() {
+		ch.commands <- hubCommand{
+			commandType: commandUnregister,
+			client:      client,
+		}
+	}()
+
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		var line any
+		select {
+		case e := <-events:
+			line, _ = botGameEvent(e, id)
+		case <-lost:
+			// 丢失的事件可能是对局开始，机器人仍在对局中时补发
+			event, ok := ch.botGameResync(c.Request.Context(), client)
+			if !ok {
+				continue
+			}
+			line = event
+		case message := <-client.send:
+			// 对局内的消息通过对局流获取，这里只转发提示、错误和挑战
+			event, ok := botMessage(message)
+			if !ok {
+				continue
+			}
+			line = event
+		case <-ticker.C:
+			if _, err := io.WriteString(c.Writer, "\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+			continue
+		case <-client.done:
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+		if err := writeLine(c.Writer, line); err != nil {
+			log.Printf("发送机器人事件失败: %v\n", err)
+			return
+		}
+	}
+}
+
+func gameIdParam(c *gin.Context) (int, bool) {
+	gameId, err := strconv.Atoi(c.Param("gameId"))
+	if err != nil {
+		dto.ErrorResponse(c, dto.WithMessage("对局ID格式错误"))
+		return 0, false
+	}
+	return gameId, true
+}
+
+// endedState 对局结束时推送的最后一行状态
+func endedState(ended GameEnded) gameStateEvent {
+	state := gameStateEvent{
+		Type:   "gameState",
+		Moves:  ended.Moves,
+		Ply:    ended.Ply,
+		Status: "ended",
+		Winner: winnerName(ended.Winner),
+	}
+	if state.Moves == nil {
+		state.Moves = make([]MoveMessage, 0)
+	}
+	return state
+}
+
+// drainEnded 从通道中已有的事件里找出对局结束事件，找不到时返回state
+func drainEnded(events <-chan Event, state gameStateEvent) gameStateEvent {
+	for {
+		select {
+		case e := <-events:
+			if ended, ok := e.(GameEnded); ok {
+				return endedState(ended)
+			}
+		default:
+			return state
+		}
+	}
+}
+
+// HandleBotGame 对局流，第一行是完整的对局信息，之后每次状态变化推送一行对局状态，对局结束后关闭
+func (ch *ChessHub) HandleBotGame(c *gin.Context) {
+	userId, ok := ch.acceptStream(c)
+	if !ok {
+		return
+	}
+	gameId, ok := gameIdParam(c)
+	if !ok {
+		return
+	}
+
+	// 先订阅再读取状态，避免漏掉两者之间的变化
+	events, lost, stop := ch.watchEvents(func(e Event) bool {
+		switch e := e.(type) {
+		case MoveMade:
+			return e.RoomId == gameId
+		case TakebackAccepted:
+			return e.RoomId == gameId
+		case DrawOffered:
+			return e.RoomId == gameId
+		case DrawDeclined:
+			return e.RoomId == gameId
+		case GameEnded:
+			return e.RoomId == gameId
+		}
+		return false
+	})
+	defer stop()
+
+	full, ok := ch.queryGame(c.Request.Context(), gameId)
+	if !ok {
+		dto.ErrorResponse(c, dto.WithMessage("对局不存在"))
+		return
+	}
+	if (full.Red == nil || full.Red.Id != userId) && (full.Black == nil || full.Black.Id != userId) {
+		dto.ErrorResponse(c, dto.WithMessage("您不在该对局中"))
+		return
+	}
+
+	startNDJSON(c)
+	if err := writeLine(c.Writer, full); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-events:
+			if ended, ok := e.(GameEnded); ok {
+				writeLine(c.Writer, endedState(ended))
+				return
+			}
+			next, ok := ch.queryGame(c.Request.Context(), gameId)
+			if !ok {
+				return
+			}
+			if err := writeLine(c.Writer, next.State); err != nil {
+				return
+			}
+		case <-lost:
+			// 有事件被丢弃时重新读取并推送完整状态
+			next, ok := ch.queryGame(c.Request.Context(), gameId)
+			if !ok {
+				return
+			}
+			if next.State.Status == "ended" {
+				// 结束事件可能还在通道中，也可能已被丢弃，此时推送不带胜方的结束状态
+				writeLine(c.Writer, drainEnded(events, next.State))
+				return
+			}
+			if err := writeLine(c.Writer, next.State); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := io.WriteString(c.Writer, "\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-ch.streams.Done():
+			// 对局流没有注册为客户端，停机时单独断开
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// botGameClient 返回机器人的客户端，并确认它正在gameId对局中
+func (ch *ChessHub) botGameClient(c *gin.Context) (*Client, bool) {
+	gameId, ok := gameIdParam(c)
+	if !ok {
+		return nil, false
+	}
+	client, ok := ch.streamClient(c)
+	if !ok {
+		return nil, false
+	}
+	if client.getRoomId() != gameId {
+		dto.ErrorResponse(c, dto.WithMessage("您不在该对局中"))
+		return nil, false
+	}
+	return client, true
+}
+
+// HandleBotMove 在对局中走子，请求体与走子消息相同
+func (ch *ChessHub) HandleBotMove(c *gin.Context) {
+	client, ok := ch.botGameClient(c)
+	if !ok {
+		return
+	}
+	body, ok := readStreamBody(c)
+	if !ok {
+		return
+	}
+	ch.submitStreamMessage(c, client, messageMove, body)
+}
+
+// HandleBotDraw 提和或回复提和，accept为yes或no
+func (ch *ChessHub) HandleBotDraw(c *gin.Context) {
+	var accept bool
+	switch c.Param("accept") {
+	case "yes":
+		accept = true
+	case "no":
+	default:
+		dto.ErrorResponse(c, dto.WithMessage("参数必须为yes或no"))
+		return
+	}
+	client, ok := ch.botGameClient(c)
+	if !ok {
+		return
+	}
+	body, _ := json.Marshal(drawMessage{BaseMessage: BaseMessage{Type: messageDraw}, Accept: accept})
+	ch.submitStreamMessage(c, client, messageDraw, body)
+}
+
+// HandleBotResign 认输
+func (ch *ChessHub) HandleBotResign(c *gin.Context) {
+	client, ok := ch.botGameClient(c)
+	if !ok {
+		return
+	}
+	ch.submitStreamMessage(c, client, messageGiveUp, nil)
+}
+
+// HandleBotChat 在对局中发送聊天，请求体与聊天消息相同
+func (ch *ChessHub) HandleBotChat(c *gin.Context) {
+	client, ok := ch.botGameClient(c)
+	if !ok {
+		return
+	}
+	body, ok := readStreamBody(c)
+	if !ok {
+		return
+	}
+	ch.submitStreamMessage(c, client, messageChat, body)
+}
+
+// HandleBotChallenge 向指定玩家发起挑战，请求体与挑战消息相同
+func (ch *ChessHub) HandleBotChallenge(c *gin.Context) {
+	ch.postStreamMessage(c, messageChallenge)
+}
+
+// HandleBotChallengeAccept 接受挑战，双方都不在房间中时开局
+func (ch *ChessHub) HandleBotChallengeAccept(c *gin.Context) {
+	ch.postChallengeReply(c, messageChallengeReply, true)
+}
+
+// HandleBotChallengeDecline 拒绝挑战
+func (ch *ChessHub) HandleBotChallengeDecline(c *gin.Context) {
+	ch.postChallengeReply(c, messageChallengeReply, false)
+}
+
+// HandleBotChallengeCancel 取消自己发起的挑战
+func (ch *ChessHub) HandleBotChallengeCancel(c *gin.Context) {
+	ch.postChallengeReply(c, messageChallengeCancel, false)
+}
+
+func (ch *ChessHub) postChallengeReply(c *gin.Context, t MessageType, accept bool) {
+	client, ok := ch.streamClient(c)
+	if !ok {
+		return
+	}
+	body, _ := json.Marshal(challengeReplyMessage{
+		BaseMessage: BaseMessage{Type: t},
+		ChallengeId: c.Param("challengeId"),
+		Accept:      accept,
+	})
+	ch.submitStreamMessage(c, client, t, body)
+}
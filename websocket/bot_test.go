@@ -0,0 +1,140 @@
+package websocket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"chinese-chess-backend/utils"
+)
+
+func newBotTestHub(t *testing.T) (*ChessHub, *utils.FakeClock) {
+	t.Helper()
+	clock := utils.NewFakeClock(time.Now())
+	hub := NewChessHub(WithClock(clock))
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+	return hub, clock
+}
+
+// nextEvent 等待通道中的下一个事件
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待事件超时")
+	}
+	return nil
+}
+
+func TestBotGameWatchesTakebackAndEndPly(t *testing.T) {
+	hub, clock := newBotTestHub(t)
+	red := newTestClient(t, hub, 1)
+	black := newTestClient(t, hub, 2)
+	events, _, stop := hub.watchEvents(func(e Event) bool {
+		switch e.(type) {
+		case TakebackAccepted, GameEnded:
+			return true
+		}
+		return false
+	})
+	defer stop()
+
+	red.send(t, `{"type":%d,"settings":{"color":"red","timeControl":{"initial":60},"allowTakeback":true}}`, messageCreate)
+	red.waitMessage(t, messageCreate, nil)
+	black.send(t, `{"type":%d,"roomId":%d}`, messageJoin, red.getRoomId())
+	red.waitMessage(t, messageJoin, nil)
+	red.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.waitMessage(t, messageCountdown, nil)
+	advanceClock(t, clock, red)
+
+	red.send(t, `{"type":%d,"from":{"x":7,"y":7},"to":{"x":4,"y":7}}`, messageMove)
+	black.waitMessage(t, messageMove, atPly(2))
+	red.send(t, `{"type":%d}`, messageTakeback)
+	black.waitMessage(t, messageTakeback, nil)
+	black.send(t, `{"type":%d,"accept":true}`, messageTakebackReply)
+
+	// 悔棋改变了序号，对局流需要据此推送新的状态
+	takeback, ok := nextEvent(t, events).(TakebackAccepted)
+	if !ok || takeback.UserId != red.Id || takeback.Ply != 3 {
+		t.Fatalf("悔棋事件不正确: %+v", takeback)
+	}
+
+	red.send(t, `{"type":%d}`, messageGiveUp)
+	ended, ok := nextEvent(t, events).(GameEnded)
+	if !ok {
+		t.Fatal("应当收到对局结束事件")
+	}
+	state := endedState(ended)
+	if state.Ply != 3 || state.Winner != "black" || state.Status != "ended" || len(state.Moves) != 0 {
+		t.Fatalf("对局结束时的状态应当使用结束时的序号: %+v", state)
+	}
+}
+
+func TestWatchEventsReportsDroppedEvents(t *testing.T) {
+	hub, _ := newBotTestHub(t)
+	events, lost, stop := hub.watchEvents(func(e Event) bool { return true })
+	defer stop()
+
+	for i := range 20 {
+		hub.events.Publish(MoveMade{RoomId: 1, Ply: i + 1})
+	}
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("通道满时应当通知事件丢失")
+	}
+	if n := len(events); n != cap(events) {
+		t.Fatalf("通道中应当有%d个事件，实际%d个", cap(events), n)
+	}
+
+	// 重新同步时从通道中找出尚未处理的结束事件
+	queried := gameStateEvent{Type: "gameState", Status: "ended", Ply: 20}
+	if state := drainEnded(events, queried); state.Winner != "" || state.Ply != 20 {
+		t.Fatalf("没有结束事件时应当使用读取到的状态: %+v", state)
+	}
+	hub.events.Publish(GameEnded{RoomId: 1, Winner: roleRed, Ply: 21})
+	var state gameStateEvent
+	waitUntil(t, "收到对局结束事件", func() bool {
+		state = drainEnded(events, queried)
+		return state.Winner != ""
+	})
+	if state.Winner != "red" || state.Ply != 21 {
+		t.Fatalf("应当使用通道中的结束事件: %+v", state)
+	}
+}
+
+func TestBotGameResyncReportsCurrentGame(t *testing.T) {
+	hub, clock := newBotTestHub(t)
+	red := newTestClient(t, hub, 1)
+	black := newTestClient(t, hub, 2)
+
+	// 不在房间中时没有需要补发的对局
+	if event, ok := hub.botGameResync(context.Background(), red.Client); ok {
+		t.Fatalf("不在房间中时不应当补发对局: %+v", event)
+	}
+
+	red.send(t, `{"type":%d,"settings":{"color":"red","timeControl":{"initial":60}}}`, messageCreate)
+	red.waitMessage(t, messageCreate, nil)
+	black.send(t, `{"type":%d,"roomId":%d}`, messageJoin, red.getRoomId())
+	red.waitMessage(t, messageJoin, nil)
+	if event, ok := hub.botGameResync(context.Background(), red.Client); ok {
+		t.Fatalf("对局开始前不应当补发对局: %+v", event)
+	}
+
+	red.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.waitMessage(t, messageCountdown, nil)
+	advanceClock(t, clock, red)
+	event, ok := hub.botGameResync(context.Background(), black.Client)
+	if !ok || event.Type != "gameStart" || event.Game.Id != red.getRoomId() || event.Game.Color != "black" || event.Game.Opponent != red.Id {
+		t.Fatalf("应当补发当前对局的开始事件: %+v %+v", event, event.Game)
+	}
+}
@@ -0,0 +1,299 @@
+package websocket
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Broker 是集群中各节点共享的状态和消息通道，生产环境使用Redis，
+// 测试中可以让多个ChessHub共用同一个内存实现
+type Broker interface {
+	// Publish 向频道发布消息
+	Publish(ctx context.Context, channel string, payload []byte) error
+	// Subscribe 订阅频道，ctx结束后返回的通道会被关闭
+	Subscribe(ctx context.Context, channels ...string) (<-chan []byte, error)
+
+	// NextRoomId 分配集群内唯一的房间id
+	NextRoomId(ctx context.Context) (int, error)
+	// SetOwner 记录房间归属的节点
+	SetOwner(ctx context.Context, roomId int, nodeId string) error
+	// Owner 返回房间归属的节点，房间不存在时返回空字符串
+	Owner(ctx context.Context, roomId int) (string, error)
+	DeleteOwner(ctx context.Context, roomId int) error
+
+	// PushMatch 将玩家加入共享的匹配队列末尾
+	PushMatch(ctx context.Context, member string) error
+	// PopMatchPair 队列中至少有两名玩家时原子地取出队首的两名，否则返回nil
+	PopMatchPair(ctx context.Context) ([]string, error)
+	RemoveMatch(ctx context.Context, member string) error
+
+	// SetSpareRoom 保存有空位的房间信息，SpareRooms返回所有节点的空余房间
+	SetSpareRoom(ctx context.Context, roomId int, info []byte) error
+	DeleteSpareRoom(ctx context.Context, roomId int) error
+	SpareRooms(ctx context.Context) ([][]byte, error)
+}
+
+const (
+	redisRoomIdKey    = "chess:room:id"
+	redisRoomOwnerKey = "chess:room:owner"
+	redisMatchKey     = "chess:match"
+	redisSpareRoomKey = "chess:room:spare"
+)
+
+// popPairScript 保证两个节点不会取到同一名玩家
+var popPairScript = redis.NewScript(`
+if redis.call('LLEN', KEYS[1]) < 2 then
+	return {}
+end
+return {redis.call('LPOP', KEYS[1]), redis.call('LPOP', KEYS[1])}
+`)
+
+type redisBroker struct {
+	rdb *redis.Client
+}
+
+func NewRedisBroker(rdb *redis.Client) Broker {
+	return &redisBroker{rdb: rdb}
+}
+
+func (b *redisBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	return b.rdb.Publish(ctx, channel, payload).Err()
+}
+
+func (b *redisBroker) Subscribe(ctx context.Context, channels ...string) (<-chan []byte, error) {
+	pubsub := b.rdb.Subscribe(ctx, channels...)
+	// 等待订阅确认，避免订阅前发布的消息丢失
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				select {
+				case out <- []byte(msg.Payload):
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (b *redisBroker) NextRoomId(ctx context.Context) (int, error) {
+	id, err := b.rdb.Incr(ctx, redisRoomIdKey).Result()
+	return int(id), err
+}
+
+func (b *redisBroker) SetOwner(ctx context.Context, roomId int, nodeId string) error {
+	return b.rdb.HSet(ctx, redisRoomOwnerKey, strconv.Itoa(roomId), nodeId).Err()
+}
+
+func (b *redisBroker) Owner(ctx context.Context, roomId int) (string, error) {
+	owner, err := b.rdb.HGet(ctx, redisRoomOwnerKey, strconv.Itoa(roomId)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return owner, err
+}
+
+func (b *redisBroker) DeleteOwner(ctx context.Context, roomId int) error {
+	return b.rdb.HDel(ctx, redisRoomOwnerKey, strconv.Itoa(roomId)).Err()
+}
+
+func (b *redisBroker) PushMatch(ctx context.Context, member string) error {
+	return b.rdb.RPush(ctx, redisMatchKey, member).Err()
+}
+
+func (b *redisBroker) PopMatchPair(ctx context.Context) ([]string, error) {
+	pair, err := popPairScript.Run(ctx, b.rdb, []string{redisMatchKey}).StringSlice()
+	if err != nil || len(pair) < 2 {
+		return nil, err
+	}
+	return pair, nil
+}
+
+func (b *redisBroker) RemoveMatch(ctx context.Context, member string) error {
+	return b.rdb.LRem(ctx, redisMatchKey, 0, member).Err()
+}
+
+func (b *redisBroker) SetSpareRoom(ctx context.Context, roomId int, info []byte) error {
+	return b.rdb.HSet(ctx, redisSpareRoomKey, strconv.Itoa(roomId), info).Err()
+}
+
+func (b *redisBroker) DeleteSpareRoom(ctx context.Context, roomId int) error {
+	return b.rdb.HDel(ctx, redisSpareRoomKey, strconv.Itoa(roomId)).Err()
+}
+
+func (b *redisBroker) SpareRooms(ctx context.Context) ([][]byte, error) {
+	values, err := b.rdb.HVals(ctx, redisSpareRoomKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	rooms := make([][]byte, 0, len(values))
+	for _, v := range values {
+		rooms = append(rooms, []byte(v))
+	}
+	return rooms, nil
+}
+
+// memoryBroker 进程内的Broker实现，多个ChessHub共用同一个实例即可模拟多节点
+type memoryBroker struct {
+	mu          sync.Mutex
+	subscribers map[string][]chan []byte
+	roomId      int
+	owners      map[int]string
+	matchQueue  []string
+	spareRooms  map[int][]byte
+}
+
+func NewMemoryBroker() Broker {
+	return &memoryBroker{
+		subscribers: make(map[string][]chan []byte),
+		owners:      make(map[int]string),
+		spareRooms:  make(map[int][]byte),
+	}
+}
+
+func (b *memoryBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	b.mu.Lock()
+	subscribers := slices.Clone(b.subscribers[channel])
+	b.mu.Unlock()
+	for _, sub := range subscribers {
+		select {
+		case sub <- slices.Clone(payload):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(ctx context.Context, channels ...string) (<-chan []byte, error) {
+	in := make(chan []byte, 256)
+	b.mu.Lock()
+	for _, channel := range channels {
+		b.subscribers[channel] = append(b.subscribers[channel], in)
+	}
+	b.mu.Unlock()
+
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		defer func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			for _, channel := range channels {
+				b.subscribers[channel] = slices.DeleteFunc(b.subscribers[channel], func(c chan []byte) bool {
+					return c == in
+				})
+			}
+		}()
+		for {
+			select {
+			case payload := <-in:
+				select {
+				case out <- payload:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (b *memoryBroker) NextRoomId(ctx context.Context) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roomId++
+	return b.roomId, nil
+}
+
+func (b *memoryBroker) SetOwner(ctx context.Context, roomId int, nodeId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.owners[roomId] = nodeId
+	return nil
+}
+
+func (b *memoryBroker) Owner(ctx context.Context, roomId int) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.owners[roomId], nil
+}
+
+func (b *memoryBroker) DeleteOwner(ctx context.Context, roomId int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.owners, roomId)
+	return nil
+}
+
+func (b *memoryBroker) PushMatch(ctx context.Context, member string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.matchQueue = append(b.matchQueue, member)
+	return nil
+}
+
+func (b *memoryBroker) PopMatchPair(ctx context.Context) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.matchQueue) < 2 {
+		return nil, nil
+	}
+	pair := slices.Clone(b.matchQueue[:2])
+	b.matchQueue = b.matchQueue[2:]
+	return pair, nil
+}
+
+func (b *memoryBroker) RemoveMatch(ctx context.Context, member string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.matchQueue = slices.DeleteFunc(b.matchQueue, func(m string) bool {
+		return m == member
+	})
+	return nil
+}
+
+func (b *memoryBroker) SetSpareRoom(ctx context.Context, roomId int, info []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.spareRooms[roomId] = slices.Clone(info)
+	return nil
+}
+
+func (b *memoryBroker) DeleteSpareRoom(ctx context.Context, roomId int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.spareRooms, roomId)
+	return nil
+}
+
+func (b *memoryBroker) SpareRooms(ctx context.Context) ([][]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rooms := make([][]byte, 0, len(b.spareRooms))
+	for _, info := range b.spareRooms {
+		rooms = append(rooms, slices.Clone(info))
+	}
+	return rooms, nil
+}
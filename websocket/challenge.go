@@ -0,0 +1,504 @@
+package websocket
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+
+	"chinese-chess-backend/dto"
+	"chinese-chess-backend/dto/room"
+)
+
+const (
+	challengeTTL          = 24 * time.Hour  // 挑战的有效期，对方不在线时挑战保留到过期
+	maxChallenges         = 10              // 每个玩家同时发出的挑战上限
+	challengeStoreTimeout = 3 * time.Second // 读写挑战存储的超时时间
+)
+
+// 挑战状态变化的事件
+const (
+	challengeCreated  = "challengeCreated"
+	challengeAccepted = "challengeAccepted"
+	challengeDeclined = "challengeDeclined"
+	challengeCanceled = "challengeCanceled"
+	challengeExpired  = "challengeExpired"
+)
+
+// Challenge 向指定玩家发起的挑战，对方接受后按挑战者的设置开局，挑战者作为房主决定执子
+type Challenge struct {
+	Id             string            `json:"id"`
+	ChallengerId   int               `json:"challengerId"`
+	ChallengerName string            `json:"challengerName"`
+	TargetId       int               `json:"targetId"`
+	Settings       room.RoomSettings `json:"settings"`
+	CreatedAt      time.Time         `json:"createdAt"`
+	ExpiresAt      time.Time         `json:"expiresAt"`
+}
+
+// ChallengeStore 保存尚未处理的挑战，过期的挑战不再返回
+type ChallengeStore interface {
+	Save(ctx context.Context, c Challenge) error
+	Get(ctx context.Context, id string) (Challenge, bool, error)
+	// Delete 删除挑战并返回挑战是否仍然存在，多个节点同时处理同一挑战时只有一个返回true
+	Delete(ctx context.Context, c Challenge) (bool, error)
+	// List 返回玩家发出和收到的挑战
+	List(ctx context.Context, userId int) ([]Challenge, error)
+}
+
+// WithChallengeStore 指定保存挑战的存储，默认保存在内存中，集群模式下需要使用共享的存储
+func WithChallengeStore(store ChallengeStore) HubOption {
+	return func(ch *ChessHub) {
+		ch.challenges = store
+	}
+}
+
+type memoryChallengeStore struct {
+	mu         sync.Mutex
+	challenges map[string]Challenge
+}
+
+func newMemoryChallengeStore() *memoryChallengeStore {
+	return &memoryChallengeStore{challenges: make(map[string]Challenge)}
+}
+
+func (s *memoryChallengeStore) Save(_ context.Context, c Challenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.challenges[c.Id] = c
+	return nil
+}
+
+func (s *memoryChallengeStore) Get(_ context.Context, id string) (Challenge, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.challenges[id]
+	if ok && !time.Now().Before(c.ExpiresAt) {
+		delete(s.challenges, id)
+		return Challenge{}, false, nil
+	}
+	return c, ok, nil
+}
+
+func (s *memoryChallengeStore) Delete(_ context.Context, c Challenge) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.challenges[c.Id]
+	delete(s.challenges, c.Id)
+	return ok, nil
+}
+
+func (s *memoryChallengeStore) List(_ context.Context, userId int) ([]Challenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	challenges := make([]Challenge, 0)
+	for id, c := range s.challenges {
+		if !now.Before(c.ExpiresAt) {
+			delete(s.challenges, id)
+			continue
+		}
+		if c.ChallengerId == userId || c.TargetId == userId {
+			challenges = append(challenges, c)
+		}
+	}
+	return challenges, nil
+}
+
+type redisChallengeStore struct {
+	rdb *redis.Client
+}
+
+// NewRedisChallengeStore 把挑战保存在Redis中，每个挑战一个带过期时间的key，
+// 每个玩家的集合中记录相关的挑战id，集群中所有节点共用
+func NewRedisChallengeStore(rdb *redis.Client) ChallengeStore {
+	return &redisChallengeStore{rdb: rdb}
+}
+
+func challengeKey(id string) string {
+	return "chess:challenge:" + id
+}
+
+func userChallengesKey(userId int) string {
+	return fmt.Sprintf("chess:challenges:%d", userId)
+}
+
+func (s *redisChallengeStore) Save(ctx context.Context, c Challenge) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	// 比挑战的有效期多保留一分钟，让大厅的定时器先处理过期并通知双方
+	ttl := time.Until(c.ExpiresAt) + time.Minute
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, challengeKey(c.Id), data, ttl)
+		for _, userId := range []int{c.ChallengerId, c.TargetId} {
+			pipe.SAdd(ctx, userChallengesKey(userId), c.Id)
+			pipe.Expire(ctx, userChallengesKey(userId), challengeTTL+time.Minute)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisChallengeStore) Get(ctx context.Context, id string) (Challenge, bool, error) {
+	data, err := s.rdb.Get(ctx, challengeKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Challenge{}, false, nil
+	}
+	if err != nil {
+		return Challenge{}, false, err
+	}
+	var c Challenge
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Challenge{}, false, err
+	}
+	if !time.Now().Before(c.ExpiresAt) {
+		return Challenge{}, false, nil
+	}
+	return c, true, nil
+}
+
+func (s *redisChallengeStore) Delete(ctx context.Context, c Challenge) (bool, error) {
+	n, err := s.rdb.Del(ctx, challengeKey(c.Id)).Result()
+	if err != nil {
+		return false, err
+	}
+	for _, userId := range []int{c.ChallengerId, c.TargetId} {
+		if err := s.rdb.SRem(ctx, userChallengesKey(userId), c.Id).Err(); err != nil {
+			log.Printf("移除玩家的挑战记录失败: %v\n", err)
+		}
+	}
+	return n == 1, nil
+}
+
+func (s *redisChallengeStore) List(ctx context.Context, userId int) ([]Challenge, error) {
+	ids, err := s.rdb.SMembers(ctx, userChallengesKey(userId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	challenges := make([]Challenge, 0, len(ids))
+	for _, id := range ids {
+		c, ok, err := s.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// 已过期的挑战
+			s.rdb.SRem(ctx, userChallengesKey(userId), id)
+			continue
+		}
+		challenges = append(challenges, c)
+	}
+	return challenges, nil
+}
+
+func newChallengeId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// userExists 对方不在本节点上时确认挑战的玩家存在
+func (ch *ChessHub) userExists(userId int) (bool, error) {
+	_, err := ch.profiles(userId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (ch *ChessHub) challengeContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), challengeStoreTimeout)
+}
+
+// notifyChallenge 把挑战的状态变化推送给双方
+func (ch *ChessHub) notifyChallenge(c Challenge, event string) {
+	msg := challengeMessage{
+		BaseMessage: BaseMessage{Type: messageChallenge},
+		Event:       event,
+		Challenge:   c,
+	}
+	ch.deliver(c.ChallengerId, msg)
+	if !ch.blocks(c.TargetId, c.ChallengerId) {
+		ch.deliver(c.TargetId, msg)
+	}
+}
+
+// visibleChallenges 去掉玩家屏蔽的人发来的挑战，这些挑战在屏蔽之前就已发出
+func (ch *ChessHub) visibleChallenges(userId int, challenges []Challenge) []Challenge {
+	return slices.DeleteFunc(challenges, func(c Challenge) bool {
+		return c.TargetId == userId && ch.blocks(userId, c.ChallengerId)
+	})
+}
+
+// closeChallenge 删除挑战并通知双方，挑战已被处理时返回false
+func (ch *ChessHub) closeChallenge(c Challenge, event string) (bool, error) {
+	ctx, cancel := ch.challengeContext()
+	defer cancel()
+	deleted, err := ch.challenges.Delete(ctx, c)
+	if err != nil || !deleted {
+		return false, err
+	}
+	ch.notifyChallenge(c, event)
+	return true, nil
+}
+
+// createChallenge 保存挑战并推送给对方，对方不在线时等对方连接后再推送
+func (ch *ChessHub) createChallenge(ctx *MessageContext, msg challengeRequest) {
+	client := ctx.Client
+	if msg.TargetId <= 0 || msg.TargetId == client.Id {
+		ctx.Fail(CodeBadRequest, "挑战对象无效")
+		return
+	}
+	settings := room.DefaultRoomSettings()
+	if msg.Settings != nil {
+		settings = *msg.Settings
+	}
+	if err := settings.Examine(); err != nil {
+		ctx.Fail(CodeInvalidSettings, err.Error())
+		return
+	}
+	if ch.blocks(client.Id, msg.TargetId) {
+		ctx.Fail(CodeInvalidState, "您已屏蔽该玩家")
+		return
+	}
+	if ch.blocks(msg.TargetId, client.Id) {
+		// 被对方屏蔽时直接丢弃挑战，不保存也不推送，挑战者照常收到创建成功，不会知道被屏蔽
+		ctx.Reply(challengeMessage{
+			BaseMessage: BaseMessage{Type: messageChallenge},
+			Event:       challengeCreated,
+			Challenge:   ch.newChallenge(client, msg.TargetId, settings),
+		})
+		return
+	}
+	if ch.getClient(msg.TargetId) == nil {
+		exists, err := ch.userExists(msg.TargetId)
+		if err != nil {
+			log.Printf("查询挑战对象失败: %v\n", err)
+			ctx.Fail(CodeUnavailable, "发起挑战失败，请稍后重试")
+			return
+		}
+		if !exists {
+			ctx.Fail(CodeBadRequest, "挑战对象不存在")
+			return
+		}
+	}
+
+	storeCtx, cancel := ch.challengeContext()
+	defer cancel()
+	pending, err := ch.challenges.List(storeCtx, client.Id)
+	if err != nil {
+		log.Printf("读取挑战失败: %v\n", err)
+		ctx.Fail(CodeUnavailable, "发起挑战失败，请稍后重试")
+		return
+	}
+	sent := 0
+	for _, c := range pending {
+		if c.ChallengerId != client.Id {
+			continue
+		}
+		if c.TargetId == msg.TargetId {
+			ctx.Fail(CodeInvalidState, "您已向该玩家发起挑战")
+			return
+		}
+		sent++
+	}
+	if sent >= maxChallenges {
+		ctx.Fail(CodeInvalidState, "发出的挑战过多，请先取消一些挑战")
+		return
+	}
+
+	challenge := ch.newChallenge(client, msg.TargetId, settings)
+	if err := ch.challenges.Save(storeCtx, challenge); err != nil {
+		log.Printf("保存挑战失败: %v\n", err)
+		ctx.Fail(CodeUnavailable, "发起挑战失败，请稍后重试")
+		return
+	}
+	created := challengeMessage{
+		BaseMessage: BaseMessage{Type: messageChallenge},
+		Event:       challengeCreated,
+		Challenge:   challenge,
+	}
+	ctx.Reply(created)
+	ch.deliver(challenge.TargetId, created)
+	ch.scheduler.Schedule(challengeTTL, func() {
+		if _, err := ch.closeChallenge(challenge, challengeExpired); err != nil {
+			log.Printf("删除过期挑战失败: %v\n", err)
+		}
+	})
+}
+
+func (ch *ChessHub) newChallenge(client *Client, targetId int, settings room.RoomSettings) Challenge {
+	now := ch.clock.Now()
+	return Challenge{
+		Id:             newChallengeId(),
+		ChallengerId:   client.Id,
+		ChallengerName: client.Name,
+		TargetId:       targetId,
+		Settings:       settings,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(challengeTTL),
+	}
+}
+
+// findChallenge 读取挑战，挑战不存在或与玩家无关时回复错误
+func (ch *ChessHub) findChallenge(ctx *MessageContext, id string, check func(c Challenge) bool) (Challenge, bool) {
+	storeCtx, cancel := ch.challengeContext()
+	defer cancel()
+	c, ok, err := ch.challenges.Get(storeCtx, id)
+	if err != nil {
+		log.Printf("读取挑战失败: %v\n", err)
+		ctx.Fail(CodeUnavailable, "读取挑战失败，请稍后重试")
+		return Challenge{}, false
+	}
+	if !ok || !check(c) {
+		ctx.Fail(CodeInvalidState, "挑战不存在或已失效")
+		return Challenge{}, false
+	}
+	return c, true
+}
+
+// replyChallenge 接受或拒绝收到的挑战。接受时双方都需要在线且不在房间中，否则挑战保留
+func (ch *ChessHub) replyChallenge(ctx *MessageContext, msg challengeReplyMessage) {
+	client := ctx.Client
+	c, ok := ch.findChallenge(ctx, msg.ChallengeId, func(c Challenge) bool {
+		return c.TargetId == client.Id
+	})
+	if !ok {
+		return
+	}
+	if msg.Accept {
+		if ch.draining.Load() {
+			ctx.Fail(CodeMaintenance, "服务器维护中，请稍后再试")
+			return
+		}
+		if !idle(client) {
+			ctx.Fail(CodeInGame, "您已在房间或对局中")
+			return
+		}
+		challenger := ch.getClient(c.ChallengerId)
+		if challenger == nil || !idle(challenger) {
+			ctx.Fail(CodeInvalidState, "对方不在线或正在对局中，请稍后再试")
+			return
+		}
+	}
+	event := challengeDeclined
+	if msg.Accept {
+		event = challengeAccepted
+	}
+	closed, err := ch.closeChallenge(c, event)
+	if err != nil {
+		log.Printf("删除挑战失败: %v\n", err)
+		ctx.Fail(CodeUnavailable, "处理挑战失败，请稍后重试")
+		return
+	}
+	if !closed {
+		ctx.Fail(CodeInvalidState, "挑战不存在或已失效")
+		return
+	}
+	if msg.Accept {
+		ctx.command(commandChallenge, c)
+	}
+}
+
+// cancelChallenge 取消自己发起的挑战
+func (ch *ChessHub) cancelChallenge(ctx *MessageContext, id string) {
+	c, ok := ch.findChallenge(ctx, id, func(c Challenge) bool {
+		return c.ChallengerId == ctx.Client.Id
+	})
+	if !ok {
+		return
+	}
+	closed, err := ch.closeChallenge(c, challengeCanceled)
+	if err != nil {
+		log.Printf("删除挑战失败: %v\n", err)
+		ctx.Fail(CodeUnavailable, "取消挑战失败，请稍后重试")
+		return
+	}
+	if !closed {
+		ctx.Fail(CodeInvalidState, "挑战不存在或已失效")
+	}
+}
+
+// startChallenge 在大厅协程中为接受挑战的双方创建房间，无需准备直接进入开局倒计时
+func (ch *ChessHub) startChallenge(target *Client, c Challenge) {
+	challenger := ch.getClient(c.ChallengerId)
+	if challenger == nil || !idle(challenger) || !idle(target) {
+		// 接受挑战后有一方离开或进入了其他房间
+		for _, p := range []*Client{challenger, target} {
+			if p == nil {
+				continue
+			}
+			p.sendMessage(NormalMessage{
+				BaseMessage: BaseMessage{Type: messageNormal},
+				Message:     "对方已离开，挑战无法开始",
+			})
+		}
+		return
+	}
+	r, err := ch.newRoom(c.Settings)
+	if err != nil {
+		log.Printf("创建挑战房间失败: %v\n", err)
+		for _, p := range []*Client{challenger, target} {
+			p.sendMessage(NormalMessage{
+				BaseMessage: BaseMessage{Type: messageNormal},
+				Message:     "创建房间失败，请稍后重试",
+			})
+		}
+		return
+	}
+	// 挑战者先进入房间，成为房主
+	for _, p := range []*Client{challenger, target} {
+		r.join(p)
+		r.setReady(p, true)
+	}
+	ch.journalChallenge(r, challenger, target)
+	r.startCountdown()
+	ch.startRoom(r)
+}
+
+// sendPendingChallenges 玩家连接后推送发出和收到的未处理挑战
+func (ch *ChessHub) sendPendingChallenges(client *Client) {
+	ctx, cancel := ch.challengeContext()
+	defer cancel()
+	challenges, err := ch.challenges.List(ctx, client.Id)
+	if err != nil {
+		log.Printf("读取挑战失败: %v\n", err)
+		return
+	}
+	for _, c := range ch.visibleChallenges(client.Id, challenges) {
+		client.sendMessage(challengeMessage{
+			BaseMessage: BaseMessage{Type: messageChallenge},
+			Event:       challengeCreated,
+			Challenge:   c,
+		})
+	}
+}
+
+// HandleChallenges 列出当前用户发出和收到的未处理挑战
+func (ch *ChessHub) HandleChallenges(c *gin.Context) {
+	userId, ok := contextUserId(c)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), challengeStoreTimeout)
+	defer cancel()
+	challenges, err := ch.challenges.List(ctx, userId)
+	if err != nil {
+		log.Printf("读取挑战失败: %v\n", err)
+		dto.ErrorResponse(c, dto.WithMessage("读取挑战失败，请稍后重试"))
+		return
+	}
+	dto.SuccessResponse(c, dto.WithData(ch.visibleChallenges(userId, challenges)))
+}
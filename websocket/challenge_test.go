@@ -0,0 +1,220 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	userModel "chinese-chess-backend/model/user"
+	"chinese-chess-backend/utils"
+)
+
+// newChallengeTestHub 启动单节点的大厅，id不超过20的玩家存在
+func newChallengeTestHub(t *testing.T) (*ChessHub, *utils.FakeClock) {
+	t.Helper()
+	clock := utils.NewFakeClock(time.Now())
+	hub := NewChessHub(WithClock(clock), WithProfileLoader(func(userId int) (userModel.User, error) {
+		if userId > 20 {
+			return userModel.User{}, gorm.ErrRecordNotFound
+		}
+		return userModel.User{ID: uint(userId), Name: fmt.Sprintf("player%d", userId)}, nil
+	}))
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+	return hub, clock
+}
+
+// payload 取出消息的内容。测试客户端收到的推送没有经过编码，只有对请求的回复带有v2信封
+func payload(m map[string]any) map[string]any {
+	if data, ok := m["data"].(map[string]any); ok {
+		return data
+	}
+	return m
+}
+
+// challengeEvent 匹配指定事件的挑战消息，id不为空时只匹配该挑战
+func challengeEvent(event, id string) func(m map[string]any) bool {
+	return func(m map[string]any) bool {
+		data := payload(m)
+		c, _ := data["challenge"].(map[string]any)
+		return data["event"] == event && (id == "" || c["id"] == id)
+	}
+}
+
+// challengeOf 取出挑战消息中的挑战
+func challengeOf(m map[string]any) map[string]any {
+	c, _ := payload(m)["challenge"].(map[string]any)
+	return c
+}
+
+// challenge 以v2协议向targetId发起挑战，返回挑战id
+func (tc *testClient) challenge(t *testing.T, requestId string, targetId int) string {
+	t.Helper()
+	tc.send(t, `{"v":2,"id":%q,"type":%d,"data":{"targetId":%d}}`, requestId, messageChallenge, targetId)
+	m := tc.waitMessage(t, messageChallenge, reply(requestId))
+	id, _ := challengeOf(m)["id"].(string)
+	if id == "" {
+		t.Fatalf("挑战请求%s没有创建成功: %v", requestId, m)
+	}
+	return id
+}
+
+// pendingChallenges 存储中与玩家有关的挑战数
+func pendingChallenges(t *testing.T, hub *ChessHub, userId int) int {
+	t.Helper()
+	challenges, err := hub.challenges.List(context.Background(), userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(challenges)
+}
+
+func TestChallengeAcceptStartsGame(t *testing.T) {
+	hub, clock := newChallengeTestHub(t)
+	alice := newProtocolTestClient(t, hub, 1, protocolV2)
+	bob := newProtocolTestClient(t, hub, 2, protocolV2)
+
+	alice.send(t, `{"v":2,"id":"c","type":%d,"data":{"targetId":%d,"settings":{"color":"black","timeControl":{"initial":60}}}}`,
+		messageChallenge, bob.Id)
+	created := alice.waitMessage(t, messageChallenge, reply("c"))
+	id, _ := challengeOf(created)["id"].(string)
+	pushed := bob.waitMessage(t, messageChallenge, challengeEvent(challengeCreated, id))
+	if c := challengeOf(pushed); c["challengerId"] != float64(alice.Id) || c["challengerName"] != "player1" {
+		t.Fatalf("推送给对方的挑战不正确: %v", c)
+	}
+
+	// 接受后双方无需准备直接开局倒计时，按挑战者的设置执黑
+	bob.send(t, `{"v":2,"id":"accept","type":%d,"data":{"challengeId":%q,"accept":true}}`, messageChallengeReply, id)
+	bob.waitMessage(t, messageAck, reply("accept"))
+	for _, tc := range []*testClient{alice, bob} {
+		tc.waitMessage(t, messageChallenge, challengeEvent(challengeAccepted, id))
+		tc.waitMessage(t, messageCountdown, nil)
+	}
+	if roomId := alice.getRoomId(); roomId == -1 || roomId != bob.getRoomId() {
+		t.Fatal("双方应当进入同一个房间")
+	}
+	advanceClock(t, clock, alice)
+	start := alice.waitMessage(t, messageStart, nil)
+	if payload(start)["role"] != "black" {
+		t.Fatalf("挑战者应当按设置执黑: %v", start)
+	}
+	if n := pendingChallenges(t, hub, alice.Id); n != 0 {
+		t.Fatalf("接受后挑战应当被删除，还剩%d个", n)
+	}
+}
+
+func TestChallengeDeclineAndCancel(t *testing.T) {
+	hub, _ := newChallengeTestHub(t)
+	alice := newProtocolTestClient(t, hub, 1, protocolV2)
+	bob := newProtocolTestClient(t, hub, 2, protocolV2)
+	carol := newProtocolTestClient(t, hub, 3, protocolV2)
+
+	declined := alice.challenge(t, "c1", bob.Id)
+	canceled := alice.challenge(t, "c2", carol.Id)
+	bob.send(t, `{"v":2,"id":"decline","type":%d,"data":{"challengeId":%q}}`, messageChallengeReply, declined)
+	alice.send(t, `{"v":2,"id":"cancel","type":%d,"data":{"challengeId":%q}}`, messageChallengeCancel, canceled)
+
+	// 双方都收到状态变化，挑战从存储中删除
+	for _, tc := range []*testClient{alice, bob} {
+		tc.waitMessage(t, messageChallenge, challengeEvent(challengeDeclined, declined))
+	}
+	for _, tc := range []*testClient{alice, carol} {
+		tc.waitMessage(t, messageChallenge, challengeEvent(challengeCanceled, canceled))
+	}
+	if n := pendingChallenges(t, hub, alice.Id); n != 0 {
+		t.Fatalf("拒绝和取消的挑战应当被删除，还剩%d个", n)
+	}
+	if bob.getRoomId() != -1 || carol.getRoomId() != -1 {
+		t.Fatal("拒绝或取消挑战不应当创建房间")
+	}
+
+	// 已经处理过的挑战不能再次处理
+	bob.send(t, `{"v":2,"id":"again","type":%d,"data":{"challengeId":%q,"accept":true}}`, messageChallengeReply, declined)
+	bob.expectError(t, "again", CodeInvalidState)
+	alice.send(t, `{"v":2,"id":"again","type":%d,"data":{"challengeId":%q}}`, messageChallengeCancel, canceled)
+	alice.expectError(t, "again", CodeInvalidState)
+}
+
+func TestChallengeRejections(t *testing.T) {
+	hub, clock := newChallengeTestHub(t)
+	alice := newProtocolTestClient(t, hub, 1, protocolV2)
+	bob := newProtocolTestClient(t, hub, 2, protocolV2)
+
+	alice.send(t, `{"v":2,"id":"self","type":%d,"data":{"targetId":%d}}`, messageChallenge, alice.Id)
+	alice.expectError(t, "self", CodeBadRequest)
+	alice.send(t, `{"v":2,"id":"unknown","type":%d,"data":{"targetId":99}}`, messageChallenge)
+	alice.expectError(t, "unknown", CodeBadRequest)
+	alice.send(t, `{"v":2,"id":"settings","type":%d,"data":{"targetId":%d,"settings":{"timeControl":{"initial":-1}}}}`,
+		messageChallenge, bob.Id)
+	alice.expectError(t, "settings", CodeInvalidSettings)
+
+	id := alice.challenge(t, "c", bob.Id)
+	alice.send(t, `{"v":2,"id":"dup","type":%d,"data":{"targetId":%d}}`, messageChallenge, bob.Id)
+	alice.expectError(t, "dup", CodeInvalidState)
+
+	// 只有被挑战者能回复，只有挑战者能取消
+	bob.send(t, `{"v":2,"id":"missing","type":%d,"data":{"challengeId":"missing","accept":true}}`, messageChallengeReply)
+	bob.expectError(t, "missing", CodeInvalidState)
+	alice.send(t, `{"v":2,"id":"own","type":%d,"data":{"challengeId":%q,"accept":true}}`, messageChallengeReply, id)
+	alice.expectError(t, "own", CodeInvalidState)
+	bob.send(t, `{"v":2,"id":"cancel","type":%d,"data":{"challengeId":%q}}`, messageChallengeCancel, id)
+	bob.expectError(t, "cancel", CodeInvalidState)
+
+	// 每个玩家同时发出的挑战有上限，请求频率限制按时钟的窗口计算
+	for target := 3; target < 3+maxChallenges-1; target++ {
+		if (target-3)%5 == 0 {
+			clock.Advance(10 * time.Second)
+		}
+		alice.challenge(t, fmt.Sprintf("c%d", target), target)
+	}
+	clock.Advance(10 * time.Second)
+	alice.send(t, `{"v":2,"id":"full","type":%d,"data":{"targetId":20}}`, messageChallenge)
+	alice.expectError(t, "full", CodeInvalidState)
+
+	// 挑战者在房间中时不能接受，挑战保留
+	alice.send(t, `{"v":2,"id":"create","type":%d}`, messageCreate)
+	alice.waitMessage(t, messageAck, reply("create"))
+	bob.send(t, `{"v":2,"id":"busy","type":%d,"data":{"challengeId":%q,"accept":true}}`, messageChallengeReply, id)
+	bob.expectError(t, "busy", CodeInvalidState)
+	if n := pendingChallenges(t, hub, bob.Id); n != 1 {
+		t.Fatalf("接受失败时挑战应当保留，实际%d个", n)
+	}
+
+	// 停机中不能发起或接受挑战
+	hub.draining.Store(true)
+	bob.send(t, `{"v":2,"id":"draining","type":%d,"data":{"targetId":%d}}`, messageChallenge, 3)
+	bob.expectError(t, "draining", CodeMaintenance)
+	bob.send(t, `{"v":2,"id":"drainingAccept","type":%d,"data":{"challengeId":%q,"accept":true}}`, messageChallengeReply, id)
+	bob.expectError(t, "drainingAccept", CodeMaintenance)
+}
+
+func TestOfflineChallengeDeliveredAndExpires(t *testing.T) {
+	hub, clock := newChallengeTestHub(t)
+	alice := newProtocolTestClient(t, hub, 1, protocolV2)
+
+	// 对方不在线时挑战保存下来，对方连接后推送
+	id := alice.challenge(t, "c", 2)
+	if n := pendingChallenges(t, hub, 2); n != 1 {
+		t.Fatalf("对方不在线时挑战应当保存，实际%d个", n)
+	}
+	bob := newProtocolTestClient(t, hub, 2, protocolV2)
+	bob.waitMessage(t, messageChallenge, challengeEvent(challengeCreated, id))
+
+	// 过期后从存储中删除并通知双方
+	clock.Advance(challengeTTL)
+	for _, tc := range []*testClient{alice, bob} {
+		tc.waitMessage(t, messageChallenge, challengeEvent(challengeExpired, id))
+	}
+	if n := pendingChallenges(t, hub, 2); n != 0 {
+		t.Fatalf("过期的挑战应当被删除，还剩%d个", n)
+	}
+	bob.send(t, `{"v":2,"id":"late","type":%d,"data":{"challengeId":%q,"accept":true}}`, messageChallengeReply, id)
+	bob.expectError(t, "late", CodeInvalidState)
+}
@@ -2,7 +2,13 @@ package websocket
 
 import (
 	"fmt"
+	"math/rand/v2"
 	"sync"
+	"time"
+
+	"chinese-chess-backend/dto/room"
+	"chinese-chess-backend/utils"
+	"chinese-chess-backend/xiangqi"
 )
 
 var (
@@ -10,30 +16,186 @@ var (
 	idLock sync.Mutex
 )
 
+const (
+	startCountdown = 3 * time.Second // 开局倒计时
+	roomInboxSize  = 64              // 房间收件箱的长度
+)
+
+type roomState int
+
+const (
+	roomWaiting   roomState = iota + 1 // 等待玩家准备
+	roomCountdown                      // 开局倒计时
+	roomPlaying                        // 对局中
+	roomFinished                       // 对局结束，等待再来一局
+)
+
 type ChessRoom struct {
-	Id      int
-	Nums    int     // 已有人数
-	Current *Client // 先进入房间的作为先手，默认为当前玩家
-	Next    *Client // 后进入房间的作为后手，默认为下一个玩家
-	History []Position
+	Id         int
+	Nums       int     // 已有人数
+	Current    *Client // 先进入房间的作为先手，默认为当前玩家
+	Next       *Client // 后进入房间的作为后手，默认为下一个玩家
+	History    []MoveMessage
+	game       *xiangqi.Game // 与History对应的局面，每走一步更新，为nil时不校验走子
+	Settings   room.RoomSettings
+	Spectators map[int]*Client // 观战者
+	State      roomState
+	Host       *Client     // 房主，可以踢出其他玩家
+	Score      map[int]int // 本房间内各玩家的胜局数
+	Draws      int         // 本房间内的和局数
+
+	ready          map[int]bool // 玩家是否已准备
+	rematch        map[int]bool // 玩家是否已请求再来一局
+	lastActive     time.Time    // 最近一次操作的时间，用于解散闲置房间
+	lastRedId      int          // 上一局红方玩家，再来一局时交换先后手
+	countdownTimer *utils.Timer
+	countdownSeq   int                          // 倒计时序号，用于忽略已取消的倒计时
+	ply            int                          // 房间的序号，每次走子、悔棋和开局时加一，不会回退
+	moveIds        map[string]bool              // 本局已处理的走子id，用于忽略重发的走子
+	takebackFrom   *Client                      // 发起悔棋请求的玩家
+	drawOffer      *Client                      // 提和的玩家，对方走子后失效
+	clocks         map[clientRole]time.Duration // 双方剩余时间
+	turnStart      time.Time                    // 当前玩家开始思考的时间
+	clockTimer     *utils.Timer
+	resumeTimer    *utils.Timer // 从快照恢复的对局在双方重连或等待超时前暂停计时
+	savedState     string       // 上次保存的快照内容，状态没有变化时不重复保存
+	journalSeq     int          // 下一条房间日志的序号
+	seed           uint64       // 随机数种子，记入日志以便回放时得到相同的执子
+	rng            *rand.Rand
+
+	hub   *ChessHub
+	inbox chan hubCommand // 房间协程按顺序处理收件箱中的命令
+	done  chan struct{}   // 房间解散后关闭
+}
+
+// reserveRoomId 保证之后分配的房间id大于从快照恢复的房间id
+func reserveRoomId(id int) {
+	idLock.Lock()
+	defer idLock.Unlock()
+	nextId = max(nextId, id)
 }
 
-func NewChessRoom() *ChessRoom {
+func NewChessRoom(settings room.RoomSettings) *ChessRoom {
 	idLock.Lock()
 	defer idLock.Unlock()
 	nextId++
-	return &ChessRoom{
-		Id:      nextId,
-		Nums:    0,
-		Current: nil,
-		Next:    nil,
-		History: make([]Position, 0),
+	r := &ChessRoom{
+		Id:         nextId,
+		Nums:       0,
+		Current:    nil,
+		Next:       nil,
+		History:    make([]MoveMessage, 0),
+		Settings:   settings,
+		Spectators: make(map[int]*Client),
+		State:      roomWaiting,
+		Score:      make(map[int]int),
+		ready:      make(map[int]bool),
+		moveIds:    make(map[string]bool),
+		rematch:    make(map[int]bool),
+		clocks:     make(map[clientRole]time.Duration),
+		inbox:      make(chan hubCommand, roomInboxSize),
+		done:       make(chan struct{}),
 	}
+	r.setSeed(rand.Uint64())
+	return r
 }
 
-// func (cr * ChessRoom) isEmpty() bool {
-// 	return cr.Nums == 0
-// }
+func (cr *ChessRoom) setSeed(seed uint64) {
+	cr.seed = seed
+	cr.rng = rand.New(rand.NewPCG(seed, seed))
+}
+
+// now 使用大厅调度器的时间，测试中可以用假时钟驱动棋钟和倒计时
+func (cr *ChessRoom) now() time.Time {
+	return cr.hub.scheduler.Now()
+}
+
+// schedule 在d之后执行fn，同一房间的定时回调串行执行
+func (cr *ChessRoom) schedule(d time.Duration, fn func()) *utils.Timer {
+	return cr.hub.scheduler.Schedule(d, fn, utils.WithKey(fmt.Sprintf("room:%d", cr.Id)))
+}
+
+func (cr *ChessRoom) touch() {
+	cr.lastActive = cr.now()
+}
+
+// isIdle 对局以外的房间超过ttl没有任何操作即视为闲置，
+// 从快照恢复的对局在玩家重连前同样会过期
+func (cr *ChessRoom) isIdle(ttl time.Duration) bool {
+	if cr.State == roomPlaying && !cr.awaitingResume() {
+		return false
+	}
+	return cr.now().Sub(cr.lastActive) > ttl
+}
+
+// awaitingResume 房间内是否还有玩家没有重连
+func (cr *ChessRoom) awaitingResume() bool {
+	for _, c := range cr.players() {
+		if c.detached {
+			return true
+		}
+	}
+	return false
+}
+
+// resume 用重连的客户端替换占位客户端，返回被替换的占位客户端
+func (cr *ChessRoom) resume(c *Client) *Client {
+	var old *Client
+	switch {
+	case cr.Current != nil && cr.Current.Id == c.Id && cr.Current.detached:
+		old, cr.Current = cr.Current, c
+	case cr.Next != nil && cr.Next.Id == c.Id && cr.Next.detached:
+		old, cr.Next = cr.Next, c
+	default:
+		return nil
+	}
+	if cr.Host == old {
+		cr.Host = c
+	}
+	c.Role = old.Role
+	status := userOnline
+	if cr.State == roomPlaying {
+		status = userPlaying
+	}
+	c.setState(status, cr.Id)
+	return old
+}
+
+func (cr *ChessRoom) resyncMessage(c *Client) resyncMessage {
+	spectate := cr.spectateMessage()
+	msg := resyncMessage{
+		BaseMessage: BaseMessage{Type: messageResync},
+		RoomId:      cr.Id,
+		Role:        c.Role,
+		Playing:     cr.State == roomPlaying,
+		Red:         spectate.Red,
+		Black:       spectate.Black,
+		History:     cr.History,
+		Settings:    cr.Settings,
+		Scores:      cr.scoreMessage().Scores,
+		Draws:       cr.Draws,
+		Ply:         cr.ply,
+	}
+	if msg.Playing && !cr.Settings.TimeControl.Unlimited() {
+		clock := cr.clockMessage()
+		msg.Clock = &clock
+	}
+	return msg
+}
+
+// resetMatch 对手变化后清空比分和先后手记录，房间回到等待状态
+func (cr *ChessRoom) resetMatch() {
+	cr.cancelCountdown()
+	cr.State = roomWaiting
+	clear(cr.Score)
+	clear(cr.rematch)
+	cr.Draws = 0
+	cr.lastRedId = 0
+}
+
+func (cr *ChessRoom) isEmpty() bool {
+	return cr.Nums == 0
+}
 
 func (cr *ChessRoom) isFull() bool {
 	return cr.Nums >= 2
@@ -46,17 +208,125 @@ func (cr *ChessRoom) exchange() {
 	cr.Current, cr.Next = cr.Next, cr.Current
 }
 
+// assignColors 决定红黑方并让红方先手。第一局根据房主的执子偏好，
+// 之后的每一局与上一局交换先后手
+func (cr *ChessRoom) assignColors() {
+	if cr.lastRedId != 0 {
+		if cr.Current.Id == cr.lastRedId {
+			cr.exchange()
+		}
+		return
+	}
+	hostRed := true
+	switch cr.Settings.Color {
+	case room.ColorBlack:
+		hostRed = false
+	case room.ColorRandom:
+		hostRed = cr.rng.IntN(2) == 0
+	}
+	if (cr.Current == cr.Host) != hostRed {
+		cr.exchange()
+	}
+}
+
+// finish 结束当前对局并记录比分，玩家留在房间内等待再来一局
+func (cr *ChessRoom) finish(winner clientRole) {
+	cr.stopClock()
+	cr.State = roomFinished
+	cr.takebackFrom = nil
+	cr.drawOffer = nil
+	clear(cr.ready)
+	clear(cr.rematch)
+	if winner == roleNone {
+		cr.Draws++
+	}
+	for _, c := range cr.players() {
+		if c.Role == roleRed {
+			cr.lastRedId = c.Id
+		}
+		if c.Role == winner {
+			cr.Score[c.Id]++
+		}
+		c.Role = roleNone
+		c.setStatus(userOnline)
+	}
+}
+
+func (cr *ChessRoom) scoreMessage() scoreMessage {
+	scores := make(map[int]int)
+	for _, c := range cr.players() {
+		scores[c.Id] = cr.Score[c.Id]
+	}
+	return scoreMessage{
+		BaseMessage: BaseMessage{Type: messageScore},
+		Scores:      scores,
+		Draws:       cr.Draws,
+		Ply:         cr.ply,
+	}
+}
+
+func (cr *ChessRoom) setRematch(c *Client) {
+	cr.rematch[c.Id] = true
+}
+
+func (cr *ChessRoom) allRematch() bool {
+	if !cr.isFull() {
+		return false
+	}
+	for _, c := range cr.players() {
+		if !cr.rematch[c.Id] {
+			return false
+		}
+	}
+	return true
+}
+
+func (cr *ChessRoom) opponent(c *Client) *Client {
+	if cr.Current == c {
+		return cr.Next
+	}
+	if cr.Next == c {
+		return cr.Current
+	}
+	return nil
+}
+
+// broadcast 发送消息给双方玩家和所有观战者
+func (cr *ChessRoom) broadcast(message any) {
+	for _, c := range cr.members() {
+		c.sendMessage(message)
+	}
+}
+
+// members 返回房间中的玩家和观众
+func (cr *ChessRoom) members() []*Client {
+	members := make([]*Client, 0, 2+len(cr.Spectators))
+	for _, c := range []*Client{cr.Current, cr.Next} {
+		if c != nil {
+			members = append(members, c)
+		}
+	}
+	for _, c := range cr.Spectators {
+		members = append(members, c)
+	}
+	return members
+}
+
 func (cr *ChessRoom) clear() {
+	cr.stopClock()
+	cr.cancelCountdown()
 	if cr.Current != nil {
-		cr.Current.RoomId = -1
-		cr.Current.Status = userOnline
+		cr.Current.resetState()
 		cr.Current = nil
 	}
 	if cr.Next != nil {
-		cr.Next.RoomId = -1
-		cr.Next.Status = userOnline
+		cr.Next.resetState()
 		cr.Next = nil
 	}
+	for id, c := range cr.Spectators {
+		c.resetState()
+		delete(cr.Spectators, id)
+	}
 	cr.Nums = 0
 }
 
@@ -64,31 +334,223 @@ func (cr *ChessRoom) join(c *Client) error {
 	if cr.isFull() {
 		return fmt.Errorf("房间满了")
 	}
-	c.RoomId = cr.Id
+	if cr.State != roomWaiting {
+		return fmt.Errorf("游戏已开始")
+	}
+	c.setState(userOnline, cr.Id)
 	if cr.Current == nil {
 		cr.Current = c
-	} else  {
+	} else {
 		cr.Next = c
 	}
+	if cr.Host == nil {
+		cr.Host = c
+	}
 
 	cr.Nums++
 
 	return nil
 }
 
-// func (cr *ChessRoom) leave(c *Client) error {
-// 	if cr.isEmpty() {
-// 		return fmt.Errorf("不在该房间")
-// 	}
-// 	if c == cr.Current {
-// 		cr.Current = nil
-// 		cr.Nums--
-// 		return nil
-// 	}
-// 	if c == cr.Next {
-// 		cr.Next = nil
-// 		cr.Nums--
-// 		return nil
-// 	}
-// 	return fmt.Errorf("不在该房间")
-// }
+func (cr *ChessRoom) leave(c *Client) error {
+	if cr.isEmpty() {
+		return fmt.Errorf("不在该房间")
+	}
+	if c == cr.Current {
+		cr.Current = nil
+	} else if c == cr.Next {
+		cr.Next = nil
+	} else {
+		return fmt.Errorf("不在该房间")
+	}
+	cr.Nums--
+	delete(cr.ready, c.Id)
+	c.resetState()
+	if cr.Host == c {
+		cr.Host = nil
+		if players := cr.players(); len(players) > 0 {
+			cr.Host = players[0]
+		}
+	}
+	return nil
+}
+
+func (cr *ChessRoom) players() []*Client {
+	players := make([]*Client, 0, 2)
+	for _, c := range []*Client{cr.Current, cr.Next} {
+		if c != nil {
+			players = append(players, c)
+		}
+	}
+	return players
+}
+
+// guest 返回房主以外的玩家
+func (cr *ChessRoom) guest() *Client {
+	for _, c := range cr.players() {
+		if c != cr.Host {
+			return c
+		}
+	}
+	return nil
+}
+
+func (cr *ChessRoom) setReady(c *Client, ready bool) {
+	cr.ready[c.Id] = ready
+}
+
+func (cr *ChessRoom) allReady() bool {
+	if !cr.isFull() {
+		return false
+	}
+	for _, c := range cr.players() {
+		if !cr.ready[c.Id] {
+			return false
+		}
+	}
+	return true
+}
+
+// beginCountdown 进入开局倒计时，倒计时结束后以本次倒计时序号调用onDone
+func (cr *ChessRoom) beginCountdown(onDone func(seq int)) {
+	cr.cancelCountdown()
+	cr.State = roomCountdown
+	cr.countdownSeq++
+	seq := cr.countdownSeq
+	cr.countdownTimer = cr.schedule(startCountdown, func() {
+		onDone(seq)
+	})
+}
+
+func (cr *ChessRoom) cancelCountdown() {
+	if cr.countdownTimer != nil {
+		cr.countdownTimer.Stop()
+		cr.countdownTimer = nil
+	}
+	if cr.State == roomCountdown {
+		cr.State = roomWaiting
+	}
+}
+
+func (cr *ChessRoom) unspectate(c *Client) {
+	delete(cr.Spectators, c.Id)
+	c.resetState()
+}
+
+func (cr *ChessRoom) spectate(c *Client) error {
+	if !cr.Settings.AllowSpectators {
+		return fmt.Errorf("该房间不允许观战")
+	}
+	c.setState(userSpectating, cr.Id)
+	cr.Spectators[c.Id] = c
+	return nil
+}
+
+func (cr *ChessRoom) spectateMessage() spectateMessage {
+	msg := spectateMessage{
+		BaseMessage: BaseMessage{Type: messageSpectate},
+		RoomId:      cr.Id,
+		History:     cr.History,
+		Settings:    cr.Settings,
+		Ply:         cr.ply,
+	}
+	for _, c := range []*Client{cr.Current, cr.Next} {
+		if c == nil {
+			continue
+		}
+		switch c.Role {
+		case roleRed:
+			msg.Red = c.Id
+		case roleBlack:
+			msg.Black = c.Id
+		}
+	}
+	return msg
+}
+
+// initClock 按时间控制初始化双方棋钟
+func (cr *ChessRoom) initClock() {
+	initial := time.Duration(cr.Settings.TimeControl.Initial) * time.Second
+	cr.clocks[roleRed] = initial
+	cr.clocks[roleBlack] = initial
+}
+
+// startClock 开始为当前玩家计时，当前玩家用完时间后调用onTimeout
+func (cr *ChessRoom) startClock(onTimeout func(*Client)) {
+	if cr.Settings.TimeControl.Unlimited() || cr.Current == nil {
+		return
+	}
+	cr.stopClock()
+	current := cr.Current
+	cr.turnStart = cr.now()
+	cr.clockTimer = cr.schedule(cr.clocks[current.Role], func() {
+		onTimeout(current)
+	})
+}
+
+func (cr *ChessRoom) stopClock() {
+	if cr.clockTimer != nil {
+		cr.clockTimer.Stop()
+		cr.clockTimer = nil
+	}
+}
+
+// spendClock 扣除当前玩家本回合的用时，返回是否超时
+func (cr *ChessRoom) spendClock() bool {
+	if cr.Settings.TimeControl.Unlimited() || cr.Current == nil {
+		return false
+	}
+	if cr.clockTimer == nil {
+		// 棋钟暂停中，例如等待从快照恢复的玩家重连
+		return false
+	}
+	cr.stopClock()
+	role := cr.Current.Role
+	cr.clocks[role] -= cr.now().Sub(cr.turnStart)
+	if cr.clocks[role] <= 0 {
+		cr.clocks[role] = 0
+		return true
+	}
+	return false
+}
+
+// addIncrement 给当前玩家加秒
+func (cr *ChessRoom) addIncrement() {
+	if cr.Settings.TimeControl.Unlimited() || cr.Current == nil {
+		return
+	}
+	cr.clocks[cr.Current.Role] += time.Duration(cr.Settings.TimeControl.Increment) * time.Second
+}
+
+// remaining 返回某一方的实时剩余时间
+func (cr *ChessRoom) remaining(role clientRole) time.Duration {
+	r := cr.clocks[role]
+	if cr.clockTimer != nil && cr.Current != nil && cr.Current.Role == role {
+		r -= cr.now().Sub(cr.turnStart)
+	}
+	return r
+}
+
+func (cr *ChessRoom) clockMessage() clockMessage {
+	msg := clockMessage{
+		BaseMessage: BaseMessage{Type: messageClock},
+		Red:         cr.remaining(roleRed).Milliseconds(),
+		Black:       cr.remaining(roleBlack).Milliseconds(),
+		Ply:         cr.ply,
+	}
+	if cr.Current != nil {
+		msg.Turn = cr.Current.Role
+	}
+	return msg
+}
+
+// replayGame 按走子记录重建局面，记录中有不合法的走子时（如旧版本保存的快照）返回nil
+func replayGame(history []MoveMessage) *xiangqi.Game {
+	game := xiangqi.NewGame()
+	for _, move := range history {
+		if err := game.Play(xiangqi.Position(move.From), xiangqi.Position(move.To)); err != nil {
+			return nil
+		}
+	}
+	return game
+}
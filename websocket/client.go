@@ -2,9 +2,16 @@ package websocket
 
 import (
 	"fmt"
+	"log"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"chinese-chess-backend/database"
+	"chinese-chess-backend/dto/user"
+	userModel "chinese-chess-backend/model/user"
 )
 
 type clientStatus int
@@ -13,6 +20,12 @@ const (
 	userOnline clientStatus = iota + 1
 	userPlaying
 	userMatching
+	userSpectating
+)
+
+const (
+	sendQueueSize = 64               // 每个客户端发送队列的长度
+	writeWait     = 10 * time.Second // 单条消息的写超时
 )
 
 type clientRole int
@@ -20,42 +33,285 @@ type clientRole int
 const (
 	// 0表示没有角色，1表示红方，2表示黑方
 	roleNone clientRole = iota
-	roleRed 
+	roleRed
 	roleBlack
 )
 
 type Client struct {
 	Conn     *websocket.Conn
 	Id       int
-	Status   clientStatus
-	RoomId   int
-	Role     clientRole // 角色
-	LastPong time.Time // 上次收到PONG的时间
+	Role     clientRole // 角色，只由所在房间的协程读写
+	LastPong time.Time  // 上次收到PONG的时间
+	Name     string     // 用户名，连接时从数据库加载
+	Bot      bool       // 机器人账号
+
+	mu         sync.Mutex // 保护status、roomId、exp、lastSeen、onState和blockedIds，读协程、大厅和房间协程都会访问
+	status     clientStatus
+	exp        int // 经验，排位对局结束时由房间协程更新
+	roomId     int
+	lastSeen   time.Time       // 长轮询客户端最近一次请求的时间
+	onState    func(c *Client) // 状态变化后调用，由大厅在注册时设置，用于发布在线状态
+	blockedIds []int           // 加入匹配队列时读取的屏蔽列表，按id排序
+
+	send      chan any      // 发送队列，只有writePump会写连接
+	done      chan struct{} // 关闭后writePump退出并断开连接
+	closeOnce sync.Once
+
+	remote    *remoteLink       // 非空表示连接在其他节点上，消息和状态经由集群转发
+	detached  bool              // 从快照恢复的占位客户端，玩家重连后被替换
+	sink      func(message any) // 非空时消息交给sink而不是写连接，用于回放日志
+	protocol  int               // 连接时协商的协议版本，决定写连接时的消息格式
+	binary    bool              // 使用protobuf二进制帧，协议版本总是v2
+	transport transport         // 连接方式，事件流和长轮询客户端没有websocket连接
 }
 
 func NewClient(conn *websocket.Conn, id int) *Client {
 	return &Client{
 		Conn:     conn,
 		Id:       id,
-		Status:   userOnline,
-		RoomId:   -1,
+		status:   userOnline,
+		roomId:   -1,
 		Role:     roleNone,
+		protocol: protocolLegacy,
 		LastPong: time.Now(),
+		send:     make(chan any, sendQueueSize),
+		done:     make(chan struct{}),
 	}
 }
 
+// sendMessage 将消息放入发送队列，不会阻塞调用方。
+// 队列已满说明客户端消费过慢，直接丢弃消息并断开连接
 func (c *Client) sendMessage(message any) error {
-	if c.Conn == nil {
+	if c.sink != nil {
+		c.sink(message)
+		return nil
+	}
+	if c.remote != nil {
+		return c.remote.deliver(c.Id, message)
+	}
+	if c.Conn == nil && c.transport == transportWebsocket {
 		return fmt.Errorf("client connection is nil")
 	}
-	err := c.Conn.WriteJSON(message)
+	select {
+	case <-c.done:
+		return fmt.Errorf("client connection is closed")
+	default:
+	}
+	select {
+	case c.send <- message:
+		return nil
+	default:
+		c.close()
+		return fmt.Errorf("客户端 %d 发送队列已满，断开连接", c.Id)
+	}
+}
+
+// writePump 是唯一写连接的goroutine，负责发送队列中的消息和定时ping
+func (c *Client) writePump() {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
+
+	for {
+		select {
+		case message := <-c.send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.writeMessage(message); err != nil {
+				log.Printf("发送消息失败: %v\n", err)
+				return
+			}
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Printf("发送 ping 失败: %v\n", err)
+				return
+			}
+		case <-c.done:
+			c.flush()
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+	}
+}
+
+// flush 断开前发出队列中剩余的消息，例如停机通知
+func (c *Client) flush() {
+	for {
+		select {
+		case message := <-c.send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.writeMessage(message); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// close 通知writePump断开连接，可以重复调用
+func (c *Client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *Client) getStatus() clientStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+func (c *Client) getRoomId() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.roomId
+}
+
+func (c *Client) setStatus(status clientStatus) {
+	c.mu.Lock()
+	changed := c.status != status
+	c.status = status
+	roomId := c.roomId
+	onState := c.onState
+	c.mu.Unlock()
+	c.syncState(status, roomId)
+	if changed && onState != nil {
+		onState(c)
+	}
+}
+
+func (c *Client) setState(status clientStatus, roomId int) {
+	c.mu.Lock()
+	changed := c.status != status || c.roomId != roomId
+	c.status = status
+	c.roomId = roomId
+	onState := c.onState
+	c.mu.Unlock()
+	c.syncState(status, roomId)
+	if changed && onState != nil {
+		onState(c)
+	}
+}
+
+func (c *Client) watchState(onState func(c *Client)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onState = onState
+}
+
+// presence 由status和roomId得出好友看到的在线状态
+func (c *Client) presence() user.Presence {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := user.Presence{State: user.PresenceOnline}
+	switch c.status {
+	case userMatching:
+		p.State = user.PresenceMatching
+	case userPlaying:
+		p.State = user.PresencePlaying
+	case userSpectating:
+		p.State = user.PresenceSpectating
+	}
+	if c.roomId != -1 {
+		p.RoomId = c.roomId
+	}
+	return p
+}
+
+// syncState 把房间协程对代理客户端状态的修改同步到玩家连接所在的节点
+func (c *Client) syncState(status clientStatus, roomId int) {
+	if c.remote != nil {
+		c.remote.syncState(c, status, roomId)
+	}
+}
+
+// resetState 离开房间后回到在线状态
+func (c *Client) resetState() {
+	c.setState(userOnline, -1)
+}
+
+func (c *Client) startPlay(role clientRole) {
+	c.Role = role
+	c.setStatus(userPlaying)
+}
+
+// ProfileLoader 按用户id读取用户名、经验和是否为机器人
+type ProfileLoader func(userId int) (userModel.User, error)
+
+// WithProfileLoader 指定连接时读取用户信息的方式，默认读取MySQL
+func WithProfileLoader(load ProfileLoader) HubOption {
+	return func(ch *ChessHub) {
+		ch.profiles = load
+	}
+}
+
+func loadMysqlProfile(userId int) (userModel.User, error) {
+	var u userModel.User
+	err := database.GetMysqlDb().
+		Select("id, name, exp, bot").
+		Where("id = ?", userId).
+		First(&u).Error
+	return u, err
+}
+
+// loadProfile 连接时加载一次用户名和经验，房间列表直接使用内存中的信息
+func (ch *ChessHub) loadProfile(c *Client) error {
+	u, err := ch.profiles(c.Id)
 	if err != nil {
 		return err
 	}
+	c.Name = u.Name
+	c.setExp(u.Exp)
+	c.Bot = u.Bot
 	return nil
 }
 
-func (c *Client) startPlay(role clientRole) {
-	c.Role = role
-	c.Status = userPlaying
+func (c *Client) getExp() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.exp
+}
+
+func (c *Client) setExp(exp int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.exp = exp
+}
+
+// addExp 增减经验，经验不会低于0
+func (c *Client) addExp(delta int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.exp = max(c.exp+delta, 0)
+}
+
+func (c *Client) setBlockedIds(ids []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blockedIds = ids
+}
+
+func (c *Client) getBlockedIds() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.blockedIds
+}
+
+// blocksUser 返回玩家是否屏蔽了userId，只检查加入匹配队列时读取的列表
+func (c *Client) blocksUser(userId int) bool {
+	_, found := slices.BinarySearch(c.getBlockedIds(), userId)
+	return found
+}
+
+func (c *Client) userInfo() user.UserInfo {
+	return user.UserInfo{
+		ID:   uint(c.Id),
+		Name: c.Name,
+		Exp:  c.getExp(),
+		Bot:  c.Bot,
+	}
 }
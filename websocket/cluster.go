@@ -0,0 +1,549 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+
+	"chinese-chess-backend/dto/room"
+	"chinese-chess-backend/utils"
+)
+
+// 集群模式下每个房间归属于创建它的节点，房间协程只在该节点上运行。
+// 连接在其他节点上的玩家在房间归属节点上用代理客户端表示：
+// 玩家的命令经由Broker发往房间归属节点，房间发给代理的消息和状态变化再发回玩家所在的节点
+
+const (
+	clusterNodeChannel  = "chess:node:" // 每个节点订阅自己的频道
+	clusterLobbyChannel = "chess:lobby" // 所有节点订阅的大厅频道
+
+	maxBlockedPairs = 3 // 一次匹配中取到有屏蔽关系的两名玩家的最多次数，超过后等待下一名玩家加入
+)
+
+type envelopeKind int
+
+const (
+	envelopeCommand envelopeKind = iota + 1 // 玩家命令，发往房间归属节点
+	envelopeDeliver                         // 发给玩家的消息，发往玩家所在节点
+	envelopeState                           // 玩家状态变化，发往玩家所在节点
+	envelopeLobby                           // 大厅房间变化，广播给所有节点
+	envelopeBlocks                          // 玩家的屏蔽列表变化，广播给所有节点
+)
+
+// clusterEnvelope 节点之间传递的消息
+type clusterEnvelope struct {
+	Kind    envelopeKind    `json:"kind"`
+	From    string          `json:"from"`
+	UserId  int             `json:"userId,omitempty"`
+	Name    string          `json:"name,omitempty"`
+	Exp     int             `json:"exp,omitempty"`
+	Bot     bool            `json:"bot,omitempty"`
+	RoomId  int             `json:"roomId,omitempty"`
+	Command CommendType     `json:"command,omitempty"`
+	Status  clientStatus    `json:"status,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// 转发的请求由房间归属节点确认或拒绝，回复经由envelopeDeliver发回
+	RequestId string `json:"requestId,omitempty"`
+	Protocol  int    `json:"protocol,omitempty"`
+}
+
+// matchEntry 共享匹配队列中的一名玩家及其连接所在的节点，
+// 带上加入队列时的屏蔽列表，取出玩家的节点不需要查询数据库
+type matchEntry struct {
+	UserId int    `json:"userId"`
+	Node   string `json:"node"`
+	Name   string `json:"name"`
+	Exp    int    `json:"exp"`
+	Bot    bool   `json:"bot,omitempty"`
+	Blocks []int  `json:"blocks,omitempty"`
+}
+
+func newMatchEntry(c *Client, node string) matchEntry {
+	return matchEntry{
+		UserId: c.Id,
+		Node:   node,
+		Name:   c.Name,
+		Exp:    c.getExp(),
+		Bot:    c.Bot,
+		Blocks: c.getBlockedIds(),
+	}
+}
+
+func (e matchEntry) String() string {
+	data, _ := json.Marshal(e)
+	return string(data)
+}
+
+type HubOption func(*ChessHub)
+
+// WithCluster 开启集群模式，nodeId在集群内必须唯一
+func WithCluster(broker Broker, nodeId string) HubOption {
+	return func(ch *ChessHub) {
+		ch.cluster = &cluster{
+			hub:     ch,
+			broker:  broker,
+			nodeId:  nodeId,
+			proxies: make(map[int]*Client),
+		}
+	}
+}
+
+type cluster struct {
+	hub    *ChessHub
+	broker Broker
+	nodeId string
+
+	mu      sync.Mutex
+	proxies map[int]*Client // 本节点房间中其他节点玩家的代理客户端
+	cancel  context.CancelFunc
+}
+
+// remoteLink 代理客户端与玩家所在节点的关联
+type remoteLink struct {
+	cluster *cluster
+	mu      sync.Mutex
+	node    string
+}
+
+func (l *remoteLink) getNode() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.node
+}
+
+func (l *remoteLink) setNode(node string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.node = node
+}
+
+func (l *remoteLink) deliver(userId int, message any) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	l.cluster.send(l.getNode(), clusterEnvelope{
+		Kind:    envelopeDeliver,
+		UserId:  userId,
+		Payload: payload,
+	})
+	return nil
+}
+
+func (l *remoteLink) syncState(c *Client, status clientStatus, roomId int) {
+	l.cluster.send(l.getNode(), clusterEnvelope{
+		Kind:   envelopeState,
+		UserId: c.Id,
+		Exp:    c.getExp(),
+		RoomId: roomId,
+		Status: status,
+	})
+	if roomId == -1 {
+		// 玩家已离开本节点的房间，不再需要代理
+		l.cluster.dropProxy(c)
+	}
+}
+
+func (cl *cluster) channel(node string) string {
+	return clusterNodeChannel + node
+}
+
+// send 发送消息给指定节点，发往同一节点的消息按调用顺序发布
+func (cl *cluster) send(node string, env clusterEnvelope) {
+	env.From = cl.nodeId
+	data, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("序列化集群消息失败: %v\n", err)
+		return
+	}
+	cl.publish(cl.channel(node), data)
+}
+
+func (cl *cluster) publish(channel string, data []byte) {
+	_, err := cl.hub.pool.Submit(context.Background(), func() error {
+		return cl.broker.Publish(context.Background(), channel, data)
+	}, utils.WithKey(channel))
+	if err != nil {
+		log.Printf("发布集群消息失败: %v\n", err)
+	}
+}
+
+// run 接收发往本节点和大厅频道的消息
+func (cl *cluster) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	messages, err := cl.broker.Subscribe(ctx, cl.channel(cl.nodeId), clusterLobbyChannel)
+	if err != nil {
+		cancel()
+		return err
+	}
+	cl.mu.Lock()
+	cl.cancel = cancel
+	cl.mu.Unlock()
+	go func() {
+		for data := range messages {
+			var env clusterEnvelope
+			if err := json.Unmarshal(data, &env); err != nil {
+				log.Printf("解析集群消息失败: %v\n", err)
+				continue
+			}
+			cl.handle(env)
+		}
+	}()
+	return nil
+}
+
+// stop 停止接收集群消息
+func (cl *cluster) stop() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.cancel != nil {
+		cl.cancel()
+	}
+}
+
+func (cl *cluster) handle(env clusterEnvelope) {
+	switch env.Kind {
+	case envelopeCommand:
+		cl.handleCommand(env)
+	case envelopeDeliver:
+		if client := cl.hub.getClient(env.UserId); client != nil {
+			client.sendMessage(env.Payload)
+		}
+	case envelopeState:
+		client := cl.hub.getClient(env.UserId)
+		if client == nil {
+			// 玩家已从本节点断开，让房间归属节点清理代理
+			if env.RoomId != -1 {
+				cl.send(env.From, clusterEnvelope{
+					Kind:    envelopeCommand,
+					UserId:  env.UserId,
+					RoomId:  env.RoomId,
+					Command: commandUnregister,
+				})
+			}
+			return
+		}
+		// 对局在其他节点结算后，玩家所在节点的经验随状态一起更新
+		client.setExp(env.Exp)
+		client.setState(env.Status, env.RoomId)
+	case envelopeLobby:
+		var msg lobbyEventMessage
+		if err := json.Unmarshal(env.Payload, &msg); err != nil {
+			log.Printf("解析大厅消息失败: %v\n", err)
+			return
+		}
+		cl.hub.publishLobby(msg)
+	case envelopeBlocks:
+		if cl.hub.blockList != nil {
+			cl.hub.blockList.Invalidate(env.UserId)
+		}
+	}
+}
+
+// handleCommand 在房间归属节点上以代理客户端的身份执行其他节点玩家的命令
+func (cl *cluster) handleCommand(env clusterEnvelope) {
+	if env.Command == commandUnregister {
+		proxy := cl.getProxy(env.UserId)
+		if proxy == nil {
+			return
+		}
+		if r := cl.hub.getRoom(env.RoomId); r != nil {
+			r.post(hubCommand{commandType: commandUnregister, client: proxy})
+		}
+		cl.dropProxy(proxy)
+		return
+	}
+
+	proxy, created := cl.proxy(env.UserId, env.From)
+	if created {
+		proxy.Name, proxy.Bot = env.Name, env.Bot
+		proxy.setExp(env.Exp)
+	}
+	cmd, err := decodeCommand(env.Command, env.Payload, proxy)
+	if err != nil {
+		log.Printf("解析集群命令失败: %v\n", err)
+		return
+	}
+	if env.RequestId != "" {
+		cmd.request = &MessageContext{
+			Hub:       cl.hub,
+			Client:    proxy,
+			RequestId: env.RequestId,
+			protocol:  env.Protocol,
+			deferred:  true,
+		}
+	}
+	r := cl.hub.getRoom(env.RoomId)
+	if r == nil || !r.post(cmd) {
+		cmd.reject(CodeRoomNotFound, "房间不存在")
+	}
+}
+
+// forward 把本节点玩家的命令转发给房间归属节点，房间不存在时返回false
+func (cl *cluster) forward(roomId int, cmd hubCommand) bool {
+	if roomId == -1 {
+		return false
+	}
+	owner, err := cl.broker.Owner(context.Background(), roomId)
+	if err != nil {
+		log.Printf("查询房间归属失败: %v\n", err)
+		return false
+	}
+	if owner == "" || owner == cl.nodeId {
+		return false
+	}
+	payload, err := encodePayload(cmd.payload)
+	if err != nil {
+		log.Printf("序列化集群命令失败: %v\n", err)
+		return false
+	}
+	env := clusterEnvelope{
+		Kind:    envelopeCommand,
+		UserId:  cmd.client.Id,
+		Name:    cmd.client.Name,
+		Exp:     cmd.client.getExp(),
+		Bot:     cmd.client.Bot,
+		RoomId:  roomId,
+		Command: cmd.commandType,
+		Payload: payload,
+	}
+	if cmd.request != nil {
+		env.RequestId, env.Protocol = cmd.request.RequestId, cmd.request.protocol
+	}
+	cl.send(owner, env)
+	return true
+}
+
+func (cl *cluster) getProxy(userId int) *Client {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.proxies[userId]
+}
+
+// proxy 返回玩家在本节点的代理客户端，房间通过指针识别玩家，所以同一玩家只有一个代理。
+// 新建的代理需要调用方填充用户名和经验
+func (cl *cluster) proxy(userId int, node string) (*Client, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if c, ok := cl.proxies[userId]; ok {
+		c.remote.setNode(node)
+		return c, false
+	}
+	c := NewClient(nil, userId)
+	c.remote = &remoteLink{cluster: cl, node: node}
+	cl.proxies[userId] = c
+	return c, true
+}
+
+func (cl *cluster) dropProxy(c *Client) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.proxies[c.Id] == c {
+		delete(cl.proxies, c.Id)
+	}
+}
+
+// claimRoom 分配集群内唯一的房间id并记录房间归属于本节点
+func (cl *cluster) claimRoom(r *ChessRoom) error {
+	id, err := cl.broker.NextRoomId(context.Background())
+	if err != nil {
+		return err
+	}
+	r.Id = id
+	return cl.broker.SetOwner(context.Background(), id, cl.nodeId)
+}
+
+func (cl *cluster) releaseRoom(roomId int) {
+	ctx := context.Background()
+	if err := cl.broker.DeleteOwner(ctx, roomId); err != nil {
+		log.Printf("删除房间归属失败: %v\n", err)
+	}
+}
+
+// match 把玩家加入共享的匹配队列，凑齐两人的节点负责创建房间。加入队列失败时返回错误
+func (cl *cluster) match(client *Client) error {
+	ctx := context.Background()
+	entry := newMatchEntry(client, cl.nodeId)
+	if err := cl.broker.PushMatch(ctx, entry.String()); err != nil {
+		return err
+	}
+	var matched []*Client
+	for range maxBlockedPairs {
+		matched = cl.popMatchPair(ctx)
+		if len(matched) < 2 || !matchBlocked(matched[0], matched[1]) {
+			break
+		}
+		// 双方有屏蔽关系，倒序放回队尾，让排在后面的玩家分别与两人匹配
+		cl.requeue(matched[1])
+		cl.requeue(matched[0])
+		matched = nil
+	}
+	if len(matched) == 2 {
+		if err := cl.hub.startMatch(matched[0], matched[1]); err != nil {
+			log.Printf("创建匹配房间失败: %v\n", err)
+		}
+	} else {
+		// 有玩家已经断开连接，剩下的玩家重新排队
+		for _, c := range matched {
+			cl.requeue(c)
+		}
+	}
+	if len(matched) < 2 || !slices.Contains(matched, client) {
+		client.sendMessage(NormalMessage{
+			BaseMessage: BaseMessage{Type: messageNormal},
+			Message:     "正在匹配，请稍等",
+		})
+	}
+	return nil
+}
+
+// popMatchPair 从共享的匹配队列中取出两名玩家，返回其中仍在匹配的玩家
+func (cl *cluster) popMatchPair(ctx context.Context) []*Client {
+	pair, err := cl.broker.PopMatchPair(ctx)
+	if err != nil {
+		log.Printf("读取匹配队列失败: %v\n", err)
+	}
+	matched := make([]*Client, 0, 2)
+	for _, member := range pair {
+		var e matchEntry
+		if err := json.Unmarshal([]byte(member), &e); err != nil {
+			continue
+		}
+		if c := cl.resolveMatch(e); c != nil {
+			matched = append(matched, c)
+		}
+	}
+	return matched
+}
+
+// resolveMatch 找到匹配队列中的玩家，本节点的玩家必须仍在匹配中
+func (cl *cluster) resolveMatch(e matchEntry) *Client {
+	if e.Node != cl.nodeId {
+		proxy, created := cl.proxy(e.UserId, e.Node)
+		if created {
+			proxy.Name, proxy.Bot = e.Name, e.Bot
+			proxy.setExp(e.Exp)
+		}
+		proxy.setBlockedIds(e.Blocks)
+		return proxy
+	}
+	client := cl.hub.getClient(e.UserId)
+	if client == nil || client.getStatus() != userMatching {
+		return nil
+	}
+	return client
+}
+
+func (cl *cluster) requeue(c *Client) {
+	node := cl.nodeId
+	if c.remote != nil {
+		node = c.remote.getNode()
+		cl.dropProxy(c)
+	}
+	entry := newMatchEntry(c, node)
+	if err := cl.broker.PushMatch(context.Background(), entry.String()); err != nil {
+		log.Printf("重新加入匹配队列失败: %v\n", err)
+	}
+}
+
+func (cl *cluster) cancelMatch(client *Client) {
+	entry := newMatchEntry(client, cl.nodeId)
+	if err := cl.broker.RemoveMatch(context.Background(), entry.String()); err != nil {
+		log.Printf("移出匹配队列失败: %v\n", err)
+	}
+}
+
+// setSpareRoom 保存房间信息并通知所有节点的大厅订阅者
+func (cl *cluster) setSpareRoom(info room.RoomInfo, event lobbyEventMessage) {
+	data, err := json.Marshal(info)
+	if err == nil {
+		err = cl.broker.SetSpareRoom(context.Background(), info.Id, data)
+	}
+	if err != nil {
+		log.Printf("保存空余房间失败: %v\n", err)
+	}
+	cl.broadcastLobby(event)
+}
+
+func (cl *cluster) deleteSpareRoom(roomId int, event lobbyEventMessage) {
+	if err := cl.broker.DeleteSpareRoom(context.Background(), roomId); err != nil {
+		log.Printf("删除空余房间失败: %v\n", err)
+	}
+	cl.broadcastLobby(event)
+}
+
+func (cl *cluster) broadcastLobby(event lobbyEventMessage) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("序列化大厅消息失败: %v\n", err)
+		return
+	}
+	data, err := json.Marshal(clusterEnvelope{
+		Kind:    envelopeLobby,
+		From:    cl.nodeId,
+		Payload: payload,
+	})
+	if err != nil {
+		log.Printf("序列化集群消息失败: %v\n", err)
+		return
+	}
+	cl.publish(clusterLobbyChannel, data)
+}
+
+// broadcastBlocks 通知所有节点丢弃玩家屏蔽列表的缓存，包括本节点
+func (cl *cluster) broadcastBlocks(userId int) {
+	data, err := json.Marshal(clusterEnvelope{
+		Kind:   envelopeBlocks,
+		From:   cl.nodeId,
+		UserId: userId,
+	})
+	if err != nil {
+		log.Printf("序列化集群消息失败: %v\n", err)
+		return
+	}
+	cl.publish(clusterLobbyChannel, data)
+}
+
+// broadcastDeliver 把发给玩家的消息广播给所有节点，包括本节点，玩家连接所在的节点负责发送
+func (cl *cluster) broadcastDeliver(userId int, message any) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("序列化玩家消息失败: %v\n", err)
+		return
+	}
+	data, err := json.Marshal(clusterEnvelope{
+		Kind:    envelopeDeliver,
+		From:    cl.nodeId,
+		UserId:  userId,
+		Payload: payload,
+	})
+	if err != nil {
+		log.Printf("序列化集群消息失败: %v\n", err)
+		return
+	}
+	cl.publish(clusterLobbyChannel, data)
+}
+
+// spareRooms 返回所有节点上有空位的房间，按房间id排序
+func (cl *cluster) spareRooms() ([]room.RoomInfo, error) {
+	values, err := cl.broker.SpareRooms(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	rooms := make([]room.RoomInfo, 0, len(values))
+	for _, v := range values {
+		var info room.RoomInfo
+		if err := json.Unmarshal(v, &info); err != nil {
+			return nil, fmt.Errorf("解析空余房间失败: %v", err)
+		}
+		rooms = append(rooms, info)
+	}
+	slices.SortFunc(rooms, func(a, b room.RoomInfo) int {
+		return a.Id - b.Id
+	})
+	return rooms, nil
+}
@@ -0,0 +1,328 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"chinese-chess-backend/dto/game"
+	"chinese-chess-backend/utils"
+)
+
+// testClient 不使用websocket连接的客户端，收到的消息都记录下来
+type testClient struct {
+	*Client
+	hub *ChessHub
+
+	mu       sync.Mutex
+	messages []map[string]any
+}
+
+func newTestClient(t *testing.T, hub *ChessHub, userId int) *testClient {
+	t.Helper()
+	return newProtocolTestClient(t, hub, userId, protocolLegacy)
+}
+
+// newProtocolTestClient 创建使用指定协议版本的客户端
+func newProtocolTestClient(t *testing.T, hub *ChessHub, userId int, protocol int) *testClient {
+	t.Helper()
+	tc := &testClient{hub: hub}
+	tc.Client = NewClient(nil, userId)
+	tc.Name = fmt.Sprintf("player%d", userId)
+	tc.protocol = protocol
+	tc.sink = func(message any) {
+		data, err := json.Marshal(message)
+		if err != nil {
+			t.Errorf("序列化消息失败: %v", err)
+			return
+		}
+		var m map[string]any
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Errorf("解析消息失败: %v", err)
+			return
+		}
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		tc.messages = append(tc.messages, m)
+	}
+	hub.commands <- hubCommand{commandType: commandRegister, client: tc.Client}
+	return tc
+}
+
+// send 以JSON文本帧的形式发送消息
+func (tc *testClient) send(t *testing.T, format string, args ...any) {
+	t.Helper()
+	if err := tc.hub.handleMessage(tc.Client, fmt.Appendf(nil, format, args...)); err != nil {
+		t.Fatalf("处理消息失败: %v", err)
+	}
+}
+
+// disconnect 断开连接，大厅处理完注销后返回
+func (tc *testClient) disconnect(t *testing.T) {
+	t.Helper()
+	tc.hub.commands <- hubCommand{commandType: commandUnregister, client: tc.Client}
+	select {
+	case <-tc.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("等待玩家%d断开超时", tc.Id)
+	}
+}
+
+func (tc *testClient) find(match func(m map[string]any) bool) map[string]any {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for _, m := range tc.messages {
+		if match(m) {
+			return m
+		}
+	}
+	return nil
+}
+
+// waitMessage 等待收到指定类型且满足条件的消息
+func (tc *testClient) waitMessage(t *testing.T, msgType MessageType, match func(m map[string]any) bool) map[string]any {
+	t.Helper()
+	var found map[string]any
+	defer func() {
+		if found == nil {
+			tc.mu.Lock()
+			t.Logf("玩家%d收到的消息: %v", tc.Id, tc.messages)
+			tc.mu.Unlock()
+		}
+	}()
+	waitUntil(t, fmt.Sprintf("玩家%d收到类型为%d的消息", tc.Id, msgType), func() bool {
+		found = tc.find(func(m map[string]any) bool {
+			return m["type"] == float64(msgType) && (match == nil || match(m))
+		})
+		return found != nil
+	})
+	return found
+}
+
+// movedTo 匹配终点为(x, y)的走子消息
+func movedTo(x, y int) func(m map[string]any) bool {
+	return func(m map[string]any) bool {
+		to, _ := m["to"].(map[string]any)
+		return to["x"] == float64(x) && to["y"] == float64(y)
+	}
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待超时: %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// newClusterHubs 启动共用同一个内存Broker和时钟的多个节点
+func newClusterHubs(t *testing.T, broker Broker, clock utils.Clock, nodes ...string) []*ChessHub {
+	t.Helper()
+	hubs := make([]*ChessHub, 0, len(nodes))
+	for _, node := range nodes {
+		hub := NewChessHub(WithCluster(broker, node), WithClock(clock))
+		go hub.Run()
+		hubs = append(hubs, hub)
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			hub.Shutdown(ctx)
+		})
+	}
+	return hubs
+}
+
+// advanceClock 推进共用的时钟，直到开局倒计时结束
+func advanceClock(t *testing.T, clock *utils.FakeClock, tc *testClient) {
+	t.Helper()
+	waitUntil(t, fmt.Sprintf("玩家%d开始对局", tc.Id), func() bool {
+		clock.Advance(100 * time.Millisecond)
+		return tc.find(func(m map[string]any) bool {
+			return m["type"] == float64(messageStart)
+		}) != nil
+	})
+}
+
+func TestClusterRoomRouting(t *testing.T) {
+	broker := NewMemoryBroker()
+	clock := utils.NewFakeClock(time.Now())
+	hubs := newClusterHubs(t, broker, clock, "a", "b")
+	a, b := hubs[0], hubs[1]
+
+	alice := newTestClient(t, a, 1)
+	bob := newTestClient(t, b, 2)
+
+	// 房间归属于创建它的节点
+	alice.send(t, `{"type":%d}`, messageCreate)
+	alice.waitMessage(t, messageCreate, nil)
+	roomId := alice.getRoomId()
+	owner, err := broker.Owner(context.Background(), roomId)
+	if err != nil || owner != "a" {
+		t.Fatalf("房间%d应当归属于节点a，实际为%q: %v", roomId, owner, err)
+	}
+
+	// 其他节点的玩家加入时命令被转发到房间归属节点，房间只在该节点上运行
+	bob.send(t, `{"type":%d,"roomId":%d}`, messageJoin, roomId)
+	alice.waitMessage(t, messageJoin, func(m map[string]any) bool {
+		return m["userId"] == float64(bob.Id)
+	})
+	waitUntil(t, "节点b同步玩家2所在的房间", func() bool {
+		return bob.getRoomId() == roomId
+	})
+	if b.getRoom(roomId) != nil {
+		t.Fatal("节点b上不应当运行其他节点的房间")
+	}
+	if a.cluster.getProxy(bob.Id) == nil {
+		t.Fatal("节点a上应当有玩家2的代理客户端")
+	}
+
+	alice.send(t, `{"type":%d,"ready":true}`, messageReady)
+	bob.send(t, `{"type":%d,"ready":true}`, messageReady)
+	bob.waitMessage(t, messageCountdown, nil)
+	advanceClock(t, clock, alice)
+	bob.waitMessage(t, messageStart, nil)
+	waitUntil(t, "节点b同步玩家2的对局状态", func() bool {
+		return bob.getStatus() == userPlaying
+	})
+
+	red, black := alice, bob
+	if start := bob.find(func(m map[string]any) bool { return m["type"] == float64(messageStart) }); start["role"] == "red" {
+		red, black = bob, alice
+	}
+	// 红方在下方、y轴向下的坐标：炮二平五，马8进7
+	red.send(t, `{"type":%d,"from":{"x":7,"y":7},"to":{"x":4,"y":7}}`, messageMove)
+	black.waitMessage(t, messageMove, movedTo(4, 7))
+	black.send(t, `{"type":%d,"from":{"x":7,"y":0},"to":{"x":6,"y":2}}`, messageMove)
+	red.waitMessage(t, messageMove, movedTo(6, 2))
+
+	// 聊天消息从房间归属节点发回玩家所在的节点
+	bob.send(t, `{"type":%d,"content":"你好"}`, messageChat)
+	alice.waitMessage(t, messageChat, func(m map[string]any) bool {
+		return m["userId"] == float64(bob.Id) && m["content"] == "你好"
+	})
+	bob.waitMessage(t, messageChat, nil)
+}
+
+func TestClusterSharedMatchmaking(t *testing.T) {
+	broker := NewMemoryBroker()
+	clock := utils.NewFakeClock(time.Now())
+	hubs := newClusterHubs(t, broker, clock, "a", "b")
+	a, b := hubs[0], hubs[1]
+
+	// 断开连接的玩家从共享的匹配队列中移除
+	carol := newTestClient(t, a, 3)
+	carol.send(t, `{"type":%d}`, messageMatch)
+	carol.waitMessage(t, messageNormal, nil)
+	carol.disconnect(t)
+
+	dave := newTestClient(t, b, 4)
+	dave.send(t, `{"type":%d}`, messageMatch)
+	dave.waitMessage(t, messageNormal, func(m map[string]any) bool {
+		return m["message"] == "正在匹配，请稍等"
+	})
+
+	// 凑齐两人的节点负责创建房间
+	erin := newTestClient(t, a, 5)
+	erin.send(t, `{"type":%d}`, messageMatch)
+	erin.waitMessage(t, messageCountdown, nil)
+	dave.waitMessage(t, messageCountdown, nil)
+	roomId := erin.getRoomId()
+	waitUntil(t, "节点b同步玩家4所在的房间", func() bool {
+		return dave.getRoomId() == roomId
+	})
+	owner, err := broker.Owner(context.Background(), roomId)
+	if err != nil || owner != "a" {
+		t.Fatalf("匹配房间应当归属于节点a，实际为%q: %v", owner, err)
+	}
+	if carol.getRoomId() != -1 {
+		t.Fatal("已断开的玩家不应当被匹配")
+	}
+
+	advanceClock(t, clock, erin)
+	dave.waitMessage(t, messageStart, nil)
+
+	// 队列中已经没有玩家，新玩家需要等待
+	frank := newTestClient(t, b, 6)
+	frank.send(t, `{"type":%d}`, messageMatch)
+	frank.waitMessage(t, messageNormal, func(m map[string]any) bool {
+		return m["message"] == "正在匹配，请稍等"
+	})
+	pair, err := broker.PopMatchPair(context.Background())
+	if err != nil || pair != nil {
+		t.Fatalf("匹配队列中应当只剩一名玩家，取到 %v: %v", pair, err)
+	}
+}
+
+func TestClusterStateCarriesExp(t *testing.T) {
+	broker := NewMemoryBroker()
+	clock := utils.NewFakeClock(time.Now())
+	hubs := newClusterHubs(t, broker, clock, "a", "b")
+	alice := newTestClient(t, hubs[0], 1)
+	bob := newTestClient(t, hubs[1], 2)
+
+	alice.send(t, `{"type":%d}`, messageCreate)
+	alice.waitMessage(t, messageCreate, nil)
+	roomId := alice.getRoomId()
+	bob.send(t, `{"type":%d,"roomId":%d}`, messageJoin, roomId)
+	waitUntil(t, "节点b同步玩家2所在的房间", func() bool {
+		return bob.getRoomId() == roomId
+	})
+
+	// 排位对局在节点a结算时只更新了代理的经验，玩家离开房间后节点b上的经验随状态更新，
+	// 玩家之后创建的房间在房间列表中显示新的经验
+	hubs[0].cluster.getProxy(bob.Id).addExp(ratedExpDelta)
+	bob.send(t, `{"type":%d}`, messageLeave)
+	waitUntil(t, "节点b同步玩家2的经验", func() bool {
+		return bob.getRoomId() == -1 && bob.getExp() == ratedExpDelta
+	})
+	bob.send(t, `{"type":%d}`, messageCreate)
+	bob.waitMessage(t, messageCreate, nil)
+	waitUntil(t, "房间列表显示新的经验", func() bool {
+		for _, info := range hubs[0].SpareRooms() {
+			if info.Current.ID == uint(bob.Id) {
+				return info.Current.Exp == ratedExpDelta
+			}
+		}
+		return false
+	})
+}
+
+func TestCorrespondenceNotifiesPlayersOnOtherNodes(t *testing.T) {
+	broker := NewMemoryBroker()
+	presence := newMemoryPresenceStore() // 相当于集群共用的Redis
+	hubs := make([]*ChessHub, 0, 2)
+	for _, node := range []string{"a", "b"} {
+		hub := NewChessHub(WithCluster(broker, node), WithPresenceStore(presence))
+		go hub.Run()
+		hubs = append(hubs, hub)
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			hub.Shutdown(ctx)
+		})
+	}
+	bob := newTestClient(t, hubs[1], 2)
+	waitUntil(t, "保存玩家2的在线状态", func() bool {
+		_, ok := hubs[0].Presence([]int{bob.Id})[bob.Id]
+		return ok
+	})
+
+	// 玩家连接在其他节点上时推送给该节点，视为在线而不发送邮件
+	info := game.GameInfo{Id: 7, RedId: 1, BlackId: 2, Turn: "black", Status: "active"}
+	if !hubs[0].NotifyCorrespondence(bob.Id, info) {
+		t.Fatal("连接在其他节点上的玩家应当视为在线")
+	}
+	bob.waitMessage(t, messageCorrespondence, func(m map[string]any) bool {
+		g, _ := m["game"].(map[string]any)
+		return g["id"] == float64(info.Id)
+	})
+	if hubs[0].NotifyCorrespondence(1, info) {
+		t.Fatal("没有连接的玩家应当视为离线")
+	}
+}
@@ -1,18 +1,39 @@
 package websocket
 
+import (
+	"encoding/json"
+)
+
 type CommendType int
 
 const (
-	commandRegister    CommendType = iota + 1 // 注册
-	commandUnregister                         // 注销
-	commandMatch                              // 匹配
-	commandMove                               // 移动
-	commandSendMessage                        // 发送消息
-	commandStart                              // 开始游戏
-	commandEnd                                // 结束游戏
-	commandJoin                               // 加入房间
-	commandCreate                             // 创建房间
-	commandHeartbeat                          // 心跳
+	commandRegister      CommendType = iota + 1 // 注册
+	commandUnregister                           // 注销
+	commandMatch                                // 匹配
+	commandMove                                 // 移动
+	commandStart                                // 开始游戏
+	commandEnd                                  // 结束游戏
+	commandJoin                                 // 加入房间
+	commandCreate                               // 创建房间
+	commandHeartbeat                            // 心跳
+	commandTakeback                             // 悔棋请求
+	commandTakebackReply                        // 悔棋回复
+	commandSpectate                             // 观战
+	commandTimeout                              // 超时判负
+	commandReady                                // 准备
+	commandKick                                 // 踢人
+	commandRematch                              // 再来一局
+	commandLeave                                // 离开房间
+	commandExpire                               // 解散闲置房间
+	commandResume                               // 玩家重连回从快照恢复的房间
+	commandShutdown                             // 停机，保存或判和进行中的对局
+	commandSync                                 // 房间处理完之前的命令后关闭payload中的通道，用于回放
+	commandChat                                 // 房间聊天
+	commandResync                               // 客户端发现序号不连续，请求完整的对局状态
+	commandDraw                                 // 提和或回复提和
+	commandState                                // 读取对局状态，payload为接收结果的通道，只在本节点使用
+	commandChallenge                            // 挑战被接受后为双方创建房间，payload为挑战
+	commandResumeExpire                         // 等待从快照恢复的玩家重连超时，开始计时
 )
 
 type moveRequest struct {
@@ -20,13 +41,78 @@ type moveRequest struct {
 	move MoveMessage
 }
 
-type sendMessageRequest struct {
-	target  *Client
-	message any
-}
-
 type hubCommand struct {
 	commandType CommendType
 	client      *Client
 	payload     any
+	request     *MessageContext // 客户端的请求，内部产生的命令为nil
+}
+
+// accept 确认命令对应的请求已被受理，已经回复过的请求不再确认
+func (cmd hubCommand) accept() {
+	if cmd.request != nil {
+		cmd.request.ack()
+	}
+}
+
+// reject 以错误码拒绝命令对应的请求。内部产生的命令直接给客户端发送提示，text为空时不发送
+func (cmd hubCommand) reject(code ErrorCode, text string) {
+	if cmd.request != nil {
+		cmd.request.Fail(code, text)
+		return
+	}
+	if text != "" && cmd.client != nil {
+		cmd.client.sendMessage(NormalMessage{
+			BaseMessage: BaseMessage{Type: messageNormal},
+			Message:     text,
+		})
+	}
+}
+
+// encodePayload 序列化命令的payload，走子命令只保留走法
+func encodePayload(payload any) (json.RawMessage, error) {
+	switch p := payload.(type) {
+	case nil:
+		return nil, nil
+	case moveRequest:
+		return json.Marshal(p.move)
+	default:
+		return json.Marshal(p)
+	}
+}
+
+func decodePayload[T any](raw json.RawMessage) (T, error) {
+	var v T
+	if len(raw) == 0 {
+		return v, nil
+	}
+	err := json.Unmarshal(raw, &v)
+	return v, err
+}
+
+// decodeCommand 还原由encodePayload序列化的命令，用于集群转发和日志回放
+func decodeCommand(commandType CommendType, payload json.RawMessage, client *Client) (hubCommand, error) {
+	cmd := hubCommand{commandType: commandType, client: client}
+	var err error
+	switch commandType {
+	case commandMove:
+		var move MoveMessage
+		move, err = decodePayload[MoveMessage](payload)
+		cmd.payload = moveRequest{from: client, move: move}
+	case commandJoin, commandSpectate:
+		cmd.payload, err = decodePayload[joinMessage](payload)
+	case commandEnd:
+		cmd.payload, err = decodePayload[bool](payload)
+	case commandTakebackReply:
+		cmd.payload, err = decodePayload[takebackReplyMessage](payload)
+	case commandReady:
+		cmd.payload, err = decodePayload[readyMessage](payload)
+	case commandStart:
+		cmd.payload, err = decodePayload[int](payload)
+	case commandChat:
+		cmd.payload, err = decodePayload[chatMessage](payload)
+	case commandDraw:
+		cmd.payload, err = decodePayload[drawMessage](payload)
+	}
+	return cmd, err
 }
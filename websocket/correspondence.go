@@ -0,0 +1,47 @@
+package websocket
+
+import (
+	"errors"
+	"time"
+
+	"chinese-chess-backend/dto/game"
+	"chinese-chess-backend/xiangqi"
+)
+
+// CorrespondenceMover 处理通信对局的走子，由service中的CorrespondenceService实现
+type CorrespondenceMover interface {
+	Move(userId int, req *game.MoveRequest) (game.GameInfo, error)
+}
+
+// RegisterCorrespondence 允许在线玩家通过websocket在通信对局中走子，
+// 走子后的对局状态由CorrespondenceService经NotifyCorrespondence推送给双方
+func RegisterCorrespondence(ch *ChessHub, mover CorrespondenceMover) {
+	Handle(ch.handlers, messageCorrespondence, func(ctx *MessageContext, msg correspondenceMoveMessage) error {
+		req := game.MoveRequest{
+			GameId: msg.GameId,
+			From:   game.Position(msg.From),
+			To:     game.Position(msg.To),
+			Ply:    msg.Ply,
+		}
+		if err := req.Examine(); err != nil {
+			ctx.Fail(CodeBadRequest, err.Error())
+			return nil
+		}
+		if _, err := mover.Move(ctx.Client.Id, &req); errors.Is(err, xiangqi.ErrIllegalMove) {
+			ctx.Fail(CodeIllegalMove, err.Error())
+		} else if err != nil {
+			ctx.Fail(CodeInvalidState, err.Error())
+		}
+		return nil
+	}, RateLimit(5, 10*time.Second))
+}
+
+// NotifyCorrespondence 把通信对局的最新状态推送给玩家，返回玩家是否在线。
+// 集群模式下连接在其他节点上的玩家同样在线，不需要邮件提醒
+func (ch *ChessHub) NotifyCorrespondence(userId int, info game.GameInfo) bool {
+	ch.deliver(userId, correspondenceMessage{
+		BaseMessage: BaseMessage{Type: messageCorrespondence},
+		Game:        info,
+	})
+	return ch.online(userId)
+}
@@ -0,0 +1,183 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"chinese-chess-backend/dto/room"
+	"chinese-chess-backend/dto/user"
+	"chinese-chess-backend/utils"
+)
+
+// Event 大厅和房间发布的领域事件
+type Event interface {
+	isEvent()
+}
+
+// ClientConnected 玩家建立连接并完成注册
+type ClientConnected struct {
+	UserId int
+	Name   string
+	Time   time.Time
+}
+
+// MatchFound 两名玩家匹配成功，进入同一个房间
+type MatchFound struct {
+	RoomId    int
+	PlayerIds []int
+	Time      time.Time
+}
+
+// GameStarted 开局倒计时结束，对局开始
+type GameStarted struct {
+	RoomId   int
+	RedId    int
+	BlackId  int
+	Settings room.RoomSettings
+	Time     time.Time
+}
+
+// MoveMade 玩家走了一步棋，Ply为走完后房间的序号
+type MoveMade struct {
+	RoomId int
+	UserId int
+	Move   MoveMessage
+	Ply    int
+	Time   time.Time
+}
+
+// GameEnded 对局结束，和棋时WinnerId和LoserId为0，Ply为结束时房间的序号
+type GameEnded struct {
+	RoomId   int
+	RedId    int
+	BlackId  int
+	Winner   clientRole
+	WinnerId int
+	LoserId  int
+	Rated    bool
+	Moves    []MoveMessage
+	Ply      int
+	Time     time.Time
+}
+
+// TakebackAccepted 悔棋被同意，UserId为悔棋的玩家，Ply为悔棋后房间的序号
+type TakebackAccepted struct {
+	RoomId int
+	UserId int
+	Ply    int
+	Time   time.Time
+}
+
+// DrawOffered 玩家提和
+type DrawOffered struct {
+	RoomId int
+	UserId int
+	Time   time.Time
+}
+
+// DrawDeclined 提和被拒绝或撤回，UserId为拒绝或撤回的玩家
+type DrawDeclined struct {
+	RoomId int
+	UserId int
+	Time   time.Time
+}
+
+// ChatPosted 房间内有人发送了聊天消息
+type ChatPosted struct {
+	RoomId  int
+	UserId  int
+	Name    string
+	Content string
+	Time    time.Time
+}
+
+// PresenceChanged 玩家上线、下线或状态变化，Presence为变化后的在线状态
+type PresenceChanged struct {
+	UserId   int
+	Presence user.Presence
+	Time     time.Time
+}
+
+func (ClientConnected) isEvent()  {}
+func (MatchFound) isEvent()       {}
+func (GameStarted) isEvent()      {}
+func (MoveMade) isEvent()         {}
+func (GameEnded) isEvent()        {}
+func (TakebackAccepted) isEvent() {}
+func (DrawOffered) isEvent()      {}
+func (DrawDeclined) isEvent()     {}
+func (ChatPosted) isEvent()       {}
+func (PresenceChanged) isEvent()  {}
+
+type subscriber struct {
+	id      int
+	handler func(Event)
+}
+
+// EventBus 进程内的事件总线。处理函数在线程池中执行，不会阻塞发布方，
+// 同一个订阅者按发布顺序依次收到事件
+type EventBus struct {
+	mu          sync.RWMutex
+	pool        *utils.WorkerPool // 为nil时在发布方同步调用处理函数
+	nextId      int
+	subscribers []subscriber
+}
+
+func NewEventBus(pool *utils.WorkerPool) *EventBus {
+	return &EventBus{pool: pool}
+}
+
+// Subscribe 订阅类型为E的事件，返回取消订阅的函数
+func Subscribe[E Event](bus *EventBus, handler func(E)) (unsubscribe func()) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.nextId++
+	id := bus.nextId
+	bus.subscribers = append(bus.subscribers, subscriber{
+		id: id,
+		handler: func(e Event) {
+			if event, ok := e.(E); ok {
+				handler(event)
+			}
+		},
+	})
+	return func() {
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+		for i, s := range bus.subscribers {
+			if s.id == id {
+				bus.subscribers = append(bus.subscribers[:i:i], bus.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish 把事件交给所有订阅者
+func (bus *EventBus) Publish(e Event) {
+	bus.mu.RLock()
+	subscribers := bus.subscribers
+	bus.mu.RUnlock()
+	for _, s := range subscribers {
+		if bus.pool == nil {
+			s.handler(e)
+			continue
+		}
+		handler := s.handler
+		_, err := bus.pool.Submit(context.Background(), func() error {
+			handler(e)
+			return nil
+		}, utils.WithKey(fmt.Sprintf("event:%d", s.id)))
+		if err != nil {
+			log.Printf("分发事件失败: %v\n", err)
+		}
+	}
+}
+
+// Events 返回大厅的事件总线，持久化、排位分、统计和通知等模块在此订阅
+func (ch *ChessHub) Events() *EventBus {
+	return ch.events
+}
@@ -0,0 +1,146 @@
+package websocket
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"chinese-chess-backend/utils"
+)
+
+// eventLog 按收到的顺序记录事件
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (l *eventLog) add(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+}
+
+func (l *eventLog) get() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.events)
+}
+
+// kinds 返回事件的类型名，跳过在线状态变化
+func (l *eventLog) kinds() []string {
+	kinds := make([]string, 0)
+	for _, e := range l.get() {
+		if _, ok := e.(PresenceChanged); !ok {
+			kinds = append(kinds, fmt.Sprintf("%T", e))
+		}
+	}
+	return kinds
+}
+
+func TestEventBusDeliversTypedEventsInOrder(t *testing.T) {
+	pool := utils.NewWorkerPool()
+	pool.Start()
+	defer pool.Stop()
+	bus := NewEventBus(pool)
+
+	var moves, all eventLog
+	unsubscribe := Subscribe(bus, func(e MoveMade) { moves.add(e) })
+	Subscribe(bus, func(e Event) { all.add(e) })
+	for ply := 1; ply <= 50; ply++ {
+		bus.Publish(MoveMade{RoomId: 1, Ply: ply})
+	}
+	bus.Publish(GameEnded{RoomId: 1, Ply: 51})
+	waitUntil(t, "订阅者收到所有事件", func() bool {
+		return len(moves.get()) == 50 && len(all.get()) == 51
+	})
+	// 只收到订阅的类型，并且按发布顺序依次处理
+	for i, e := range moves.get() {
+		if e.(MoveMade).Ply != i+1 {
+			t.Fatalf("第%d个事件的序号为%d", i+1, e.(MoveMade).Ply)
+		}
+	}
+	if _, ok := all.get()[50].(GameEnded); !ok {
+		t.Fatal("订阅所有事件时应当最后收到对局结束")
+	}
+
+	// 取消订阅后不再收到事件，其他订阅者不受影响
+	unsubscribe()
+	bus.Publish(MoveMade{RoomId: 1, Ply: 52})
+	waitUntil(t, "其余订阅者收到事件", func() bool {
+		return len(all.get()) == 52
+	})
+	if n := len(moves.get()); n != 50 {
+		t.Fatalf("取消订阅后不应当再收到事件，共收到%d个", n)
+	}
+
+	// 没有线程池时在发布方同步调用
+	var direct eventLog
+	syncBus := NewEventBus(nil)
+	Subscribe(syncBus, func(e ChatPosted) { direct.add(e) })
+	syncBus.Publish(ChatPosted{RoomId: 1, Content: "你好"})
+	if len(direct.get()) != 1 {
+		t.Fatal("没有线程池时应当同步处理事件")
+	}
+}
+
+func TestHubPublishesLifecycleEvents(t *testing.T) {
+	hub, clock := newRoomTestHub(t)
+	var events eventLog
+	Subscribe(hub.Events(), func(e Event) { events.add(e) })
+
+	alice := newProtocolTestClient(t, hub, 1, protocolV2)
+	bob := newProtocolTestClient(t, hub, 2, protocolV2)
+	alice.send(t, `{"type":%d}`, messageMatch)
+	waitUntil(t, "玩家1进入匹配", func() bool { return alice.getStatus() == userMatching })
+	bob.send(t, `{"type":%d}`, messageMatch)
+	bob.waitMessage(t, messageCountdown, nil)
+	advanceClock(t, clock, alice)
+	red, black := alice, bob
+	if start := bob.find(func(m map[string]any) bool { return m["type"] == float64(messageStart) }); start["role"] == "red" {
+		red, black = bob, alice
+	}
+
+	// 被拒绝的走子和聊天不发布事件
+	black.send(t, `{"v":2,"id":"early","type":%d,"data":{"from":{"x":7,"y":0},"to":{"x":6,"y":2}}}`, messageMove)
+	black.expectError(t, "early", CodeNotYourTurn)
+	red.send(t, `{"v":2,"id":"illegal","type":%d,"data":{"from":{"x":7,"y":7},"to":{"x":6,"y":6}}}`, messageMove)
+	red.expectError(t, "illegal", CodeIllegalMove)
+	red.send(t, `{"v":2,"id":"move","type":%d,"data":{"from":{"x":7,"y":7},"to":{"x":4,"y":7}}}`, messageMove)
+	red.waitMessage(t, messageAck, reply("move"))
+	black.send(t, `{"v":2,"id":"chat","type":%d,"data":{"content":"你好"}}`, messageChat)
+	black.waitMessage(t, messageAck, reply("chat"))
+	black.send(t, `{"v":2,"id":"resign","type":%d}`, messageGiveUp)
+	black.waitMessage(t, messageAck, reply("resign"))
+
+	want := []string{
+		"websocket.ClientConnected", "websocket.ClientConnected", "websocket.MatchFound",
+		"websocket.GameStarted", "websocket.MoveMade", "websocket.ChatPosted", "websocket.GameEnded",
+	}
+	waitUntil(t, "收到对局结束事件", func() bool {
+		return len(events.kinds()) == len(want)
+	})
+	if kinds := events.kinds(); !slices.Equal(kinds, want) {
+		t.Fatalf("事件顺序不正确: %v", kinds)
+	}
+	for _, e := range events.get() {
+		switch e := e.(type) {
+		case MatchFound:
+			if !slices.Contains(e.PlayerIds, alice.Id) || !slices.Contains(e.PlayerIds, bob.Id) {
+				t.Fatalf("匹配事件的玩家不正确: %+v", e)
+			}
+		case GameStarted:
+			if e.RedId != red.Id || e.BlackId != black.Id {
+				t.Fatalf("开局事件的执子不正确: %+v", e)
+			}
+		case MoveMade:
+			if e.UserId != red.Id || e.Ply != 2 {
+				t.Fatalf("走子事件不正确: %+v", e)
+			}
+		case GameEnded:
+			if e.WinnerId != red.Id || e.LoserId != black.Id || len(e.Moves) != 1 {
+				t.Fatalf("对局结束事件不正确: %+v", e)
+			}
+		}
+	}
+}
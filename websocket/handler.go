@@ -0,0 +1,285 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// MessageContext 处理一条客户端消息时的上下文
+type MessageContext struct {
+	Hub       *ChessHub
+	Client    *Client
+	Type      MessageType
+	RequestId string // v2协议中客户端选择的请求id，旧版协议为空
+	Raw       []byte // 消息体，v2协议中为信封的data
+	Payload   any    // 解码器的结果
+
+	protocol int  // 客户端的协议版本，集群转发的请求由房间归属节点上的代理客户端回复
+	answered bool // 已经回复过该请求，不再发送确认
+	deferred bool // 请求已交给大厅协程，由大厅或房间处理完后确认或拒绝
+}
+
+// versioned 客户端使用v2协议并带了请求id，需要确认或回复错误码
+func (ctx *MessageContext) versioned() bool {
+	return ctx.protocol >= protocolV2 && ctx.RequestId != ""
+}
+
+// Reply 给发送消息的客户端回复，v2协议中回复带有请求id，之后不再发送确认
+func (ctx *MessageContext) Reply(message any) {
+	if ctx.versioned() {
+		env := responseEnvelope{V: protocolV2, Id: ctx.RequestId, Data: message}
+		if m, ok := message.(typedMessage); ok {
+			env.Type = m.messageType()
+		}
+		message = env
+	}
+	ctx.answered = true
+	ctx.Hub.sendMessage(ctx.Client, message)
+}
+
+// Fail 拒绝请求。v2协议中回复错误码，旧版协议回复text，text为空时不回复
+func (ctx *MessageContext) Fail(code ErrorCode, text string) {
+	ctx.answered = true
+	if ctx.versioned() {
+		if text == "" {
+			text = string(code)
+		}
+		ctx.Hub.sendMessage(ctx.Client, responseEnvelope{
+			V:     protocolV2,
+			Id:    ctx.RequestId,
+			Type:  messageError,
+			Error: &envelopeError{Code: code, Message: text},
+		})
+		return
+	}
+	if text == "" {
+		return
+	}
+	msgType := messageNormal
+	if code == CodeMaintenance {
+		msgType = messageMaintenance
+	}
+	ctx.Hub.sendMessage(ctx.Client, NormalMessage{
+		BaseMessage: BaseMessage{Type: msgType},
+		Message:     text,
+	})
+}
+
+// ack 确认已受理请求，只有v2协议中带了请求id且尚未回复时才发送
+func (ctx *MessageContext) ack() {
+	if !ctx.versioned() || ctx.answered {
+		return
+	}
+	ctx.answered = true
+	ctx.Hub.sendMessage(ctx.Client, responseEnvelope{
+		V:    protocolV2,
+		Id:   ctx.RequestId,
+		Type: messageAck,
+	})
+}
+
+// command 把客户端的请求交给大厅协程，之后由大厅或房间确认或拒绝，处理函数不能再回复
+func (ctx *MessageContext) command(commandType CommendType, payload any) {
+	ctx.deferred = true
+	ctx.Hub.commands <- hubCommand{
+		commandType: commandType,
+		client:      ctx.Client,
+		payload:     payload,
+		request:     ctx,
+	}
+}
+
+// MessageHandler 处理一条客户端消息，返回错误时断开该客户端的连接
+type MessageHandler func(ctx *MessageContext) error
+
+// MessageDecoder 把原始消息解码为处理函数需要的payload
+type MessageDecoder func(raw []byte) (any, error)
+
+// Middleware 包装消息处理函数，可以在处理前后做检查或记录
+type Middleware func(next MessageHandler) MessageHandler
+
+// HandlerRegistry 按消息类型登记解码器和处理函数，其他包可以通过ChessHub.Handlers注册新的消息类型
+type HandlerRegistry struct {
+	mu          sync.RWMutex
+	routes      map[MessageType]MessageHandler // 已包装解码和该类型的中间件
+	middlewares []Middleware                   // 作用于所有消息类型，先登记的在外层
+}
+
+func NewHandlerRegistry() *HandlerRegistry {
+	return &HandlerRegistry{routes: make(map[MessageType]MessageHandler)}
+}
+
+// Use 添加作用于所有消息类型的中间件，对之后的消息立即生效
+func (r *HandlerRegistry) Use(middlewares ...Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// Register 登记消息类型的解码器和处理函数，重复登记会替换之前的处理函数。
+// middlewares只作用于该类型，在解码之前执行；decode为nil时不解码payload，
+// 解码失败的消息会被忽略
+func (r *HandlerRegistry) Register(t MessageType, decode MessageDecoder, handler MessageHandler, middlewares ...Middleware) {
+	h := func(ctx *MessageContext) error {
+		if decode != nil {
+			payload, err := decode(ctx.Raw)
+			if err != nil {
+				log.Printf("解析消息 %d 失败: %v\n", ctx.Type, err)
+				if ctx.versioned() {
+					ctx.Fail(CodeBadRequest, "消息格式错误")
+				}
+				return nil
+			}
+			ctx.Payload = payload
+		}
+		return handler(ctx)
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[t] = h
+}
+
+// Handle 登记消息类型，消息按JSON解码为T后交给fn
+func Handle[T any](r *HandlerRegistry, t MessageType, fn func(ctx *MessageContext, msg T) error, middlewares ...Middleware) {
+	decode := func(raw []byte) (any, error) {
+		var msg T
+		err := json.Unmarshal(raw, &msg)
+		return msg, err
+	}
+	r.Register(t, decode, func(ctx *MessageContext) error {
+		return fn(ctx, ctx.Payload.(T))
+	}, middlewares...)
+}
+
+// dispatch 按消息类型找到处理函数，依次经过全局中间件、该类型的中间件后处理消息，
+// 处理完成后确认v2协议的请求，交给大厅协程的请求由大厅或房间确认。旧版协议中未登记的消息类型会被忽略
+func (r *HandlerRegistry) dispatch(ctx *MessageContext) error {
+	r.mu.RLock()
+	handler, ok := r.routes[ctx.Type]
+	middlewares := r.middlewares
+	r.mu.RUnlock()
+	if !ok {
+		if ctx.versioned() {
+			ctx.Fail(CodeUnknownType, "未知的消息类型")
+		}
+		return nil
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	err := handler(ctx)
+	if ctx.deferred {
+		// 大厅协程可能正在处理该请求，不能再读写回复状态
+		return err
+	}
+	if err != nil {
+		if ctx.versioned() && !ctx.answered {
+			ctx.Fail(CodeInternal, err.Error())
+		}
+		return err
+	}
+	ctx.ack()
+	return nil
+}
+
+// Handlers 返回大厅的消息处理注册表
+func (ch *ChessHub) Handlers() *HandlerRegistry {
+	return ch.handlers
+}
+
+// Recovery 把处理函数中的panic转为错误，只断开出错的客户端
+func Recovery() Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx *MessageContext) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("处理消息 %d panic: %v\n%s", ctx.Type, r, debug.Stack())
+					err = fmt.Errorf("处理消息 %d panic: %v", ctx.Type, r)
+				}
+			}()
+			return next(ctx)
+		}
+	}
+}
+
+// Logging 记录处理失败和耗时超过slow的消息
+func Logging(slow time.Duration) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx *MessageContext) error {
+			start := time.Now()
+			err := next(ctx)
+			if err != nil {
+				log.Printf("用户 %d 的消息 %d 处理失败: %v\n", ctx.Client.Id, ctx.Type, err)
+			} else if d := time.Since(start); d > slow {
+				log.Printf("用户 %d 的消息 %d 处理耗时 %v\n", ctx.Client.Id, ctx.Type, d)
+			}
+			return err
+		}
+	}
+}
+
+// Guard 只有check通过时才继续处理，否则交给onReject
+func Guard(check func(c *Client) bool, onReject MessageHandler) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx *MessageContext) error {
+			if !check(ctx.Client) {
+				return onReject(ctx)
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// Reject 以错误码拒绝请求后结束处理，用作Guard的onReject。text为空时旧版客户端不会收到回复
+func Reject(code ErrorCode, text string) MessageHandler {
+	return func(ctx *MessageContext) error {
+		ctx.Fail(code, text)
+		return nil
+	}
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// RateLimit 限制每个客户端在window内最多发送limit条该类型的消息，超出的消息被丢弃
+func RateLimit(limit int, window time.Duration) Middleware {
+	var mu sync.Mutex
+	windows := make(map[*Client]*rateWindow)
+	allow := func(c *Client, now time.Time) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(windows) > 1024 {
+			// 清理已过期的窗口，避免断开的客户端一直占用内存
+			for k, w := range windows {
+				if now.Sub(w.start) >= window {
+					delete(windows, k)
+				}
+			}
+		}
+		w, ok := windows[c]
+		if !ok || now.Sub(w.start) >= window {
+			windows[c] = &rateWindow{start: now, count: 1}
+			return true
+		}
+		w.count++
+		return w.count <= limit
+	}
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx *MessageContext) error {
+			if !allow(ctx.Client, ctx.Hub.clock.Now()) {
+				ctx.Fail(CodeRateLimited, "操作过于频繁，请稍后再试")
+				return nil
+			}
+			return next(ctx)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"chinese-chess-backend/utils"
+)
+
+// reply 匹配对请求id的确认或错误回复
+func reply(id string) func(m map[string]any) bool {
+	return func(m map[string]any) bool {
+		return m["id"] == id
+	}
+}
+
+// errorCode 取出错误回复中的错误码
+func errorCode(m map[string]any) ErrorCode {
+	e, _ := m["error"].(map[string]any)
+	code, _ := e["code"].(string)
+	return ErrorCode(code)
+}
+
+// expectError 等待请求被以code拒绝
+func (tc *testClient) expectError(t *testing.T, id string, code ErrorCode) {
+	t.Helper()
+	m := tc.waitMessage(t, messageError, reply(id))
+	if got := errorCode(m); got != code {
+		t.Fatalf("请求%s的错误码为%q，应当为%q", id, got, code)
+	}
+	if tc.find(func(m map[string]any) bool { return m["type"] == float64(messageAck) && m["id"] == id }) != nil {
+		t.Fatalf("被拒绝的请求%s不应当再被确认", id)
+	}
+}
+
+func TestRoomRepliesToVersionedRequests(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+	hub := NewChessHub(WithClock(clock))
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+	alice := newProtocolTestClient(t, hub, 1, protocolV2)
+	bob := newProtocolTestClient(t, hub, 2, protocolV2)
+
+	// 大厅找不到房间时以错误码拒绝
+	bob.send(t, `{"v":2,"id":"missing","type":%d,"data":{"roomId":99999}}`, messageJoin)
+	bob.expectError(t, "missing", CodeRoomNotFound)
+
+	alice.send(t, `{"v":2,"id":"create","type":%d}`, messageCreate)
+	alice.waitMessage(t, messageAck, reply("create"))
+	if alice.find(func(m map[string]any) bool { return m["type"] == float64(messageCreate) }) == nil {
+		t.Fatal("确认创建房间前应当先收到创建成功的消息")
+	}
+	bob.send(t, `{"v":2,"id":"join","type":%d,"data":{"roomId":%d}}`, messageJoin, alice.getRoomId())
+	bob.waitMessage(t, messageAck, reply("join"))
+
+	// 房间中的拒绝带有请求id和错误码
+	bob.send(t, `{"v":2,"id":"kick","type":%d}`, messageKick)
+	bob.expectError(t, "kick", CodeNotHost)
+
+	alice.send(t, `{"v":2,"id":"ready","type":%d,"data":{"ready":true}}`, messageReady)
+	bob.send(t, `{"v":2,"id":"ready","type":%d,"data":{"ready":true}}`, messageReady)
+	alice.waitMessage(t, messageAck, reply("ready"))
+	bob.waitMessage(t, messageAck, reply("ready"))
+	advanceClock(t, clock, alice)
+	bob.waitMessage(t, messageStart, nil)
+	waitUntil(t, "双方进入对局", func() bool {
+		return alice.getStatus() == userPlaying && bob.getStatus() == userPlaying
+	})
+	red, black := alice, bob
+	if start := bob.find(func(m map[string]any) bool { return m["type"] == float64(messageStart) }); start["role"] == "red" {
+		red, black = bob, alice
+	}
+
+	black.send(t, `{"v":2,"id":"early","type":%d,"data":{"from":{"x":7,"y":0},"to":{"x":6,"y":2}}}`, messageMove)
+	black.expectError(t, "early", CodeNotYourTurn)
+	red.send(t, `{"v":2,"id":"illegal","type":%d,"data":{"from":{"x":7,"y":7},"to":{"x":6,"y":6}}}`, messageMove)
+	red.expectError(t, "illegal", CodeIllegalMove)
+
+	// 房间受理走子后才确认
+	red.send(t, `{"v":2,"id":"move","type":%d,"data":{"from":{"x":7,"y":7},"to":{"x":4,"y":7}}}`, messageMove)
+	red.waitMessage(t, messageAck, reply("move"))
+	if black.find(func(m map[string]any) bool { return m["type"] == float64(messageMove) }) == nil {
+		t.Fatal("确认走子时房间应当已经转发给对手")
+	}
+}
+
+func TestClusterForwardedRequestReplies(t *testing.T) {
+	broker := NewMemoryBroker()
+	clock := utils.NewFakeClock(time.Now())
+	hubs := newClusterHubs(t, broker, clock, "a", "b")
+	alice := newProtocolTestClient(t, hubs[0], 1, protocolV2)
+	bob := newProtocolTestClient(t, hubs[1], 2, protocolV2)
+
+	// 房间在节点a上，节点b上的玩家收到房间归属节点的确认和错误码
+	alice.send(t, `{"v":2,"id":"create","type":%d}`, messageCreate)
+	alice.waitMessage(t, messageAck, reply("create"))
+	bob.send(t, `{"v":2,"id":"join","type":%d,"data":{"roomId":%d}}`, messageJoin, alice.getRoomId())
+	bob.waitMessage(t, messageAck, reply("join"))
+	bob.send(t, `{"v":2,"id":"kick","type":%d}`, messageKick)
+	bob.expectError(t, "kick", CodeNotHost)
+
+	// 转发回来的回复已经包在信封中，发给客户端前不再重复包装
+	raw, err := json.Marshal(responseEnvelope{
+		V:     protocolV2,
+		Id:    "kick",
+		Type:  messageError,
+		Error: &envelopeError{Code: CodeNotHost, Message: "只有房主可以踢人"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, ok := bob.encode(json.RawMessage(raw)).(responseEnvelope)
+	if !ok || env.Id != "kick" || env.Error == nil || env.Error.Code != CodeNotHost || env.Data != nil {
+		t.Fatalf("转发的回复被错误地包装: %+v", env)
+	}
+}
@@ -0,0 +1,185 @@
+package websocket
+
+import (
+	"fmt"
+	"time"
+
+	"chinese-chess-backend/dto/room"
+)
+
+const slowMessageThreshold = 100 * time.Millisecond // 处理耗时超过该值的消息会被记录
+
+func isPlaying(c *Client) bool {
+	return c.getStatus() == userPlaying
+}
+
+func notPlaying(c *Client) bool {
+	return c.getStatus() != userPlaying
+}
+
+func inRoom(c *Client) bool {
+	return c.getRoomId() != -1
+}
+
+func notInRoom(c *Client) bool {
+	return c.getRoomId() == -1
+}
+
+// waitingInRoom 在房间中但不在对局中
+func waitingInRoom(c *Client) bool {
+	return c.getStatus() == userOnline && c.getRoomId() != -1
+}
+
+func idle(c *Client) bool {
+	return c.getStatus() == userOnline && c.getRoomId() == -1
+}
+
+// rejectWhileDraining 停机期间不再接受新的匹配和房间
+func rejectWhileDraining(next MessageHandler) MessageHandler {
+	return func(ctx *MessageContext) error {
+		if ctx.Hub.draining.Load() {
+			ctx.Fail(CodeMaintenance, "服务器维护中，请稍后再试")
+			return nil
+		}
+		return next(ctx)
+	}
+}
+
+// registerHandlers 登记内置的消息类型
+func (ch *ChessHub) registerHandlers() {
+	r := ch.handlers
+	r.Use(Recovery(), Logging(slowMessageThreshold))
+
+	notInGame := Guard(notPlaying, Reject(CodeInGame, "您已在游戏中"))
+	notJoined := Guard(notInRoom, Reject(CodeAlreadyInRoom, "您已在房间中"))
+	playingOnly := Guard(isPlaying, Reject(CodeNotPlaying, ""))
+	roomOnly := Guard(waitingInRoom, Reject(CodeNotInRoom, "您不在房间中"))
+
+	r.Register(messageMatch, nil, func(ctx *MessageContext) error {
+		switch ctx.Client.getStatus() {
+		case userOnline:
+			// 在读协程中读取屏蔽列表，大厅协程匹配时不再查询数据库
+			ctx.Hub.loadBlocks(ctx.Client)
+			ctx.Client.setStatus(userMatching)
+			ctx.command(commandMatch, nil)
+		case userMatching:
+			ctx.Fail(CodeAlreadyMatching, "您已在匹配队列中，请耐心等待")
+		case userPlaying:
+			ctx.Fail(CodeInGame, "您已在游戏中")
+		}
+		return nil
+	}, rejectWhileDraining, Guard(func(c *Client) bool {
+		return !waitingInRoom(c)
+	}, Reject(CodeAlreadyInRoom, "您已在房间中")), RateLimit(5, 10*time.Second))
+
+	Handle(r, messageMove, func(ctx *MessageContext, move MoveMessage) error {
+		move.Type = messageMove // v2协议的消息体中不带类型，转发给对手前补上
+		ctx.command(commandMove, moveRequest{from: ctx.Client, move: move})
+		return nil
+	}, Guard(isPlaying, func(ctx *MessageContext) error {
+		ctx.Fail(CodeNotPlaying, "")
+		return fmt.Errorf("玩家不在游戏中")
+	}))
+
+	r.Register(messageEnd, nil, func(ctx *MessageContext) error {
+		ctx.command(commandEnd, nil)
+		return nil
+	}, playingOnly)
+
+	r.Register(messageGiveUp, nil, func(ctx *MessageContext) error {
+		ctx.command(commandEnd, true) // 认输
+		return nil
+	}, playingOnly)
+
+	Handle(r, messageJoin, func(ctx *MessageContext, msg joinMessage) error {
+		ctx.command(commandJoin, msg)
+		return nil
+	}, notInGame, notJoined)
+
+	Handle(r, messageCreate, func(ctx *MessageContext, msg createMessage) error {
+		settings := room.DefaultRoomSettings()
+		if msg.Settings != nil {
+			settings = *msg.Settings
+		}
+		if err := settings.Examine(); err != nil {
+			ctx.Fail(CodeInvalidSettings, err.Error())
+			return nil
+		}
+		ctx.command(commandCreate, settings)
+		return nil
+	}, rejectWhileDraining, notInGame, notJoined, RateLimit(5, 10*time.Second))
+
+	Handle(r, messageDraw, func(ctx *MessageContext, msg drawMessage) error {
+		ctx.command(commandDraw, msg)
+		return nil
+	}, playingOnly)
+
+	r.Register(messageTakeback, nil, func(ctx *MessageContext) error {
+		ctx.command(commandTakeback, nil)
+		return nil
+	}, playingOnly)
+
+	Handle(r, messageTakebackReply, func(ctx *MessageContext, msg takebackReplyMessage) error {
+		ctx.command(commandTakebackReply, msg)
+		return nil
+	}, playingOnly)
+
+	Handle(r, messageReady, func(ctx *MessageContext, msg readyMessage) error {
+		ctx.command(commandReady, msg)
+		return nil
+	}, roomOnly)
+
+	r.Register(messageKick, nil, func(ctx *MessageContext) error {
+		ctx.command(commandKick, nil)
+		return nil
+	}, roomOnly)
+
+	r.Register(messageRematch, nil, func(ctx *MessageContext) error {
+		ctx.command(commandRematch, nil)
+		return nil
+	}, roomOnly)
+
+	r.Register(messageLeave, nil, func(ctx *MessageContext) error {
+		ctx.command(commandLeave, nil)
+		return nil
+	}, Guard(inRoom, Reject(CodeNotInRoom, "您不在房间中")))
+
+	Handle(r, messageChat, func(ctx *MessageContext, msg chatMessage) error {
+		ctx.command(commandChat, msg)
+		return nil
+	}, Guard(inRoom, Reject(CodeNotInRoom, "您不在房间中")), RateLimit(5, 5*time.Second))
+
+	r.Register(messageResync, nil, func(ctx *MessageContext) error {
+		ctx.command(commandResync, nil)
+		return nil
+	}, Guard(inRoom, Reject(CodeNotInRoom, "您不在房间中")))
+
+	Handle(r, messageLobby, func(ctx *MessageContext, msg lobbySubscribeMessage) error {
+		if msg.Subscribe {
+			ctx.Hub.subscribeLobby(ctx.Client)
+		} else {
+			ctx.Hub.unsubscribeLobby(ctx.Client)
+		}
+		return nil
+	})
+
+	Handle(r, messageChallenge, func(ctx *MessageContext, msg challengeRequest) error {
+		ctx.Hub.createChallenge(ctx, msg)
+		return nil
+	}, rejectWhileDraining, RateLimit(5, 10*time.Second))
+
+	Handle(r, messageChallengeReply, func(ctx *MessageContext, msg challengeReplyMessage) error {
+		ctx.Hub.replyChallenge(ctx, msg)
+		return nil
+	})
+
+	Handle(r, messageChallengeCancel, func(ctx *MessageContext, msg challengeReplyMessage) error {
+		ctx.Hub.cancelChallenge(ctx, msg.ChallengeId)
+		return nil
+	})
+
+	Handle(r, messageSpectate, func(ctx *MessageContext, msg joinMessage) error {
+		ctx.command(commandSpectate, msg)
+		return nil
+	}, Guard(idle, Reject(CodeInvalidState, "当前状态无法观战")))
+}
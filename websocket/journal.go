@@ -0,0 +1,247 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"chinese-chess-backend/dto/room"
+	"chinese-chess-backend/utils"
+)
+
+// JournalEntry 房间处理过的一条命令。房间的第一条记录是创建房间、匹配成功或接受挑战，
+// 之后依次是房间协程按顺序处理的命令
+type JournalEntry struct {
+	RoomId  int             `json:"roomId"`
+	Seq     int             `json:"seq"`
+	Time    time.Time       `json:"time"`
+	Command CommendType     `json:"command"`
+	UserId  int             `json:"userId,omitempty"`
+	Name    string          `json:"name,omitempty"`
+	Exp     int             `json:"exp,omitempty"`
+	Seed    uint64          `json:"seed,omitempty"` // 仅第一条记录携带房间的随机数种子
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Journal 只追加的房间命令日志
+type Journal interface {
+	Append(ctx context.Context, entry JournalEntry) error
+	Read(ctx context.Context, roomId int) ([]JournalEntry, error)
+}
+
+// WithJournal 记录每个房间处理的命令，可以用Replay复现房间发出的消息
+func WithJournal(journal Journal) HubOption {
+	return func(ch *ChessHub) {
+		ch.journal = journal
+	}
+}
+
+type fileJournal struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileJournal 每个房间的日志保存为dir下的一个JSON Lines文件
+func NewFileJournal(dir string) (Journal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileJournal{dir: dir}, nil
+}
+
+func (j *fileJournal) path(roomId int) string {
+	return filepath.Join(j.dir, fmt.Sprintf("room-%d.jsonl", roomId))
+}
+
+func (j *fileJournal) Append(ctx context.Context, entry JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f, err := os.OpenFile(j.path(entry.RoomId), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (j *fileJournal) Read(ctx context.Context, roomId int) ([]JournalEntry, error) {
+	f, err := os.Open(j.path(roomId))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := make([]JournalEntry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("解析日志失败: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+type redisJournal struct {
+	rdb *redis.Client
+}
+
+// NewRedisJournal 每个房间的日志保存为一个Redis Stream
+func NewRedisJournal(rdb *redis.Client) Journal {
+	return &redisJournal{rdb: rdb}
+}
+
+func (j *redisJournal) key(roomId int) string {
+	return fmt.Sprintf("chess:journal:%d", roomId)
+}
+
+func (j *redisJournal) Append(ctx context.Context, entry JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return j.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: j.key(entry.RoomId),
+		Values: map[string]any{"entry": data},
+	}).Err()
+}
+
+func (j *redisJournal) Read(ctx context.Context, roomId int) ([]JournalEntry, error) {
+	messages, err := j.rdb.XRange(ctx, j.key(roomId), "-", "+").Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]JournalEntry, 0, len(messages))
+	for _, msg := range messages {
+		data, _ := msg.Values["entry"].(string)
+		var entry JournalEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, fmt.Errorf("解析日志失败: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// appendJournal 按房间顺序异步写入日志，任务队列已满时房间协程等待空位。
+// 写入失败的记录在日志中留下序号空缺，Replay会拒绝回放这样的日志
+func (cr *ChessRoom) appendJournal(entry JournalEntry) {
+	journal := cr.hub.journal
+	if journal == nil {
+		return
+	}
+	entry.RoomId = cr.Id
+	entry.Seq = cr.journalSeq
+	entry.Time = cr.now()
+	cr.journalSeq++
+	_, err := cr.hub.pool.Submit(context.Background(), func() error {
+		return journal.Append(context.Background(), entry)
+	}, utils.WithKey(fmt.Sprintf("journal:%d", cr.Id)))
+	if err != nil {
+		log.Printf("写入房间 %d 第 %d 条日志失败: %v\n", cr.Id, entry.Seq, err)
+	}
+}
+
+// record 记录房间协程即将处理的命令
+func (cr *ChessRoom) record(cmd hubCommand) {
+	if cr.hub.journal == nil {
+		return
+	}
+	switch cmd.commandType {
+	case commandSync, commandShutdown, commandState:
+		// 不属于对局本身的命令
+		return
+	}
+	payload, err := encodePayload(cmd.payload)
+	if err != nil {
+		log.Printf("序列化房间日志失败: %v\n", err)
+		return
+	}
+	entry := JournalEntry{
+		Command: cmd.commandType,
+		Payload: payload,
+	}
+	if c := cmd.client; c != nil {
+		entry.UserId, entry.Name, entry.Exp = c.Id, c.Name, c.getExp()
+	}
+	cr.appendJournal(entry)
+}
+
+// journalCreate 记录玩家创建房间，在房间协程启动前调用
+func (ch *ChessHub) journalCreate(r *ChessRoom, host *Client) {
+	if ch.journal == nil {
+		return
+	}
+	payload, err := json.Marshal(r.Settings)
+	if err != nil {
+		log.Printf("序列化房间日志失败: %v\n", err)
+		return
+	}
+	r.appendJournal(JournalEntry{
+		Command: commandCreate,
+		UserId:  host.Id,
+		Name:    host.Name,
+		Exp:     host.getExp(),
+		Seed:    r.seed,
+		Payload: payload,
+	})
+}
+
+// challengeJournal 挑战创建的房间的日志内容，第一名玩家是挑战者
+type challengeJournal struct {
+	Players  []*playerSnapshot `json:"players"`
+	Settings room.RoomSettings `json:"settings"`
+}
+
+// journalChallenge 记录接受挑战后创建的房间，在房间协程启动前调用
+func (ch *ChessHub) journalChallenge(r *ChessRoom, challenger, target *Client) {
+	if ch.journal == nil {
+		return
+	}
+	payload, err := json.Marshal(challengeJournal{
+		Players:  []*playerSnapshot{newPlayerSnapshot(challenger), newPlayerSnapshot(target)},
+		Settings: r.Settings,
+	})
+	if err != nil {
+		log.Printf("序列化房间日志失败: %v\n", err)
+		return
+	}
+	r.appendJournal(JournalEntry{
+		Command: commandChallenge,
+		Seed:    r.seed,
+		Payload: payload,
+	})
+}
+
+// journalMatch 记录匹配成功创建的房间，在房间协程启动前调用
+func (ch *ChessHub) journalMatch(r *ChessRoom, a, b *Client) {
+	if ch.journal == nil {
+		return
+	}
+	payload, err := json.Marshal([]*playerSnapshot{newPlayerSnapshot(a), newPlayerSnapshot(b)})
+	if err != nil {
+		log.Printf("序列化房间日志失败: %v\n", err)
+		return
+	}
+	r.appendJournal(JournalEntry{
+		Command: commandMatch,
+		Seed:    r.seed,
+		Payload: payload,
+	})
+}
@@ -0,0 +1,90 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"chinese-chess-backend/utils"
+)
+
+// recordedGame 在记录日志的大厅中下完一局，返回房间的日志
+func recordedGame(t *testing.T) []JournalEntry {
+	t.Helper()
+	journal, err := NewFileJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := utils.NewFakeClock(time.Now())
+	hub := NewChessHub(WithClock(clock), WithJournal(journal))
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+	red := newTestClient(t, hub, 1)
+	black := newTestClient(t, hub, 2)
+
+	roomId := openRoom(t, red, black, `{"color":"red"}`)
+	red.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.waitMessage(t, messageCountdown, nil)
+	advanceClock(t, clock, red)
+	red.send(t, `{"type":%d,"from":{"x":7,"y":7},"to":{"x":4,"y":7}}`, messageMove)
+	black.waitMessage(t, messageMove, nil)
+	red.send(t, `{"type":%d}`, messageGiveUp)
+	black.waitMessage(t, messageEnd, nil)
+
+	var entries []JournalEntry
+	waitUntil(t, "日志写入认输", func() bool {
+		entries, err = journal.Read(context.Background(), roomId)
+		return err == nil && slices.ContainsFunc(entries, func(e JournalEntry) bool {
+			return e.Command == commandEnd
+		})
+	})
+	return entries
+}
+
+func TestReplayReproducesRoomMessages(t *testing.T) {
+	entries := recordedGame(t)
+	messages, err := Replay(entries)
+	if err != nil {
+		t.Fatalf("回放失败: %v", err)
+	}
+	// 黑方依次收到红方的走子和对局结束
+	var types []MessageType
+	for _, m := range messages {
+		if m.UserId != 2 {
+			continue
+		}
+		var base BaseMessage
+		if err := json.Unmarshal(m.Message, &base); err != nil {
+			t.Fatal(err)
+		}
+		if base.Type == messageMove || base.Type == messageEnd {
+			types = append(types, base.Type)
+		}
+	}
+	if !slices.Equal(types, []MessageType{messageMove, messageEnd}) {
+		t.Fatalf("回放的消息不正确: %v", types)
+	}
+}
+
+func TestReplayRejectsJournalGaps(t *testing.T) {
+	entries := recordedGame(t)
+	// 中间一条写入失败的日志
+	gap := slices.Delete(slices.Clone(entries), 2, 3)
+	if _, err := Replay(gap); err == nil || !strings.Contains(err.Error(), "缺少第 2 条") {
+		t.Fatalf("日志不连续时应当拒绝回放，实际 %v", err)
+	}
+	if _, err := Replay(entries[1:]); err == nil {
+		t.Fatal("缺少第一条日志时应当拒绝回放")
+	}
+	if _, err := Replay(nil); err == nil {
+		t.Fatal("日志为空时应当拒绝回放")
+	}
+}
@@ -0,0 +1,152 @@
+package websocket
+
+import (
+	"log"
+	"slices"
+
+	"chinese-chess-backend/dto/room"
+)
+
+type lobbyEvent string
+
+const (
+	lobbyRoomAdded   lobbyEvent = "added"
+	lobbyRoomUpdated lobbyEvent = "updated"
+	lobbyRoomRemoved lobbyEvent = "removed"
+)
+
+type lobbySubscribeMessage struct {
+	BaseMessage
+	Subscribe bool `json:"subscribe"`
+}
+
+// lobbySnapshotMessage 订阅大厅时下发的完整房间列表
+type lobbySnapshotMessage struct {
+	BaseMessage
+	Rooms []room.RoomInfo `json:"rooms"`
+}
+
+// lobbyEventMessage 房间列表的增量变化，removed事件只携带房间id
+type lobbyEventMessage struct {
+	BaseMessage
+	Event  lobbyEvent     `json:"event"`
+	RoomId int            `json:"roomId"`
+	Room   *room.RoomInfo `json:"room,omitempty"`
+}
+
+func (ch *ChessHub) roomInfo(r *ChessRoom) room.RoomInfo {
+	info := room.RoomInfo{
+		Id:       r.Id,
+		Settings: r.Settings,
+	}
+	if r.Host != nil {
+		info.Current = r.Host.userInfo()
+	}
+	if guest := r.guest(); guest != nil {
+		info.Next = guest.userInfo()
+	}
+	return info
+}
+
+// SpareRooms 返回当前有空位的房间列表的副本，集群模式下包含所有节点的房间
+func (ch *ChessHub) SpareRooms() []room.RoomInfo {
+	if ch.cluster != nil {
+		rooms, err := ch.cluster.spareRooms()
+		if err == nil {
+			return rooms
+		}
+		log.Printf("读取集群空余房间失败: %v\n", err)
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return slices.Clone(ch.spareRooms)
+}
+
+// addSpareRoom 将有空位的房间加入房间列表，已在列表中则更新房间信息
+func (ch *ChessHub) addSpareRoom(r *ChessRoom) {
+	info := ch.roomInfo(r)
+	event := lobbyRoomAdded
+	ch.mu.Lock()
+	idx := slices.IndexFunc(ch.spareRooms, func(i room.RoomInfo) bool {
+		return i.Id == r.Id
+	})
+	if idx >= 0 {
+		ch.spareRooms[idx] = info
+		event = lobbyRoomUpdated
+	} else {
+		ch.spareRooms = append(ch.spareRooms, info)
+	}
+	ch.mu.Unlock()
+
+	msg := lobbyEventMessage{
+		BaseMessage: BaseMessage{Type: messageLobbyEvent},
+		Event:       event,
+		RoomId:      r.Id,
+		Room:        &info,
+	}
+	if ch.cluster != nil {
+		ch.cluster.setSpareRoom(info, msg)
+		return
+	}
+	ch.publishLobby(msg)
+}
+
+func (ch *ChessHub) removeSpareRoom(roomId int) {
+	ch.mu.Lock()
+	idx := slices.IndexFunc(ch.spareRooms, func(i room.RoomInfo) bool {
+		return i.Id == roomId
+	})
+	if idx >= 0 {
+		ch.spareRooms = slices.Delete(ch.spareRooms, idx, idx+1)
+	}
+	ch.mu.Unlock()
+
+	if idx < 0 {
+		return
+	}
+	msg := lobbyEventMessage{
+		BaseMessage: BaseMessage{Type: messageLobbyEvent},
+		Event:       lobbyRoomRemoved,
+		RoomId:      roomId,
+	}
+	if ch.cluster != nil {
+		ch.cluster.deleteSpareRoom(roomId, msg)
+		return
+	}
+	ch.publishLobby(msg)
+}
+
+// subscribeLobby 订阅大厅并下发当前房间列表
+func (ch *ChessHub) subscribeLobby(c *Client) {
+	ch.mu.Lock()
+	ch.lobby[c.Id] = c
+	ch.mu.Unlock()
+	rooms := ch.SpareRooms()
+
+	c.sendMessage(lobbySnapshotMessage{
+		BaseMessage: BaseMessage{Type: messageLobby},
+		Rooms:       rooms,
+	})
+}
+
+func (ch *ChessHub) unsubscribeLobby(c *Client) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.lobby[c.Id] == c {
+		delete(ch.lobby, c.Id)
+	}
+}
+
+// publishLobby 推送给本节点的大厅订阅者，集群模式下由各节点收到大厅广播后调用
+func (ch *ChessHub) publishLobby(message lobbyEventMessage) {
+	ch.mu.Lock()
+	subscribers := make([]*Client, 0, len(ch.lobby))
+	for _, c := range ch.lobby {
+		subscribers = append(subscribers, c)
+	}
+	ch.mu.Unlock()
+
+	for _, c := range subscribers {
+		c.sendMessage(message)
+	}
+}
@@ -1,5 +1,11 @@
 package websocket
 
+import (
+	"chinese-chess-backend/dto/game"
+	"chinese-chess-backend/dto/room"
+	"chinese-chess-backend/dto/user"
+)
+
 type MessageType int
 
 // 信息类型
@@ -15,10 +21,39 @@ const (
 	messageError  = 10
 )
 
+const (
+	messageTakeback        MessageType = iota + 11 // 悔棋请求
+	messageTakebackReply                           // 悔棋回复
+	messageSpectate                                // 观战消息
+	messageClock                                   // 棋钟消息
+	messageReady                                   // 准备消息
+	messageKick                                    // 踢人消息
+	messageCountdown                               // 开局倒计时消息
+	messageRematch                                 // 再来一局消息
+	messageScore                                   // 比分消息
+	messageLeave                                   // 离开房间消息
+	messageRoomExpired                             // 房间过期消息
+	messageLobby                                   // 订阅大厅消息
+	messageLobbyEvent                              // 大厅房间变化消息
+	messageResync                                  // 重连后的对局同步消息
+	messageMaintenance                             // 服务器停机维护消息
+	messageChat                                    // 房间聊天消息
+	messageAck                                     // v2协议中对请求的确认
+	messageDraw                                    // 提和、接受或拒绝和棋
+	messageCorrespondence                          // 通信对局走子或对局变化
+	messageChallenge                               // 发起挑战或挑战状态变化
+	messageChallengeReply                          // 接受或拒绝挑战
+	messageChallengeCancel                         // 取消自己发起的挑战
+	messageFriend                                  // 好友请求或好友关系变化
+	messagePresence                                // 好友的在线状态变化
+)
+
 type BaseMessage struct {
 	Type MessageType `json:"type"`
 }
 
+// Position 双方客户端共用的棋盘坐标，x为列（0到8），y为行（0到9），y轴向下，
+// 黑方在上方、红方在下方，与xiangqi.Position一致
 type Position struct {
 	X int `json:"x"`
 	Y int `json:"y"`
@@ -26,8 +61,10 @@ type Position struct {
 
 type MoveMessage struct {
 	BaseMessage
-	From Position `json:"from"`
-	To   Position `json:"to"`
+	From   Position `json:"from"`
+	To     Position `json:"to"`
+	MoveId string   `json:"moveId,omitempty"` // 客户端生成的走子id，重发的走子只会处理一次
+	Ply    int      `json:"ply,omitempty"`    // 客户端发送时为期望的序号，服务端转发时为走完后房间的序号
 }
 
 type NormalMessage struct {
@@ -37,15 +74,168 @@ type NormalMessage struct {
 
 type startMessage struct {
 	BaseMessage
-	Role string `json:"role"`
+	Role     string            `json:"role"`
+	Settings room.RoomSettings `json:"settings"`
+	Ply      int               `json:"ply"`
 }
 
 type joinMessage struct {
 	BaseMessage
 	RoomId int `json:"roomId"`
+	UserId int `json:"userId,omitempty"` // 加入房间的玩家，仅服务端下发时携带
+	Ply    int `json:"ply,omitempty"`    // 仅服务端下发时携带
+}
+
+type createMessage struct {
+	BaseMessage
+	Settings *room.RoomSettings `json:"settings"`
 }
 
 type endMessage struct {
 	BaseMessage
 	Winner clientRole `json:"winner"`
+	Ply    int        `json:"ply"`
+}
+
+type takebackReplyMessage struct {
+	BaseMessage
+	Accept bool `json:"accept"`
+	Ply    int  `json:"ply,omitempty"` // 仅服务端下发时携带
+}
+
+type spectateMessage struct {
+	BaseMessage
+	RoomId   int               `json:"roomId"`
+	Red      int               `json:"red"`
+	Black    int               `json:"black"`
+	History  []MoveMessage     `json:"history"`
+	Settings room.RoomSettings `json:"settings"`
+	Ply      int               `json:"ply"`
+}
+
+// clockMessage 双方剩余时间，单位为毫秒
+type clockMessage struct {
+	BaseMessage
+	Red   int64      `json:"red"`
+	Black int64      `json:"black"`
+	Turn  clientRole `json:"turn"`
+	Ply   int        `json:"ply"`
+}
+
+type readyMessage struct {
+	BaseMessage
+	UserId int  `json:"userId"`
+	Ready  bool `json:"ready"`
+	Ply    int  `json:"ply,omitempty"` // 仅服务端下发时携带
+}
+
+type countdownMessage struct {
+	BaseMessage
+	Seconds int  `json:"seconds"`
+	Cancel  bool `json:"cancel"`
+	Ply     int  `json:"ply"`
+}
+
+type rematchMessage struct {
+	BaseMessage
+	UserId int `json:"userId"`
+	Ply    int `json:"ply"`
+}
+
+// scoreMessage 房间内的比分，Scores为玩家id到胜局数的映射
+type scoreMessage struct {
+	BaseMessage
+	Scores map[int]int `json:"scores"`
+	Draws  int         `json:"draws"`
+	Ply    int         `json:"ply"`
+}
+
+type leaveMessage struct {
+	BaseMessage
+	UserId int `json:"userId"`
+	Ply    int `json:"ply"`
+}
+
+// drawMessage 客户端Accept为true时提和或接受对方的提和，为false时拒绝对方或撤回自己的提和；
+// 服务端转发时补上发起的玩家
+type drawMessage struct {
+	BaseMessage
+	UserId int  `json:"userId,omitempty"`
+	Accept bool `json:"accept"`
+	Ply    int  `json:"ply,omitempty"` // 仅服务端下发时携带
+}
+
+// correspondenceMoveMessage 客户端在通信对局中走子，Ply为期望的步数，含义与MoveMessage相同
+type correspondenceMoveMessage struct {
+	BaseMessage
+	GameId uint     `json:"gameId"`
+	From   Position `json:"from"`
+	To     Position `json:"to"`
+	Ply    int      `json:"ply,omitempty"`
+}
+
+// correspondenceMessage 通信对局发生变化时推送给在线的双方
+type correspondenceMessage struct {
+	BaseMessage
+	Game game.GameInfo `json:"game"`
+}
+
+// challengeRequest 客户端向指定玩家发起挑战，Settings为空时使用默认设置
+type challengeRequest struct {
+	BaseMessage
+	TargetId int                `json:"targetId"`
+	Settings *room.RoomSettings `json:"settings,omitempty"`
+}
+
+// challengeReplyMessage 客户端接受或拒绝挑战，取消挑战时只需携带ChallengeId
+type challengeReplyMessage struct {
+	BaseMessage
+	ChallengeId string `json:"challengeId"`
+	Accept      bool   `json:"accept"`
+}
+
+// challengeMessage 挑战发起或状态变化时推送给双方，Event为challengeCreated等
+type challengeMessage struct {
+	BaseMessage
+	Event     string    `json:"event"`
+	Challenge Challenge `json:"challenge"`
+}
+
+// friendMessage 好友请求或好友关系变化时推送给对方，Event为user.FriendRequested等
+type friendMessage struct {
+	BaseMessage
+	Event  string          `json:"event"`
+	Friend user.FriendInfo `json:"friend"`
+}
+
+// presenceMessage 好友的在线状态变化时推送
+type presenceMessage struct {
+	BaseMessage
+	UserId   int           `json:"userId"`
+	Presence user.Presence `json:"presence"`
+}
+
+// chatMessage 客户端只需携带Content，服务端转发时补上发送者
+type chatMessage struct {
+	BaseMessage
+	UserId  int    `json:"userId,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Content string `json:"content"`
+	Ply     int    `json:"ply,omitempty"` // 仅服务端下发时携带
+}
+
+// resyncMessage 玩家重连回房间后下发的完整对局状态
+type resyncMessage struct {
+	BaseMessage
+	RoomId   int               `json:"roomId"`
+	Role     clientRole        `json:"role"`
+	Playing  bool              `json:"playing"`
+	Red      int               `json:"red"`
+	Black    int               `json:"black"`
+	History  []MoveMessage     `json:"history"`
+	Settings room.RoomSettings `json:"settings"`
+	Clock    *clockMessage     `json:"clock,omitempty"`
+	Scores   map[int]int       `json:"scores"`
+	Draws    int               `json:"draws"`
+	Ply      int               `json:"ply"`
 }
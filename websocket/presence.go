@@ -0,0 +1,265 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"chinese-chess-backend/dto/user"
+)
+
+const (
+	redisPresenceKey     = "chess:presence"
+	presenceStoreTimeout = 3 * time.Second // 读写在线状态的超时时间
+)
+
+// PresenceStore 保存在线玩家的状态，不在存储中的玩家视为离线。
+// node为写入状态的节点，玩家断开时只删除本节点写入的状态，避免覆盖玩家在其他节点上的新连接
+type PresenceStore interface {
+	Set(ctx context.Context, node string, userId int, p user.Presence) error
+	Delete(ctx context.Context, node string, userId int) error
+	Get(ctx context.Context, userIds []int) (map[int]user.Presence, error)
+	// Clear 删除node写入的所有状态，节点启动时调用，清理上次异常退出时遗留的在线状态
+	Clear(ctx context.Context, node string) error
+}
+
+// WithPresenceStore 指定在线状态的存储，默认保存在内存中，集群中需要使用共享的存储
+func WithPresenceStore(store PresenceStore) HubOption {
+	return func(ch *ChessHub) {
+		ch.presence = store
+	}
+}
+
+type presenceEntry struct {
+	user.Presence
+	Node string `json:"node"`
+}
+
+type memoryPresenceStore struct {
+	mu      sync.Mutex
+	entries map[int]presenceEntry
+}
+
+func newMemoryPresenceStore() *memoryPresenceStore {
+	return &memoryPresenceStore{entries: make(map[int]presenceEntry)}
+}
+
+func (s *memoryPresenceStore) Set(_ context.Context, node string, userId int, p user.Presence) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[userId] = presenceEntry{Presence: p, Node: node}
+	return nil
+}
+
+func (s *memoryPresenceStore) Delete(_ context.Context, node string, userId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[userId]; ok && e.Node == node {
+		delete(s.entries, userId)
+	}
+	return nil
+}
+
+func (s *memoryPresenceStore) Get(_ context.Context, userIds []int) (map[int]user.Presence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	presence := make(map[int]user.Presence, len(userIds))
+	for _, id := range userIds {
+		if e, ok := s.entries[id]; ok {
+			presence[id] = e.Presence
+		}
+	}
+	return presence, nil
+}
+
+func (s *memoryPresenceStore) Clear(_ context.Context, node string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, e := range s.entries {
+		if e.Node == node {
+			delete(s.entries, id)
+		}
+	}
+	return nil
+}
+
+type redisPresenceStore struct {
+	rdb *redis.Client
+}
+
+// NewRedisPresenceStore 把在线状态保存在Redis的哈希中，集群中所有节点共用
+func NewRedisPresenceStore(rdb *redis.Client) PresenceStore {
+	return &redisPresenceStore{rdb: rdb}
+}
+
+// deletePresenceScript 只在状态由指定节点写入时删除
+var deletePresenceScript = redis.NewScript(`
+local value = redis.call('HGET', KEYS[1], ARGV[1])
+if value and cjson.decode(value).node == ARGV[2] then
+	return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+func (s *redisPresenceStore) Set(ctx context.Context, node string, userId int, p user.Presence) error {
+	data, err := json.Marshal(presenceEntry{Presence: p, Node: node})
+	if err != nil {
+		return err
+	}
+	return s.rdb.HSet(ctx, redisPresenceKey, strconv.Itoa(userId), data).Err()
+}
+
+func (s *redisPresenceStore) Delete(ctx context.Context, node string, userId int) error {
+	return deletePresenceScript.Run(ctx, s.rdb, []string{redisPresenceKey}, strconv.Itoa(userId), node).Err()
+}
+
+func (s *redisPresenceStore) Get(ctx context.Context, userIds []int) (map[int]user.Presence, error) {
+	presence := make(map[int]user.Presence, len(userIds))
+	if len(userIds) == 0 {
+		return presence, nil
+	}
+	fields := make([]string, 0, len(userIds))
+	for _, id := range userIds {
+		fields = append(fields, strconv.Itoa(id))
+	}
+	values, err := s.rdb.HMGet(ctx, redisPresenceKey, fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var e presenceEntry
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			log.Printf("解析在线状态失败: %v\n", err)
+			continue
+		}
+		presence[userIds[i]] = e.Presence
+	}
+	return presence, nil
+}
+
+func (s *redisPresenceStore) Clear(ctx context.Context, node string) error {
+	entries, err := s.rdb.HGetAll(ctx, redisPresenceKey).Result()
+	if err != nil {
+		return err
+	}
+	stale := make([]string, 0)
+	for field, data := range entries {
+		var e presenceEntry
+		if json.Unmarshal([]byte(data), &e) == nil && e.Node == node {
+			stale = append(stale, field)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	return s.rdb.HDel(ctx, redisPresenceKey, stale...).Err()
+}
+
+// FriendLister 查询玩家的好友，由service中的FriendService实现
+type FriendLister interface {
+	FriendIds(userId int) ([]int, error)
+}
+
+// RegisterFriends 玩家的在线状态变化时推送给其所有好友
+func RegisterFriends(ch *ChessHub, friends FriendLister) {
+	Subscribe(ch.events, func(e PresenceChanged) {
+		ids, err := friends.FriendIds(e.UserId)
+		if err != nil {
+			log.Printf("查询好友失败: %v\n", err)
+			return
+		}
+		msg := presenceMessage{
+			BaseMessage: BaseMessage{Type: messagePresence},
+			UserId:      e.UserId,
+			Presence:    e.Presence,
+		}
+		for _, id := range ids {
+			ch.deliver(id, msg)
+		}
+	})
+}
+
+// NotifyFriend 把好友请求和好友关系的变化推送给玩家
+func (ch *ChessHub) NotifyFriend(userId int, event string, friend user.FriendInfo) {
+	ch.deliver(userId, friendMessage{
+		BaseMessage: BaseMessage{Type: messageFriend},
+		Event:       event,
+		Friend:      friend,
+	})
+}
+
+// Presence 查询玩家的在线状态，不在结果中的玩家为离线
+func (ch *ChessHub) Presence(userIds []int) map[int]user.Presence {
+	ctx, cancel := context.WithTimeout(context.Background(), presenceStoreTimeout)
+	defer cancel()
+	presence, err := ch.presence.Get(ctx, userIds)
+	if err != nil {
+		log.Printf("读取在线状态失败: %v\n", err)
+		return map[int]user.Presence{}
+	}
+	return presence
+}
+
+// online 返回玩家是否在线。集群模式下本节点没有玩家的连接时，从共享的存储中读取其他节点写入的在线状态
+func (ch *ChessHub) online(userId int) bool {
+	if ch.getClient(userId) != nil {
+		return true
+	}
+	if ch.cluster == nil {
+		return false
+	}
+	_, ok := ch.Presence([]int{userId})[userId]
+	return ok
+}
+
+func (ch *ChessHub) nodeId() string {
+	if ch.cluster == nil {
+		return ""
+	}
+	return ch.cluster.nodeId
+}
+
+// publishPresence 玩家状态变化时发布在线状态，已被新连接替换的旧连接不再发布
+func (ch *ChessHub) publishPresence(c *Client) {
+	if ch.getClient(c.Id) != c {
+		return
+	}
+	ch.events.Publish(PresenceChanged{
+		UserId:   c.Id,
+		Presence: c.presence(),
+		Time:     ch.clock.Now(),
+	})
+}
+
+// savePresence 按发布顺序把在线状态写入存储，避免阻塞修改状态的大厅和房间协程
+func (ch *ChessHub) savePresence(e PresenceChanged) {
+	ctx, cancel := context.WithTimeout(context.Background(), presenceStoreTimeout)
+	defer cancel()
+	var err error
+	if e.Presence.State == user.PresenceOffline {
+		err = ch.presence.Delete(ctx, ch.nodeId(), e.UserId)
+	} else {
+		err = ch.presence.Set(ctx, ch.nodeId(), e.UserId, e.Presence)
+	}
+	if err != nil {
+		log.Printf("保存在线状态失败: %v\n", err)
+	}
+}
+
+// clearPresence 清理本节点上次运行时遗留的在线状态
+func (ch *ChessHub) clearPresence() {
+	ctx, cancel := context.WithTimeout(context.Background(), presenceStoreTimeout)
+	defer cancel()
+	if err := ch.presence.Clear(ctx, ch.nodeId()); err != nil {
+		log.Printf("清理在线状态失败: %v\n", err)
+	}
+}
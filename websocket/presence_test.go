@@ -0,0 +1,77 @@
+package websocket
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"chinese-chess-backend/dto/user"
+	"chinese-chess-backend/utils"
+)
+
+// fakeFriendLister 内存中的好友关系
+type fakeFriendLister map[int][]int
+
+func (f fakeFriendLister) FriendIds(userId int) ([]int, error) {
+	return slices.Clone(f[userId]), nil
+}
+
+// presenceOf 匹配userId的在线状态推送
+func presenceOf(userId int, state string) func(m map[string]any) bool {
+	return func(m map[string]any) bool {
+		p, _ := m["presence"].(map[string]any)
+		return m["userId"] == float64(userId) && p["state"] == state
+	}
+}
+
+func TestPresencePushedToFriends(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+	hub := NewChessHub(WithClock(clock))
+	RegisterFriends(hub, fakeFriendLister{1: {2}, 2: {1}})
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+	alice := newTestClient(t, hub, 1)
+	carol := newTestClient(t, hub, 3)
+
+	// 上线和进入房间都推送给好友
+	bob := newTestClient(t, hub, 2)
+	alice.waitMessage(t, messagePresence, presenceOf(bob.Id, user.PresenceOnline))
+	bob.send(t, `{"type":%d}`, messageCreate)
+	bob.waitMessage(t, messageCreate, nil)
+	m := alice.waitMessage(t, messagePresence, func(m map[string]any) bool {
+		p, _ := m["presence"].(map[string]any)
+		return m["userId"] == float64(bob.Id) && p["roomId"] == float64(bob.getRoomId())
+	})
+	if p, _ := m["presence"].(map[string]any); p["state"] != user.PresenceOnline {
+		t.Fatalf("在房间中等待时应当为在线: %v", m)
+	}
+	waitUntil(t, "保存玩家2的在线状态", func() bool {
+		return hub.Presence([]int{bob.Id})[bob.Id].RoomId == bob.getRoomId()
+	})
+
+	// 下线后推送离线并从存储中删除
+	bob.disconnect(t)
+	alice.waitMessage(t, messagePresence, presenceOf(bob.Id, user.PresenceOffline))
+	waitUntil(t, "删除玩家2的在线状态", func() bool {
+		_, ok := hub.Presence([]int{bob.Id})[bob.Id]
+		return !ok
+	})
+	if carol.find(func(m map[string]any) bool { return m["type"] == float64(messagePresence) }) != nil {
+		t.Fatal("在线状态不应当推送给不是好友的玩家")
+	}
+	if alice.find(presenceOf(alice.Id, user.PresenceOnline)) != nil {
+		t.Fatal("自己的在线状态不应当推送给自己")
+	}
+
+	// 好友请求推送给在线的玩家
+	hub.NotifyFriend(alice.Id, user.FriendRequested, user.FriendInfo{Id: 3, Name: "player3"})
+	req := alice.waitMessage(t, messageFriend, nil)
+	if f, _ := req["friend"].(map[string]any); req["event"] != user.FriendRequested || f["id"] != float64(3) {
+		t.Fatalf("好友请求的推送不正确: %v", req)
+	}
+}
@@ -0,0 +1,679 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"chinese-chess-backend/dto/game"
+	"chinese-chess-backend/dto/room"
+	"chinese-chess-backend/dto/user"
+)
+
+// 按proto/chess.proto手写的protobuf编解码，字段编号必须与schema保持一致
+
+// protoMessage 可以编码为protobuf的下发消息
+type protoMessage interface {
+	appendProto(b []byte) []byte
+}
+
+// protoDecodable 可以从protobuf解码的客户端消息
+type protoDecodable interface {
+	unmarshalProto(b []byte) error
+}
+
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendMessage 编码嵌套消息，fn向传入的空切片追加子消息的字段
+func appendMessage(b []byte, num protowire.Number, fn func(b []byte) []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, fn(nil))
+}
+
+// appendScores 编码map<int32, int32>，按键排序使输出稳定
+func appendScores(b []byte, num protowire.Number, scores map[int]int) []byte {
+	keys := make([]int, 0, len(scores))
+	for k := range scores {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		b = appendMessage(b, num, func(b []byte) []byte {
+			b = appendInt(b, 1, int64(k))
+			return appendInt(b, 2, int64(scores[k]))
+		})
+	}
+	return b
+}
+
+type protoField struct {
+	num   protowire.Number
+	typ   protowire.Type
+	value uint64 // varint字段的值
+	bytes []byte // length-delimited字段的值
+}
+
+func (f protoField) int() int {
+	return int(int64(f.value))
+}
+
+func (f protoField) bool() bool {
+	return f.value != 0
+}
+
+func (f protoField) string() string {
+	return string(f.bytes)
+}
+
+// parseProto 依次把每个字段交给fn，未知字段会被跳过
+func parseProto(b []byte, fn func(f protoField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendPosition(b []byte, p Position) []byte {
+	b = appendInt(b, 1, int64(p.X))
+	return appendInt(b, 2, int64(p.Y))
+}
+
+func parsePosition(b []byte) (Position, error) {
+	var p Position
+	err := parseProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			p.X = f.int()
+		case 2:
+			p.Y = f.int()
+		}
+		return nil
+	})
+	return p, err
+}
+
+func appendSettings(b []byte, s room.RoomSettings) []byte {
+	b = appendString(b, 1, string(s.Color))
+	b = appendMessage(b, 2, func(b []byte) []byte {
+		b = appendInt(b, 1, int64(s.TimeControl.Initial))
+		return appendInt(b, 2, int64(s.TimeControl.Increment))
+	})
+	b = appendBool(b, 3, s.Rated)
+	b = appendBool(b, 4, s.AllowTakeback)
+	return appendBool(b, 5, s.AllowSpectators)
+}
+
+func parseSettings(b []byte) (room.RoomSettings, error) {
+	var s room.RoomSettings
+	err := parseProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			s.Color = room.ColorPreference(f.string())
+		case 2:
+			return parseProto(f.bytes, func(f protoField) error {
+				switch f.num {
+				case 1:
+					s.TimeControl.Initial = f.int()
+				case 2:
+					s.TimeControl.Increment = f.int()
+				}
+				return nil
+			})
+		case 3:
+			s.Rated = f.bool()
+		case 4:
+			s.AllowTakeback = f.bool()
+		case 5:
+			s.AllowSpectators = f.bool()
+		}
+		return nil
+	})
+	return s, err
+}
+
+func appendUserInfo(b []byte, u user.UserInfo) []byte {
+	b = appendInt(b, 1, int64(u.ID))
+	b = appendString(b, 2, u.Token)
+	b = appendString(b, 3, u.Name)
+	b = appendInt(b, 4, int64(u.Exp))
+	return appendBool(b, 5, u.Bot)
+}
+
+func appendRoomInfo(b []byte, info room.RoomInfo) []byte {
+	b = appendInt(b, 1, int64(info.Id))
+	b = appendMessage(b, 2, func(b []byte) []byte { return appendUserInfo(b, info.Current) })
+	b = appendMessage(b, 3, func(b []byte) []byte { return appendUserInfo(b, info.Next) })
+	return appendMessage(b, 4, func(b []byte) []byte { return appendSettings(b, info.Settings) })
+}
+
+func (m NormalMessage) appendProto(b []byte) []byte {
+	return appendString(b, 1, m.Message)
+}
+
+func (m MoveMessage) appendProto(b []byte) []byte {
+	b = appendMessage(b, 1, func(b []byte) []byte { return appendPosition(b, m.From) })
+	b = appendMessage(b, 2, func(b []byte) []byte { return appendPosition(b, m.To) })
+	b = appendString(b, 3, m.MoveId)
+	return appendInt(b, 4, int64(m.Ply))
+}
+
+func (m *MoveMessage) unmarshalProto(b []byte) error {
+	return parseProto(b, func(f protoField) error {
+		var err error
+		switch f.num {
+		case 1:
+			m.From, err = parsePosition(f.bytes)
+		case 2:
+			m.To, err = parsePosition(f.bytes)
+		case 3:
+			m.MoveId = f.string()
+		case 4:
+			m.Ply = f.int()
+		}
+		return err
+	})
+}
+
+func (m startMessage) appendProto(b []byte) []byte {
+	b = appendString(b, 1, m.Role)
+	b = appendMessage(b, 2, func(b []byte) []byte { return appendSettings(b, m.Settings) })
+	return appendInt(b, 3, int64(m.Ply))
+}
+
+func (m endMessage) appendProto(b []byte) []byte {
+	b = appendInt(b, 1, int64(m.Winner))
+	return appendInt(b, 2, int64(m.Ply))
+}
+
+func (m joinMessage) appendProto(b []byte) []byte {
+	b = appendInt(b, 1, int64(m.RoomId))
+	b = appendInt(b, 2, int64(m.UserId))
+	return appendInt(b, 3, int64(m.Ply))
+}
+
+func (m *joinMessage) unmarshalProto(b []byte) error {
+	return parseProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.RoomId = f.int()
+		case 2:
+			m.UserId = f.int()
+		case 3:
+			m.Ply = f.int()
+		}
+		return nil
+	})
+}
+
+func (m *createMessage) unmarshalProto(b []byte) error {
+	return parseProto(b, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		settings, err := parseSettings(f.bytes)
+		m.Settings = &settings
+		return err
+	})
+}
+
+func (m takebackReplyMessage) appendProto(b []byte) []byte {
+	b = appendBool(b, 1, m.Accept)
+	return appendInt(b, 2, int64(m.Ply))
+}
+
+func (m *takebackReplyMessage) unmarshalProto(b []byte) error {
+	return parseProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.Accept = f.bool()
+		case 2:
+			m.Ply = f.int()
+		}
+		return nil
+	})
+}
+
+func (m spectateMessage) appendProto(b []byte) []byte {
+	b = appendInt(b, 1, int64(m.RoomId))
+	b = appendInt(b, 2, int64(m.Red))
+	b = appendInt(b, 3, int64(m.Black))
+	for _, move := range m.History {
+		b = appendMessage(b, 4, move.appendProto)
+	}
+	b = appendMessage(b, 5, func(b []byte) []byte { return appendSettings(b, m.Settings) })
+	return appendInt(b, 6, int64(m.Ply))
+}
+
+func (m clockMessage) appendProto(b []byte) []byte {
+	b = appendInt(b, 1, m.Red)
+	b = appendInt(b, 2, m.Black)
+	b = appendInt(b, 3, int64(m.Turn))
+	return appendInt(b, 4, int64(m.Ply))
+}
+
+func (m readyMessage) appendProto(b []byte) []byte {
+	b = appendInt(b, 1, int64(m.UserId))
+	b = appendBool(b, 2, m.Ready)
+	return appendInt(b, 3, int64(m.Ply))
+}
+
+func (m *readyMessage) unmarshalProto(b []byte) error {
+	return parseProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.UserId = f.int()
+		case 2:
+			m.Ready = f.bool()
+		case 3:
+			m.Ply = f.int()
+		}
+		return nil
+	})
+}
+
+func (m countdownMessage) appendProto(b []byte) []byte {
+	b = appendInt(b, 1, int64(m.Seconds))
+	b = appendBool(b, 2, m.Cancel)
+	return appendInt(b, 3, int64(m.Ply))
+}
+
+func (m rematchMessage) appendProto(b []byte) []byte {
+	b = appendInt(b, 1, int64(m.UserId))
+	return appendInt(b, 2, int64(m.Ply))
+}
+
+func (m scoreMessage) appendProto(b []byte) []byte {
+	b = appendScores(b, 1, m.Scores)
+	b = appendInt(b, 2, int64(m.Draws))
+	return appendInt(b, 3, int64(m.Ply))
+}
+
+func (m leaveMessage) appendProto(b []byte) []byte {
+	b = appendInt(b, 1, int64(m.UserId))
+	return appendInt(b, 2, int64(m.Ply))
+}
+
+func (m *lobbySubscribeMessage) unmarshalProto(b []byte) error {
+	return parseProto(b, func(f protoField) error {
+		if f.num == 1 {
+			m.Subscribe = f.bool()
+		}
+		return nil
+	})
+}
+
+func (m lobbySnapshotMessage) appendProto(b []byte) []byte {
+	for _, info := range m.Rooms {
+		b = appendMessage(b, 1, func(b []byte) []byte { return appendRoomInfo(b, info) })
+	}
+	return b
+}
+
+func (m lobbyEventMessage) appendProto(b []byte) []byte {
+	b = appendString(b, 1, string(m.Event))
+	b = appendInt(b, 2, int64(m.RoomId))
+	if m.Room != nil {
+		b = appendMessage(b, 3, func(b []byte) []byte { return appendRoomInfo(b, *m.Room) })
+	}
+	return b
+}
+
+func (m resyncMessage) appendProto(b []byte) []byte {
+	b = appendInt(b, 1, int64(m.RoomId))
+	b = appendInt(b, 2, int64(m.Role))
+	b = appendBool(b, 3, m.Playing)
+	b = appendInt(b, 4, int64(m.Red))
+	b = appendInt(b, 5, int64(m.Black))
+	for _, move := range m.History {
+		b = appendMessage(b, 6, move.appendProto)
+	}
+	b = appendMessage(b, 7, func(b []byte) []byte { return appendSettings(b, m.Settings) })
+	if m.Clock != nil {
+		b = appendMessage(b, 8, m.Clock.appendProto)
+	}
+	b = appendScores(b, 9, m.Scores)
+	b = appendInt(b, 10, int64(m.Draws))
+	return appendInt(b, 11, int64(m.Ply))
+}
+
+func (m chatMessage) appendProto(b []byte) []byte {
+	b = appendInt(b, 1, int64(m.UserId))
+	b = appendString(b, 2, m.Name)
+	b = appendString(b, 3, m.Content)
+	return appendInt(b, 4, int64(m.Ply))
+}
+
+func (m *chatMessage) unmarshalProto(b []byte) error {
+	return parseProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.UserId = f.int()
+		case 2:
+			m.Name = f.string()
+		case 3:
+			m.Content = f.string()
+		case 4:
+			m.Ply = f.int()
+		}
+		return nil
+	})
+}
+
+func (m drawMessage) appendProto(b []byte) []byte {
+	b = appendInt(b, 1, int64(m.UserId))
+	b = appendBool(b, 2, m.Accept)
+	return appendInt(b, 3, int64(m.Ply))
+}
+
+func (m *drawMessage) unmarshalProto(b []byte) error {
+	return parseProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.UserId = f.int()
+		case 2:
+			m.Accept = f.bool()
+		case 3:
+			m.Ply = f.int()
+		}
+		return nil
+	})
+}
+
+func (m *correspondenceMoveMessage) unmarshalProto(b []byte) error {
+	return parseProto(b, func(f protoField) error {
+		var err error
+		switch f.num {
+		case 1:
+			m.GameId = uint(f.value)
+		case 2:
+			m.From, err = parsePosition(f.bytes)
+		case 3:
+			m.To, err = parsePosition(f.bytes)
+		case 4:
+			m.Ply = f.int()
+		}
+		return err
+	})
+}
+
+func appendCorrespondenceGame(b []byte, g game.GameInfo) []byte {
+	b = appendInt(b, 1, int64(g.Id))
+	b = appendInt(b, 2, int64(g.RedId))
+	b = appendInt(b, 3, int64(g.BlackId))
+	b = appendInt(b, 4, int64(g.DaysPerMove))
+	for _, move := range g.Moves {
+		b = appendMessage(b, 5, func(b []byte) []byte {
+			b = appendMessage(b, 1, func(b []byte) []byte { return appendPosition(b, Position(move.From)) })
+			b = appendMessage(b, 2, func(b []byte) []byte { return appendPosition(b, Position(move.To)) })
+			return appendInt(b, 4, int64(move.Ply))
+		})
+	}
+	b = appendInt(b, 6, int64(g.Ply))
+	b = appendString(b, 7, g.Turn)
+	b = appendString(b, 8, g.Status)
+	b = appendString(b, 9, g.Winner)
+	b = appendString(b, 10, g.Reason)
+	if g.Deadline != nil {
+		b = appendInt(b, 11, g.Deadline.UnixMilli())
+	}
+	return appendInt(b, 12, int64(g.DrawOffer))
+}
+
+func (m correspondenceMessage) appendProto(b []byte) []byte {
+	return appendMessage(b, 1, func(b []byte) []byte { return appendCorrespondenceGame(b, m.Game) })
+}
+
+func (m *challengeRequest) unmarshalProto(b []byte) error {
+	return parseProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.TargetId = f.int()
+		case 2:
+			settings, err := parseSettings(f.bytes)
+			m.Settings = &settings
+			return err
+		}
+		return nil
+	})
+}
+
+func (m challengeMessage) appendProto(b []byte) []byte {
+	c := m.Challenge
+	b = appendString(b, 1, m.Event)
+	return appendMessage(b, 2, func(b []byte) []byte {
+		b = appendString(b, 1, c.Id)
+		b = appendInt(b, 2, int64(c.ChallengerId))
+		b = appendString(b, 3, c.ChallengerName)
+		b = appendInt(b, 4, int64(c.TargetId))
+		b = appendMessage(b, 5, func(b []byte) []byte { return appendSettings(b, c.Settings) })
+		b = appendInt(b, 6, c.CreatedAt.UnixMilli())
+		return appendInt(b, 7, c.ExpiresAt.UnixMilli())
+	})
+}
+
+func (m *challengeReplyMessage) unmarshalProto(b []byte) error {
+	return parseProto(b, func(f protoField) error {
+		switch f.num {
+		case 1:
+			m.ChallengeId = f.string()
+		case 2:
+			m.Accept = f.bool()
+		}
+		return nil
+	})
+}
+
+func appendPresence(b []byte, p user.Presence) []byte {
+	b = appendString(b, 1, p.State)
+	return appendInt(b, 2, int64(p.RoomId))
+}
+
+func (m friendMessage) appendProto(b []byte) []byte {
+	f := m.Friend
+	b = appendString(b, 1, m.Event)
+	return appendMessage(b, 2, func(b []byte) []byte {
+		b = appendInt(b, 1, int64(f.Id))
+		b = appendString(b, 2, f.Name)
+		b = appendInt(b, 3, int64(f.Exp))
+		if f.Presence != nil {
+			b = appendMessage(b, 4, func(b []byte) []byte { return appendPresence(b, *f.Presence) })
+		}
+		return appendInt(b, 5, f.Since.UnixMilli())
+	})
+}
+
+func (m presenceMessage) appendProto(b []byte) []byte {
+	b = appendInt(b, 1, int64(m.UserId))
+	return appendMessage(b, 2, func(b []byte) []byte { return appendPresence(b, m.Presence) })
+}
+
+// inboundProto 客户端消息类型对应的消息结构，不在表中的类型没有消息体
+var inboundProto = map[MessageType]func() protoDecodable{
+	messageMove:            func() protoDecodable { return &MoveMessage{} },
+	messageJoin:            func() protoDecodable { return &joinMessage{} },
+	messageCreate:          func() protoDecodable { return &createMessage{} },
+	messageTakebackReply:   func() protoDecodable { return &takebackReplyMessage{} },
+	messageSpectate:        func() protoDecodable { return &joinMessage{} },
+	messageReady:           func() protoDecodable { return &readyMessage{} },
+	messageLobby:           func() protoDecodable { return &lobbySubscribeMessage{} },
+	messageChat:            func() protoDecodable { return &chatMessage{} },
+	messageDraw:            func() protoDecodable { return &drawMessage{} },
+	messageCorrespondence:  func() protoDecodable { return &correspondenceMoveMessage{} },
+	messageChallenge:       func() protoDecodable { return &challengeRequest{} },
+	messageChallengeReply:  func() protoDecodable { return &challengeReplyMessage{} },
+	messageChallengeCancel: func() protoDecodable { return &challengeReplyMessage{} },
+}
+
+func decodeJSON[T protoMessage](raw []byte) (protoMessage, error) {
+	var msg T
+	err := json.Unmarshal(raw, &msg)
+	return msg, err
+}
+
+// outboundProto 下发消息类型对应的消息结构，用于把集群转发来的JSON消息转为protobuf
+var outboundProto = map[MessageType]func(raw []byte) (protoMessage, error){
+	messageNormal:         decodeJSON[NormalMessage],
+	messageMove:           decodeJSON[MoveMessage],
+	messageStart:          decodeJSON[startMessage],
+	messageEnd:            decodeJSON[endMessage],
+	messageJoin:           decodeJSON[joinMessage],
+	messageCreate:         decodeJSON[NormalMessage],
+	messageError:          decodeJSON[NormalMessage],
+	messageTakebackReply:  decodeJSON[takebackReplyMessage],
+	messageSpectate:       decodeJSON[spectateMessage],
+	messageClock:          decodeJSON[clockMessage],
+	messageReady:          decodeJSON[readyMessage],
+	messageCountdown:      decodeJSON[countdownMessage],
+	messageRematch:        decodeJSON[rematchMessage],
+	messageScore:          decodeJSON[scoreMessage],
+	messageLeave:          decodeJSON[leaveMessage],
+	messageRoomExpired:    decodeJSON[NormalMessage],
+	messageLobby:          decodeJSON[lobbySnapshotMessage],
+	messageLobbyEvent:     decodeJSON[lobbyEventMessage],
+	messageResync:         decodeJSON[resyncMessage],
+	messageMaintenance:    decodeJSON[NormalMessage],
+	messageChat:           decodeJSON[chatMessage],
+	messageDraw:           decodeJSON[drawMessage],
+	messageCorrespondence: decodeJSON[correspondenceMessage],
+	messageChallenge:      decodeJSON[challengeMessage],
+	messageFriend:         decodeJSON[friendMessage],
+	messagePresence:       decodeJSON[presenceMessage],
+}
+
+// jsonBody 去掉type后仍有字段时返回消息的JSON，没有消息体时返回nil
+func jsonBody(raw json.RawMessage) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "type")
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return raw, nil
+}
+
+// marshalFrame 把encode包装好的信封编码为一个二进制帧。
+// 没有protobuf格式的消息以JSON编码放在信封的json字段中，客户端按type自行解析
+func marshalFrame(env responseEnvelope) ([]byte, error) {
+	var data, fallback []byte
+	var err error
+	switch m := env.Data.(type) {
+	case nil, BaseMessage:
+	case protoMessage:
+		data = m.appendProto(nil)
+	case json.RawMessage:
+		decode, ok := outboundProto[env.Type]
+		if !ok {
+			fallback, err = jsonBody(m)
+			break
+		}
+		var msg protoMessage
+		msg, err = decode(m)
+		if err == nil {
+			data = msg.appendProto(nil)
+		}
+	default:
+		fallback, err = json.Marshal(m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("编码消息 %d 失败: %v", env.Type, err)
+	}
+	b := appendInt(nil, 1, int64(env.V))
+	b = appendString(b, 2, env.Id)
+	b = appendInt(b, 3, int64(env.Type))
+	if len(data) > 0 {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendBytes(b, data)
+	}
+	if env.Error != nil {
+		b = appendMessage(b, 5, func(b []byte) []byte {
+			b = appendString(b, 1, string(env.Error.Code))
+			return appendString(b, 2, env.Error.Message)
+		})
+	}
+	if len(fallback) > 0 {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, fallback)
+	}
+	return b, nil
+}
+
+// decodeBinaryRequest 解析二进制帧，消息体转为JSON后交给与文本帧相同的处理函数
+func decodeBinaryRequest(frame []byte) (requestEnvelope, []byte, error) {
+	req := requestEnvelope{V: protocolV2}
+	var data []byte
+	err := parseProto(frame, func(f protoField) error {
+		switch f.num {
+		case 1:
+			req.V = f.int()
+		case 2:
+			req.Id = f.string()
+		case 3:
+			req.Type = MessageType(f.int())
+		case 4:
+			data = f.bytes
+		}
+		return nil
+	})
+	if err != nil {
+		return req, nil, err
+	}
+	newMessage, ok := inboundProto[req.Type]
+	if !ok {
+		return req, []byte("{}"), nil
+	}
+	msg := newMessage()
+	if err := msg.unmarshalProto(data); err != nil {
+		// 消息体格式错误时交给处理函数按解码失败处理，不断开连接
+		log.Printf("解析消息 %d 的protobuf消息体失败: %v\n", req.Type, err)
+		return req, nil, nil
+	}
+	body, err := json.Marshal(msg)
+	return req, body, err
+}
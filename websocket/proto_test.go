@@ -0,0 +1,280 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"chinese-chess-backend/dto/game"
+	"chinese-chess-backend/dto/room"
+	"chinese-chess-backend/dto/user"
+)
+
+// 各字段都不为零值的样例，用于检查每个字段都参与了编码
+var (
+	sampleSettings = room.RoomSettings{
+		Color:           room.ColorRed,
+		TimeControl:     room.TimeControl{Initial: 600, Increment: 5},
+		Rated:           true,
+		AllowTakeback:   true,
+		AllowSpectators: true,
+	}
+	sampleMove     = MoveMessage{From: Position{X: 7, Y: 7}, To: Position{X: 4, Y: 7}, MoveId: "m1", Ply: 2}
+	sampleRoomInfo = room.RoomInfo{
+		Id:       1001,
+		Current:  user.UserInfo{ID: 1, Token: "t1", Name: "red", Exp: 120, Bot: true},
+		Next:     user.UserInfo{ID: 2, Name: "black", Exp: 80},
+		Settings: sampleSettings,
+	}
+	sampleTime = time.UnixMilli(1760000000000).UTC()
+)
+
+// outboundSamples 每种有protobuf格式的下发消息的样例
+func outboundSamples() map[MessageType]protoMessage {
+	clock := clockMessage{Red: 60000, Black: 59000, Turn: roleBlack, Ply: 3}
+	deadline := sampleTime.Add(72 * time.Hour)
+	return map[MessageType]protoMessage{
+		messageNormal:        NormalMessage{Message: "连接成功"},
+		messageMove:          sampleMove,
+		messageStart:         startMessage{Role: "red", Settings: sampleSettings, Ply: 1},
+		messageEnd:           endMessage{Winner: roleRed, Ply: 7},
+		messageJoin:          joinMessage{RoomId: 1001, UserId: 2, Ply: 1},
+		messageCreate:        NormalMessage{Message: "创建成功"},
+		messageError:         NormalMessage{Message: "出错了"},
+		messageTakebackReply: takebackReplyMessage{Accept: true, Ply: 4},
+		messageSpectate: spectateMessage{
+			RoomId: 1001, Red: 1, Black: 2, History: []MoveMessage{sampleMove}, Settings: sampleSettings, Ply: 2,
+		},
+		messageClock:       clock,
+		messageReady:       readyMessage{UserId: 2, Ready: true, Ply: 1},
+		messageCountdown:   countdownMessage{Seconds: 3, Cancel: true, Ply: 1},
+		messageRematch:     rematchMessage{UserId: 1, Ply: 9},
+		messageScore:       scoreMessage{Scores: map[int]int{1: 2, 2: 1}, Draws: 1, Ply: 9},
+		messageLeave:       leaveMessage{UserId: 2, Ply: 9},
+		messageRoomExpired: NormalMessage{Message: "房间已解散"},
+		messageLobby:       lobbySnapshotMessage{Rooms: []room.RoomInfo{sampleRoomInfo}},
+		messageLobbyEvent:  lobbyEventMessage{Event: "updated", RoomId: 1001, Room: &sampleRoomInfo},
+		messageResync: resyncMessage{
+			RoomId: 1001, Role: roleRed, Playing: true, Red: 1, Black: 2, History: []MoveMessage{sampleMove},
+			Settings: sampleSettings, Clock: &clock, Scores: map[int]int{1: 1}, Draws: 2, Ply: 2,
+		},
+		messageMaintenance: NormalMessage{Message: "停机维护"},
+		messageChat:        chatMessage{UserId: 1, Name: "red", Content: "你好", Ply: 2},
+		messageDraw:        drawMessage{UserId: 1, Accept: true, Ply: 2},
+		messageCorrespondence: correspondenceMessage{Game: game.GameInfo{
+			Id: 5, RedId: 1, BlackId: 2, DaysPerMove: 3,
+			Moves: []game.Move{{From: game.Position{X: 7, Y: 7}, To: game.Position{X: 4, Y: 7}, Ply: 1}},
+			Ply:   1, Turn: "black", Status: "playing", Winner: "red", Reason: "resign", Deadline: &deadline, DrawOffer: 2,
+		}},
+		messageChallenge: challengeMessage{Event: "created", Challenge: Challenge{
+			Id: "c1", ChallengerId: 1, ChallengerName: "red", TargetId: 2, Settings: sampleSettings,
+			CreatedAt: sampleTime, ExpiresAt: sampleTime.Add(time.Minute),
+		}},
+		messageFriend: friendMessage{Event: user.FriendAccepted, Friend: user.FriendInfo{
+			Id: 2, Name: "black", Exp: 80, Presence: &user.Presence{State: "playing", RoomId: 1001}, Since: sampleTime,
+		}},
+		messagePresence: presenceMessage{UserId: 2, Presence: user.Presence{State: "online", RoomId: 1001}},
+	}
+}
+
+// frameFields 解析二进制帧中信封的各字段
+func frameFields(t *testing.T, frame []byte) map[protowire.Number]protoField {
+	t.Helper()
+	fields := make(map[protowire.Number]protoField)
+	if err := parseProto(frame, func(f protoField) error {
+		fields[f.num] = f
+		return nil
+	}); err != nil {
+		t.Fatalf("解析二进制帧失败: %v", err)
+	}
+	return fields
+}
+
+func TestProtoOutboundMessages(t *testing.T) {
+	samples := outboundSamples()
+	for msgType := range outboundProto {
+		if _, ok := samples[msgType]; !ok {
+			t.Errorf("消息类型 %d 缺少样例", msgType)
+		}
+	}
+	for msgType, sample := range samples {
+		direct, err := marshalFrame(responseEnvelope{V: protocolV2, Id: "r1", Type: msgType, Data: sample})
+		if err != nil {
+			t.Fatalf("编码消息 %d 失败: %v", msgType, err)
+		}
+		fields := frameFields(t, direct)
+		if fields[1].int() != protocolV2 || fields[2].string() != "r1" || MessageType(fields[3].int()) != msgType {
+			t.Fatalf("消息 %d 的信封字段不正确: %v", msgType, fields)
+		}
+		if len(fields[4].bytes) == 0 || fields[6].bytes != nil {
+			t.Fatalf("消息 %d 应当以protobuf编码在data中", msgType)
+		}
+
+		// 集群转发来的JSON消息与本节点的消息编码结果相同
+		raw, err := json.Marshal(sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forwarded, err := marshalFrame(responseEnvelope{V: protocolV2, Id: "r1", Type: msgType, Data: json.RawMessage(raw)})
+		if err != nil {
+			t.Fatalf("编码转发的消息 %d 失败: %v", msgType, err)
+		}
+		if !bytes.Equal(direct, forwarded) {
+			t.Errorf("转发的消息 %d（%T）与直接编码的结果不同，JSON字段与protobuf字段不一致", msgType, sample)
+		}
+
+		// 每个字段都参与编码：逐个清空字段后编码结果必须变化
+		v := reflect.ValueOf(sample)
+		for i := range v.NumField() {
+			field := v.Type().Field(i)
+			if field.Anonymous {
+				continue
+			}
+			cleared := reflect.New(v.Type()).Elem()
+			cleared.Set(v)
+			cleared.Field(i).SetZero()
+			if bytes.Equal(cleared.Interface().(protoMessage).appendProto(nil), sample.appendProto(nil)) {
+				t.Errorf("%T 的字段 %s 没有编码", sample, field.Name)
+			}
+		}
+	}
+}
+
+// inboundSamples 每种有消息体的客户端消息的样例和其protobuf编码
+func inboundSamples() map[MessageType]struct {
+	msg   any
+	proto []byte
+} {
+	type sample = struct {
+		msg   any
+		proto []byte
+	}
+	of := func(m protoMessage) sample { return sample{msg: m, proto: m.appendProto(nil)} }
+	samples := map[MessageType]sample{
+		messageMove:          of(sampleMove),
+		messageJoin:          of(joinMessage{RoomId: 1001}),
+		messageSpectate:      of(joinMessage{RoomId: 1002}),
+		messageTakebackReply: of(takebackReplyMessage{Accept: true}),
+		messageReady:         of(readyMessage{Ready: true}),
+		messageChat:          of(chatMessage{Content: "你好"}),
+		messageDraw:          of(drawMessage{Accept: true}),
+	}
+	settings := sampleSettings
+	samples[messageCreate] = sample{
+		msg:   createMessage{Settings: &settings},
+		proto: appendMessage(nil, 1, func(b []byte) []byte { return appendSettings(b, settings) }),
+	}
+	samples[messageLobby] = sample{
+		msg:   lobbySubscribeMessage{Subscribe: true},
+		proto: appendBool(nil, 1, true),
+	}
+	move := correspondenceMoveMessage{GameId: 5, From: Position{X: 7, Y: 7}, To: Position{X: 4, Y: 7}, Ply: 3}
+	b := appendInt(nil, 1, int64(move.GameId))
+	b = appendMessage(b, 2, func(b []byte) []byte { return appendPosition(b, move.From) })
+	b = appendMessage(b, 3, func(b []byte) []byte { return appendPosition(b, move.To) })
+	samples[messageCorrespondence] = sample{msg: move, proto: appendInt(b, 4, int64(move.Ply))}
+	b = appendInt(nil, 1, 2)
+	samples[messageChallenge] = sample{
+		msg:   challengeRequest{TargetId: 2, Settings: &settings},
+		proto: appendMessage(b, 2, func(b []byte) []byte { return appendSettings(b, settings) }),
+	}
+	b = appendString(nil, 1, "c1")
+	samples[messageChallengeReply] = sample{
+		msg:   challengeReplyMessage{ChallengeId: "c1", Accept: true},
+		proto: appendBool(b, 2, true),
+	}
+	samples[messageChallengeCancel] = sample{
+		msg:   challengeReplyMessage{ChallengeId: "c1"},
+		proto: appendString(nil, 1, "c1"),
+	}
+	return samples
+}
+
+func TestProtoInboundMessages(t *testing.T) {
+	samples := inboundSamples()
+	for msgType := range inboundProto {
+		if _, ok := samples[msgType]; !ok {
+			t.Errorf("消息类型 %d 缺少样例", msgType)
+		}
+	}
+	for msgType, sample := range samples {
+		frame := appendInt(nil, 1, protocolV2)
+		frame = appendString(frame, 2, "q1")
+		frame = appendInt(frame, 3, int64(msgType))
+		frame = protowire.AppendTag(frame, 4, protowire.BytesType)
+		frame = protowire.AppendBytes(frame, sample.proto)
+
+		req, body, err := decodeBinaryRequest(frame)
+		if err != nil {
+			t.Fatalf("解析消息 %d 失败: %v", msgType, err)
+		}
+		if req.V != protocolV2 || req.Id != "q1" || req.Type != msgType {
+			t.Fatalf("消息 %d 的信封解析错误: %+v", msgType, req)
+		}
+		// 解析出的JSON交给与文本帧相同的处理函数，解码后应当与样例相同
+		decoded := reflect.New(reflect.TypeOf(sample.msg))
+		if err := json.Unmarshal(body, decoded.Interface()); err != nil {
+			t.Fatalf("消息 %d 的JSON无法解码: %v", msgType, err)
+		}
+		if got := decoded.Elem().Interface(); !reflect.DeepEqual(got, sample.msg) {
+			t.Errorf("消息 %d 往返后为 %+v，应当为 %+v", msgType, got, sample.msg)
+		}
+	}
+}
+
+func TestProtoCoversEveryMessageType(t *testing.T) {
+	// 没有消息体的类型，二进制帧中不带data
+	noBody := map[MessageType]bool{
+		messageMatch:    true,
+		messageGiveUp:   true,
+		messageTakeback: true,
+		messageKick:     true,
+		messageAck:      true,
+	}
+	types := []MessageType{messageNormal, messageMatch, messageMove, messageStart, messageEnd,
+		messageJoin, messageCreate, messageGiveUp, messageError}
+	for msgType := messageTakeback; msgType <= messagePresence; msgType++ {
+		types = append(types, msgType)
+	}
+	for _, msgType := range types {
+		_, out := outboundProto[msgType]
+		_, in := inboundProto[msgType]
+		if !out && !in && !noBody[msgType] {
+			t.Errorf("消息类型 %d 没有protobuf格式，也没有登记为无消息体", msgType)
+		}
+	}
+}
+
+func TestProtoJSONFallback(t *testing.T) {
+	// 没有protobuf格式的消息以JSON放在json字段中，不会导致断开连接
+	unmapped := struct {
+		BaseMessage
+		Extra string `json:"extra"`
+	}{BaseMessage: BaseMessage{Type: 99}, Extra: "x"}
+	frame, err := marshalFrame(responseEnvelope{V: protocolV2, Type: 99, Data: unmapped})
+	if err != nil {
+		t.Fatalf("没有protobuf格式的消息编码失败: %v", err)
+	}
+	fields := frameFields(t, frame)
+	if fields[4].bytes != nil || string(fields[6].bytes) != `{"type":99,"extra":"x"}` {
+		t.Fatalf("没有protobuf格式的消息应当以JSON编码，实际 %q", fields[6].bytes)
+	}
+
+	// 集群转发来的未登记类型同样使用JSON，只有type的消息不带消息体
+	raw := json.RawMessage(`{"type":99,"extra":"x"}`)
+	frame, err = marshalFrame(responseEnvelope{V: protocolV2, Type: 99, Data: raw})
+	if err != nil || !bytes.Equal(frameFields(t, frame)[6].bytes, raw) {
+		t.Fatalf("转发的未登记消息应当以JSON编码: %v", err)
+	}
+	frame, err = marshalFrame(responseEnvelope{V: protocolV2, Type: messageKick, Data: json.RawMessage(`{"type":16}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := frameFields(t, frame); fields[4].bytes != nil || fields[6].bytes != nil {
+		t.Fatalf("没有消息体的类型不应当带data或json: %v", fields)
+	}
+}
@@ -0,0 +1,153 @@
+package websocket
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/websocket"
+)
+
+// 客户端协议版本，连接时协商
+const (
+	protocolLegacy = 1 // 裸的{type, ...}消息，没有请求id和确认
+	protocolV2     = 2 // 消息包在信封中，带请求id，服务端回复确认或错误码
+
+	subprotocolV2    = "chess.v2"       // 通过Sec-WebSocket-Protocol协商v2，也可以在地址中带上protocol=2
+	subprotocolProto = "chess.v2.proto" // v2信封和消息使用protobuf编码，以二进制帧收发，格式见proto/chess.proto
+)
+
+// ErrorCode v2协议中机器可读的错误码
+type ErrorCode string
+
+const (
+	CodeBadRequest      ErrorCode = "bad_request"      // 消息格式错误
+	CodeUnknownType     ErrorCode = "unknown_type"     // 未登记的消息类型
+	CodeInternal        ErrorCode = "internal"         // 服务端处理失败，连接会被断开
+	CodeMaintenance     ErrorCode = "maintenance"      // 服务器停机维护
+	CodeRateLimited     ErrorCode = "rate_limited"     // 操作过于频繁
+	CodeNotInRoom       ErrorCode = "not_in_room"      // 不在房间中
+	CodeAlreadyInRoom   ErrorCode = "already_in_room"  // 已在房间中
+	CodeInGame          ErrorCode = "in_game"          // 已在对局中
+	CodeNotPlaying      ErrorCode = "not_playing"      // 不在对局中
+	CodeAlreadyMatching ErrorCode = "already_matching" // 已在匹配队列中
+	CodeInvalidState    ErrorCode = "invalid_state"    // 当前状态不允许该操作
+	CodeInvalidSettings ErrorCode = "invalid_settings" // 房间设置无效
+	CodeUnavailable     ErrorCode = "unavailable"      // 依赖的存储暂时不可用，可以稍后重试
+	CodeRoomNotFound    ErrorCode = "room_not_found"   // 房间不存在或已解散
+	CodeNotYourTurn     ErrorCode = "not_your_turn"    // 还没有轮到自己走子
+	CodeStalePly        ErrorCode = "stale_ply"        // 基于过期的局面走子，服务端会下发完整状态
+	CodeIllegalMove     ErrorCode = "illegal_move"     // 走法不合法
+	CodeNotHost         ErrorCode = "not_host"         // 只有房主可以操作
+)
+
+// requestEnvelope v2协议中客户端发送的消息，Id由客户端选择，服务端的确认和错误回复会带上同一个Id
+type requestEnvelope struct {
+	V    int             `json:"v"`
+	Id   string          `json:"id,omitempty"`
+	Type MessageType     `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type envelopeError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// responseEnvelope v2协议中服务端发送的消息。主动推送的消息没有Id，
+// 对请求的确认类型为messageAck，错误类型为messageError并带有Error
+type responseEnvelope struct {
+	V     int            `json:"v"`
+	Id    string         `json:"id,omitempty"`
+	Type  MessageType    `json:"type"`
+	Data  any            `json:"data,omitempty"`
+	Error *envelopeError `json:"error,omitempty"`
+}
+
+type typedMessage interface {
+	messageType() MessageType
+}
+
+func (b BaseMessage) messageType() MessageType {
+	return b.Type
+}
+
+// negotiateProtocol 根据握手请求选择协议版本和是否使用二进制帧，客户端没有要求时使用旧版协议
+func negotiateProtocol(r *http.Request, conn *websocket.Conn) (version int, binary bool) {
+	switch {
+	case conn.Subprotocol() == subprotocolProto:
+		return protocolV2, true
+	case conn.Subprotocol() == subprotocolV2 || r.URL.Query().Get("protocol") == "2":
+		return protocolV2, false
+	}
+	return protocolLegacy, false
+}
+
+// encode 按客户端的协议版本包装要发送的消息
+func (c *Client) encode(message any) any {
+	if c.protocol < protocolV2 {
+		return message
+	}
+	if env, ok := message.(responseEnvelope); ok {
+		return env
+	}
+	env := responseEnvelope{V: protocolV2, Data: message}
+	switch m := message.(type) {
+	case typedMessage:
+		env.Type = m.messageType()
+	case json.RawMessage:
+		// 集群转发来的消息已经序列化，从中取出类型。房间归属节点对请求的回复已经包在信封中
+		var fwd forwardedEnvelope
+		if err := json.Unmarshal(m, &fwd); err == nil {
+			if fwd.V >= protocolV2 {
+				return fwd.response()
+			}
+			env.Type = fwd.Type
+		}
+	}
+	return env
+}
+
+// forwardedEnvelope 集群转发来的已序列化消息，V不为0时是房间归属节点回复的信封
+type forwardedEnvelope struct {
+	V     int             `json:"v"`
+	Id    string          `json:"id"`
+	Type  MessageType     `json:"type"`
+	Data  json.RawMessage `json:"data"`
+	Error *envelopeError  `json:"error"`
+}
+
+func (f forwardedEnvelope) response() responseEnvelope {
+	env := responseEnvelope{V: f.V, Id: f.Id, Type: f.Type, Error: f.Error}
+	if len(f.Data) > 0 {
+		env.Data = f.Data
+	}
+	return env
+}
+
+// writeMessage 按客户端协商的格式写一条消息，只由writePump调用
+func (c *Client) writeMessage(message any) error {
+	if !c.binary {
+		return c.Conn.WriteJSON(c.encode(message))
+	}
+	frame, err := marshalFrame(c.encode(message).(responseEnvelope))
+	if err != nil {
+		return err
+	}
+	return c.Conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// decodeRequest 解析客户端消息，v2信封中的data作为消息体，旧版消息原样返回
+func decodeRequest(raw []byte) (requestEnvelope, []byte, error) {
+	var req requestEnvelope
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return req, nil, err
+	}
+	if req.V < protocolV2 {
+		return req, raw, nil
+	}
+	if len(req.Data) == 0 || slices.Equal(req.Data, []byte("null")) {
+		return req, []byte("{}"), nil
+	}
+	return req, req.Data, nil
+}
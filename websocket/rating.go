@@ -0,0 +1,38 @@
+package websocket
+
+import (
+	"log"
+
+	"gorm.io/gorm"
+
+	"chinese-chess-backend/database"
+	userModel "chinese-chess-backend/model/user"
+)
+
+const ratedExpDelta = 10 // 排位对局胜负的经验变化
+
+// subscribeRating 排位对局结束后结算双方经验
+func subscribeRating(bus *EventBus) {
+	Subscribe(bus, func(e GameEnded) {
+		if e.Rated && e.WinnerId != 0 {
+			settleRatedGame(e.WinnerId, e.LoserId)
+		}
+	})
+}
+
+// settleRatedGame 排位对局结束后调整双方经验
+func settleRatedGame(winnerId, loserId int) {
+	db := database.GetMysqlDb()
+	err := db.Model(&userModel.User{}).
+		Where("id = ?", winnerId).
+		Update("exp", gorm.Expr("exp + ?", ratedExpDelta)).Error
+	if err != nil {
+		log.Printf("更新胜者经验失败: %v\n", err)
+	}
+	err = db.Model(&userModel.User{}).
+		Where("id = ?", loserId).
+		Update("exp", gorm.Expr("GREATEST(exp - ?, 0)", ratedExpDelta)).Error
+	if err != nil {
+		log.Printf("更新败者经验失败: %v\n", err)
+	}
+}
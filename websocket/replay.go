@@ -0,0 +1,228 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"chinese-chess-backend/dto/room"
+)
+
+// ReplayMessage 回放时房间发给某个玩家的一条消息，Seq为触发该消息的日志序号
+type ReplayMessage struct {
+	Seq     int             `json:"seq"`
+	UserId  int             `json:"userId"`
+	Message json.RawMessage `json:"message"`
+}
+
+// replayClock 停在当前日志时间的时钟，定时器永远不会触发，
+// 倒计时结束和超时判负都按日志中的记录重放
+type replayClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *replayClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *replayClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	return make(chan time.Time), func() {}
+}
+
+func (c *replayClock) set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// replayer 在独立的大厅中用假客户端重放一个房间的日志
+type replayer struct {
+	hub      *ChessHub
+	clock    *replayClock
+	clients  map[int]*Client
+	mu       sync.Mutex
+	seq      int
+	messages []ReplayMessage
+	err      error
+}
+
+// Replay 把一个房间的日志重放到新的ChessHub中，按顺序返回房间发出的所有消息。
+// 回放的大厅没有运行Run，不会结算排位分，也不会再次记录日志
+func Replay(entries []JournalEntry) ([]ReplayMessage, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("日志为空")
+	}
+	entries = append([]JournalEntry(nil), entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Seq < entries[j].Seq
+	})
+	for i, entry := range entries {
+		// 写入失败的日志会留下空缺，之后的命令无法正确回放
+		if entry.Seq != i {
+			return nil, fmt.Errorf("日志不连续，缺少第 %d 条", i)
+		}
+	}
+
+	clock := &replayClock{now: entries[0].Time}
+	rp := &replayer{
+		hub:     NewChessHub(WithClock(clock)),
+		clock:   clock,
+		clients: make(map[int]*Client),
+	}
+	defer func() {
+		rp.hub.scheduler.Stop()
+		rp.hub.pool.Stop()
+	}()
+
+	r, err := rp.openRoom(entries[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries[1:] {
+		rp.begin(entry)
+		var client *Client
+		if entry.UserId != 0 {
+			client = rp.client(entry.UserId, entry.Name, entry.Exp)
+		}
+		cmd, err := decodeCommand(entry.Command, entry.Payload, client)
+		if err != nil {
+			return rp.messages, fmt.Errorf("解析第 %d 条日志失败: %v", entry.Seq, err)
+		}
+		if !r.post(cmd) || !rp.settle(r) {
+			// 房间已解散，之后不会再有日志
+			break
+		}
+	}
+	rp.settle(r)
+	return rp.result()
+}
+
+// openRoom 按第一条日志重建房间并启动房间协程
+func (rp *replayer) openRoom(entry JournalEntry) (*ChessRoom, error) {
+	rp.begin(entry)
+	switch entry.Command {
+	case commandCreate:
+		settings, err := decodePayload[room.RoomSettings](entry.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("解析房间设置失败: %v", err)
+		}
+		r := rp.newRoom(entry, settings)
+		host := rp.client(entry.UserId, entry.Name, entry.Exp)
+		r.join(host)
+		rp.hub.startRoom(r)
+		host.sendMessage(NormalMessage{
+			BaseMessage: BaseMessage{Type: messageCreate},
+		})
+		return r, nil
+	case commandMatch:
+		players, err := decodePayload[[]playerSnapshot](entry.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("解析匹配玩家失败: %v", err)
+		}
+		if len(players) != 2 {
+			return nil, fmt.Errorf("匹配日志中应有两名玩家")
+		}
+		r := rp.newRoom(entry, room.DefaultRoomSettings())
+		for _, p := range players {
+			c := rp.client(p.Id, p.Name, p.Exp)
+			r.join(c)
+			r.setReady(c, true)
+		}
+		r.startCountdown()
+		rp.hub.startRoom(r)
+		return r, nil
+	case commandChallenge:
+		journal, err := decodePayload[challengeJournal](entry.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("解析挑战日志失败: %v", err)
+		}
+		if len(journal.Players) != 2 {
+			return nil, fmt.Errorf("挑战日志中应有两名玩家")
+		}
+		r := rp.newRoom(entry, journal.Settings)
+		for _, p := range journal.Players {
+			c := rp.client(p.Id, p.Name, p.Exp)
+			r.join(c)
+			r.setReady(c, true)
+		}
+		r.startCountdown()
+		rp.hub.startRoom(r)
+		return r, nil
+	default:
+		return nil, fmt.Errorf("日志应以创建房间、匹配成功或接受挑战开始")
+	}
+}
+
+func (rp *replayer) newRoom(entry JournalEntry, settings room.RoomSettings) *ChessRoom {
+	reserveRoomId(entry.RoomId)
+	r := NewChessRoom(settings)
+	r.Id = entry.RoomId
+	r.setSeed(entry.Seed)
+	r.hub = rp.hub
+	r.touch()
+	return r
+}
+
+// client 返回日志中玩家对应的假客户端，发给它的消息被记录下来
+func (rp *replayer) client(userId int, name string, exp int) *Client {
+	if c, ok := rp.clients[userId]; ok {
+		return c
+	}
+	c := NewClient(nil, userId)
+	c.Name = name
+	c.setExp(exp)
+	c.sink = func(message any) {
+		rp.record(userId, message)
+	}
+	rp.clients[userId] = c
+	rp.hub.mu.Lock()
+	rp.hub.Clients[userId] = c
+	rp.hub.mu.Unlock()
+	return c
+}
+
+// begin 把时钟拨到日志记录的时间，之后发出的消息归到这条日志下
+func (rp *replayer) begin(entry JournalEntry) {
+	rp.clock.set(entry.Time)
+	rp.mu.Lock()
+	rp.seq = entry.Seq
+	rp.mu.Unlock()
+}
+
+func (rp *replayer) record(userId int, message any) {
+	data, err := json.Marshal(message)
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if err != nil {
+		if rp.err == nil {
+			rp.err = fmt.Errorf("序列化消息失败: %v", err)
+		}
+		return
+	}
+	rp.messages = append(rp.messages, ReplayMessage{Seq: rp.seq, UserId: userId, Message: data})
+}
+
+// settle 等待房间处理完已投递的命令，房间已解散时返回false
+func (rp *replayer) settle(r *ChessRoom) bool {
+	synced := make(chan struct{})
+	if !r.post(hubCommand{commandType: commandSync, payload: synced}) {
+		return false
+	}
+	select {
+	case <-synced:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+func (rp *replayer) result() ([]ReplayMessage, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.messages, rp.err
+}
@@ -0,0 +1,642 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"chinese-chess-backend/xiangqi"
+)
+
+const maxChatLength = 200 // 单条聊天消息的最大字数
+
+// run 是房间协程的主循环，同一房间的命令严格按到达顺序逐个处理
+func (cr *ChessRoom) run() {
+	for {
+		select {
+		case cmd := <-cr.inbox:
+			cr.record(cmd)
+			cr.handle(cmd)
+			// 处理时没有拒绝的请求视为已受理
+			cmd.accept()
+			select {
+			case <-cr.done:
+				// 房间已在处理命令时解散
+				return
+			default:
+				cr.saveChangedSnapshot()
+			}
+		case <-cr.done:
+			return
+		}
+	}
+}
+
+// post 将命令投递到房间的收件箱，房间已解散时返回false
+func (cr *ChessRoom) post(cmd hubCommand) bool {
+	select {
+	case cr.inbox <- cmd:
+		return true
+	case <-cr.done:
+		return false
+	}
+}
+
+// close 解散房间，房间内所有人回到在线状态，只能在房间协程中调用
+func (cr *ChessRoom) close() {
+	cr.clear()
+	cr.hub.removeRoom(cr.Id)
+	cr.deleteSnapshot()
+	close(cr.done)
+}
+
+func (cr *ChessRoom) handle(cmd hubCommand) {
+	switch cmd.commandType {
+	case commandJoin:
+		client := cmd.client
+		if err := cr.join(client); err != nil {
+			cmd.reject(CodeInvalidState, err.Error())
+			return
+		}
+		cr.touch()
+		if cr.isFull() {
+			cr.hub.removeSpareRoom(cr.Id)
+		}
+		// 通知房间内的玩家有人加入，双方准备后开始游戏
+		cr.broadcast(joinMessage{
+			BaseMessage: BaseMessage{Type: messageJoin},
+			RoomId:      cr.Id,
+			UserId:      client.Id,
+			Ply:         cr.ply,
+		})
+	case commandSpectate:
+		client := cmd.client
+		if err := cr.spectate(client); err != nil {
+			cmd.reject(CodeInvalidState, err.Error())
+			return
+		}
+		client.sendMessage(cr.spectateMessage())
+	case commandUnregister:
+		client := cmd.client
+		if _, ok := cr.Spectators[client.Id]; ok {
+			delete(cr.Spectators, client.Id)
+			return
+		}
+		if cr.Current != client && cr.Next != client {
+			return
+		}
+		cr.stopClock()
+		if target := cr.opponent(client); target != nil {
+			target.sendMessage(NormalMessage{
+				BaseMessage: BaseMessage{Type: messageNormal},
+				Message:     "对方已断开连接",
+			})
+		}
+		for _, c := range cr.Spectators {
+			c.sendMessage(NormalMessage{
+				BaseMessage: BaseMessage{Type: messageNormal},
+				Message:     "玩家已断开连接，对局结束",
+			})
+		}
+		cr.close()
+	case commandMove:
+		req := cmd.payload.(moveRequest)
+		if cr.State != roomPlaying {
+			cmd.reject(CodeNotPlaying, "游戏未开始")
+			return
+		}
+		if cr.resumeTimer != nil {
+			cmd.reject(CodeInvalidState, "请等待对方重新连接")
+			return
+		}
+		// 对局中才检查重发，处理过的走子已经交换了走棋方，需要在检查走棋方之前确认
+		moveKey := fmt.Sprintf("%d:%s", req.from.Id, req.move.MoveId)
+		if req.move.MoveId != "" && cr.moveIds[moveKey] {
+			// 网络抖动后重发的走子，已经处理过
+			return
+		}
+		if cr.Current != req.from {
+			// 如果不是当前玩家，则不允许移动
+			cmd.reject(CodeNotYourTurn, "请等待对方移动")
+			return
+		}
+		if req.move.Ply != 0 && req.move.Ply != cr.ply+1 {
+			// 客户端基于过期的局面走子，下发完整状态让客户端重新同步
+			cmd.reject(CodeStalePly, "棋局已变化，请重新走子")
+			req.from.sendMessage(cr.resyncMessage(req.from))
+			return
+		}
+		if cr.game != nil {
+			if err := cr.game.Play(xiangqi.Position(req.move.From), xiangqi.Position(req.move.To)); err != nil {
+				cmd.reject(CodeIllegalMove, "走法不合法")
+				req.from.sendMessage(cr.resyncMessage(req.from))
+				return
+			}
+		}
+
+		if cr.spendClock() {
+			cr.finishGame(cr.Next.Role)
+			return
+		}
+		cr.addIncrement()
+		cr.takebackFrom = nil
+		cr.drawOffer = nil
+		cr.ply++
+		req.move.Ply = cr.ply
+		if req.move.MoveId != "" {
+			cr.moveIds[moveKey] = true
+		}
+		cr.History = append(cr.History, req.move)
+		cr.hub.events.Publish(MoveMade{
+			RoomId: cr.Id,
+			UserId: req.from.Id,
+			Move:   req.move,
+			Ply:    cr.ply,
+			Time:   cr.now(),
+		})
+
+		cr.Next.sendMessage(req.move)
+		for _, c := range cr.Spectators {
+			c.sendMessage(req.move)
+		}
+		if cr.game != nil && cr.game.Over() {
+			// 对方被将死或困毙
+			cr.finishGame(req.from.Role)
+			return
+		}
+
+		// 交换当前玩家和下一个玩家
+		cr.exchange()
+		cr.startClock(cr.onClockTimeout)
+		if !cr.Settings.TimeControl.Unlimited() {
+			cr.broadcast(cr.clockMessage())
+		}
+	case commandStart:
+		// 只有最近一次未取消的倒计时结束才能开始游戏
+		if seq, _ := cmd.payload.(int); cr.State != roomCountdown || seq != cr.countdownSeq {
+			return
+		}
+		if !cr.isFull() {
+			cr.cancelCountdown()
+			return
+		}
+		cr.State = roomPlaying
+		cr.countdownTimer = nil
+		cr.touch()
+		cr.History = make([]MoveMessage, 0)
+		cr.game = xiangqi.NewGame()
+		cr.moveIds = make(map[string]bool)
+		cr.ply++
+		cr.assignColors()
+		cr.Current.startPlay(roleRed)
+		cr.Next.startPlay(roleBlack)
+		cur := startMessage{BaseMessage: BaseMessage{Type: messageStart}, Role: "red", Settings: cr.Settings, Ply: cr.ply}
+		next := startMessage{BaseMessage: BaseMessage{Type: messageStart}, Role: "black", Settings: cr.Settings, Ply: cr.ply}
+		cr.Current.sendMessage(cur)
+		cr.Next.sendMessage(next)
+		cr.hub.events.Publish(GameStarted{
+			RoomId:   cr.Id,
+			RedId:    cr.Current.Id,
+			BlackId:  cr.Next.Id,
+			Settings: cr.Settings,
+			Time:     cr.now(),
+		})
+		for _, c := range cr.Spectators {
+			c.sendMessage(cr.spectateMessage())
+		}
+		if !cr.Settings.TimeControl.Unlimited() {
+			cr.initClock()
+			cr.startClock(cr.onClockTimeout)
+			cr.broadcast(cr.clockMessage())
+		}
+		// 移除空余房间
+		cr.hub.removeSpareRoom(cr.Id)
+	case commandEnd:
+		if cr.State != roomPlaying || (cr.Current != cmd.client && cr.Next != cmd.client) {
+			cmd.reject(CodeNotPlaying, "")
+			return
+		}
+		// 客户端只能认输，将死和困毙在走子后由服务端判定，超时和和棋也由服务端处理
+		if giveUp, _ := cmd.payload.(bool); giveUp {
+			cr.finishGame(cr.opponent(cmd.client).Role)
+			return
+		}
+		cmd.reject(CodeInvalidState, "对局尚未结束")
+	case commandTakeback:
+		client := cmd.client
+		if cr.State != roomPlaying {
+			cmd.reject(CodeNotPlaying, "游戏未开始")
+			return
+		}
+		if !cr.Settings.AllowTakeback {
+			cmd.reject(CodeInvalidState, "该房间不允许悔棋")
+			return
+		}
+		// 只能在自己走完、对方还未走时悔棋
+		if cr.Next != client || len(cr.History) == 0 {
+			cmd.reject(CodeInvalidState, "当前无法悔棋")
+			return
+		}
+		cr.takebackFrom = client
+		cr.Current.sendMessage(BaseMessage{Type: messageTakeback})
+	case commandTakebackReply:
+		client := cmd.client
+		reply := cmd.payload.(takebackReplyMessage)
+		if cr.takebackFrom == nil || cr.Current != client {
+			cmd.reject(CodeInvalidState, "没有待处理的悔棋请求")
+			return
+		}
+		cr.takebackFrom = nil
+		if reply.Accept {
+			if cr.spendClock() {
+				cr.finishGame(cr.Next.Role)
+				return
+			}
+			cr.History = cr.History[:len(cr.History)-1]
+			if cr.game != nil {
+				cr.game.Undo()
+			}
+			cr.ply++
+			cr.exchange()
+			cr.startClock(cr.onClockTimeout)
+			cr.hub.events.Publish(TakebackAccepted{RoomId: cr.Id, UserId: cr.Current.Id, Ply: cr.ply, Time: cr.now()})
+		}
+		cr.broadcast(takebackReplyMessage{
+			BaseMessage: BaseMessage{Type: messageTakebackReply},
+			Accept:      reply.Accept,
+			Ply:         cr.ply,
+		})
+		if reply.Accept && !cr.Settings.TimeControl.Unlimited() {
+			cr.broadcast(cr.clockMessage())
+		}
+	case commandTimeout:
+		// 计时器到期后确认玩家确实超时，避免走子与计时器的竞争
+		client := cmd.client
+		if cr.State != roomPlaying || cr.Current != client || cr.clockTimer == nil {
+			return
+		}
+		if remaining := cr.remaining(client.Role); remaining > 0 {
+			// 计时器提前触发，按剩余时间重新计时，否则对局会一直停在这里
+			cr.clockTimer = cr.schedule(remaining, func() {
+				cr.onClockTimeout(client)
+			})
+			return
+		}
+		cr.clocks[client.Role] = 0
+		cr.finishGame(cr.Next.Role)
+	case commandReady:
+		client := cmd.client
+		readyMsg := cmd.payload.(readyMessage)
+		if cr.State == roomPlaying || (cr.Current != client && cr.Next != client) {
+			cmd.reject(CodeInvalidState, "当前无法准备")
+			return
+		}
+		cr.touch()
+		cr.setReady(client, readyMsg.Ready)
+		cr.broadcast(readyMessage{
+			BaseMessage: BaseMessage{Type: messageReady},
+			UserId:      client.Id,
+			Ready:       readyMsg.Ready,
+			Ply:         cr.ply,
+		})
+		if cr.allReady() {
+			if cr.State == roomWaiting {
+				cr.startCountdown()
+			}
+		} else if cr.State == roomCountdown {
+			cr.cancelCountdown()
+			cr.broadcast(countdownMessage{
+				BaseMessage: BaseMessage{Type: messageCountdown},
+				Cancel:      true,
+				Ply:         cr.ply,
+			})
+		}
+	case commandKick:
+		client := cmd.client
+		if cr.Host != client {
+			cmd.reject(CodeNotHost, "只有房主可以踢人")
+			return
+		}
+		if cr.State == roomPlaying {
+			cmd.reject(CodeInGame, "游戏已开始")
+			return
+		}
+		target := cr.guest()
+		if target == nil {
+			cmd.reject(CodeInvalidState, "房间内没有其他玩家")
+			return
+		}
+		if cr.State == roomCountdown {
+			cr.cancelCountdown()
+			cr.broadcast(countdownMessage{
+				BaseMessage: BaseMessage{Type: messageCountdown},
+				Cancel:      true,
+				Ply:         cr.ply,
+			})
+		}
+		cr.touch()
+		cr.leave(target)
+		cr.resetMatch()
+		target.sendMessage(BaseMessage{Type: messageKick})
+		client.sendMessage(NormalMessage{
+			BaseMessage: BaseMessage{Type: messageNormal},
+			Message:     "已将对方踢出房间",
+		})
+		cr.hub.addSpareRoom(cr)
+	case commandRematch:
+		client := cmd.client
+		if cr.State != roomFinished || (cr.Current != client && cr.Next != client) {
+			cmd.reject(CodeInvalidState, "当前无法再来一局")
+			return
+		}
+		if !cr.isFull() {
+			cmd.reject(CodeInvalidState, "对方已离开房间")
+			return
+		}
+		cr.touch()
+		cr.setRematch(client)
+		if !cr.allRematch() {
+			cr.broadcast(rematchMessage{
+				BaseMessage: BaseMessage{Type: messageRematch},
+				UserId:      client.Id,
+				Ply:         cr.ply,
+			})
+			return
+		}
+		// 双方都同意再来一局，交换先后手后开始倒计时
+		for _, c := range cr.players() {
+			cr.setReady(c, true)
+		}
+		cr.broadcast(cr.scoreMessage())
+		cr.startCountdown()
+	case commandLeave:
+		client := cmd.client
+		if _, ok := cr.Spectators[client.Id]; ok {
+			cr.unspectate(client)
+			client.sendMessage(leaveMessage{
+				BaseMessage: BaseMessage{Type: messageLeave},
+				UserId:      client.Id,
+				Ply:         cr.ply,
+			})
+			return
+		}
+		if cr.Current != client && cr.Next != client {
+			client.resetState()
+			return
+		}
+		if cr.State == roomPlaying {
+			cmd.reject(CodeInGame, "对局中无法离开房间，请先认输")
+			return
+		}
+		if cr.State == roomCountdown {
+			cr.broadcast(countdownMessage{
+				BaseMessage: BaseMessage{Type: messageCountdown},
+				Cancel:      true,
+				Ply:         cr.ply,
+			})
+		}
+		cr.touch()
+		// 先通知包括自己在内的所有人，再离开房间
+		cr.broadcast(leaveMessage{
+			BaseMessage: BaseMessage{Type: messageLeave},
+			UserId:      client.Id,
+			Ply:         cr.ply,
+		})
+		cr.leave(client)
+		cr.resetMatch()
+		if cr.isEmpty() {
+			cr.close()
+			return
+		}
+		// 剩下的玩家成为房主，房间重新出现在房间列表中
+		cr.hub.addSpareRoom(cr)
+	case commandResume:
+		client := cmd.client
+		old := cr.resume(client)
+		if old == nil {
+			return
+		}
+		cr.touch()
+		switch {
+		case cr.State != roomPlaying:
+		case cr.resumeTimer != nil && !cr.awaitingResume():
+			// 双方都已重连，开始计时
+			cr.resumeTimer.Stop()
+			cr.resumeTimer = nil
+			cr.startClock(cr.onClockTimeout)
+		case cr.Current == client && cr.clockTimer != nil:
+			// 计时器绑定的是占位客户端，为重连的玩家重新计时
+			if cr.spendClock() {
+				cr.finishGame(cr.Next.Role)
+				return
+			}
+			cr.startClock(cr.onClockTimeout)
+		}
+		client.sendMessage(cr.resyncMessage(client))
+		if target := cr.opponent(client); target != nil {
+			target.sendMessage(NormalMessage{
+				BaseMessage: BaseMessage{Type: messageNormal},
+				Message:     "对方已重新连接",
+			})
+		}
+	case commandShutdown:
+		ctx := cmd.payload.(context.Context)
+		if cr.hub.snapshots != nil {
+			// 保存快照后直接退出，重启后玩家重连即可继续对局
+			if future := cr.saveSnapshot(); future != nil {
+				if err := future.Wait(ctx); err != nil {
+					log.Printf("停机时保存房间 %d 失败: %v\n", cr.Id, err)
+				}
+			}
+			cr.stopClock()
+			cr.cancelCountdown()
+			close(cr.done)
+			return
+		}
+		// 无法保存对局时判和
+		if cr.State == roomPlaying {
+			cr.finishGame(roleNone)
+		}
+		cr.close()
+	case commandSync:
+		close(cmd.payload.(chan struct{}))
+	case commandChat:
+		client := cmd.client
+		if _, ok := cr.Spectators[client.Id]; !ok && cr.Current != client && cr.Next != client {
+			cmd.reject(CodeNotInRoom, "")
+			return
+		}
+		msg := cmd.payload.(chatMessage)
+		content := strings.TrimSpace(msg.Content)
+		if content == "" {
+			cmd.reject(CodeBadRequest, "")
+			return
+		}
+		if utf8.RuneCountInString(content) > maxChatLength {
+			cmd.reject(CodeBadRequest, fmt.Sprintf("聊天消息不能超过%d个字", maxChatLength))
+			return
+		}
+		chat := chatMessage{
+			BaseMessage: BaseMessage{Type: messageChat},
+			UserId:      client.Id,
+			Name:        client.Name,
+			Content:     content,
+			Ply:         cr.ply,
+		}
+		for _, c := range cr.members() {
+			// 屏蔽了发送者的玩家看不到其聊天
+			if c == client || !cr.hub.blocks(c.Id, client.Id) {
+				c.sendMessage(chat)
+			}
+		}
+		cr.hub.events.Publish(ChatPosted{
+			RoomId:  cr.Id,
+			UserId:  client.Id,
+			Name:    client.Name,
+			Content: content,
+			Time:    cr.now(),
+		})
+	case commandResync:
+		client := cmd.client
+		if _, ok := cr.Spectators[client.Id]; ok {
+			client.sendMessage(cr.spectateMessage())
+			return
+		}
+		if cr.Current != client && cr.Next != client {
+			cmd.reject(CodeNotInRoom, "")
+			return
+		}
+		client.sendMessage(cr.resyncMessage(client))
+	case commandState:
+		cmd.payload.(chan gameFullEvent) <- cr.gameFull()
+	case commandDraw:
+		client := cmd.client
+		if cr.State != roomPlaying || (cr.Current != client && cr.Next != client) {
+			cmd.reject(CodeNotPlaying, "")
+			return
+		}
+		opponent := cr.opponent(client)
+		reply := cmd.payload.(drawMessage)
+		switch {
+		case reply.Accept && cr.drawOffer == opponent:
+			cr.finishGame(roleNone)
+		case reply.Accept:
+			if cr.drawOffer == client {
+				return
+			}
+			cr.drawOffer = client
+			opponent.sendMessage(drawMessage{
+				BaseMessage: BaseMessage{Type: messageDraw},
+				UserId:      client.Id,
+				Accept:      true,
+				Ply:         cr.ply,
+			})
+			cr.hub.events.Publish(DrawOffered{RoomId: cr.Id, UserId: client.Id, Time: cr.now()})
+		case cr.drawOffer != nil:
+			// 拒绝对方的提和或撤回自己的提和
+			cr.drawOffer = nil
+			opponent.sendMessage(drawMessage{
+				BaseMessage: BaseMessage{Type: messageDraw},
+				UserId:      client.Id,
+				Ply:         cr.ply,
+			})
+			cr.hub.events.Publish(DrawDeclined{RoomId: cr.Id, UserId: client.Id, Time: cr.now()})
+		}
+	case commandResumeExpire:
+		if cr.resumeTimer == nil {
+			return
+		}
+		// 仍有玩家没有重连，不再等待，没有重连的玩家照常计时
+		cr.resumeTimer = nil
+		if cr.State == roomPlaying {
+			cr.startClock(cr.onClockTimeout)
+			if !cr.Settings.TimeControl.Unlimited() {
+				cr.broadcast(cr.clockMessage())
+			}
+		}
+	case commandExpire:
+		if !cr.isIdle(cr.hub.roomTTL()) {
+			return
+		}
+		cr.broadcast(NormalMessage{
+			BaseMessage: BaseMessage{Type: messageRoomExpired},
+			Message:     "房间长时间无操作，已自动解散",
+		})
+		cr.close()
+	}
+}
+
+// startCountdown 通知房间内所有人开局倒计时，倒计时结束后开始游戏
+func (cr *ChessRoom) startCountdown() {
+	cr.beginCountdown(func(seq int) {
+		cr.post(hubCommand{
+			commandType: commandStart,
+			payload:     seq,
+		})
+	})
+	cr.broadcast(countdownMessage{
+		BaseMessage: BaseMessage{Type: messageCountdown},
+		Seconds:     int(startCountdown / time.Second),
+		Ply:         cr.ply,
+	})
+}
+
+func (cr *ChessRoom) onClockTimeout(c *Client) {
+	cr.post(hubCommand{
+		commandType: commandTimeout,
+		client:      c,
+	})
+}
+
+// finishGame 通知房间内所有人对局结果并结算排位分，房间进入等待再来一局的状态
+func (cr *ChessRoom) finishGame(winner clientRole) {
+	cr.stopClock()
+	// 发送消息给两个客户端，通知他们结束游戏
+	endMsg := endMessage{
+		BaseMessage: BaseMessage{Type: messageEnd},
+		Winner:      winner,
+		Ply:         cr.ply,
+	}
+	cr.broadcast(endMsg)
+	ended := GameEnded{
+		RoomId: cr.Id,
+		Winner: winner,
+		Rated:  cr.Settings.Rated,
+		Moves:  slices.Clone(cr.History),
+		Ply:    cr.ply,
+		Time:   cr.now(),
+	}
+	for _, c := range cr.players() {
+		switch c.Role {
+		case roleRed:
+			ended.RedId = c.Id
+		case roleBlack:
+			ended.BlackId = c.Id
+		}
+	}
+	if winner != roleNone {
+		ended.WinnerId, ended.LoserId = cr.Current.Id, cr.Next.Id
+		if cr.Current.Role != winner {
+			ended.WinnerId, ended.LoserId = ended.LoserId, ended.WinnerId
+		}
+	}
+	cr.hub.events.Publish(ended)
+	if ended.Rated && winner != roleNone {
+		winnerId := ended.WinnerId
+		// 同步内存中的经验，房间列表无需重新查询数据库
+		for _, c := range cr.players() {
+			if c.Id == winnerId {
+				c.addExp(ratedExpDelta)
+			} else {
+				c.addExp(-ratedExpDelta)
+			}
+		}
+	}
+	cr.finish(winner)
+	cr.touch()
+	cr.broadcast(cr.scoreMessage())
+}
@@ -0,0 +1,351 @@
+package websocket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"chinese-chess-backend/utils"
+)
+
+// atPly 匹配序号为ply的消息
+func atPly(ply int) func(m map[string]any) bool {
+	return func(m map[string]any) bool {
+		return m["ply"] == float64(ply)
+	}
+}
+
+func TestRoomBroadcastsCarryPly(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+	hub := NewChessHub(WithClock(clock))
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+	red := newTestClient(t, hub, 1)
+	black := newTestClient(t, hub, 2)
+
+	red.send(t, `{"type":%d,"settings":{"color":"red","timeControl":{"initial":60},"allowSpectators":true}}`, messageCreate)
+	red.waitMessage(t, messageCreate, nil)
+	black.send(t, `{"type":%d,"roomId":%d}`, messageJoin, red.getRoomId())
+	red.waitMessage(t, messageJoin, nil)
+
+	red.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.waitMessage(t, messageCountdown, atPly(0))
+	advanceClock(t, clock, red)
+	black.waitMessage(t, messageClock, atPly(1))
+
+	red.send(t, `{"type":%d,"from":{"x":7,"y":7},"to":{"x":4,"y":7}}`, messageMove)
+	black.waitMessage(t, messageMove, atPly(2))
+	red.waitMessage(t, messageClock, atPly(2))
+
+	black.send(t, `{"type":%d,"content":"你好"}`, messageChat)
+	red.waitMessage(t, messageChat, atPly(2))
+	black.send(t, `{"type":%d,"accept":true}`, messageDraw)
+	red.waitMessage(t, messageDraw, atPly(2))
+
+	red.send(t, `{"type":%d}`, messageGiveUp)
+	black.waitMessage(t, messageEnd, atPly(2))
+	black.waitMessage(t, messageScore, atPly(2))
+	black.send(t, `{"type":%d}`, messageRematch)
+	red.waitMessage(t, messageRematch, atPly(2))
+}
+
+func TestRoomBoardFollowsTakeback(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+	hub := NewChessHub(WithClock(clock))
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+	red := newProtocolTestClient(t, hub, 1, protocolV2)
+	black := newProtocolTestClient(t, hub, 2, protocolV2)
+
+	red.send(t, `{"type":%d,"settings":{"color":"red","allowTakeback":true}}`, messageCreate)
+	red.waitMessage(t, messageCreate, nil)
+	black.send(t, `{"type":%d,"roomId":%d}`, messageJoin, red.getRoomId())
+	red.waitMessage(t, messageJoin, nil)
+	red.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.waitMessage(t, messageCountdown, nil)
+	advanceClock(t, clock, red)
+	black.waitMessage(t, messageStart, nil)
+
+	red.send(t, `{"v":2,"id":"cannon","type":%d,"data":{"from":{"x":7,"y":7},"to":{"x":4,"y":7}}}`, messageMove)
+	black.waitMessage(t, messageMove, atPly(2))
+	// 红炮离开后黑炮没有炮架，不能打马
+	black.send(t, `{"v":2,"id":"capture","type":%d,"data":{"from":{"x":7,"y":2},"to":{"x":7,"y":9}}}`, messageMove)
+	black.expectError(t, "capture", CodeIllegalMove)
+
+	red.send(t, `{"type":%d}`, messageTakeback)
+	black.waitMessage(t, messageTakeback, nil)
+	black.send(t, `{"type":%d,"accept":true}`, messageTakebackReply)
+	red.waitMessage(t, messageTakebackReply, atPly(3))
+
+	// 悔棋后局面回退一步，炮回到原位可以再走一次
+	red.send(t, `{"v":2,"id":"again","type":%d,"data":{"from":{"x":7,"y":7},"to":{"x":4,"y":7}}}`, messageMove)
+	red.waitMessage(t, messageAck, reply("again"))
+	black.waitMessage(t, messageMove, atPly(4))
+}
+
+func TestEarlyClockTimeoutIsRescheduled(t *testing.T) {
+	clock := utils.NewFakeClock(time.Now())
+	hub := NewChessHub(WithClock(clock))
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+	red := newTestClient(t, hub, 1)
+	black := newTestClient(t, hub, 2)
+
+	red.send(t, `{"type":%d,"settings":{"color":"red","timeControl":{"initial":60}}}`, messageCreate)
+	red.waitMessage(t, messageCreate, nil)
+	roomId := red.getRoomId()
+	black.send(t, `{"type":%d,"roomId":%d}`, messageJoin, roomId)
+	red.waitMessage(t, messageJoin, nil)
+	red.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.waitMessage(t, messageCountdown, nil)
+	advanceClock(t, clock, red)
+	syncRoom(t, hub, roomId)
+
+	// 模拟计时器提前触发：原计时器不再触发，红方还剩30秒时收到超时
+	r := hub.getRoom(roomId)
+	r.clockTimer.Stop()
+	clock.Advance(30 * time.Second)
+	r.onClockTimeout(red.Client)
+	syncRoom(t, hub, roomId)
+	if black.find(func(m map[string]any) bool { return m["type"] == float64(messageEnd) }) != nil {
+		t.Fatal("还有剩余时间时不应当判负")
+	}
+
+	// 按剩余时间重新计时，到时后判负
+	waitUntil(t, "红方超时判负", func() bool {
+		clock.Advance(time.Second)
+		return black.find(func(m map[string]any) bool { return m["type"] == float64(messageEnd) }) != nil
+	})
+}
+
+func newRoomTestHub(t *testing.T) (*ChessHub, *utils.FakeClock) {
+	t.Helper()
+	clock := utils.NewFakeClock(time.Now())
+	hub := NewChessHub(WithClock(clock))
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+	return hub, clock
+}
+
+// openRoom 不在房间中的host以settings创建房间，guest加入
+func openRoom(t *testing.T, host, guest *testClient, settings string) int {
+	t.Helper()
+	host.send(t, `{"type":%d,"settings":%s}`, messageCreate, settings)
+	waitUntil(t, "创建房间", func() bool { return host.getRoomId() != -1 })
+	roomId := host.getRoomId()
+	guest.send(t, `{"type":%d,"roomId":%d}`, messageJoin, roomId)
+	waitUntil(t, "加入房间", func() bool { return guest.getRoomId() == roomId })
+	return roomId
+}
+
+// count 返回玩家收到的满足match的msgType类型消息数
+func (tc *testClient) count(msgType MessageType, match func(m map[string]any) bool) int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	n := 0
+	for _, m := range tc.messages {
+		if m["type"] == float64(msgType) && (match == nil || match(m)) {
+			n++
+		}
+	}
+	return n
+}
+
+// cancelled 匹配取消倒计时的消息
+func cancelled(cancel bool) func(m map[string]any) bool {
+	return func(m map[string]any) bool {
+		return m["cancel"] == cancel
+	}
+}
+
+func TestReadyCountdownAndKick(t *testing.T) {
+	hub, clock := newRoomTestHub(t)
+	host := newProtocolTestClient(t, hub, 1, protocolV2)
+	guest := newProtocolTestClient(t, hub, 2, protocolV2)
+	roomId := openRoom(t, host, guest, `{"color":"red"}`)
+
+	// 加入房间后不会直接开始，只有一方准备时不倒计时
+	host.send(t, `{"v":2,"id":"ready","type":%d,"data":{"ready":true}}`, messageReady)
+	guest.waitMessage(t, messageReady, func(m map[string]any) bool { return m["userId"] == float64(host.Id) })
+	syncRoom(t, hub, roomId)
+	if host.count(messageCountdown, nil)+host.count(messageStart, nil) != 0 {
+		t.Fatal("只有一方准备时不应当开始倒计时")
+	}
+
+	// 双方准备后倒计时，倒计时中取消准备则取消倒计时
+	guest.send(t, `{"v":2,"id":"ready","type":%d,"data":{"ready":true}}`, messageReady)
+	host.waitMessage(t, messageCountdown, cancelled(false))
+	guest.send(t, `{"v":2,"id":"unready","type":%d,"data":{"ready":false}}`, messageReady)
+	host.waitMessage(t, messageCountdown, cancelled(true))
+	clock.Advance(startCountdown + time.Second)
+	syncRoom(t, hub, roomId)
+	if host.count(messageStart, nil) != 0 {
+		t.Fatal("取消的倒计时不应当开始对局")
+	}
+
+	// 只有房主可以踢人，倒计时中踢人同时取消倒计时
+	guest.send(t, `{"v":2,"id":"kick","type":%d}`, messageKick)
+	guest.expectError(t, "kick", CodeNotHost)
+	guest.send(t, `{"v":2,"id":"ready2","type":%d,"data":{"ready":true}}`, messageReady)
+	guest.waitMessage(t, messageAck, reply("ready2"))
+	if n := host.count(messageCountdown, cancelled(false)); n != 2 {
+		t.Fatalf("再次准备后应当重新倒计时，收到%d次倒计时", n)
+	}
+	host.send(t, `{"v":2,"id":"kick","type":%d}`, messageKick)
+	host.waitMessage(t, messageAck, reply("kick"))
+	guest.waitMessage(t, messageKick, nil)
+	if n := host.count(messageCountdown, cancelled(true)); n != 2 {
+		t.Fatalf("踢人时应当取消倒计时，收到%d次取消", n)
+	}
+	if guest.getRoomId() != -1 {
+		t.Fatal("被踢出的玩家应当离开房间")
+	}
+	if rooms := hub.SpareRooms(); len(rooms) != 1 || rooms[0].Id != roomId {
+		t.Fatalf("踢人后房间应当重新出现在房间列表中: %+v", rooms)
+	}
+	host.send(t, `{"v":2,"id":"kick2","type":%d}`, messageKick)
+	host.expectError(t, "kick2", CodeInvalidState)
+
+	// 对局中不能踢人，也不能再准备，读协程中就会拒绝
+	guest.send(t, `{"v":2,"id":"rejoin","type":%d,"data":{"roomId":%d}}`, messageJoin, roomId)
+	guest.waitMessage(t, messageAck, reply("rejoin"))
+	host.send(t, `{"v":2,"id":"ready3","type":%d,"data":{"ready":true}}`, messageReady)
+	guest.send(t, `{"v":2,"id":"ready3","type":%d,"data":{"ready":true}}`, messageReady)
+	host.waitMessage(t, messageAck, reply("ready3"))
+	guest.waitMessage(t, messageAck, reply("ready3"))
+	advanceClock(t, clock, host)
+	host.send(t, `{"v":2,"id":"kick3","type":%d}`, messageKick)
+	host.expectError(t, "kick3", CodeNotInRoom)
+	guest.send(t, `{"v":2,"id":"ready4","type":%d,"data":{"ready":false}}`, messageReady)
+	guest.expectError(t, "ready4", CodeNotInRoom)
+}
+
+func TestRematchSwapsColorsAndKeepsScore(t *testing.T) {
+	hub, clock := newRoomTestHub(t)
+	host := newProtocolTestClient(t, hub, 1, protocolV2)
+	guest := newProtocolTestClient(t, hub, 2, protocolV2)
+	roomId := openRoom(t, host, guest, `{"color":"red"}`)
+
+	// 对局结束前不能再来一局
+	host.send(t, `{"v":2,"id":"early","type":%d}`, messageRematch)
+	host.expectError(t, "early", CodeInvalidState)
+
+	host.send(t, `{"type":%d,"ready":true}`, messageReady)
+	guest.send(t, `{"type":%d,"ready":true}`, messageReady)
+	guest.waitMessage(t, messageCountdown, nil)
+	advanceClock(t, clock, host)
+	host.waitMessage(t, messageStart, func(m map[string]any) bool { return m["role"] == "red" })
+	host.send(t, `{"type":%d}`, messageGiveUp)
+	guest.waitMessage(t, messageEnd, nil)
+
+	// 对局结束后房间保留，一方请求时通知对方，双方都同意后交换先后手开始倒计时
+	guest.send(t, `{"v":2,"id":"rematch","type":%d}`, messageRematch)
+	host.waitMessage(t, messageRematch, func(m map[string]any) bool { return m["userId"] == float64(guest.Id) })
+	if host.getRoomId() != roomId || guest.getRoomId() != roomId {
+		t.Fatal("对局结束后双方应当留在房间中")
+	}
+	host.send(t, `{"v":2,"id":"rematch","type":%d}`, messageRematch)
+	score := guest.waitMessage(t, messageScore, func(m map[string]any) bool {
+		scores, _ := m["scores"].(map[string]any)
+		return scores["2"] == float64(1)
+	})
+	if scores := score["scores"].(map[string]any); scores["1"] != float64(0) {
+		t.Fatalf("比分不正确: %v", scores)
+	}
+	waitUntil(t, "再来一局开始", func() bool {
+		clock.Advance(100 * time.Millisecond)
+		return host.count(messageStart, nil) == 2
+	})
+	host.waitMessage(t, messageStart, func(m map[string]any) bool { return m["role"] == "black" })
+	guest.waitMessage(t, messageStart, func(m map[string]any) bool { return m["role"] == "red" })
+
+	// 对方离开后不能再来一局
+	guest.send(t, `{"type":%d}`, messageGiveUp)
+	host.waitMessage(t, messageScore, func(m map[string]any) bool {
+		scores, _ := m["scores"].(map[string]any)
+		return scores["1"] == float64(1)
+	})
+	guest.send(t, `{"v":2,"id":"leave","type":%d}`, messageLeave)
+	host.waitMessage(t, messageLeave, func(m map[string]any) bool { return m["userId"] == float64(guest.Id) })
+	host.send(t, `{"v":2,"id":"alone","type":%d}`, messageRematch)
+	host.expectError(t, "alone", CodeInvalidState)
+}
+
+func TestLeaveRoomAndIdleExpiry(t *testing.T) {
+	hub, clock := newRoomTestHub(t)
+	host := newProtocolTestClient(t, hub, 1, protocolV2)
+	guest := newProtocolTestClient(t, hub, 2, protocolV2)
+	idler := newProtocolTestClient(t, hub, 3, protocolV2)
+
+	host.send(t, `{"v":2,"id":"stray","type":%d}`, messageLeave)
+	host.expectError(t, "stray", CodeNotInRoom)
+
+	// 对局中不能离开房间
+	roomId := openRoom(t, host, guest, `{"color":"red"}`)
+	host.send(t, `{"type":%d,"ready":true}`, messageReady)
+	guest.send(t, `{"type":%d,"ready":true}`, messageReady)
+	guest.waitMessage(t, messageCountdown, nil)
+	advanceClock(t, clock, host)
+	host.send(t, `{"v":2,"id":"flee","type":%d}`, messageLeave)
+	host.expectError(t, "flee", CodeInGame)
+	host.send(t, `{"type":%d}`, messageGiveUp)
+	guest.waitMessage(t, messageEnd, nil)
+
+	// 房主离开后剩下的玩家成为房主，房间重新出现在房间列表中
+	host.send(t, `{"v":2,"id":"leave","type":%d}`, messageLeave)
+	guest.waitMessage(t, messageLeave, func(m map[string]any) bool { return m["userId"] == float64(host.Id) })
+	host.waitMessage(t, messageAck, reply("leave"))
+	if host.getRoomId() != -1 {
+		t.Fatal("离开的玩家不应当再在房间中")
+	}
+	if rooms := hub.SpareRooms(); len(rooms) != 1 || rooms[0].Id != roomId || rooms[0].Current.ID != uint(guest.Id) {
+		t.Fatalf("剩下的玩家应当成为房主: %+v", rooms)
+	}
+	// 最后一名玩家离开后房间解散
+	guest.send(t, `{"v":2,"id":"leave","type":%d}`, messageLeave)
+	guest.waitMessage(t, messageAck, reply("leave"))
+	waitUntil(t, "房间解散", func() bool {
+		return hub.getRoom(roomId) == nil && len(hub.SpareRooms()) == 0
+	})
+
+	// 长时间无操作的房间被解散并通知房间内的玩家，对局中的房间不会过期
+	idler.send(t, `{"v":2,"id":"create","type":%d}`, messageCreate)
+	idler.waitMessage(t, messageAck, reply("create"))
+	idleRoomId := idler.getRoomId()
+	playingRoomId := openRoom(t, host, guest, `{"color":"red"}`)
+	host.send(t, `{"type":%d,"ready":true}`, messageReady)
+	guest.send(t, `{"type":%d,"ready":true}`, messageReady)
+	waitUntil(t, "第二局开始", func() bool {
+		clock.Advance(100 * time.Millisecond)
+		return host.count(messageStart, nil) == 2
+	})
+	waitUntil(t, "闲置房间过期", func() bool {
+		clock.Advance(time.Minute)
+		return idler.count(messageRoomExpired, nil) == 1
+	})
+	waitUntil(t, "闲置房间解散", func() bool {
+		return hub.getRoom(idleRoomId) == nil && idler.getRoomId() == -1
+	})
+	if hub.getRoom(playingRoomId) == nil || host.count(messageRoomExpired, nil) != 0 {
+		t.Fatal("对局中的房间不应当过期")
+	}
+}
@@ -0,0 +1,332 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"chinese-chess-backend/dto/room"
+	"chinese-chess-backend/utils"
+)
+
+// SnapshotStore 保存房间快照，进程重启后据此恢复房间
+type SnapshotStore interface {
+	Save(ctx context.Context, roomId int, data []byte) error
+	Delete(ctx context.Context, roomId int) error
+	LoadAll(ctx context.Context) ([][]byte, error)
+}
+
+type redisSnapshotStore struct {
+	rdb *redis.Client
+	key string
+}
+
+// NewRedisSnapshotStore 把快照保存在Redis的key哈希中，集群中每个节点应使用不同的key
+func NewRedisSnapshotStore(rdb *redis.Client, key string) SnapshotStore {
+	return &redisSnapshotStore{rdb: rdb, key: key}
+}
+
+func (s *redisSnapshotStore) Save(ctx context.Context, roomId int, data []byte) error {
+	return s.rdb.HSet(ctx, s.key, strconv.Itoa(roomId), data).Err()
+}
+
+func (s *redisSnapshotStore) Delete(ctx context.Context, roomId int) error {
+	return s.rdb.HDel(ctx, s.key, strconv.Itoa(roomId)).Err()
+}
+
+func (s *redisSnapshotStore) LoadAll(ctx context.Context) ([][]byte, error) {
+	values, err := s.rdb.HVals(ctx, s.key).Result()
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([][]byte, 0, len(values))
+	for _, v := range values {
+		snapshots = append(snapshots, []byte(v))
+	}
+	return snapshots, nil
+}
+
+type memorySnapshotStore struct {
+	mu        sync.Mutex
+	snapshots map[int][]byte
+}
+
+func NewMemorySnapshotStore() SnapshotStore {
+	return &memorySnapshotStore{snapshots: make(map[int][]byte)}
+}
+
+func (s *memorySnapshotStore) Save(ctx context.Context, roomId int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[roomId] = data
+	return nil
+}
+
+func (s *memorySnapshotStore) Delete(ctx context.Context, roomId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.snapshots, roomId)
+	return nil
+}
+
+func (s *memorySnapshotStore) LoadAll(ctx context.Context) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshots := make([][]byte, 0, len(s.snapshots))
+	for _, data := range s.snapshots {
+		snapshots = append(snapshots, data)
+	}
+	return snapshots, nil
+}
+
+const resumeGrace = time.Minute // 从快照恢复的对局等待双方重连的最长时间，超时后开始计时
+
+// WithSnapshotStore 每次房间状态变化后保存快照，启动时恢复快照中的房间
+func WithSnapshotStore(store SnapshotStore) HubOption {
+	return func(ch *ChessHub) {
+		ch.snapshots = store
+	}
+}
+
+type playerSnapshot struct {
+	Id   int        `json:"id"`
+	Name string     `json:"name"`
+	Exp  int        `json:"exp"`
+	Bot  bool       `json:"bot,omitempty"`
+	Role clientRole `json:"role"`
+}
+
+// roomSnapshot 房间的持久化状态，棋盘由走子记录复原
+type roomSnapshot struct {
+	Id        int               `json:"id"`
+	Settings  room.RoomSettings `json:"settings"`
+	State     roomState         `json:"state"`
+	Current   *playerSnapshot   `json:"current,omitempty"` // 对局中为轮到走棋的玩家
+	Next      *playerSnapshot   `json:"next,omitempty"`
+	HostId    int               `json:"hostId"`
+	History   []MoveMessage     `json:"history"`
+	Score     map[int]int       `json:"score"`
+	Draws     int               `json:"draws"`
+	LastRedId int               `json:"lastRedId"`
+	Red       int64             `json:"red"`   // 红方剩余时间，单位为毫秒
+	Black     int64             `json:"black"` // 黑方剩余时间，单位为毫秒
+	SavedAt   time.Time         `json:"savedAt"`
+	Journal   int               `json:"journal"` // 下一条房间日志的序号，恢复后日志接着编号
+	Ply       int               `json:"ply"`
+	MoveIds   []string          `json:"moveIds,omitempty"` // 本局已处理的走子，恢复后重发的走子仍只处理一次
+}
+
+func newPlayerSnapshot(c *Client) *playerSnapshot {
+	if c == nil {
+		return nil
+	}
+	return &playerSnapshot{
+		Id:   c.Id,
+		Name: c.Name,
+		Exp:  c.getExp(),
+		Bot:  c.Bot,
+		Role: c.Role,
+	}
+}
+
+func (cr *ChessRoom) snapshot() roomSnapshot {
+	s := roomSnapshot{
+		Id:        cr.Id,
+		Settings:  cr.Settings,
+		State:     cr.State,
+		Current:   newPlayerSnapshot(cr.Current),
+		Next:      newPlayerSnapshot(cr.Next),
+		History:   cr.History,
+		Score:     cr.Score,
+		Draws:     cr.Draws,
+		LastRedId: cr.lastRedId,
+		Red:       cr.remaining(roleRed).Milliseconds(),
+		Black:     cr.remaining(roleBlack).Milliseconds(),
+		SavedAt:   cr.now(),
+		Journal:   cr.journalSeq,
+		Ply:       cr.ply,
+	}
+	if len(cr.moveIds) > 0 {
+		s.MoveIds = slices.Sorted(maps.Keys(cr.moveIds))
+	}
+	if cr.Host != nil {
+		s.HostId = cr.Host.Id
+	}
+	return s
+}
+
+func (cr *ChessRoom) snapshotKey() utils.JobOption {
+	return utils.WithKey(fmt.Sprintf("snapshot:%d", cr.Id))
+}
+
+// saveSnapshot 在房间协程中序列化快照，写入由线程池按房间顺序完成。
+// 返回的Future完成时，本次及之前的快照都已写入
+func (cr *ChessRoom) saveSnapshot() *utils.Future {
+	store := cr.hub.snapshots
+	if store == nil {
+		return nil
+	}
+	data, err := json.Marshal(cr.snapshot())
+	if err != nil {
+		log.Printf("序列化房间快照失败: %v\n", err)
+		return nil
+	}
+	roomId := cr.Id
+	future, err := cr.hub.pool.Submit(context.Background(), func() error {
+		return store.Save(context.Background(), roomId, data)
+	}, cr.snapshotKey())
+	if err != nil {
+		log.Printf("保存房间快照失败: %v\n", err)
+	}
+	return future
+}
+
+// saveChangedSnapshot 房间处理完命令后调用，聊天、准备等不影响快照内容的命令不保存。
+// 对局中的剩余时间随时间变化，比较时只使用上次走子后记录的剩余时间
+func (cr *ChessRoom) saveChangedSnapshot() {
+	if cr.hub.snapshots == nil {
+		return
+	}
+	s := cr.snapshot()
+	s.SavedAt = time.Time{}
+	s.Journal = 0
+	s.Red = cr.clocks[roleRed].Milliseconds()
+	s.Black = cr.clocks[roleBlack].Milliseconds()
+	data, err := json.Marshal(s)
+	if err != nil {
+		log.Printf("序列化房间快照失败: %v\n", err)
+		return
+	}
+	if string(data) == cr.savedState {
+		return
+	}
+	cr.savedState = string(data)
+	cr.saveSnapshot()
+}
+
+func (cr *ChessRoom) deleteSnapshot() {
+	store := cr.hub.snapshots
+	if store == nil {
+		return
+	}
+	roomId := cr.Id
+	_, err := cr.hub.pool.Submit(context.Background(), func() error {
+		return store.Delete(context.Background(), roomId)
+	}, cr.snapshotKey())
+	if err != nil {
+		log.Printf("删除房间快照失败: %v\n", err)
+	}
+}
+
+// restoreRooms 根据快照重建房间，玩家以占位客户端的身份留在房间中，重连后被替换
+func (ch *ChessHub) restoreRooms() {
+	if ch.snapshots == nil {
+		return
+	}
+	values, err := ch.snapshots.LoadAll(context.Background())
+	if err != nil {
+		log.Printf("读取房间快照失败: %v\n", err)
+		return
+	}
+	for _, data := range values {
+		var s roomSnapshot
+		if err := json.Unmarshal(data, &s); err != nil {
+			log.Printf("解析房间快照失败: %v\n", err)
+			continue
+		}
+		r, err := ch.restoreRoom(s)
+		if err != nil {
+			log.Printf("恢复房间 %d 失败: %v\n", s.Id, err)
+			continue
+		}
+		for _, c := range r.players() {
+			ch.resume[c.Id] = r.Id
+		}
+		if !r.isFull() && r.State == roomWaiting {
+			ch.addSpareRoom(r)
+		}
+		ch.startRoom(r)
+		log.Printf("已从快照恢复房间 %d\n", r.Id)
+	}
+}
+
+func (ch *ChessHub) restoreRoom(s roomSnapshot) (*ChessRoom, error) {
+	if s.Current == nil && s.Next == nil {
+		return nil, fmt.Errorf("房间内没有玩家")
+	}
+	if s.State == roomPlaying && (s.Current == nil || s.Next == nil) {
+		return nil, fmt.Errorf("对局缺少玩家")
+	}
+	reserveRoomId(s.Id)
+	r := NewChessRoom(s.Settings)
+	r.Id = s.Id
+	r.hub = ch
+	if ch.cluster != nil {
+		if err := ch.cluster.broker.SetOwner(context.Background(), r.Id, ch.cluster.nodeId); err != nil {
+			return nil, err
+		}
+	}
+	r.Current = placeholderClient(s.Current)
+	r.Next = placeholderClient(s.Next)
+	for _, c := range r.players() {
+		r.Nums++
+		if c.Id == s.HostId {
+			r.Host = c
+		}
+	}
+	if r.Host == nil {
+		r.Host = r.players()[0]
+	}
+	r.History = s.History
+	r.game = replayGame(s.History)
+	if s.Score != nil {
+		r.Score = s.Score
+	}
+	r.Draws = s.Draws
+	r.lastRedId = s.LastRedId
+	r.journalSeq = s.Journal
+	r.ply = s.Ply
+	for _, key := range s.MoveIds {
+		r.moveIds[key] = true
+	}
+	r.touch()
+
+	switch s.State {
+	case roomPlaying:
+		// 停机期间不计入玩家的用时，双方都重连或等待超时后才开始计时
+		r.State = roomPlaying
+		r.clocks[roleRed] = time.Duration(s.Red) * time.Millisecond
+		r.clocks[roleBlack] = time.Duration(s.Black) * time.Millisecond
+		r.resumeTimer = r.schedule(resumeGrace, func() {
+			r.post(hubCommand{commandType: commandResumeExpire})
+		})
+	case roomFinished:
+		r.State = roomFinished
+	default:
+		// 倒计时中断后需要重新准备
+		r.State = roomWaiting
+	}
+	return r, nil
+}
+
+// placeholderClient 快照中玩家的占位客户端，没有连接，发给它的消息会被丢弃
+func placeholderClient(p *playerSnapshot) *Client {
+	if p == nil {
+		return nil
+	}
+	c := NewClient(nil, p.Id)
+	c.Name = p.Name
+	c.setExp(p.Exp)
+	c.Bot = p.Bot
+	c.Role = p.Role
+	c.detached = true
+	return c
+}
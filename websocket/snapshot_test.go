@@ -0,0 +1,207 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"chinese-chess-backend/dto/room"
+	"chinese-chess-backend/utils"
+)
+
+// countingSnapshotStore 记录保存快照的次数
+type countingSnapshotStore struct {
+	SnapshotStore
+	saves atomic.Int32
+}
+
+func (s *countingSnapshotStore) Save(ctx context.Context, roomId int, data []byte) error {
+	s.saves.Add(1)
+	return s.SnapshotStore.Save(ctx, roomId, data)
+}
+
+const restoredRoomId = 1000
+
+// newRestoredHub 启动一个从快照恢复了进行中对局的节点，红方为玩家1，黑方为玩家2，双方各剩60秒
+func newRestoredHub(t *testing.T) (*ChessHub, *countingSnapshotStore, *utils.FakeClock) {
+	t.Helper()
+	settings := room.DefaultRoomSettings()
+	settings.TimeControl = room.TimeControl{Initial: 60}
+	data, err := json.Marshal(roomSnapshot{
+		Id:       restoredRoomId,
+		Settings: settings,
+		State:    roomPlaying,
+		Current:  &playerSnapshot{Id: 1, Name: "red", Role: roleRed},
+		Next:     &playerSnapshot{Id: 2, Name: "black", Role: roleBlack},
+		HostId:   1,
+		History:  []MoveMessage{},
+		Red:      60000,
+		Black:    60000,
+		Ply:      1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &countingSnapshotStore{SnapshotStore: NewMemorySnapshotStore()}
+	store.SnapshotStore.Save(context.Background(), restoredRoomId, data)
+
+	clock := utils.NewFakeClock(time.Now())
+	hub := NewChessHub(WithSnapshotStore(store), WithClock(clock))
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+	return hub, store, clock
+}
+
+// syncRoom 等待房间处理完之前投递的命令
+func syncRoom(t *testing.T, hub *ChessHub, roomId int) {
+	t.Helper()
+	waitUntil(t, "房间恢复", func() bool {
+		return hub.getRoom(roomId) != nil
+	})
+	synced := make(chan struct{})
+	if !hub.getRoom(roomId).post(hubCommand{commandType: commandSync, payload: synced}) {
+		t.Fatal("房间已解散")
+	}
+	<-synced
+}
+
+func TestRestoredGameHoldsClockUntilBothPlayersReturn(t *testing.T) {
+	hub, _, clock := newRestoredHub(t)
+
+	red := newTestClient(t, hub, 1)
+	red.waitMessage(t, messageResync, nil)
+	clock.Advance(10 * time.Second)
+	syncRoom(t, hub, restoredRoomId)
+	if r := hub.getRoom(restoredRoomId); r.clockTimer != nil || r.resumeTimer == nil {
+		t.Fatal("只有一方重连时不应当开始计时")
+	}
+
+	red.send(t, `{"type":%d,"from":{"x":7,"y":7},"to":{"x":4,"y":7}}`, messageMove)
+	red.waitMessage(t, messageNormal, func(m map[string]any) bool {
+		return m["message"] == "请等待对方重新连接"
+	})
+
+	black := newTestClient(t, hub, 2)
+	black.waitMessage(t, messageResync, nil)
+	syncRoom(t, hub, restoredRoomId)
+	r := hub.getRoom(restoredRoomId)
+	if r.clockTimer == nil || r.resumeTimer != nil {
+		t.Fatal("双方都重连后应当开始计时")
+	}
+	if got := r.clocks[roleRed]; got != time.Minute {
+		t.Fatalf("等待重连期间不应当扣除用时，红方剩余 %v", got)
+	}
+}
+
+func TestRestoredGameStartsClockAfterGrace(t *testing.T) {
+	hub, _, clock := newRestoredHub(t)
+
+	red := newTestClient(t, hub, 1)
+	red.waitMessage(t, messageResync, nil)
+	waitUntil(t, "等待重连超时后开始计时", func() bool {
+		clock.Advance(time.Second)
+		return red.find(func(m map[string]any) bool {
+			return m["type"] == float64(messageClock)
+		}) != nil
+	})
+	syncRoom(t, hub, restoredRoomId)
+	if r := hub.getRoom(restoredRoomId); r.clockTimer == nil || r.resumeTimer != nil {
+		t.Fatal("等待重连超时后应当开始计时")
+	}
+}
+
+func TestSnapshotSavedOnlyOnStateChange(t *testing.T) {
+	hub, store, _ := newRestoredHub(t)
+
+	red := newTestClient(t, hub, 1)
+	black := newTestClient(t, hub, 2)
+	red.waitMessage(t, messageResync, nil)
+	black.waitMessage(t, messageResync, nil)
+	syncRoom(t, hub, restoredRoomId)
+	settled := func() int32 {
+		// 快照由线程池异步写入
+		var last int32 = -1
+		waitUntil(t, "快照写入完成", func() bool {
+			n := store.saves.Load()
+			done := n == last
+			last = n
+			time.Sleep(20 * time.Millisecond)
+			return done
+		})
+		return last
+	}
+	before := settled()
+
+	red.send(t, `{"type":%d,"content":"你好"}`, messageChat)
+	black.waitMessage(t, messageChat, nil)
+	syncRoom(t, hub, restoredRoomId)
+	if after := settled(); after != before {
+		t.Fatalf("聊天不应当保存快照，保存次数从%d变为%d", before, after)
+	}
+
+	red.send(t, `{"type":%d,"from":{"x":7,"y":7},"to":{"x":4,"y":7}}`, messageMove)
+	black.waitMessage(t, messageMove, nil)
+	syncRoom(t, hub, restoredRoomId)
+	if after := settled(); after != before+1 {
+		t.Fatalf("走子后应当保存一次快照，保存次数从%d变为%d", before, after)
+	}
+}
+
+func TestRestoredGameIgnoresRetriedMove(t *testing.T) {
+	hub, store, clock := newRestoredHub(t)
+	red := newTestClient(t, hub, 1)
+	black := newTestClient(t, hub, 2)
+	red.waitMessage(t, messageResync, nil)
+	black.waitMessage(t, messageResync, nil)
+	syncRoom(t, hub, restoredRoomId)
+
+	red.send(t, `{"type":%d,"from":{"x":7,"y":7},"to":{"x":4,"y":7},"moveId":"m1"}`, messageMove)
+	black.waitMessage(t, messageMove, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := hub.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.LoadAll(context.Background())
+	if err != nil || len(data) != 1 {
+		t.Fatalf("停机后应当保存一个快照: %v", err)
+	}
+	var s roomSnapshot
+	if err := json.Unmarshal(data[0], &s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.MoveIds) != 1 || s.MoveIds[0] != "1:m1" {
+		t.Fatalf("快照中应当保存已处理的走子id，实际 %v", s.MoveIds)
+	}
+
+	// 重启后红方重发同一步走子，轮到黑方走棋时也只确认不处理
+	restarted := NewChessHub(WithSnapshotStore(store), WithClock(clock))
+	go restarted.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		restarted.Shutdown(ctx)
+	})
+	red = newProtocolTestClient(t, restarted, 1, protocolV2)
+	black = newTestClient(t, restarted, 2)
+	red.waitMessage(t, messageResync, nil)
+	black.waitMessage(t, messageResync, nil)
+	red.send(t, `{"v":2,"id":"retry","type":%d,"data":{"from":{"x":7,"y":7},"to":{"x":4,"y":7},"moveId":"m1"}}`, messageMove)
+	red.waitMessage(t, messageAck, reply("retry"))
+	if red.find(reply("retry"))["type"] != float64(messageAck) {
+		t.Fatal("重发的走子不应当被拒绝")
+	}
+	syncRoom(t, restarted, restoredRoomId)
+	if r := restarted.getRoom(restoredRoomId); r.ply != 2 || len(r.History) != 1 {
+		t.Fatalf("重发的走子不应当再次处理，序号 %d，记录 %d 步", r.ply, len(r.History))
+	}
+	if black.find(func(m map[string]any) bool { return m["type"] == float64(messageMove) }) != nil {
+		t.Fatal("重发的走子不应当再次转发给对手")
+	}
+}
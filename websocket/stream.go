@@ -0,0 +1,418 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"chinese-chess-backend/dto"
+)
+
+// transport 客户端的连接方式。无法使用websocket的客户端通过事件流或长轮询接收消息，
+// 通过REST接口发送消息，和websocket客户端共用大厅的命令处理
+type transport int
+
+const (
+	transportWebsocket transport = iota
+	transportEvents              // Server-Sent Events
+	transportPoll                // 长轮询
+	transportBot                 // 机器人接口的NDJSON事件流
+)
+
+const (
+	pollTimeout     = 25 * time.Second // 长轮询没有消息时最多挂起的时间
+	pollIdleTimeout = time.Minute      // 长轮询客户端超过该时间没有请求时注销
+	maxPollMessages = 100              // 一次轮询最多返回的消息数
+	maxStreamBody   = 1024 * 1024
+
+	requestIdHeader = "X-Request-Id" // v2协议中REST请求的请求id，确认和错误回复经由事件流或轮询下发
+)
+
+// pollResponse 长轮询的响应，Closed为true表示客户端已被断开，需要重新轮询建立新的会话
+type pollResponse struct {
+	Messages []any `json:"messages"`
+	Closed   bool  `json:"closed"`
+}
+
+// contextUserId 读取鉴权中间件写入的用户id，失败时直接回复错误
+func contextUserId(c *gin.Context) (int, bool) {
+	userId, exists := c.Get("userId")
+	if !exists {
+		dto.ErrorResponse(c, dto.WithMessage("用户未登录"))
+		return 0, false
+	}
+
+	id, ok := userId.(int)
+	if !ok {
+		dto.ErrorResponse(c, dto.WithMessage("用户ID转换失败"))
+		return 0, false
+	}
+	return id, true
+}
+
+// streamProtocol 事件流和长轮询通过地址中的protocol=2使用v2协议，不支持二进制协议
+func streamProtocol(c *gin.Context) int {
+	if c.Query("protocol") == "2" {
+		return protocolV2
+	}
+	return protocolLegacy
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) seen(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastSeen = now
+}
+
+func (c *Client) lastSeenAt() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastSeen
+}
+
+// receive 等待发送队列中的消息，收到第一条后取出队列中已有的其余消息。
+// 客户端断开后仍然返回队列中剩余的消息，例如停机通知，取完后closed为true
+func (c *Client) receive(ctx context.Context, timeout time.Duration) (messages []any, closed bool) {
+	messages = make([]any, 0)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case message := <-c.send:
+		messages = append(messages, c.encode(message))
+	case <-c.done:
+	case <-timer.C:
+		return messages, false
+	case <-ctx.Done():
+		return messages, false
+	}
+drain:
+	for len(messages) < maxPollMessages {
+		select {
+		case message := <-c.send:
+			messages = append(messages, c.encode(message))
+		default:
+			break drain
+		}
+	}
+	return messages, c.closed() && len(c.send) == 0
+}
+
+func writeEvent(w gin.ResponseWriter, message any) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+func (ch *ChessHub) acceptStream(c *gin.Context) (int, bool) {
+	if ch.draining.Load() {
+		dto.ErrorResponse(c, dto.WithMessage("服务器维护中，请稍后再试"))
+		return 0, false
+	}
+	return contextUserId(c)
+}
+
+// HandleEvents 以Server-Sent Events推送websocket客户端会收到的全部消息，请求结束时注销客户端
+func (ch *ChessHub) HandleEvents(c *gin.Context) {
+	id, ok := ch.acceptStream(c)
+	if !ok {
+		return
+	}
+
+	client := NewClient(nil, id)
+	client.transport = transportEvents
+	client.protocol = streamProtocol(c)
+	if err := ch.loadProfile(client); err != nil {
+		log.Printf("加载用户信息失败: %v\n", err)
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no") // 避免nginx缓冲事件
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	defer client.close()
+	ch.commands <- hubCommand{
+		commandType: commandRegister,
+		client:      client,
+	}
+	defer func() {
+		ch.commands <- hubCommand{
+			commandType: commandUnregister,
+			client:      client,
+		}
+	}()
+
+	ch.sendMessage(client, NormalMessage{
+		BaseMessage: BaseMessage{Type: messageNormal},
+		Message:     "连接成功",
+	})
+
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case message := <-client.send:
+			if err := writeEvent(c.Writer, client.encode(message)); err != nil {
+				log.Printf("发送事件失败: %v\n", err)
+				return
+			}
+		case <-ticker.C:
+			// 注释行作为心跳，防止代理断开空闲连接
+			if _, err := io.WriteString(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-client.done:
+			for {
+				select {
+				case message := <-client.send:
+					if err := writeEvent(c.Writer, client.encode(message)); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// HandlePoll 长轮询，第一次请求时注册客户端，之后每次请求返回期间收到的消息。
+// 同一用户同时只应有一个进行中的轮询请求
+func (ch *ChessHub) HandlePoll(c *gin.Context) {
+	id, ok := contextUserId(c)
+	if !ok {
+		return
+	}
+	client := ch.pollClient(id, streamProtocol(c))
+	if client == nil {
+		dto.ErrorResponse(c, dto.WithMessage("服务器维护中，请稍后再试"))
+		return
+	}
+	messages, closed := client.receive(c.Request.Context(), pollTimeout)
+	client.seen(ch.clock.Now())
+	dto.SuccessResponse(c, dto.WithData(pollResponse{
+		Messages: messages,
+		Closed:   closed,
+	}))
+}
+
+// pollClient 返回用户的长轮询客户端，没有或已断开且消息已取完时注册一个新的客户端，
+// 停机中不再注册并返回nil
+func (ch *ChessHub) pollClient(id int, protocol int) *Client {
+	now := ch.clock.Now()
+	ch.mu.Lock()
+	old := ch.polls[id]
+	if old != nil && (!old.closed() || len(old.send) > 0) {
+		ch.mu.Unlock()
+		old.seen(now)
+		return old
+	}
+	if ch.draining.Load() {
+		ch.mu.Unlock()
+		return nil
+	}
+	client := NewClient(nil, id)
+	client.transport = transportPoll
+	client.protocol = protocol
+	client.seen(now)
+	ch.polls[id] = client
+	ch.mu.Unlock()
+
+	if old != nil {
+		ch.commands <- hubCommand{
+			commandType: commandUnregister,
+			client:      old,
+		}
+	}
+	if err := ch.loadProfile(client); err != nil {
+		log.Printf("加载用户信息失败: %v\n", err)
+	}
+	ch.commands <- hubCommand{
+		commandType: commandRegister,
+		client:      client,
+	}
+	ch.sendMessage(client, NormalMessage{
+		BaseMessage: BaseMessage{Type: messageNormal},
+		Message:     "连接成功",
+	})
+	ch.scheduler.Schedule(pollIdleTimeout, func() {
+		ch.expirePoll(client)
+	})
+	return client
+}
+
+// expirePoll 注销长时间没有轮询的客户端
+func (ch *ChessHub) expirePoll(client *Client) {
+	idle := ch.clock.Now().Sub(client.lastSeenAt())
+	if idle < pollIdleTimeout && !client.closed() {
+		ch.scheduler.Schedule(pollIdleTimeout-idle, func() {
+			ch.expirePoll(client)
+		})
+		return
+	}
+	ch.closePoll(client)
+}
+
+// closePoll 移除并注销长轮询客户端，已被新的客户端替换时不做处理
+func (ch *ChessHub) closePoll(client *Client) {
+	ch.mu.Lock()
+	current := ch.polls[client.Id] == client
+	if current {
+		delete(ch.polls, client.Id)
+	}
+	ch.mu.Unlock()
+	if !current {
+		return
+	}
+	client.close()
+	// 在定时器的线程池中执行，不能阻塞等待大厅协程
+	go func() {
+		ch.commands <- hubCommand{
+			commandType: commandUnregister,
+			client:      client,
+		}
+	}()
+}
+
+// CloseStreams 通知并断开事件流、长轮询客户端和机器人对局流。HTTP服务停机时会等待进行中的请求结束，
+// 需要在停机开始时调用，websocket连接不受影响
+func (ch *ChessHub) CloseStreams() {
+	ch.closeStreams()
+	ch.mu.Lock()
+	clients := make([]*Client, 0)
+	for _, c := range ch.Clients {
+		if c.transport != transportWebsocket {
+			clients = append(clients, c)
+		}
+	}
+	ch.mu.Unlock()
+	for _, c := range clients {
+		c.sendMessage(NormalMessage{
+			BaseMessage: BaseMessage{Type: messageMaintenance},
+			Message:     "服务器即将停机维护，请稍后重新连接",
+		})
+		c.close()
+	}
+}
+
+// streamClient 返回发送REST请求的用户的事件流或长轮询客户端
+func (ch *ChessHub) streamClient(c *gin.Context) (*Client, bool) {
+	id, ok := contextUserId(c)
+	if !ok {
+		return nil, false
+	}
+	client := ch.getClient(id)
+	if client == nil || client.transport == transportWebsocket || client.closed() {
+		dto.ErrorResponse(c, dto.WithMessage("未通过事件流或长轮询连接"))
+		return nil, false
+	}
+	return client, true
+}
+
+func readStreamBody(c *gin.Context) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxStreamBody))
+	if err != nil {
+		dto.ErrorResponse(c, dto.WithMessage("读取请求失败"))
+		return nil, false
+	}
+	return body, true
+}
+
+// HandleStreamMessage 发送任意类型的消息，请求体与websocket客户端发送的消息相同
+func (ch *ChessHub) HandleStreamMessage(c *gin.Context) {
+	client, ok := ch.streamClient(c)
+	if !ok {
+		return
+	}
+	body, ok := readStreamBody(c)
+	if !ok {
+		return
+	}
+	ch.finishStreamRequest(c, client, ch.handleMessage(client, body))
+}
+
+// HandleStreamMatch 加入匹配队列
+func (ch *ChessHub) HandleStreamMatch(c *gin.Context) {
+	ch.postStreamMessage(c, messageMatch)
+}
+
+// HandleStreamMove 走子，请求体与走子消息相同
+func (ch *ChessHub) HandleStreamMove(c *gin.Context) {
+	ch.postStreamMessage(c, messageMove)
+}
+
+// HandleStreamChat 发送房间聊天，请求体与聊天消息相同
+func (ch *ChessHub) HandleStreamChat(c *gin.Context) {
+	ch.postStreamMessage(c, messageChat)
+}
+
+// postStreamMessage 把请求体作为t类型的消息交给处理函数，回复经由事件流或长轮询下发
+func (ch *ChessHub) postStreamMessage(c *gin.Context, t MessageType) {
+	client, ok := ch.streamClient(c)
+	if !ok {
+		return
+	}
+	body, ok := readStreamBody(c)
+	if !ok {
+		return
+	}
+	ch.submitStreamMessage(c, client, t, body)
+}
+
+// submitStreamMessage 以client的身份处理t类型的消息，body为空时表示没有消息体
+func (ch *ChessHub) submitStreamMessage(c *gin.Context, client *Client, t MessageType, body []byte) {
+	if len(body) == 0 {
+		body = []byte("{}")
+	}
+	req := requestEnvelope{
+		V:    client.protocol,
+		Id:   c.GetHeader(requestIdHeader),
+		Type: t,
+	}
+	ch.finishStreamRequest(c, client, ch.dispatchRequest(client, req, body))
+}
+
+// finishStreamRequest 处理失败时和websocket一样断开客户端
+func (ch *ChessHub) finishStreamRequest(c *gin.Context, client *Client, err error) {
+	if err != nil {
+		log.Printf("处理消息失败: %v\n", err)
+		if client.transport == transportPoll {
+			ch.closePoll(client)
+		} else {
+			client.close()
+		}
+		dto.ErrorResponse(c, dto.WithMessage(err.Error()))
+		return
+	}
+	if client.transport == transportPoll {
+		client.seen(ch.clock.Now())
+	}
+	dto.SuccessResponse(c)
+}
@@ -0,0 +1,334 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	userModel "chinese-chess-backend/model/user"
+	"chinese-chess-backend/utils"
+)
+
+// streamResponse 接口统一的响应格式
+type streamResponse struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// newStreamTestServer 启动挂载了事件流和REST接口的服务，以X-User-Id头代替鉴权中间件
+func newStreamTestServer(t *testing.T) (*ChessHub, *utils.FakeClock, *httptest.Server) {
+	t.Helper()
+	clock := utils.NewFakeClock(time.Now())
+	hub := NewChessHub(WithClock(clock), WithProfileLoader(func(userId int) (userModel.User, error) {
+		return userModel.User{Name: fmt.Sprintf("player%d", userId), Exp: 100}, nil
+	}))
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if id, err := strconv.Atoi(c.GetHeader("X-User-Id")); err == nil {
+			c.Set("userId", id)
+		}
+	})
+	r.GET("/stream/events", hub.HandleEvents)
+	r.GET("/stream/poll", hub.HandlePoll)
+	r.POST("/stream/messages", hub.HandleStreamMessage)
+	r.POST("/stream/match", hub.HandleStreamMatch)
+	r.POST("/stream/move", hub.HandleStreamMove)
+	r.POST("/stream/chat", hub.HandleStreamChat)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return hub, clock, server
+}
+
+// streamRequest 以userId的身份请求path，userId为0时不带身份，requestId非空时作为v2请求id
+func streamRequest(ctx context.Context, t *testing.T, server *httptest.Server, method, path string, userId int, requestId, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userId != 0 {
+		req.Header.Set("X-User-Id", strconv.Itoa(userId))
+	}
+	if requestId != "" {
+		req.Header.Set(requestIdHeader, requestId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("请求%s失败: %v", path, err)
+	}
+	return resp
+}
+
+// post 发送REST请求并解析响应
+func post(t *testing.T, server *httptest.Server, path string, userId int, requestId, body string) streamResponse {
+	t.Helper()
+	resp := streamRequest(context.Background(), t, server, http.MethodPost, path, userId, requestId, body)
+	defer resp.Body.Close()
+	var r streamResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("解析%s的响应失败: %v", path, err)
+	}
+	return r
+}
+
+// pollSession 用户的长轮询会话，记录已经收到的消息
+type pollSession struct {
+	server   *httptest.Server
+	userId   int
+	query    string
+	messages []map[string]any
+}
+
+// poll 发起一次长轮询，返回本次收到的消息
+func (ps *pollSession) poll(t *testing.T) (pollResponse, streamResponse) {
+	t.Helper()
+	resp := streamRequest(context.Background(), t, ps.server, http.MethodGet, "/stream/poll"+ps.query, ps.userId, "", "")
+	defer resp.Body.Close()
+	var r streamResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		t.Fatalf("解析轮询响应失败: %v", err)
+	}
+	var p pollResponse
+	if r.Code == 100 {
+		if err := json.Unmarshal(r.Data, &p); err != nil {
+			t.Fatalf("解析轮询消息失败: %v", err)
+		}
+		for _, m := range p.Messages {
+			ps.messages = append(ps.messages, m.(map[string]any))
+		}
+	}
+	return p, r
+}
+
+// pollUntil 持续轮询直到收到匹配的消息，之前收到的消息同样参与匹配
+func (ps *pollSession) pollUntil(t *testing.T, match func(m map[string]any) bool) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, m := range ps.messages {
+			if match(m) {
+				return m
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("玩家%d等待轮询消息超时，已收到: %v", ps.userId, ps.messages)
+		}
+		ps.poll(t)
+	}
+}
+
+// eventStream 事件流中已经收到的消息
+type eventStream struct {
+	userId int
+	events chan map[string]any
+	seen   []map[string]any
+}
+
+// openEvents 建立事件流，测试结束时断开
+func openEvents(t *testing.T, server *httptest.Server, userId int, query string) *eventStream {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	resp := streamRequest(ctx, t, server, http.MethodGet, "/stream/events"+query, userId, "", "")
+	t.Cleanup(func() {
+		cancel()
+		resp.Body.Close()
+	})
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("事件流的Content-Type为%q", ct)
+	}
+	es := &eventStream{userId: userId, events: make(chan map[string]any, 64)}
+	go func() {
+		defer close(es.events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data: "))
+			if !ok {
+				continue
+			}
+			var m map[string]any
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Errorf("解析事件失败: %v", err)
+				return
+			}
+			es.events <- m
+		}
+	}()
+	return es
+}
+
+// waitEvent 等待匹配的事件，之前收到的事件同样参与匹配
+func (es *eventStream) waitEvent(t *testing.T, match func(m map[string]any) bool) map[string]any {
+	t.Helper()
+	for _, m := range es.seen {
+		if match(m) {
+			return m
+		}
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m, ok := <-es.events:
+			if !ok {
+				t.Fatalf("玩家%d的事件流已断开，已收到: %v", es.userId, es.seen)
+			}
+			es.seen = append(es.seen, m)
+			if match(m) {
+				return m
+			}
+		case <-timeout:
+			t.Fatalf("玩家%d等待事件超时，已收到: %v", es.userId, es.seen)
+		}
+	}
+}
+
+// ofType 匹配指定类型的消息，v2协议的类型同样在信封的顶层
+func ofType(t MessageType) func(m map[string]any) bool {
+	return func(m map[string]any) bool {
+		return m["type"] == float64(t)
+	}
+}
+
+// connected 匹配连接成功的提示，v2协议中提示在data中
+func connected(m map[string]any) bool {
+	if data, ok := m["data"].(map[string]any); ok {
+		m = data
+	}
+	return m["message"] == "连接成功"
+}
+
+func TestStreamsShareHubCommands(t *testing.T) {
+	hub, _, server := newStreamTestServer(t)
+	alice := openEvents(t, server, 1, "")
+	alice.waitEvent(t, connected)
+	bob := &pollSession{server: server, userId: 2, query: "?protocol=2"}
+	bob.pollUntil(t, connected)
+	if c := hub.getClient(1); c == nil || c.transport != transportEvents || c.Name != "player1" {
+		t.Fatalf("事件流应当注册为读取了用户信息的客户端: %+v", c)
+	}
+
+	// 不在房间中聊天被拒绝，v2协议的错误回复带着请求头中的id经由轮询下发
+	if r := post(t, server, "/stream/chat", bob.userId, "early", `{"content":"你好"}`); r.Code != 100 {
+		t.Fatalf("被大厅拒绝的请求仍然应当成功提交: %+v", r)
+	}
+	m := bob.pollUntil(t, reply("early"))
+	if m["type"] != float64(messageError) || errorCode(m) != CodeNotInRoom {
+		t.Fatalf("应当以%q拒绝: %v", CodeNotInRoom, m)
+	}
+
+	// 两种连接方式的玩家通过REST接口匹配到同一个房间
+	if r := post(t, server, "/stream/match", alice.userId, "", ""); r.Code != 100 {
+		t.Fatalf("匹配失败: %+v", r)
+	}
+	alice.waitEvent(t, func(m map[string]any) bool {
+		return m["type"] == float64(messageNormal) && m["message"] == "正在匹配，请稍等"
+	})
+	if r := post(t, server, "/stream/match", bob.userId, "match", ""); r.Code != 100 {
+		t.Fatalf("匹配失败: %+v", r)
+	}
+	bob.pollUntil(t, func(m map[string]any) bool {
+		return m["type"] == float64(messageAck) && m["id"] == "match"
+	})
+	bob.pollUntil(t, ofType(messageCountdown))
+	alice.waitEvent(t, ofType(messageCountdown))
+	waitUntil(t, "双方进入同一个房间", func() bool {
+		roomId := hub.getClient(alice.userId).getRoomId()
+		return roomId != -1 && roomId == hub.getClient(bob.userId).getRoomId()
+	})
+
+	// 通用接口的请求体与websocket消息相同
+	if r := post(t, server, "/stream/messages", alice.userId, "", fmt.Sprintf(`{"type":%d,"content":"你好"}`, messageChat)); r.Code != 100 {
+		t.Fatalf("发送消息失败: %+v", r)
+	}
+	bob.pollUntil(t, func(m map[string]any) bool {
+		data, _ := m["data"].(map[string]any)
+		return m["type"] == float64(messageChat) && data["content"] == "你好" && data["userId"] == float64(alice.userId)
+	})
+}
+
+func TestStreamRequestErrors(t *testing.T) {
+	hub, _, server := newStreamTestServer(t)
+
+	if r := post(t, server, "/stream/match", 0, "", ""); r.Code != 0 || r.Message != "用户未登录" {
+		t.Fatalf("没有登录时应当拒绝: %+v", r)
+	}
+	if _, r := (&pollSession{server: server}).poll(t); r.Code != 0 || r.Message != "用户未登录" {
+		t.Fatalf("没有登录时应当拒绝轮询: %+v", r)
+	}
+	// websocket客户端和没有连接的用户不能使用REST接口
+	newTestClient(t, hub, 1)
+	waitUntil(t, "玩家1注册", func() bool { return hub.getClient(1) != nil })
+	for _, id := range []int{1, 2} {
+		if r := post(t, server, "/stream/match", id, "", ""); r.Code != 0 || r.Message != "未通过事件流或长轮询连接" {
+			t.Fatalf("玩家%d没有事件流时应当拒绝: %+v", id, r)
+		}
+	}
+
+	// 处理失败时和websocket一样断开，之后的轮询建立新的会话
+	carol := &pollSession{server: server, userId: 3}
+	carol.pollUntil(t, connected)
+	first := hub.getClient(3)
+	if r := post(t, server, "/stream/messages", carol.userId, "", "{"); r.Code != 0 {
+		t.Fatalf("无法解析的消息应当返回错误: %+v", r)
+	}
+	if !first.closed() {
+		t.Fatal("处理失败后应当断开长轮询客户端")
+	}
+	if r := post(t, server, "/stream/match", carol.userId, "", ""); r.Code != 0 {
+		t.Fatalf("断开后不能再发送消息: %+v", r)
+	}
+	carol.messages = nil
+	carol.pollUntil(t, connected)
+	waitUntil(t, "新的长轮询客户端注册", func() bool {
+		c := hub.getClient(3)
+		return c != nil && c != first
+	})
+
+	// 停机中不再接受事件流和新的长轮询会话
+	hub.draining.Store(true)
+	resp := streamRequest(context.Background(), t, server, http.MethodGet, "/stream/events", 4, "", "")
+	defer resp.Body.Close()
+	var r streamResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil || r.Message != "服务器维护中，请稍后再试" {
+		t.Fatalf("停机中应当拒绝事件流: %+v, %v", r, err)
+	}
+	if _, r := (&pollSession{server: server, userId: 4}).poll(t); r.Message != "服务器维护中，请稍后再试" {
+		t.Fatalf("停机中应当拒绝新的长轮询: %+v", r)
+	}
+}
+
+func TestIdlePollClientExpires(t *testing.T) {
+	hub, clock, server := newStreamTestServer(t)
+	alice := &pollSession{server: server, userId: 1}
+	alice.pollUntil(t, connected)
+	client := hub.getClient(1)
+
+	// 超过一分钟没有轮询时注销，之后的轮询建立新的会话
+	clock.Advance(2 * pollIdleTimeout)
+	waitUntil(t, "长轮询客户端注销", func() bool {
+		return client.closed() && hub.getClient(1) == nil
+	})
+	alice.messages = nil
+	alice.pollUntil(t, connected)
+	if c := hub.getClient(1); c == nil || c == client {
+		t.Fatal("应当注册新的长轮询客户端")
+	}
+}
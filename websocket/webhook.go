@@ -0,0 +1,59 @@
+package websocket
+
+import (
+	"chinese-chess-backend/dto/room"
+)
+
+// WebhookDispatcher 把事件推送给外部系统，由service中的WebhookService实现
+type WebhookDispatcher interface {
+	Dispatch(event string, data any)
+}
+
+type matchFoundPayload struct {
+	RoomId    int   `json:"roomId"`
+	PlayerIds []int `json:"playerIds"`
+}
+
+type gameStartedPayload struct {
+	RoomId   int               `json:"roomId"`
+	RedId    int               `json:"redId"`
+	BlackId  int               `json:"blackId"`
+	Settings room.RoomSettings `json:"settings"`
+}
+
+type gameEndedPayload struct {
+	RoomId   int           `json:"roomId"`
+	Winner   clientRole    `json:"winner"`
+	WinnerId int           `json:"winnerId"` // 和棋时为0
+	LoserId  int           `json:"loserId"`
+	Rated    bool          `json:"rated"`
+	Moves    []MoveMessage `json:"moves"`
+}
+
+// SubscribeWebhooks 把匹配、开局和终局事件转发给webhook
+func SubscribeWebhooks(bus *EventBus, dispatcher WebhookDispatcher) {
+	Subscribe(bus, func(e MatchFound) {
+		dispatcher.Dispatch("match.found", matchFoundPayload{
+			RoomId:    e.RoomId,
+			PlayerIds: e.PlayerIds,
+		})
+	})
+	Subscribe(bus, func(e GameStarted) {
+		dispatcher.Dispatch("game.started", gameStartedPayload{
+			RoomId:   e.RoomId,
+			RedId:    e.RedId,
+			BlackId:  e.BlackId,
+			Settings: e.Settings,
+		})
+	})
+	Subscribe(bus, func(e GameEnded) {
+		dispatcher.Dispatch("game.ended", gameEndedPayload{
+			RoomId:   e.RoomId,
+			Winner:   e.Winner,
+			WinnerId: e.WinnerId,
+			LoserId:  e.LoserId,
+			Rated:    e.Rated,
+			Moves:    e.Moves,
+		})
+	})
+}
@@ -1,20 +1,20 @@
 package websocket
 
 import (
+	"context"
 	"fmt"
 	"log"
 
 	"github.com/gin-gonic/gin"
 
-	"context"
-	"encoding/json"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 
-	"chinese-chess-backend/database"
+	"chinese-chess-backend/config"
 	"chinese-chess-backend/dto"
 	"chinese-chess-backend/dto/room"
 	"chinese-chess-backend/dto/user"
@@ -30,6 +30,7 @@ const (
 var upgrader = &websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{subprotocolProto, subprotocolV2},
 	// 允许所有CORS请求，生产环境应该限制
 	CheckOrigin: func(r *http.Request) bool {
 		return true
@@ -41,22 +42,66 @@ type ChessHub struct {
 	Clients    map[int]*Client
 	commands   chan hubCommand
 	spareRooms []room.RoomInfo // 有空位的房间id
-	mu         sync.Mutex
-	pool       *utils.WorkerPool
-	matchPool  [](*Client)
+	lobby      map[int]*Client // 订阅了大厅的客户端
+	polls      map[int]*Client // 长轮询的客户端，按用户id索引
+	mu         sync.Mutex      // 保护Rooms、Clients、spareRooms、lobby和polls
+	matchPool  [](*Client)     // 只由大厅协程访问
+	clock      utils.Clock
+	scheduler  *utils.Scheduler
+	pool       *utils.WorkerPool // 执行定时回调和集群消息的发布
+	cluster    *cluster          // 为nil时以单节点模式运行
+	snapshots  SnapshotStore     // 为nil时不保存房间快照
+	resume     map[int]int       // 从快照恢复、尚未重连的玩家所在的房间，只由大厅协程访问
+	draining   atomic.Bool       // 停机中，不再接受新连接、匹配和创建房间
+	journal    Journal           // 为nil时不记录房间命令
+	challenges ChallengeStore
+	presence   PresenceStore
+	profiles   ProfileLoader
+	blockList  BlockList // 为nil时不检查屏蔽关系
+	events     *EventBus
+	handlers   *HandlerRegistry
+
+	streams      context.Context // 停机时取消，用于断开没有注册为客户端的机器人对局流
+	closeStreams context.CancelFunc
+}
+
+// WithClock 指定棋钟和定时器使用的时钟，回放日志时传入FakeClock
+func WithClock(clock utils.Clock) HubOption {
+	return func(ch *ChessHub) {
+		ch.clock = clock
+	}
 }
 
-func NewChessHub() *ChessHub {
+func NewChessHub(opts ...HubOption) *ChessHub {
 	pool := utils.NewWorkerPool()
+	streams, closeStreams := context.WithCancel(context.Background())
 	hub := &ChessHub{
 		Rooms:      make(map[int](*ChessRoom)),
 		Clients:    make(map[int]*Client),
 		commands:   make(chan hubCommand),
 		spareRooms: make([]room.RoomInfo, 0),
+		lobby:      make(map[int]*Client),
+		polls:      make(map[int]*Client),
+		resume:     make(map[int]int),
 		mu:         sync.Mutex{},
+		clock:      utils.RealClock,
 		pool:       pool,
+		events:     NewEventBus(pool),
+		handlers:   NewHandlerRegistry(),
+		challenges: newMemoryChallengeStore(),
+		presence:   newMemoryPresenceStore(),
+		profiles:   loadMysqlProfile,
+
+		streams:      streams,
+		closeStreams: closeStreams,
 	}
+	hub.registerHandlers()
+	for _, opt := range opts {
+		opt(hub)
+	}
+	hub.scheduler = utils.NewScheduler(utils.WithClock(hub.clock), utils.WithWorkerPool(pool))
 	pool.Start()
+	hub.scheduler.Start()
 
 	return hub
 }
@@ -67,256 +112,348 @@ func (ch *ChessHub) Run() {
 			log.Printf("Worker pool error: %v\n", err)
 		}
 	}()
+	ch.scheduler.Schedule(ch.sweepInterval(), ch.sweepIdleRooms)
+	subscribeRating(ch.events)
+	ch.clearPresence()
+	Subscribe(ch.events, ch.savePresence)
+	if ch.cluster != nil {
+		if err := ch.cluster.run(context.Background()); err != nil {
+			log.Printf("订阅集群消息失败: %v\n", err)
+		}
+	}
+	ch.restoreRooms()
+	// 大厅协程只负责注册、匹配和创建房间，并按房间id把对局命令转发给房间协程
 	for cmd := range ch.commands {
-		ch.pool.Process(context.Background(), func() error {
-			switch cmd.commandType {
-			case commandRegister:
-				client := cmd.client
-				ch.mu.Lock()
-				ch.Clients[client.Id] = client
-				ch.mu.Unlock()
-				// 在线用户
-				database.SetValue(fmt.Sprint(client.Id), "a", 0)
-			case commandUnregister:
-				client := cmd.client
-				roomId := client.RoomId
-				ch.mu.Lock()
-				room, ok := ch.Rooms[roomId]
-				ch.mu.Unlock()
-				if ok {
-					var target *Client
-					if room.Current == client {
-						target = room.Next
-					} else {
-						target = room.Current
-					}
-					if target != nil {
-						ch.sendMessage(target, NormalMessage{
-							BaseMessage: BaseMessage{Type: messageNormal},
-							Message:     "对方已断开连接",
-						})
-					}
-					room.clear()
-					ch.mu.Lock()
-					delete(ch.Rooms, roomId)
-					// 如果房间原本只有一个人，那么删除房间
-					for i, r := range ch.spareRooms {
-						if r.Id == roomId {
-							ch.spareRooms = slices.Delete(ch.spareRooms, i, i+1)
-							break
-						}
-					}
-					ch.mu.Unlock()
-				}
-				ch.mu.Lock()
-				if _, ok := ch.Clients[client.Id]; ok {
-					delete(ch.Clients, client.Id)
-					client.Conn.Close()
+		switch cmd.commandType {
+		case commandRegister:
+			client := cmd.client
+			ch.mu.Lock()
+			ch.Clients[client.Id] = client
+			ch.mu.Unlock()
+			ch.events.Publish(ClientConnected{
+				UserId: client.Id,
+				Name:   client.Name,
+				Time:   ch.clock.Now(),
+			})
+			client.watchState(ch.publishPresence)
+			ch.publishPresence(client)
+			go ch.sendPendingChallenges(client)
+			if roomId, ok := ch.resume[client.Id]; ok {
+				// 重启前正在房间中，回到原来的房间
+				delete(ch.resume, client.Id)
+				ch.dispatch(roomId, hubCommand{
+					commandType: commandResume,
+					client:      client,
+				})
+			}
+		case commandUnregister:
+			client := cmd.client
+			ch.unsubscribeLobby(client)
+			ch.matchPool = slices.DeleteFunc(ch.matchPool, func(c *Client) bool {
+				return c == client
+			})
+			if ch.cluster != nil && client.getStatus() == userMatching {
+				ch.cluster.cancelMatch(client)
+			}
+			ch.dispatch(client.getRoomId(), cmd)
+			ch.mu.Lock()
+			current := ch.Clients[client.Id] == client
+			if current {
+				delete(ch.Clients, client.Id)
+			}
+			ch.mu.Unlock()
+			client.close()
+			if current {
+				// 已被新连接替换时玩家仍然在线
+				ch.events.Publish(PresenceChanged{
+					UserId:   client.Id,
+					Presence: user.Presence{State: user.PresenceOffline},
+					Time:     ch.clock.Now(),
+				})
+			}
+		case commandMatch:
+			client := cmd.client
+			if ch.cluster != nil {
+				if err := ch.cluster.match(client); err != nil {
+					log.Printf("加入匹配队列失败: %v\n", err)
+					client.setStatus(userOnline)
+					cmd.reject(CodeUnavailable, "匹配失败，请稍后重试")
+					continue
 				}
-				ch.mu.Unlock()
-				database.DeleteValue(fmt.Sprint(client.Id))
-			case commandMatch:
-				client := cmd.client
-				ch.mu.Lock()
+				cmd.accept()
+				continue
+			}
+			// 与最早排队且双方没有屏蔽关系的玩家匹配
+			i := slices.IndexFunc(ch.matchPool, func(c *Client) bool {
+				return !matchBlocked(c, client)
+			})
+			if i == -1 {
 				ch.matchPool = append(ch.matchPool, client)
-				fmt.Println(ch.matchPool)
-				if len(ch.matchPool) < 2 {
-					client.sendMessage(NormalMessage{
-						BaseMessage: BaseMessage{Type: messageNormal},
-						Message:     "正在匹配，请稍等",
-					})
-					ch.mu.Unlock()
-					return nil
-				}
-				// 匹配成功，创建房间
-				room := NewChessRoom()
-				room.join(ch.matchPool[0])
-				room.join(ch.matchPool[1])
-				ch.matchPool = ch.matchPool[2:]
-				ch.Rooms[room.Id] = room
-				ch.mu.Unlock()
-				// 发送消息给两个客户端，通知他们开始游戏
-				go func() {
-					ch.commands <- hubCommand{
-						commandType: commandStart,
-						client:      client,
-					}
-				}()
-			case commandMove:
-				req := cmd.payload.(moveRequest)
-				room := ch.Rooms[req.from.RoomId]
-				if room == nil {
-					req.from.sendMessage(NormalMessage{
-						BaseMessage: BaseMessage{Type: messageNormal},
-						Message:     "房间不存在",
-					})
-					return nil
-				}
-
-				if !room.isFull() {
-					req.from.sendMessage(NormalMessage{
-						BaseMessage: BaseMessage{Type: messageNormal},
-						Message:     "游戏未开始",
-					})
-					return nil
-				}
+				client.sendMessage(NormalMessage{
+					BaseMessage: BaseMessage{Type: messageNormal},
+					Message:     "正在匹配，请稍等",
+				})
+				cmd.accept()
+				continue
+			}
+			// 匹配成功，创建房间
+			opponent := ch.matchPool[i]
+			ch.matchPool = slices.Delete(ch.matchPool, i, i+1)
+			if err := ch.startMatch(opponent, client); err != nil {
+				log.Printf("创建匹配房间失败: %v\n", err)
+			}
+			cmd.accept()
+		case commandCreate:
+			// 创建房间
+			client := cmd.client
+			if client.getRoomId() != -1 {
+				cmd.reject(CodeAlreadyInRoom, "您已在房间中")
+				continue
+			}
+			settings := cmd.payload.(room.RoomSettings)
+			r, err := ch.newRoom(settings)
+			if err != nil {
+				log.Printf("创建房间失败: %v\n", err)
+				cmd.reject(CodeUnavailable, "创建房间失败，请稍后重试")
+				continue
+			}
+			r.join(client)
+			ch.journalCreate(r, client)
+			ch.addSpareRoom(r)
+			ch.startRoom(r)
+			// 发送消息给客户端，通知他们创建房间成功
+			client.sendMessage(NormalMessage{
+				BaseMessage: BaseMessage{Type: messageCreate},
+			})
+			cmd.accept()
+		case commandChallenge:
+			ch.startChallenge(cmd.client, cmd.payload.(Challenge))
+			cmd.accept()
+		case commandJoin, commandSpectate:
+			joinMsg := cmd.payload.(joinMessage)
+			if !ch.dispatch(joinMsg.RoomId, cmd) {
+				cmd.reject(CodeRoomNotFound, "房间不存在")
+			}
+		case commandShutdown:
+			req := cmd.payload.(shutdownRequest)
+			req.done <- ch.drain(req.ctx)
+		case commandHeartbeat:
+			// 更新客户端的最后一次心跳时间
+			client := cmd.client
+			client.LastPong = time.Now()
+		default:
+			// 其余命令都属于客户端所在的房间，由房间确认或拒绝
+			if !ch.dispatch(cmd.client.getRoomId(), cmd) {
+				cmd.reject(CodeRoomNotFound, "房间不存在")
+			}
+		}
+	}
+}
 
-				if room.Current != req.from {
-					// 如果不是当前玩家，则不允许移动
-					req.from.sendMessage(NormalMessage{
-						BaseMessage: BaseMessage{Type: messageNormal},
-						Message:     "请等待对方移动",
-					})
-					return nil
-				}
+type shutdownRequest struct {
+	ctx  context.Context
+	done chan error
+}
 
-				target := room.Next
+// Shutdown 停止接受新连接和新对局，通知在线玩家停机维护，
+// 等待房间处理完已收到的命令并保存或判和进行中的对局，最后断开所有连接
+func (ch *ChessHub) Shutdown(ctx context.Context) error {
+	if !ch.draining.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer func() {
+		ch.scheduler.Stop()
+		ch.pool.Stop()
+	}()
+	done := make(chan error, 1)
+	select {
+	case ch.commands <- hubCommand{
+		commandType: commandShutdown,
+		payload:     shutdownRequest{ctx: ctx, done: done},
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-				target.sendMessage(req.move)
+// drain 在大厅协程中执行，期间大厅不处理其他命令，断开连接的玩家不会解散房间
+func (ch *ChessHub) drain(ctx context.Context) error {
+	message := "服务器即将停机维护，进行中的对局将被判和"
+	if ch.snapshots != nil {
+		message = "服务器即将停机维护，对局已保存，请稍后重新连接"
+	}
+	ch.mu.Lock()
+	clients := make([]*Client, 0, len(ch.Clients))
+	for _, c := range ch.Clients {
+		clients = append(clients, c)
+	}
+	rooms := make([]*ChessRoom, 0, len(ch.Rooms))
+	for _, r := range ch.Rooms {
+		rooms = append(rooms, r)
+	}
+	ch.mu.Unlock()
 
-				// 交换当前玩家和下一个玩家
-				room.exchange()
-			case commandSendMessage:
-				req := cmd.payload.(sendMessageRequest)
-				err := req.target.sendMessage(req.message)
-				if err != nil {
-					return fmt.Errorf("发送消息失败: %v", err)
-				}
-			case commandStart:
-				room := ch.Rooms[cmd.client.RoomId]
-				if room == nil {
-					cmd.client.RoomId = -1
-					cmd.client.Status = userOnline
-					cmd.client.sendMessage(NormalMessage{
-						BaseMessage: BaseMessage{Type: messageNormal},
-						Message:     "请进行匹配",
-					})
-					return nil
-				}
-				if !room.isFull() {
-					cmd.client.sendMessage(NormalMessage{
-						BaseMessage: BaseMessage{Type: messageNormal},
-						Message:     "房间未满员，无法开始游戏",
-					})
-					return nil
-				}
-				room.Current.startPlay(roleRed)
-				room.Next.startPlay(roleBlack)
-				cur := startMessage{BaseMessage: BaseMessage{Type: messageStart}, Role: "red"}
-				next := startMessage{BaseMessage: BaseMessage{Type: messageStart}, Role: "black"}
-				room.Current.sendMessage(cur)
-				room.Next.sendMessage(next)
-				// 移除空余房间
-				ch.mu.Lock()
-				for i, r := range ch.spareRooms {
-					if r.Id == room.Id {
-						ch.spareRooms = slices.Delete(ch.spareRooms, i, i+1)
-						break
-					}
-				}
-				ch.mu.Unlock()
-			case commandEnd:
-				var winner clientRole
-
-				room := ch.Rooms[cmd.client.RoomId]
-				if room == nil {
-					cmd.client.sendMessage(NormalMessage{
-						BaseMessage: BaseMessage{Type: messageNormal},
-						Message:     "房间不存在",
-					})
-					return nil
-				}
-				if cmd.payload == nil {
-					winner = cmd.client.Role
-				} else {
-					r := cmd.payload.(clientRole)
-					if r != roleNone {
-						if r == roleRed {
-							r = roleBlack
-						} else {
-							r = roleRed
-						}
-					}
-					winner = r
-				}
-				// 发送消息给两个客户端，通知他们结束游戏
-				endMsg := endMessage{
-					BaseMessage: BaseMessage{Type: messageEnd},
-					Winner:      winner,
-				}
-				room.Current.sendMessage(endMsg)
-				room.Next.sendMessage(endMsg)
-				room.clear()
-				delete(ch.Rooms, cmd.client.RoomId)
-			case commandHeartbeat:
-				// 更新客户端的最后一次心跳时间
-				client := cmd.client
-				client.LastPong = time.Now()
-			case commandJoin:
-				joinMsg := cmd.payload.(joinMessage)
-				ch.mu.Lock()
-				room := ch.Rooms[joinMsg.RoomId]
-				if room == nil {
-					ch.sendMessage(cmd.client, NormalMessage{
-						BaseMessage: BaseMessage{Type: messageNormal},
-						Message:     "房间不存在",
-					})
-					ch.mu.Unlock()
-					return nil
-				}
-				err := room.join(cmd.client)
-				if err != nil {
-					cmd.client.sendMessage(NormalMessage{
-						BaseMessage: BaseMessage{Type: messageNormal},
-						Message:     err.Error(),
-					})
-					ch.mu.Unlock()
-					return nil
-				}
-				ch.mu.Unlock()
-				// 发送消息给两个客户端，通知他们开始游戏
-				go func() {
-					ch.commands <- hubCommand{
-						commandType: commandStart,
-						client:      cmd.client,
-					}
-				}()
-			case commandCreate:
-				// 创建房间
-				client := cmd.client
-				r := NewChessRoom()
-				r.join(client)
-				ch.Rooms[r.Id] = r
-				roomInfo := room.RoomInfo{
-					Id: client.RoomId,
-					Current: user.UserInfo{
-						ID: uint(client.Id),
-					},
-				}
-				ch.mu.Lock()
-				ch.spareRooms = append(ch.spareRooms, roomInfo)
-				ch.mu.Unlock()
-				// 发送消息给客户端，通知他们创建房间成功
-				ch.sendMessage(client, NormalMessage{
-					BaseMessage: BaseMessage{Type: messageCreate},
-				})
-				return nil
-			}
-			return nil
+	for _, c := range clients {
+		c.sendMessage(NormalMessage{
+			BaseMessage: BaseMessage{Type: messageMaintenance},
+			Message:     message,
 		})
 	}
+	for _, c := range ch.matchPool {
+		c.setStatus(userOnline)
+	}
+	ch.matchPool = nil
+	if ch.cluster != nil {
+		for _, c := range clients {
+			if c.getStatus() == userMatching {
+				ch.cluster.cancelMatch(c)
+			}
+		}
+		ch.cluster.stop()
+	}
+
+	var err error
+	for _, r := range rooms {
+		r.post(hubCommand{commandType: commandShutdown, payload: ctx})
+	}
+	for _, r := range rooms {
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+	for _, c := range clients {
+		c.close()
+	}
+	return err
+}
+
+func (ch *ChessHub) newRoom(settings room.RoomSettings) (*ChessRoom, error) {
+	r := NewChessRoom(settings)
+	r.hub = ch
+	if ch.cluster != nil {
+		// 集群模式下房间id由所有节点共享的计数器分配
+		if err := ch.cluster.claimRoom(r); err != nil {
+			return nil, err
+		}
+	}
+	r.touch()
+	return r, nil
+}
+
+// startMatch 为匹配成功的两名玩家创建房间，匹配的对局无需准备，直接进入开局倒计时
+func (ch *ChessHub) startMatch(a, b *Client) error {
+	r, err := ch.newRoom(room.DefaultRoomSettings())
+	if err != nil {
+		return err
+	}
+	for _, c := range []*Client{a, b} {
+		r.join(c)
+		r.setReady(c, true)
+	}
+	ch.journalMatch(r, a, b)
+	r.startCountdown()
+	ch.startRoom(r)
+	ch.events.Publish(MatchFound{
+		RoomId:    r.Id,
+		PlayerIds: []int{a.Id, b.Id},
+		Time:      ch.clock.Now(),
+	})
+	return nil
+}
+
+// startRoom 登记房间并启动房间协程
+func (ch *ChessHub) startRoom(r *ChessRoom) {
+	ch.mu.Lock()
+	ch.Rooms[r.Id] = r
+	ch.mu.Unlock()
+	go r.run()
+}
+
+func (ch *ChessHub) getRoom(roomId int) *ChessRoom {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.Rooms[roomId]
+}
+
+func (ch *ChessHub) getClient(userId int) *Client {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.Clients[userId]
+}
+
+// deliver 把消息发给玩家，集群模式下广播给所有节点，由玩家连接所在的节点发送
+func (ch *ChessHub) deliver(userId int, message any) {
+	if ch.cluster != nil {
+		ch.cluster.broadcastDeliver(userId, message)
+	} else if client := ch.getClient(userId); client != nil {
+		client.sendMessage(message)
+	}
+}
+
+// dispatch 把命令投递给房间，房间在其他节点上时经由集群转发，房间不存在时返回false。
+// 投递成功后由房间确认或拒绝命令对应的请求
+func (ch *ChessHub) dispatch(roomId int, cmd hubCommand) bool {
+	if r := ch.getRoom(roomId); r != nil {
+		return r.post(cmd)
+	}
+	if ch.cluster != nil {
+		return ch.cluster.forward(roomId, cmd)
+	}
+	return false
+}
+
+// removeRoom 将已解散的房间从大厅中移除
+func (ch *ChessHub) removeRoom(roomId int) {
+	ch.mu.Lock()
+	delete(ch.Rooms, roomId)
+	ch.mu.Unlock()
+	ch.removeSpareRoom(roomId)
+	if ch.cluster != nil {
+		ch.cluster.releaseRoom(roomId)
+	}
+}
+
+func (ch *ChessHub) roomTTL() time.Duration {
+	return time.Duration(config.GetRoomConfig().IdleTTL) * time.Second
+}
+
+func (ch *ChessHub) sweepInterval() time.Duration {
+	return min(ch.roomTTL()/2, time.Minute)
+}
+
+// sweepIdleRooms 定期让每个房间检查自己是否闲置超过配置时长
+func (ch *ChessHub) sweepIdleRooms() {
+	ch.mu.Lock()
+	rooms := make([]*ChessRoom, 0, len(ch.Rooms))
+	for _, r := range ch.Rooms {
+		rooms = append(rooms, r)
+	}
+	ch.mu.Unlock()
+	for _, r := range rooms {
+		r.post(hubCommand{commandType: commandExpire})
+	}
+	ch.scheduler.Schedule(ch.sweepInterval(), ch.sweepIdleRooms)
 }
 
 func (ch *ChessHub) HandleConnection(c *gin.Context) {
-	userId, exists := c.Get("userId")
-	if !exists {
-		dto.ErrorResponse(c, dto.WithMessage("用户未登录"))
+	if ch.draining.Load() {
+		dto.ErrorResponse(c, dto.WithMessage("服务器维护中，请稍后再试"))
 		return
 	}
 
-	id, ok := userId.(int)
+	id, ok := contextUserId(c)
 	if !ok {
-		dto.ErrorResponse(c, dto.WithMessage("用户ID转换失败"))
 		return
 	}
 
@@ -329,6 +466,10 @@ func (ch *ChessHub) HandleConnection(c *gin.Context) {
 
 	// 创建一个新的客户端
 	client := NewClient(conn, id)
+	client.protocol, client.binary = negotiateProtocol(c.Request, conn)
+	if err := ch.loadProfile(client); err != nil {
+		log.Printf("加载用户信息失败: %v\n", err)
+	}
 
 	conn.SetReadLimit(1024 * 1024)
 	conn.SetPongHandler(func(string) error {
@@ -343,18 +484,8 @@ func (ch *ChessHub) HandleConnection(c *gin.Context) {
 
 	conn.SetReadDeadline(time.Now().Add(HeartbeatTimeout))
 
-	go func() {
-		ticker := time.NewTicker(HeartbeatInterval)
-		defer ticker.Stop()
-
-		for range ticker.C {
-			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				fmt.Printf("发送 ping 失败: %v\n", err)
-				return
-			}
-		}
-	}()
+	go client.writePump()
+	defer client.close()
 
 	ch.commands <- hubCommand{
 		commandType: commandRegister,
@@ -373,13 +504,17 @@ func (ch *ChessHub) HandleConnection(c *gin.Context) {
 	})
 
 	for {
-		_, message, err := conn.ReadMessage()
+		frameType, message, err := conn.ReadMessage()
 		if err != nil {
 			fmt.Printf("读取消息失败: %v\n", err)
 			break
 		}
 
-		err = ch.handleMessage(client, message)
+		if frameType == websocket.BinaryMessage {
+			err = ch.handleBinaryMessage(client, message)
+		} else {
+			err = ch.handleMessage(client, message)
+		}
 		if err != nil {
 			fmt.Printf("处理消息失败: %v\n", err)
 			return
@@ -388,125 +523,39 @@ func (ch *ChessHub) HandleConnection(c *gin.Context) {
 	fmt.Println("客户端断开连接")
 }
 
-func (ch *ChessHub) GetSpareRooms(c *gin.Context) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
-
-	c.Set("rooms", ch.spareRooms)
-	c.Next()
-}
-
 func (ch *ChessHub) handleMessage(client *Client, rawMessage []byte) error {
-	var base BaseMessage
-	err := json.Unmarshal(rawMessage, &base)
+	req, body, err := decodeRequest(rawMessage)
 	if err != nil {
 		return fmt.Errorf("解析消息失败: %v", err)
 	}
+	return ch.dispatchRequest(client, req, body)
+}
 
-	switch base.Type {
-	case messageMatch:
-		switch client.Status {
-		case userOnline:
-			client.Status = userMatching
-			ch.commands <- hubCommand{
-				commandType: commandMatch,
-				client:      client,
-			}
-		case userMatching:
-			msg := NormalMessage{
-				BaseMessage: BaseMessage{Type: messageNormal},
-				Message:     "您已在匹配队列中，请耐心等待",
-			}
-			ch.sendMessage(client, msg)
-		case userPlaying:
-			msg := NormalMessage{
-				BaseMessage: BaseMessage{Type: messageNormal},
-				Message:     "您已在游戏中",
-			}
-			ch.sendMessage(client, msg)
-		}
-	case messageMove:
-		if client.Status == userPlaying {
-			var moveMsg MoveMessage
-			err := json.Unmarshal(rawMessage, &moveMsg)
-			if err != nil {
-				fmt.Printf("解析移动消息失败: %v\n", err)
-				return err
-			}
-
-			ch.commands <- hubCommand{
-				commandType: commandMove,
-				client:      client,
-				payload: moveRequest{
-					from: client,
-					move: moveMsg,
-				},
-			}
-		} else {
-			return fmt.Errorf("玩家不在游戏中")
-		}
-	case messageEnd:
-		if client.Status == userPlaying {
-			ch.commands <- hubCommand{
-				commandType: commandEnd,
-				client:      client,
-			}
-		}
-	case messageJoin:
-		// 用户加入房间
-		if client.Status == userPlaying {
-			// 如果用户已经在游戏中，则不允许加入房间
-			msg := NormalMessage{
-				BaseMessage: BaseMessage{Type: messageNormal},
-				Message:     "您已在游戏中",
-			}
-			ch.sendMessage(client, msg)
-			return nil
-		}
-		var joinMsg joinMessage
-		err := json.Unmarshal(rawMessage, &joinMsg)
-		if err != nil {
-			fmt.Printf("解析加入房间消息失败: %v\n", err)
-			return nil
-		}
-		ch.commands <- hubCommand{
-			commandType: commandJoin,
-			client:      client,
-			payload:     joinMsg,
-		}
-	case messageCreate:
-		// 用户创建房间
-		if client.Status == userPlaying {
-			// 如果用户已经在游戏中，则不允许创建房间
-			msg := NormalMessage{
-				BaseMessage: BaseMessage{Type: messageNormal},
-				Message:     "您已在游戏中",
-			}
-			ch.sendMessage(client, msg)
-			return nil
-		}
-		ch.commands <- hubCommand{
-			commandType: commandCreate,
-			client:      client,
-		}
-	case messageGiveUp:
-		if client.Status == userPlaying {
-			ch.commands <- hubCommand{
-				commandType: commandEnd,
-				client:      client,
-				payload:     client.Role,
-			}
-		}
+// handleBinaryMessage 处理protobuf二进制帧，只有协商了chess.v2.proto的客户端可以发送
+func (ch *ChessHub) handleBinaryMessage(client *Client, frame []byte) error {
+	if !client.binary {
+		return fmt.Errorf("客户端 %d 未协商二进制协议", client.Id)
 	}
-	return nil
+	req, body, err := decodeBinaryRequest(frame)
+	if err != nil {
+		return fmt.Errorf("解析二进制消息失败: %v", err)
+	}
+	return ch.dispatchRequest(client, req, body)
+}
+
+func (ch *ChessHub) dispatchRequest(client *Client, req requestEnvelope, body []byte) error {
+	return ch.handlers.dispatch(&MessageContext{
+		Hub:       ch,
+		Client:    client,
+		Type:      req.Type,
+		RequestId: req.Id,
+		Raw:       body,
+		protocol:  client.protocol,
+	})
 }
 
 func (ch *ChessHub) sendMessage(client *Client, message any) {
-	ch.commands <- hubCommand{
-		commandType: commandSendMessage,
-		payload: sendMessageRequest{
-			target:  client,
-			message: message,
-		},
+	if err := client.sendMessage(message); err != nil {
+		log.Printf("发送消息失败: %v\n", err)
 	}
 }
@@ -0,0 +1,90 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closed 返回玩家的连接是否已被断开
+func (tc *testClient) closed() bool {
+	select {
+	case <-tc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestShutdownAdjudicatesGamesWithoutSnapshots(t *testing.T) {
+	hub, clock := newRoomTestHub(t)
+	red := newTestClient(t, hub, 1)
+	black := newTestClient(t, hub, 2)
+	matcher := newTestClient(t, hub, 3)
+	idler := newTestClient(t, hub, 4)
+
+	roomId := openRoom(t, red, black, `{"color":"red"}`)
+	red.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.send(t, `{"type":%d,"ready":true}`, messageReady)
+	black.waitMessage(t, messageCountdown, nil)
+	advanceClock(t, clock, red)
+	matcher.send(t, `{"type":%d}`, messageMatch)
+	matcher.waitQueued(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := hub.Shutdown(ctx); err != nil {
+		t.Fatalf("停机失败: %v", err)
+	}
+
+	// 所有玩家收到停机通知，没有快照存储时进行中的对局判和，随后断开所有连接
+	for _, tc := range []*testClient{red, black, matcher, idler} {
+		tc.waitMessage(t, messageMaintenance, func(m map[string]any) bool {
+			return strings.Contains(m["message"].(string), "判和")
+		})
+		if !tc.closed() {
+			t.Fatalf("停机后玩家%d的连接应当断开", tc.Id)
+		}
+	}
+	for _, tc := range []*testClient{red, black} {
+		tc.waitMessage(t, messageEnd, func(m map[string]any) bool { return m["winner"] == float64(roleNone) })
+	}
+	if hub.getRoom(roomId) != nil {
+		t.Fatal("停机后房间应当解散")
+	}
+	if matcher.getStatus() != userOnline {
+		t.Fatal("停机时应当取消匹配")
+	}
+
+	// 停机期间拒绝新的匹配和房间，重复停机直接返回
+	late := newProtocolTestClient(t, hub, 5, protocolV2)
+	late.send(t, `{"v":2,"id":"match","type":%d}`, messageMatch)
+	late.expectError(t, "match", CodeMaintenance)
+	late.send(t, `{"v":2,"id":"create","type":%d}`, messageCreate)
+	late.expectError(t, "create", CodeMaintenance)
+	if err := hub.Shutdown(ctx); err != nil {
+		t.Fatalf("重复停机应当直接返回: %v", err)
+	}
+}
+
+func TestShutdownGivesUpAtDeadline(t *testing.T) {
+	hub, _ := newRoomTestHub(t)
+	// 发送停机通知时阻塞大厅协程，模拟处理不完的玩家
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	stuck := NewClient(nil, 1)
+	stuck.sink = func(message any) {
+		if m, ok := message.(NormalMessage); ok && m.Type == messageMaintenance {
+			<-release
+		}
+	}
+	hub.commands <- hubCommand{commandType: commandRegister, client: stuck}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := hub.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("超过停机期限时应当返回超时错误，实际 %v", err)
+	}
+}
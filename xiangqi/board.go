@@ -0,0 +1,232 @@
+package xiangqi
+
+const (
+	rows = 10
+	cols = 9
+)
+
+// 棋子，正数为红方，负数为黑方
+const (
+	king int8 = iota + 1
+	advisor
+	elephant
+	horse
+	rook
+	cannon
+	pawn
+)
+
+// board 以红方为下方，红方在第0到4行
+type board [rows][cols]int8
+
+type square struct {
+	row, col int
+}
+
+func newBoard() board {
+	var b board
+	back := [cols]int8{rook, horse, elephant, advisor, king, advisor, elephant, horse, rook}
+	for col, p := range back {
+		b[0][col] = p
+		b[9][col] = -p
+	}
+	for _, col := range []int{1, 7} {
+		b[2][col] = cannon
+		b[7][col] = -cannon
+	}
+	for col := 0; col < cols; col += 2 {
+		b[3][col] = pawn
+		b[6][col] = -pawn
+	}
+	return b
+}
+
+func (s square) valid() bool {
+	return s.row >= 0 && s.row < rows && s.col >= 0 && s.col < cols
+}
+
+func (b *board) at(s square) int8 {
+	return b[s.row][s.col]
+}
+
+// pieceSide 红方为1，黑方为-1
+func pieceSide(p int8) int8 {
+	switch {
+	case p > 0:
+		return 1
+	case p < 0:
+		return -1
+	}
+	return 0
+}
+
+func abs8(v int8) int8 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func sign(v int) int {
+	switch {
+	case v > 0:
+		return 1
+	case v < 0:
+		return -1
+	}
+	return 0
+}
+
+func inPalace(side int8, s square) bool {
+	if s.col < 3 || s.col > 5 {
+		return false
+	}
+	if side > 0 {
+		return s.row <= 2
+	}
+	return s.row >= 7
+}
+
+func ownHalf(side int8, s square) bool {
+	if side > 0 {
+		return s.row <= 4
+	}
+	return s.row >= 5
+}
+
+// between 同一行或同一列上两点之间的棋子数
+func (b *board) between(from, to square) int {
+	dr, dc := sign(to.row-from.row), sign(to.col-from.col)
+	count := 0
+	for r, c := from.row+dr, from.col+dc; r != to.row || c != to.col; r, c = r+dr, c+dc {
+		if b[r][c] != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// pseudoLegal 按棋子的走法判断能否从from走到to，不考虑走后己方是否被将军
+func (b *board) pseudoLegal(side int8, from, to square) bool {
+	if !from.valid() || !to.valid() || from == to {
+		return false
+	}
+	p := b.at(from)
+	if pieceSide(p) != side || pieceSide(b.at(to)) == side {
+		return false
+	}
+	dr, dc := to.row-from.row, to.col-from.col
+	straight := dr == 0 || dc == 0
+	switch abs8(p) {
+	case king:
+		if b.at(to) == -side*king && dc == 0 && b.between(from, to) == 0 {
+			// 将帅照面
+			return true
+		}
+		return inPalace(side, to) && absInt(dr)+absInt(dc) == 1
+	case advisor:
+		return inPalace(side, to) && absInt(dr) == 1 && absInt(dc) == 1
+	case elephant:
+		eye := square{from.row + dr/2, from.col + dc/2}
+		return ownHalf(side, to) && absInt(dr) == 2 && absInt(dc) == 2 && b.at(eye) == 0
+	case horse:
+		var leg square
+		switch {
+		case absInt(dr) == 2 && absInt(dc) == 1:
+			leg = square{from.row + dr/2, from.col}
+		case absInt(dr) == 1 && absInt(dc) == 2:
+			leg = square{from.row, from.col + dc/2}
+		default:
+			return false
+		}
+		return b.at(leg) == 0
+	case rook:
+		return straight && b.between(from, to) == 0
+	case cannon:
+		if !straight {
+			return false
+		}
+		if b.at(to) == 0 {
+			return b.between(from, to) == 0
+		}
+		return b.between(from, to) == 1
+	case pawn:
+		forward := int(side)
+		if dr == forward && dc == 0 {
+			return true
+		}
+		// 过河后可以横走
+		return !ownHalf(side, from) && dr == 0 && absInt(dc) == 1
+	}
+	return false
+}
+
+func (b *board) move(from, to square) {
+	b[to.row][to.col] = b.at(from)
+	b[from.row][from.col] = 0
+}
+
+func (b *board) king(side int8) (square, bool) {
+	for r := range rows {
+		for c := range cols {
+			if b[r][c] == side*king {
+				return square{r, c}, true
+			}
+		}
+	}
+	return square{}, false
+}
+
+// inCheck 己方的将帅已被吃或者对方下一步可以吃掉将帅
+func (b *board) inCheck(side int8) bool {
+	k, ok := b.king(side)
+	if !ok {
+		return true
+	}
+	for r := range rows {
+		for c := range cols {
+			from := square{r, c}
+			if pieceSide(b.at(from)) == -side && b.pseudoLegal(-side, from, k) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// legal 走法符合棋子的规则，并且走后己方没有被将军
+func (b *board) legal(side int8, from, to square) bool {
+	if !b.pseudoLegal(side, from, to) {
+		return false
+	}
+	next := *b
+	next.move(from, to)
+	return !next.inCheck(side)
+}
+
+// hasLegalMove 是否存在走后不被将军的走法，没有时被将死或困毙，都判负
+func (b *board) hasLegalMove(side int8) bool {
+	for r := range rows {
+		for c := range cols {
+			from := square{r, c}
+			if pieceSide(b.at(from)) != side {
+				continue
+			}
+			for tr := range rows {
+				for tc := range cols {
+					if b.legal(side, from, square{tr, tc}) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+// Package xiangqi 实现象棋的走子规则，实时对局和通信对局都用它校验走法和判断对局是否结束
+package xiangqi
+
+import "errors"
+
+var ErrIllegalMove = errors.New("走法不合法")
+
+// Position 双方客户端共用的坐标：x为列，从0到8；y为行，从0到9，y轴向下。
+// 黑方在上方，黑将在(4,0)；红方在下方，红帅在(4,9)
+type Position struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+func (p Position) square() square {
+	return square{rows - 1 - p.Y, p.X}
+}
+
+// Game 一局棋的当前局面，红方先走。每走一步保存一份局面用于悔棋
+type Game struct {
+	boards []board
+	side   int8 // 轮到走子的一方
+}
+
+func NewGame() *Game {
+	return &Game{boards: []board{newBoard()}, side: 1}
+}
+
+func (g *Game) current() *board {
+	return &g.boards[len(g.boards)-1]
+}
+
+// Play 轮到的一方从from走到to，走法不合法或走后己方被将军时返回ErrIllegalMove，局面不变
+func (g *Game) Play(from, to Position) error {
+	b := *g.current()
+	f, t := from.square(), to.square()
+	if !b.legal(g.side, f, t) {
+		return ErrIllegalMove
+	}
+	b.move(f, t)
+	g.boards = append(g.boards, b)
+	g.side = -g.side
+	return nil
+}
+
+// Undo 撤销最后一步，没有走子时返回false
+func (g *Game) Undo() bool {
+	if len(g.boards) == 1 {
+		return false
+	}
+	g.boards = g.boards[:len(g.boards)-1]
+	g.side = -g.side
+	return true
+}
+
+// Over 轮到走子的一方被将死或困毙，即上一步走子的一方获胜
+func (g *Game) Over() bool {
+	return !g.current().hasLegalMove(g.side)
+}
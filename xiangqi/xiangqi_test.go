@@ -0,0 +1,142 @@
+package xiangqi
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPieceMoves(t *testing.T) {
+	b := newBoard()
+	cases := []struct {
+		name        string
+		from, to    square
+		side        int8
+		pseudoLegal bool
+	}{
+		{"炮平中", square{2, 7}, square{2, 4}, 1, true},
+		{"炮隔子吃马", square{2, 7}, square{9, 7}, 1, true},
+		{"马走日", square{0, 1}, square{2, 2}, 1, true},
+		{"马不能直走", square{0, 1}, square{1, 1}, 1, false},
+		{"相飞田", square{0, 2}, square{2, 4}, 1, true},
+		{"仕不能出九宫", square{0, 3}, square{1, 2}, 1, false},
+		{"兵未过河不能横走", square{3, 0}, square{3, 1}, 1, false},
+		{"兵向前", square{3, 0}, square{4, 0}, 1, true},
+		{"卒向前", square{6, 0}, square{5, 0}, -1, true},
+		{"不能走对方的棋子", square{6, 0}, square{5, 0}, 1, false},
+		{"车被挡住", square{0, 0}, square{5, 0}, 1, false},
+	}
+	for _, c := range cases {
+		if got := b.pseudoLegal(c.side, c.from, c.to); got != c.pseudoLegal {
+			t.Errorf("%s: pseudoLegal = %v, want %v", c.name, got, c.pseudoLegal)
+		}
+	}
+
+	// 去掉炮架后不能吃子
+	b[7][7] = 0
+	if b.pseudoLegal(1, square{2, 7}, square{9, 7}) {
+		t.Error("炮没有炮架时不能吃子")
+	}
+}
+
+func TestCheckmate(t *testing.T) {
+	var b board
+	b[9][4] = -king
+	b[0][3] = king
+	b[9][8] = rook
+	b[8][0] = rook
+	if !b.inCheck(-1) {
+		t.Fatal("黑将应当被将军")
+	}
+	if b.hasLegalMove(-1) {
+		t.Fatal("双车错应当将死黑方")
+	}
+	b[8][0] = 0
+	if !b.hasLegalMove(-1) {
+		t.Fatal("去掉一个车后黑将可以上移解将")
+	}
+
+	g := &Game{boards: []board{b}, side: -1}
+	if g.Over() {
+		t.Fatal("黑方还能走子，对局不应结束")
+	}
+	b[8][0] = rook
+	g.boards[0] = b
+	if !g.Over() {
+		t.Fatal("黑方被将死，对局应当结束")
+	}
+}
+
+func TestFlyingGeneral(t *testing.T) {
+	var b board
+	b[0][4] = king
+	b[9][4] = -king
+	if !b.inCheck(1) || !b.inCheck(-1) {
+		t.Fatal("将帅照面时双方都应视为被将军")
+	}
+	b[5][4] = pawn
+	if b.inCheck(1) {
+		t.Fatal("中间有子时将帅不算照面")
+	}
+	// 挡在中间的兵不能离开
+	if b.legal(1, square{5, 4}, square{5, 3}) {
+		t.Fatal("走后将帅照面的走法不合法")
+	}
+}
+
+func TestGamePlayAndUndo(t *testing.T) {
+	// 红方在下方、y轴向下：红帅在(4,9)，黑将在(4,0)
+	g := NewGame()
+	moves := [][2]Position{
+		{{7, 7}, {4, 7}}, // 炮二平五
+		{{7, 0}, {6, 2}}, // 马8进7
+		{{7, 9}, {6, 7}}, // 马二进三
+	}
+	for i, m := range moves {
+		if err := g.Play(m[0], m[1]); err != nil {
+			t.Fatalf("第%d步应当合法: %v", i+1, err)
+		}
+	}
+	if err := g.Play(Position{0, 0}, Position{0, 5}); !errors.Is(err, ErrIllegalMove) {
+		t.Fatal("车不能越过自己的卒")
+	}
+	if err := g.Play(Position{0, 9}, Position{0, 8}); !errors.Is(err, ErrIllegalMove) {
+		t.Fatal("不能走对方的棋子")
+	}
+	if err := g.Play(Position{0, 0}, Position{0, 1}); err != nil {
+		t.Fatalf("车进一应当合法: %v", err)
+	}
+
+	// 悔棋后轮到黑方重新走
+	if !g.Undo() {
+		t.Fatal("有走子时应当可以悔棋")
+	}
+	if err := g.Play(Position{0, 0}, Position{0, 1}); err != nil {
+		t.Fatalf("悔棋后车进一应当合法: %v", err)
+	}
+
+	if err := NewGame().Play(Position{4, 4}, Position{4, 5}); !errors.Is(err, ErrIllegalMove) {
+		t.Fatal("空位不能走子")
+	}
+	if NewGame().Undo() {
+		t.Fatal("没有走子时不能悔棋")
+	}
+}
+
+func TestGameOverAfterMate(t *testing.T) {
+	var b board
+	b[9][4] = -king
+	b[0][3] = king
+	b[8][0] = rook
+	b[5][8] = rook
+	g := &Game{boards: []board{b}, side: 1}
+	if g.Over() {
+		t.Fatal("红方还能走子，对局不应结束")
+	}
+	// 车一进四形成双车错，黑将在(4,0)无路可走
+	if err := g.Play(Position{8, 4}, Position{8, 0}); err != nil {
+		t.Fatalf("车进四应当合法: %v", err)
+	}
+	if !g.Over() {
+		t.Fatal("黑方被将死，对局应当结束")
+	}
+}